@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flant/dapp/pkg/build"
+	"github.com/flant/dapp/pkg/git_artifacts_cache"
+	"github.com/flant/dapp/pkg/lock"
+)
+
+func newDimgCmd() *cobra.Command {
+	opts := &projectOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "dimg",
+		Short: "Build and manage dimgs",
+	}
+	opts.addFlags(cmd)
+
+	cmd.AddCommand(
+		newDimgListCmd(opts),
+		newDimgBuildCmd(opts),
+		newDimgPushCmd(opts),
+		newDimgStagesCmd(opts),
+		newDimgRemoteGitClonesCmd(opts),
+	)
+
+	return cmd
+}
+
+func newDimgListCmd(opts *projectOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List dimgs from dappfile",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, err := newProject(opts)
+			if err != nil {
+				return err
+			}
+
+			dimgs, err := p.Dimgs(nil)
+			if err != nil {
+				return err
+			}
+
+			for _, dimg := range dimgs {
+				fmt.Println(dimg.Name)
+			}
+
+			return nil
+		},
+	}
+}
+
+func newDimgPushCmd(opts *projectOptions) *cobra.Command {
+	var tags []string
+	var withStages bool
+
+	cmd := &cobra.Command{
+		Use:   "push REPO [DIMG...]",
+		Short: "Push built dimgs into the docker repo",
+		Long: `Push built dimgs into the docker repo.
+
+Dimgs are pushed into REPO/<dimg name> with every --tag, the nameless dimg is pushed into REPO.
+With --with-stages stages images are pushed into REPO as dimgstage-<signature> tags,
+stages which are already in REPO are skipped. Dimgs built in dev mode are never pushed.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			repo := args[0]
+
+			p, err := newProject(opts)
+			if err != nil {
+				return err
+			}
+
+			dimgs, err := p.Dimgs(args[1:])
+			if err != nil {
+				return err
+			}
+
+			nodes, err := build.NewDimgsGraph(dimgs)
+			if err != nil {
+				return err
+			}
+
+			if err := initDockerAndLocks(opts); err != nil {
+				return err
+			}
+
+			// Git artifacts cache files are not pruned while stages signatures are calculated
+			return lock.WithLock(git_artifacts_cache.UsageLockName, lock.LockOptions{ReadOnly: true}, func() error {
+				stages, err := newDimgsStages(p, nodes, build.GitArtifactsOptions{})
+				if err != nil {
+					return err
+				}
+
+				for _, node := range nodes {
+					if node.IsArtifact() {
+						continue
+					}
+
+					if err := stages[node].Push(repo, build.PushOptions{Tags: tags, WithStages: withStages}); err != nil {
+						return fmt.Errorf("%s push failed: %s", node, err)
+					}
+				}
+
+				return nil
+			})
+		},
+	}
+
+	cmd.Flags().StringArrayVar(&tags, "tag", []string{"latest"}, "tag of pushed dimgs, can be specified several times")
+	cmd.Flags().BoolVar(&withStages, "with-stages", false, "push stages images too")
+
+	return cmd
+}
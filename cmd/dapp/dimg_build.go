@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flant/dapp/pkg/build"
+	"github.com/flant/dapp/pkg/build/builder"
+	"github.com/flant/dapp/pkg/config"
+	"github.com/flant/dapp/pkg/dapp"
+	"github.com/flant/dapp/pkg/git_artifacts_cache"
+	"github.com/flant/dapp/pkg/lock"
+)
+
+const containerDappPath = "/.dapp"
+
+func newDimgBuildCmd(opts *projectOptions) *cobra.Command {
+	var workers int
+	var plan bool
+	var streamGitArchives bool
+	var gitCloneDepth int
+	var devMode bool
+	var devModeUntracked bool
+	var gitRenames bool
+	var gitCopies bool
+
+	cmd := &cobra.Command{
+		Use:   "build [DIMG...]",
+		Short: "Build dimgs from dappfile",
+		Long: `Build dimgs from dappfile.
+
+Dimgs and artifacts are built after their fromDimg, fromDimgArtifact and imported artifacts,
+independent dimgs are built concurrently by --workers builders.
+
+With --plan stages are not built: every stage of every dimg is listed with its signature,
+local cache status and the reason of the rebuild. Plan is read-only: remote git repos are
+not cloned and fetched, existing clones are used, and no locks are taken.
+
+With --stream-git-archives git archives are streamed into stage containers without
+intermediate files in the tmp directory, owner and group of git directives should be ids then,
+otherwise archives files are used.
+
+With --git-clone-depth remote git repos are cloned with the limited history, only branches
+and tags of git directives are fetched, the history is deepened when a commit is missing.
+Shallow clones are kept apart from full clones for every depth, git binary is required
+to deepen them.
+
+With --dev the own repo is used with uncommitted changes of tracked files, --dev-untracked
+adds untracked files, which are not ignored. Dev mode stages have other signatures and
+dapp-dev-mode label, such stages are never pushed.
+
+With --git-renames git patches have renames of files instead of removal and addition,
+--git-copies also detects copies of modified files. Files renamed into or out of
+the include and exclude paths of git directives are added or removed.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, err := newProject(opts)
+			if err != nil {
+				return err
+			}
+
+			dimgs, err := p.Dimgs(args)
+			if err != nil {
+				return err
+			}
+
+			nodes, err := build.NewDimgsGraph(dimgs)
+			if err != nil {
+				return err
+			}
+
+			if err := initDockerAndLocks(opts); err != nil {
+				return err
+			}
+
+			gitArtifactsOptions := build.GitArtifactsOptions{
+				StreamArchives:   streamGitArchives,
+				CloneDepth:       gitCloneDepth,
+				DevMode:          devMode || devModeUntracked,
+				DevModeUntracked: devModeUntracked,
+				DetectRenames:    gitRenames || gitCopies,
+				DetectCopies:     gitCopies,
+				IsDryRun:         plan,
+			}
+
+			if plan {
+				stages, err := newDimgsStages(p, nodes, gitArtifactsOptions)
+				if err != nil {
+					return err
+				}
+
+				return printBuildPlan(nodes, stages)
+			}
+
+			// Git artifacts cache files are not pruned while stages use them
+			err = lock.WithLock(git_artifacts_cache.UsageLockName, lock.LockOptions{ReadOnly: true}, func() error {
+				stages, err := newDimgsStages(p, nodes, gitArtifactsOptions)
+				if err != nil {
+					return err
+				}
+
+				scheduler := &build.Scheduler{Workers: workers}
+
+				return scheduler.Run(nodes, func(node *build.DimgNode, lockOwner string) error {
+					return stages[node].Build(lockOwner)
+				})
+			})
+			if err != nil {
+				return err
+			}
+
+			return autoPruneGitArtifactsCache()
+		},
+	}
+
+	cmd.Flags().IntVar(&workers, "workers", runtime.NumCPU(), "max number of dimgs built at the same time")
+	cmd.Flags().BoolVar(&plan, "plan", false, "print stages to be built and the reasons without building")
+	cmd.Flags().BoolVar(&streamGitArchives, "stream-git-archives", false, "stream git archives into stage containers instead of archives files")
+	cmd.Flags().IntVar(&gitCloneDepth, "git-clone-depth", 0, "clone remote git repos with the limited number of commits, 0 means the whole history")
+	cmd.Flags().BoolVar(&devMode, "dev", false, "build from the working tree of the own repo with uncommitted changes")
+	cmd.Flags().BoolVar(&devModeUntracked, "dev-untracked", false, "build in dev mode with untracked files, which are not ignored")
+	cmd.Flags().BoolVar(&gitRenames, "git-renames", false, "detect renames of files in git patches")
+	cmd.Flags().BoolVar(&gitCopies, "git-copies", false, "detect renames and copies of files in git patches")
+
+	return cmd
+}
+
+// newDimgsStages calculates stages of nodes in graph order, so that dependencies stages are ready for dependants,
+// project specific git artifacts options are set for every node
+func newDimgsStages(p *project, nodes []*build.DimgNode, gitArtifactsOptions build.GitArtifactsOptions) (map[*build.DimgNode]*build.DimgStages, error) {
+	res := make(map[*build.DimgNode]*build.DimgStages)
+	artifacts := make(map[*config.DimgArtifact]*build.DimgStages)
+	dimgs := make(map[*config.Dimg]*build.DimgStages)
+
+	// Cache files are verified once for all dimgs, plan does not write cache files
+	if !gitArtifactsOptions.IsDryRun {
+		gitArtifactsOptions.Cache = gitArtifactsCache()
+	}
+
+	for _, node := range nodes {
+		tmpDir, err := ioutil.TempDir(dapp.TmpDir, "dimg-")
+		if err != nil {
+			return nil, err
+		}
+
+		gitArtifactsOptions.ProjectDir = p.Dir
+		gitArtifactsOptions.BuildDir = p.BuildDir()
+		gitArtifactsOptions.TmpDir = tmpDir
+		gitArtifactsOptions.ContainerTmpDir = fmt.Sprintf("%s/tmp", containerDappPath)
+
+		gitArtifacts, err := build.NewGitArtifacts(node.Base(), gitArtifactsOptions)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", node, err)
+		}
+
+		opts := build.DimgStagesOptions{
+			ProjectName:     p.Name,
+			StageCache:      p.StageCache(),
+			Builder:         build.NewDimgBuilder(node, &builder.Extra{ContainerDappPath: containerDappPath, TmpPath: tmpDir}),
+			GitArtifacts:    gitArtifacts,
+			Artifacts:       artifacts,
+			TmpDir:          tmpDir,
+			BuildDir:        p.BuildDir(),
+			ContainerTmpDir: gitArtifactsOptions.ContainerTmpDir,
+			DevMode:         gitArtifactsOptions.DevMode,
+		}
+
+		base := node.Base()
+		if base.FromDimg != nil {
+			opts.FromDimg = dimgs[base.FromDimg]
+		} else if base.FromDimgArtifact != nil {
+			opts.FromDimg = artifacts[base.FromDimgArtifact]
+		}
+
+		stages, err := build.NewDimgStages(node, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		res[node] = stages
+		if node.IsArtifact() {
+			artifacts[node.Artifact] = stages
+		} else {
+			dimgs[node.Dimg] = stages
+		}
+	}
+
+	return res, nil
+}
+
+func printBuildPlan(nodes []*build.DimgNode, stages map[*build.DimgNode]*build.DimgStages) error {
+	for _, node := range nodes {
+		plans, err := stages[node].Plan()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s\n", node)
+		for _, p := range plans {
+			var status string
+			switch {
+			case p.Empty:
+				fmt.Printf("  %-24s %s\n", p.Name, "empty")
+				continue
+			case p.Cached:
+				status = "cached"
+			default:
+				status = fmt.Sprintf("build: %s", p.Reason)
+			}
+
+			fmt.Printf("  %-24s %s %s\n", p.Name, p.Signature, status)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/spf13/cobra"
+
+	"github.com/flant/dapp/pkg/dapp"
+	"github.com/flant/dapp/pkg/docker"
+	"github.com/flant/dapp/pkg/lock"
+)
+
+func newDimgStagesCmd(opts *projectOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stages",
+		Short: "Manage project stages cache",
+	}
+
+	cleanupCmd := &cobra.Command{
+		Use:   "cleanup",
+		Short: "Remove unused project stages",
+	}
+	cleanupCmd.AddCommand(newDimgStagesCleanupLocalCmd(opts))
+
+	flushCmd := &cobra.Command{
+		Use:   "flush",
+		Short: "Remove all project stages",
+	}
+	flushCmd.AddCommand(newDimgStagesFlushLocalCmd(opts))
+
+	cmd.AddCommand(cleanupCmd, flushCmd)
+
+	return cmd
+}
+
+func newDimgStagesCleanupLocalCmd(opts *projectOptions) *cobra.Command {
+	var improperCacheVersion bool
+
+	cmd := &cobra.Command{
+		Use:   "local",
+		Short: "Remove local project stages, build containers and dangling images",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !improperCacheVersion {
+				return fmt.Errorf("`--improper-cache-version` option required")
+			}
+
+			p, err := newProject(opts)
+			if err != nil {
+				return err
+			}
+
+			if err := initDockerAndLocks(opts); err != nil {
+				return err
+			}
+
+			err = lock.WithLock(fmt.Sprintf("%s.images", p.Name), lock.LockOptions{}, func() error {
+				fmt.Printf("Removing stages of project `%s` with improper cache version ...\n", p.Name)
+
+				images, err := projectDimgstages(p)
+				if err != nil {
+					return err
+				}
+
+				var improperImages []types.ImageSummary
+				for _, image := range images {
+					if image.Labels["dapp-cache-version"] != dapp.BuildCacheVersion {
+						improperImages = append(improperImages, image)
+					}
+				}
+
+				if err := removeImagesByTags(improperImages); err != nil {
+					return err
+				}
+
+				fmt.Printf("Removing stages of project `%s` with improper cache version DONE\n", p.Name)
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			return flushProjectContainersAndDanglingImages(p)
+		},
+	}
+
+	cmd.Flags().BoolVar(&improperCacheVersion, "improper-cache-version", false, "remove stages built with another cache version")
+
+	return cmd
+}
+
+func newDimgStagesFlushLocalCmd(opts *projectOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "local",
+		Short: "Remove all local project stages, build containers and dangling images",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, err := newProject(opts)
+			if err != nil {
+				return err
+			}
+
+			if err := initDockerAndLocks(opts); err != nil {
+				return err
+			}
+
+			err = lock.WithLock(fmt.Sprintf("%s.images", p.Name), lock.LockOptions{}, func() error {
+				fmt.Printf("Flushing stages of project `%s` ...\n", p.Name)
+
+				images, err := projectDimgstages(p)
+				if err != nil {
+					return err
+				}
+
+				if err := removeImagesByTags(images); err != nil {
+					return err
+				}
+
+				fmt.Printf("Flushing stages of project `%s` DONE\n", p.Name)
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			return flushProjectContainersAndDanglingImages(p)
+		},
+	}
+}
+
+func projectDimgstages(p *project) ([]types.ImageSummary, error) {
+	filterSet := filters.NewArgs()
+	filterSet.Add("dangling", "false")
+	filterSet.Add("label", fmt.Sprintf("dapp=%s", p.Name))
+	filterSet.Add("reference", p.StageCache())
+
+	return docker.Images(types.ImageListOptions{Filters: filterSet})
+}
+
+func removeImagesByTags(images []types.ImageSummary) error {
+	var tags []string
+	for _, image := range images {
+		tags = append(tags, image.RepoTags...)
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	return docker.CliRmi(append([]string{"--force"}, tags...)...)
+}
+
+func flushProjectContainersAndDanglingImages(p *project) error {
+	containersFilterSet := filters.NewArgs()
+	containersFilterSet.Add("name", "dapp.build.")
+	containersFilterSet.Add("label", fmt.Sprintf("dapp=%s", p.Name))
+
+	containers, err := docker.Containers(types.ContainerListOptions{All: true, Filters: containersFilterSet})
+	if err != nil {
+		return err
+	}
+
+	var containersIds []string
+	for _, container := range containers {
+		containersIds = append(containersIds, container.ID)
+	}
+
+	if len(containersIds) > 0 {
+		fmt.Printf("Removing build containers of project `%s`\n", p.Name)
+
+		if err := docker.CliRm(append([]string{"--force"}, containersIds...)...); err != nil {
+			return err
+		}
+	}
+
+	imagesFilterSet := filters.NewArgs()
+	imagesFilterSet.Add("dangling", "true")
+	imagesFilterSet.Add("label", fmt.Sprintf("dapp=%s", p.Name))
+
+	images, err := docker.Images(types.ImageListOptions{Filters: imagesFilterSet})
+	if err != nil {
+		return err
+	}
+
+	var imagesIds []string
+	for _, image := range images {
+		imagesIds = append(imagesIds, image.ID)
+	}
+
+	if len(imagesIds) > 0 {
+		fmt.Printf("Removing dangling images of project `%s`\n", p.Name)
+
+		if err := docker.CliRmi(imagesIds...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
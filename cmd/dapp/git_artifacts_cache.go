@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flant/dapp/pkg/git_artifacts_cache"
+	"github.com/flant/dapp/pkg/lock"
+)
+
+func gitArtifactsCache() *git_artifacts_cache.Cache {
+	return &git_artifacts_cache.Cache{Dir: git_artifacts_cache.DefaultDir}
+}
+
+func newGitArtifactsCacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "git-artifacts-cache",
+		Short: "Manage host cache of git artifacts archives and patches",
+	}
+
+	cmd.AddCommand(newGitArtifactsCacheUsageCmd(), newGitArtifactsCachePruneCmd())
+
+	return cmd
+}
+
+func newGitArtifactsCacheUsageCmd() *cobra.Command {
+	var verbose bool
+
+	cmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Print size of the cache and its entries",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			entries, err := gitArtifactsCache().List()
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+			sizes := make(map[string]int64)
+			counts := make(map[string]int)
+			var total int64
+
+			if verbose {
+				fmt.Fprintf(w, "KIND\tNAME\tSIZE\tLAST USED\n")
+			}
+			for _, entry := range entries {
+				sizes[entry.Kind] += entry.Size
+				counts[entry.Kind]++
+				total += entry.Size
+
+				if verbose {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", entry.Kind, entry.Name, formatSize(entry.Size), entry.LastUsedAt.Format("2006-01-02 15:04:05"))
+				}
+			}
+			if verbose {
+				fmt.Fprintf(w, "\n")
+			}
+
+			fmt.Fprintf(w, "KIND\tENTRIES\tSIZE\n")
+			for _, kind := range []string{git_artifacts_cache.ArchivesKind, git_artifacts_cache.PatchesKind} {
+				fmt.Fprintf(w, "%s\t%d\t%s\n", kind, counts[kind], formatSize(sizes[kind]))
+			}
+			fmt.Fprintf(w, "total\t%d\t%s\n", len(entries), formatSize(total))
+
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().BoolVar(&verbose, "verbose", false, "print every entry")
+
+	return cmd
+}
+
+func newGitArtifactsCachePruneCmd() *cobra.Command {
+	var maxAge time.Duration
+	var maxSizeMb int64
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove entries unused longer than --max-age and least recently used entries exceeding --max-size-mb",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := lock.Init(); err != nil {
+				return err
+			}
+
+			return pruneGitArtifactsCache(git_artifacts_cache.PruneOptions{MaxAge: maxAge, MaxSize: maxSizeMb * 1024 * 1024}, lock.LockOptions{})
+		},
+	}
+
+	cmd.Flags().DurationVar(&maxAge, "max-age", git_artifacts_cache.DefaultMaxAge, "remove entries unused longer, 0 means no limit")
+	cmd.Flags().Int64Var(&maxSizeMb, "max-size-mb", git_artifacts_cache.DefaultMaxSize/1024/1024, "max size of the cache, 0 means no limit")
+
+	return cmd
+}
+
+func pruneGitArtifactsCache(opts git_artifacts_cache.PruneOptions, lockOpts lock.LockOptions) error {
+	return lock.WithLock(git_artifacts_cache.UsageLockName, lockOpts, func() error {
+		fmt.Printf("Pruning git artifacts cache ...\n")
+
+		removed, err := gitArtifactsCache().Prune(opts)
+
+		var size int64
+		for _, entry := range removed {
+			size += entry.Size
+		}
+		fmt.Printf("Removed %d entries of %s\n", len(removed), formatSize(size))
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Pruning git artifacts cache DONE\n")
+
+		return nil
+	})
+}
+
+// autoPruneGitArtifactsCache prunes the cache with default limits after build,
+// prune is skipped when the cache is used by other builds
+func autoPruneGitArtifactsCache() error {
+	err := pruneGitArtifactsCache(
+		git_artifacts_cache.PruneOptions{MaxAge: git_artifacts_cache.DefaultMaxAge, MaxSize: git_artifacts_cache.DefaultMaxSize},
+		lock.LockOptions{Timeout: time.Second},
+	)
+	if _, ok := err.(*lock.TimeoutError); ok {
+		return nil
+	}
+
+	return err
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1024*1024*1024:
+		return fmt.Sprintf("%.1fG", float64(size)/1024/1024/1024)
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1fM", float64(size)/1024/1024)
+	case size >= 1024:
+		return fmt.Sprintf("%.1fK", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%dB", size)
+	}
+}
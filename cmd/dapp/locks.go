@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flant/dapp/pkg/lock"
+)
+
+func newLocksCmd() *cobra.Command {
+	var locksDir string
+
+	cmd := &cobra.Command{
+		Use:   "locks",
+		Short: "Inspect dapp locks",
+	}
+	cmd.PersistentFlags().StringVar(&locksDir, "locks-dir", lock.LocksDir, "path to the locks directory")
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List file locks with their holders",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			locks, err := lock.ListLocks(locksDir)
+			if err != nil {
+				return err
+			}
+
+			return lock.FprintLocks(os.Stdout, locks)
+		},
+	})
+
+	return cmd
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flant/dapp/pkg/dapp"
+)
+
+// exitCode can be set by commands, which report status by the exit code, e.g. ruby2go
+var exitCode int
+
+func main() {
+	dapp.TrapSignals()
+
+	err := dapp.Init()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	rootCmd := &cobra.Command{
+		Use:           "dapp",
+		Short:         "Build and manage docker images described by dappfile",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	rootCmd.AddCommand(
+		newDimgCmd(),
+		newGitArtifactsCacheCmd(),
+		newLocksCmd(),
+		newRuby2GoCmd(),
+		newRuby2GoServerCmd(),
+	)
+
+	err = rootCmd.Execute()
+
+	if terminateErr := dapp.Terminate(); terminateErr != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", terminateErr)
+		if exitCode == 0 {
+			exitCode = 1
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	os.Exit(exitCode)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	git "github.com/flant/go-git"
+	"github.com/spf13/cobra"
+
+	"github.com/flant/dapp/pkg/config"
+	"github.com/flant/dapp/pkg/dapp"
+	"github.com/flant/dapp/pkg/docker"
+	"github.com/flant/dapp/pkg/lock"
+)
+
+type projectOptions struct {
+	Dir          string
+	Name         string
+	DockerConfig string
+}
+
+func (opts *projectOptions) addFlags(cmd *cobra.Command) {
+	defaultDockerConfig := os.Getenv("DAPP_DOCKER_CONFIG")
+	if defaultDockerConfig == "" {
+		defaultDockerConfig = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+
+	cmd.PersistentFlags().StringVar(&opts.Dir, "dir", "", "path to the project directory (current working directory by default)")
+	cmd.PersistentFlags().StringVar(&opts.Name, "name", "", "project name (origin remote repo name or project directory name by default)")
+	cmd.PersistentFlags().StringVar(&opts.DockerConfig, "docker-config", defaultDockerConfig, "path to the docker config directory (DAPP_DOCKER_CONFIG)")
+}
+
+type project struct {
+	Dir  string
+	Name string
+}
+
+func newProject(opts *projectOptions) (*project, error) {
+	dir := opts.Dir
+	if dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine working dir: %s", err)
+		}
+		dir = wd
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// NOTICE: dappfile render is dumped into the working directory, so it should be the project directory.
+	err = os.Chdir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot change working dir to `%s`: %s", dir, err)
+	}
+
+	name := opts.Name
+	if name == "" {
+		name, err = projectName(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &project{Dir: dir, Name: name}, nil
+}
+
+func initDockerAndLocks(opts *projectOptions) error {
+	err := lock.Init()
+	if err != nil {
+		return err
+	}
+
+	return docker.Init(opts.DockerConfig)
+}
+
+func projectName(dir string) (string, error) {
+	repository, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		return filepath.Base(dir), nil
+	} else if err != nil {
+		return "", fmt.Errorf("cannot open git repo `%s`: %s", dir, err)
+	}
+
+	remote, err := repository.Remote("origin")
+	if err == git.ErrRemoteNotFound {
+		return filepath.Base(dir), nil
+	} else if err != nil {
+		return "", err
+	}
+
+	urls := remote.Config().URLs
+	if len(urls) == 0 {
+		return filepath.Base(dir), nil
+	}
+
+	parts := strings.Split(strings.TrimRight(urls[0], "/"), "/")
+
+	return strings.TrimSuffix(parts[len(parts)-1], ".git"), nil
+}
+
+func (p *project) StageCache() string {
+	return fmt.Sprintf("dimgstage-%s", p.Name)
+}
+
+// BuildDir should be in sync with ruby dapp build_dir
+func (p *project) BuildDir() string {
+	return filepath.Join(dapp.HomeDir, "builds", p.Name)
+}
+
+func (p *project) DappfilePath() (string, error) {
+	for _, file := range []string{"dappfile.yml", "dappfile.yaml"} {
+		path := filepath.Join(p.Dir, file)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("dappfile.yml or dappfile.yaml is not found in %s", p.Dir)
+}
+
+// Dimgs returns dimgs from dappfile filtered by names, all dimgs are returned when names are empty
+func (p *project) Dimgs(names []string) ([]*config.Dimg, error) {
+	dappfilePath, err := p.DappfilePath()
+	if err != nil {
+		return nil, err
+	}
+
+	dimgs, err := config.ParseDimgs(dappfilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		return dimgs, nil
+	}
+
+	var res []*config.Dimg
+	for _, name := range names {
+		var found *config.Dimg
+		for _, dimg := range dimgs {
+			if dimg.Name == name {
+				found = dimg
+				break
+			}
+		}
+
+		if found == nil {
+			return nil, fmt.Errorf("no such dimg `%s` in %s", name, dappfilePath)
+		}
+
+		res = append(res, found)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flant/dapp/pkg/build"
+	"github.com/flant/dapp/pkg/config"
+	"github.com/flant/dapp/pkg/git_repo"
+	"github.com/flant/dapp/pkg/lock"
+)
+
+func newDimgRemoteGitClonesCmd(opts *projectOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "remote-git-clones",
+		Short: "Manage clones of remote git repos in the project build directory",
+	}
+
+	cmd.AddCommand(newRemoteGitClonesListCmd(opts), newRemoteGitClonesMaintainCmd(opts))
+
+	return cmd
+}
+
+func newRemoteGitClonesListCmd(opts *projectOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "Print clones with url, size and last use time",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, err := newProject(opts)
+			if err != nil {
+				return err
+			}
+
+			dir := build.RemoteGitReposDir(p.BuildDir())
+
+			clones, err := git_repo.ListRemoteClones(dir)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+			fmt.Fprintf(w, "PATH\tURL\tSIZE\tLAST USED\n")
+			for _, clone := range clones {
+				path, err := filepath.Rel(dir, clone.Path)
+				if err != nil {
+					return err
+				}
+
+				url := clone.Url
+				if url == "" {
+					url = "-"
+				}
+
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", path, url, formatSize(clone.Size), clone.LastUsedAt.Format("2006-01-02 15:04:05"))
+			}
+
+			return w.Flush()
+		},
+	}
+}
+
+func newRemoteGitClonesMaintainCmd(opts *projectOptions) *cobra.Command {
+	var unusedDays int
+	var skipGc bool
+
+	cmd := &cobra.Command{
+		Use:   "maintain",
+		Short: "Remove unused clones, verify and repack other clones, broken clones are cloned again",
+		Long: `Remove unused clones, verify and repack other clones, broken clones are cloned again.
+
+Clones unused longer than --unused-days are removed. Objects of other clones are verified,
+broken clones of dappfile git directives are cloned again, other broken clones are removed.
+Verified clones are repacked into a single pack unless --skip-gc is specified.
+Every clone is maintained under the lock of its remote git repo, which is used by clone and fetch.
+Builds read objects without the lock, so old packs and loose objects are removed by the repack,
+which is run a day after the previous one or later.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, err := newProject(opts)
+			if err != nil {
+				return err
+			}
+
+			if err := lock.Init(); err != nil {
+				return err
+			}
+
+			remotes, err := dappfileRemoteGitRepos(p)
+			if err != nil {
+				return err
+			}
+
+			clones, err := git_repo.ListRemoteClones(build.RemoteGitReposDir(p.BuildDir()))
+			if err != nil {
+				return err
+			}
+
+			var failed int
+			for _, clone := range clones {
+				if err := maintainRemoteGitClone(clone, remotes[clone.Path], unusedDays, skipGc); err != nil {
+					fmt.Fprintf(os.Stderr, "WARNING: cannot maintain clone `%s`: %s\n", clone.Path, err)
+					failed++
+				}
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("maintenance of %d of %d clones failed", failed, len(clones))
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&unusedDays, "unused-days", 30, "remove clones unused longer, 0 means no limit")
+	cmd.Flags().BoolVar(&skipGc, "skip-gc", false, "do not repack verified clones")
+
+	return cmd
+}
+
+// maintainRemoteGitClone uses repo of the dappfile to clone again, clones of other repos are removed when broken
+func maintainRemoteGitClone(clone *git_repo.RemoteClone, repo *git_repo.Remote, unusedDays int, skipGc bool) error {
+	isDappfileRepo := repo != nil
+	if !isDappfileRepo {
+		repo = &git_repo.Remote{Url: clone.Url, ClonePath: clone.Path, Mirrors: clone.Mirrors}
+
+		// Lock name is the same as the name of the git directive with the url
+		name, err := config.GitRepoNameFromUrl(clone.Url)
+		if err != nil {
+			name = filepath.Base(filepath.Dir(clone.Path))
+		}
+		repo.Name = name
+	}
+
+	if unusedDays > 0 && time.Since(clone.LastUsedAt) > time.Duration(unusedDays)*24*time.Hour {
+		fmt.Printf("Removing clone `%s` of remote git repo `%s` unused since %s\n", clone.Path, repo.String(), clone.LastUsedAt.Format("2006-01-02"))
+		return repo.RemoveClone()
+	}
+
+	fmt.Printf("Verifying clone `%s` of remote git repo `%s` ...\n", clone.Path, repo.String())
+
+	if err := repo.Verify(); err != nil {
+		fmt.Printf("Clone `%s` of remote git repo `%s` is broken: %s\n", clone.Path, repo.String(), err)
+
+		if isDappfileRepo {
+			return repo.Reclone()
+		}
+
+		return repo.RemoveClone()
+	}
+
+	fmt.Printf("Verifying clone `%s` of remote git repo `%s` DONE\n", clone.Path, repo.String())
+
+	if skipGc {
+		return nil
+	}
+
+	return repo.Gc()
+}
+
+// dappfileRemoteGitRepos returns repos of git directives by clone path, refs of directives
+// with the same clone are merged, repos are empty without dappfile
+func dappfileRemoteGitRepos(p *project) (map[string]*git_repo.Remote, error) {
+	res := make(map[string]*git_repo.Remote)
+
+	if _, err := p.DappfilePath(); err != nil {
+		return res, nil
+	}
+
+	dimgs, err := p.Dimgs(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := build.NewDimgsGraph(dimgs)
+	if err != nil {
+		return nil, err
+	}
+
+	gitArtifactsOptions := build.GitArtifactsOptions{ProjectDir: p.Dir, BuildDir: p.BuildDir()}
+
+	for _, node := range nodes {
+		base := node.Base()
+		if base.Git == nil {
+			continue
+		}
+
+		for _, remote := range base.Git.Remote {
+			repo := build.NewRemoteGitRepo(remote, gitArtifactsOptions)
+
+			existing, exists := res[repo.ClonePath]
+			if !exists {
+				res[repo.ClonePath] = repo
+				continue
+			}
+
+			// All branches and tags are fetched for the directive without refs
+			if len(existing.Branches)+len(existing.Tags) == 0 || len(repo.Branches)+len(repo.Tags) == 0 {
+				existing.Branches, existing.Tags = nil, nil
+			} else {
+				existing.Branches = append(existing.Branches, repo.Branches...)
+				existing.Tags = append(existing.Tags, repo.Tags...)
+			}
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flant/dapp/pkg/ruby2go"
+	"github.com/flant/dapp/pkg/ruby2go/commands"
+)
+
+func newRuby2GoCmd() *cobra.Command {
+	var argsFromFilePath, resultToFilePath string
+
+	cmd := &cobra.Command{
+		Use:   "ruby2go PROGNAME",
+		Short: "Run ruby dapp json bridge command",
+		Long: fmt.Sprintf(`Run ruby dapp json bridge command.
+
+Compatibility mode for ruby dapp: PROGNAME is one of %s,
+input parameters are read from --args-from-file and output is written into --result-to-file json file.
+Exit code is 16 when command fails.`, strings.Join(commands.Names(), ", ")),
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			runFunc, ok := commands.Commands[args[0]]
+			if !ok {
+				return fmt.Errorf("ruby2go command `%s` isn't supported", args[0])
+			}
+
+			if argsFromFilePath == "" {
+				return fmt.Errorf("`--args-from-file` param required")
+			}
+			if resultToFilePath == "" {
+				return fmt.Errorf("`--result-to-file` param required")
+			}
+
+			code, err := ruby2go.RunWithFiles(argsFromFilePath, resultToFilePath, runFunc)
+			if err != nil {
+				return err
+			}
+			exitCode = code
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&argsFromFilePath, "args-from-file", "", "path to json file with input parameters")
+	cmd.Flags().StringVar(&resultToFilePath, "result-to-file", "", "path to json file with program output")
+
+	return cmd
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flant/dapp/pkg/dapp"
+	"github.com/flant/dapp/pkg/ruby2go"
+	"github.com/flant/dapp/pkg/ruby2go/commands"
+)
+
+func newRuby2GoServerCmd() *cobra.Command {
+	var socketPath string
+
+	cmd := &cobra.Command{
+		Use:   "ruby2go-server",
+		Short: "Serve ruby dapp json bridge commands by long-running process",
+		Long: `Serve ruby dapp json bridge commands by long-running process.
+
+Requests are newline delimited JSON-RPC 2.0 objects: method is ruby2go PROGNAME, params are the same as in
+--args-from-file json file. Response result is the same as in --result-to-file json file and timing field
+contains call duration in seconds.
+
+Requests are read from stdin and responses are written into stdout unless --socket is specified,
+commands output is redirected to stderr in this mode.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			server := ruby2go.NewServer(commands.Commands)
+
+			if socketPath == "" {
+				out := os.Stdout
+				os.Stdout = os.Stderr
+
+				errCh := make(chan error, 1)
+				go func() { errCh <- server.ServeConn(os.Stdin, out) }()
+
+				select {
+				case err := <-errCh:
+					return err
+				case <-dapp.Context().Done():
+					return nil
+				}
+			}
+
+			err := os.Remove(socketPath)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("cannot remove stale socket `%s`: %s", socketPath, err)
+			}
+
+			listener, err := net.Listen("unix", socketPath)
+			if err != nil {
+				return err
+			}
+			dapp.AddCleanupHook(dapp.TmpFilesCleanupStage, func() { os.Remove(socketPath) })
+
+			go func() {
+				<-dapp.Context().Done()
+				listener.Close()
+			}()
+
+			err = server.Serve(listener)
+			if dapp.Context().Err() != nil {
+				return nil
+			}
+
+			return err
+		},
+	}
+
+	cmd.Flags().StringVar(&socketPath, "socket", "", "path to the unix socket to listen on")
+
+	return cmd
+}
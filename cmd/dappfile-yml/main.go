@@ -12,7 +12,7 @@ import (
 	"gopkg.in/flant/yaml.v2"
 
 	"github.com/flant/dapp/pkg/config"
-	"github.com/flant/dapp/pkg/ruby2go"
+	"github.com/flant/dapp/pkg/dapp"
 )
 
 var (
@@ -36,7 +36,7 @@ func usage() {
 }
 
 func main() {
-	ruby2go.Trap()
+	dapp.TrapSignals()
 
 	WorkingDir, err := os.Getwd()
 	if err != nil {
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/flant/dapp/pkg/lock"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "locks list\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	var locksDir string
+
+	flag.Usage = usage
+	flag.StringVar(&locksDir, "locks-dir", lock.LocksDir, "path to the locks directory")
+	flag.Parse()
+
+	if flag.NArg() != 1 || flag.Arg(0) != "list" {
+		usage()
+	}
+
+	locks, err := lock.ListLocks(locksDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot list locks: %s\n", err)
+		os.Exit(1)
+	}
+
+	err = lock.FprintLocks(os.Stdout, locks)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot print locks: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -9,3 +9,5 @@ go install github.com/flant/dapp/cmd/image
 go install github.com/flant/dapp/cmd/builder
 go install github.com/flant/dapp/cmd/dappdeps
 go install github.com/flant/dapp/cmd/docker_registry
+go install github.com/flant/dapp/cmd/locks
+go install github.com/flant/dapp/cmd/dapp
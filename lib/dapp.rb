@@ -9,6 +9,7 @@ require 'mixlib/shellout'
 require 'securerandom'
 require 'excon'
 require 'json'
+require 'open3'
 require 'uri'
 require 'ostruct'
 require 'time'
@@ -15,7 +15,7 @@ module Dapp
           ruby2go_dappdeps(dappdeps: dappdeps, command: command, **options).tap do |res|
             unless res["error"].nil?
               raise Error::Dapp, code: :ruby2go_dappdeps_command_failed_unexpected_error,
-                                 data: { dappdeps: dappdeps, command: command, message: res["error"] }
+                                 data: { dappdeps: dappdeps, command: command, message: res["error"]["message"] }
             end
             break res['data']
           end
@@ -36,6 +36,8 @@ module Dapp
       end
 
       def _ruby2go(progname, args_hash)
+        return _ruby2go_server_call(progname, args_hash) if _ruby2go_server?
+
         call_id = SecureRandom.uuid
 
         args_file = File.join(_ruby2go_tmp_dir, "args.#{call_id}.json")
@@ -74,6 +76,51 @@ module Dapp
         end
       end
 
+      def _ruby2go_server?
+        !!ENV['DAPP_RUBY2GO_SERVER']
+      end
+
+      def _ruby2go_server_call(progname, args_hash)
+        server = _ruby2go_server
+
+        request = { jsonrpc: "2.0", id: SecureRandom.uuid, method: progname, params: args_hash }
+        server[:stdin].puts JSON.dump(request)
+        server[:stdin].flush
+
+        unless (line = server[:stdout].gets)
+          raise ::Dapp::Error::Base, code: :ruby2go_server_unexpected_exit, data: { progname: progname }
+        end
+
+        response = JSON.load(line)
+        if (error = response["error"])
+          raise ::Dapp::Error::Base, code: :ruby2go_server_call_failed, data: { progname: progname, message: error["message"] }
+        end
+
+        log_secondary "ruby2go `#{progname}` call: #{response["timing"]["duration"].round(3)} sec" if log_verbose?
+
+        response["result"]
+      end
+
+      def _ruby2go_server
+        @_ruby2go_server ||= begin
+          bin_path = ENV[_ruby2go_bin_path_env_var_name("dapp")]
+          unless bin_path && File.exists?(bin_path)
+            raise ::Dapp::Error::Dapp,
+              code: :ruby2go_bin_path_not_found,
+              data: {env_var_name: _ruby2go_bin_path_env_var_name("dapp"), path: bin_path}
+          end
+
+          stdin, stdout, wait_thr = Open3.popen2(bin_path, "ruby2go-server")
+
+          @_call_after_before_terminate << proc {
+            stdin.close
+            wait_thr.join
+          }
+
+          { stdin: stdin, stdout: stdout, wait_thr: wait_thr }
+        end
+      end
+
       def _ruby2go_tmp_dir
         @_ruby2go_tmp_dir ||= Dir.mktmpdir('dapp-ruby2go-', tmp_base_dir)
       end
@@ -32,7 +32,7 @@ module Dapp
         }.merge(options)
 
         dimg.dapp.ruby2go_builder(command_options).tap do |res|
-          raise Error::Build, code: :ruby2go_builder_command_failed_unexpected_error, data: { command: command, message: res["error"] } unless res["error"].nil?
+          raise Error::Build, code: :ruby2go_builder_command_failed_unexpected_error, data: { command: command, message: res["error"]["message"] } unless res["error"].nil?
           break res['data']
         end
       end
@@ -86,6 +86,12 @@ module Dapp
               next
             end
 
+            # Stages of dev mode are built from uncommitted changes
+            if stage_image.labels.key?('dapp-dev-mode')
+              dapp.log_state(image_name, state: dapp.t(code: 'state.dev_mode'))
+              next
+            end
+
             export_base!(image_name, push: true) do
               stage_image.export!(image_name)
             end
@@ -44,7 +44,7 @@ module Dapp
         def ruby2go_docker_registry_command(command:, **options)
           (options[:options] ||= {}).merge!(host_docker_config_dir: dapp.class.host_docker_config_dir)
           dapp.ruby2go_docker_registry(command: command, **options).tap do |res|
-            raise Error::Registry, code: :ruby2go_docker_registry_command_failed_unexpected_error, data: { command: command, message: res["error"] } unless res["error"].nil?
+            raise Error::Registry, code: :ruby2go_docker_registry_command_failed_unexpected_error, data: { command: command, message: res["error"]["message"] } unless res["error"].nil?
             break res['data']
           end
         end
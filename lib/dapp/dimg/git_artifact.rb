@@ -205,7 +205,7 @@ module Dapp
           "Stage" => JSON.dump(get_stub_stage_state(stage)),
         )
 
-        raise res["error"] if res["error"]
+        raise res["error"]["message"] if res["error"]
 
         self.set_ruby2go_state_hash(JSON.load(res["data"]["GitArtifact"]))
         stage.set_ruby2go_state_hash(JSON.load(res["data"]["Stage"]))
@@ -257,7 +257,7 @@ module Dapp
           "Stage" => JSON.dump(get_stub_stage_state(stage)),
         )
 
-        raise res["error"] if res["error"]
+        raise res["error"]["message"] if res["error"]
 
         self.set_ruby2go_state_hash(JSON.load(res["data"]["GitArtifact"]))
         stage.set_ruby2go_state_hash(JSON.load(res["data"]["Stage"]))
@@ -429,7 +429,7 @@ module Dapp
         @latest_commit ||= begin
           res = repo.dapp.ruby2go_git_artifact("GitArtifact" => JSON.dump(get_ruby2go_state_hash), "method" => "LatestCommit")
 
-          raise res["error"] if res["error"]
+          raise res["error"]["message"] if res["error"]
 
           self.set_ruby2go_state_hash(JSON.load(res["data"]["GitArtifact"]))
 
@@ -25,7 +25,7 @@ module Dapp
         def ruby2go_method(method, args_hash={})
           res = dapp.ruby2go_git_repo(args_hash.merge("RemoteGitRepo" => JSON.dump(get_ruby2go_state_hash), "method" => method))
 
-          raise res["error"] if res["error"]
+          raise res["error"]["message"] if res["error"]
 
           self.set_ruby2go_state_hash(JSON.load(res["data"]["RemoteGitRepo"]))
 
@@ -48,7 +48,7 @@ module Dapp
           def ruby2go_command(dapp, command:, **options)
             (options[:options] ||= {}).merge!(host_docker_config_dir: dapp.class.host_docker_config_dir)
             dapp.ruby2go_image({ command: command }.merge(options)).tap do |res|
-              raise Error::Build, code: :ruby2go_image_command_failed_unexpected_error, data: { command: command, message: res["error"] } unless res["error"].nil?
+              raise Error::Build, code: :ruby2go_image_command_failed_unexpected_error, data: { command: command, message: res["error"]["message"] } unless res["error"].nil?
               break res['data']
             end
           end
@@ -129,10 +129,10 @@ module Dapp
           res = self.dapp.ruby2go_image(**ruby2go_image_build_options)
           if res["error"].nil?
             set_ruby2go_state_hash(JSON.load(res['data']['image']))
-          elsif res["error"].start_with? "container run failed"
+          elsif res["error"]["code"] == "container_run_failed"
             raise Error::Build, code: :ruby2go_image_command_failed, data: { command: "build" }
           else
-            raise Error::Build, code: :ruby2go_image_command_failed_unexpected_error, data: { command: "build", message: res["error"] }
+            raise Error::Build, code: :ruby2go_image_command_failed_unexpected_error, data: { command: "build", message: res["error"]["message"] }
           end
         end
 
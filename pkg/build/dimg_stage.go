@@ -0,0 +1,636 @@
+package build
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/flant/dapp/pkg/config"
+	"github.com/flant/dapp/pkg/dapp"
+	"github.com/flant/dapp/pkg/image"
+	"github.com/flant/dapp/pkg/util"
+)
+
+const patchSizeStep = 1024 * 1024
+
+// StageDependency is a named argument of the stage signature, names are used to explain stage cache misses
+type StageDependency struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// DimgStage calculates signature and git artifacts layer commits of the stage in the same way as ruby dapp,
+// so that stages cache is shared between ruby and native builds
+type DimgStage struct {
+	Name      StageName
+	Dimg      *DimgStages
+	PrevStage *DimgStage
+
+	signature       string
+	signatureInputs []StageDependency
+	dependencies    []StageDependency
+	hasDependencies bool
+	layerCommits    map[*GitArtifact]string
+	image           *image.Stage
+}
+
+func (s *DimgStage) String() string {
+	return fmt.Sprintf("%s stage `%s`", s.Dimg.Node, s.Name)
+}
+
+func (s *DimgStage) GetPrevStage() Stage {
+	if s.PrevStage == nil {
+		return nil
+	}
+	return s.PrevStage
+}
+
+func (s *DimgStage) GetImage() Image {
+	return &dimgStageImage{s}
+}
+
+// Image returns image of the stage, empty stage uses image of the previous stage
+func (s *DimgStage) Image() *image.Stage {
+	if s.image != nil {
+		return s.image
+	}
+	if s.PrevStage != nil {
+		return s.PrevStage.Image()
+	}
+	return nil
+}
+
+func (s *DimgStage) ImageName() string {
+	return fmt.Sprintf("%s:%s", s.Dimg.Options.StageCache, s.signature)
+}
+
+func (s *DimgStage) IsEmpty() (bool, error) {
+	b := s.Dimg.Options.Builder
+
+	switch s.Name {
+	case BeforeInstallStage:
+		return b.IsBeforeInstallEmpty(), nil
+	case InstallStage:
+		return b.IsInstallEmpty(), nil
+	case BeforeSetupStage:
+		return b.IsBeforeSetupEmpty(), nil
+	case SetupStage:
+		return b.IsSetupEmpty(), nil
+	case BuildArtifactStage:
+		return b.IsBuildArtifactEmpty(), nil
+	}
+
+	if s.isGitArtifactStage() && len(s.Dimg.Options.GitArtifacts) == 0 {
+		return true, nil
+	}
+
+	deps, err := s.Dependencies()
+	if err != nil {
+		return false, err
+	}
+
+	return len(deps) == 0, nil
+}
+
+func (s *DimgStage) Signature() (string, error) {
+	if s.signature != "" {
+		return s.signature, nil
+	}
+
+	empty, err := s.IsEmpty()
+	if err != nil {
+		return "", err
+	}
+
+	var signature string
+	if empty {
+		if s.PrevStage == nil {
+			return "", fmt.Errorf("first stage `%s` cannot be empty", s.Name)
+		}
+
+		signature, err = s.PrevStage.Signature()
+		if err != nil {
+			return "", err
+		}
+	} else {
+		inputs, err := s.calculateSignatureInputs()
+		if err != nil {
+			return "", err
+		}
+
+		var args []string
+		for _, input := range inputs {
+			args = append(args, input.Value)
+		}
+
+		signature = util.Sha256Hash(args...)
+		s.signatureInputs = inputs
+	}
+
+	s.signature = signature
+
+	return signature, nil
+}
+
+// SignatureInputs are all arguments of the signature of not empty stage
+func (s *DimgStage) SignatureInputs() []StageDependency {
+	return s.signatureInputs
+}
+
+func (s *DimgStage) calculateSignatureInputs() ([]StageDependency, error) {
+	var inputs []StageDependency
+
+	if s.PrevStage != nil {
+		prevSignature, err := s.PrevStage.Signature()
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, StageDependency{Name: "previous stage", Value: prevSignature})
+	}
+
+	// Dev mode flag of build cache version is in sync with ruby dapp
+	devMode := "0"
+	if s.Dimg.Options.DevMode {
+		devMode = "1"
+	}
+	inputs = append(inputs,
+		StageDependency{Name: "dapp build cache version", Value: dapp.BuildCacheVersion},
+		StageDependency{Name: "dev mode", Value: devMode},
+	)
+
+	if checksum := s.builderChecksum(s.Name); checksum != "" {
+		inputs = append(inputs, StageDependency{Name: fmt.Sprintf("%s commands", s.Name), Value: checksum})
+	}
+
+	deps, err := s.Dependencies()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(inputs, deps...), nil
+}
+
+// Dependencies are stage signature arguments besides previous stage signature and builder checksum,
+// empty dependencies are omitted
+func (s *DimgStage) Dependencies() ([]StageDependency, error) {
+	if s.hasDependencies {
+		return s.dependencies, nil
+	}
+
+	deps, err := s.calculateDependencies()
+	if err != nil {
+		return nil, err
+	}
+
+	s.dependencies = nil
+	for _, dep := range deps {
+		if dep.Value != "" {
+			s.dependencies = append(s.dependencies, dep)
+		}
+	}
+	s.hasDependencies = true
+
+	return s.dependencies, nil
+}
+
+func (s *DimgStage) calculateDependencies() ([]StageDependency, error) {
+	switch s.Name {
+	case FromStage:
+		return s.fromDependencies(), nil
+	case BeforeInstallStage:
+		return []StageDependency{s.builderDependency(BeforeInstallStage)}, nil
+	case BeforeInstallArtifactStage, AfterInstallArtifactStage, BeforeSetupArtifactStage, AfterSetupArtifactStage:
+		return s.artifactsDependencies(), nil
+	case GAArchiveStage:
+		return s.gaArchiveDependencies()
+	case GAPreInstallPatchStage, GAPostInstallPatchStage, GAPreSetupPatchStage, GAArtifactPatchStage:
+		return s.relatedStageContext(gaRelatedStages[s.Name])
+	case GAPostSetupPatchStage:
+		return s.gaPostSetupPatchDependencies()
+	case GALatestPatchStage:
+		return s.gaLatestPatchDependencies()
+	case DockerInstructionsStage:
+		return s.dockerInstructionsDependencies(), nil
+	}
+
+	// Builder stages depend on builder checksum only
+	return nil, nil
+}
+
+func (s *DimgStage) builderChecksum(name StageName) string {
+	b := s.Dimg.Options.Builder
+
+	switch name {
+	case BeforeInstallStage:
+		return b.BeforeInstallChecksum()
+	case InstallStage:
+		return b.InstallChecksum()
+	case BeforeSetupStage:
+		return b.BeforeSetupChecksum()
+	case SetupStage:
+		return b.SetupChecksum()
+	case BuildArtifactStage:
+		return b.BuildArtifactChecksum()
+	}
+
+	return ""
+}
+
+func (s *DimgStage) builderDependency(name StageName) StageDependency {
+	return StageDependency{Name: fmt.Sprintf("%s commands", name), Value: s.builderChecksum(name)}
+}
+
+// joinDependencyValues gives the same signature as separate values, because signature arguments are joined with `:::`
+func joinDependencyValues(values []string) string {
+	var res []string
+	for _, value := range values {
+		if value != "" {
+			res = append(res, value)
+		}
+	}
+	return strings.Join(res, ":::")
+}
+
+func (s *DimgStage) fromDependencies() []StageDependency {
+	base := s.Dimg.Node.Base()
+
+	fromImage := StageDependency{Name: "from image", Value: base.From}
+	if s.Dimg.Options.FromDimg != nil {
+		fromImage = StageDependency{Name: s.Dimg.Options.FromDimg.Node.String(), Value: s.Dimg.Options.FromDimg.Signature()}
+	}
+
+	return []StageDependency{
+		fromImage,
+		{Name: "fromCacheVersion", Value: base.FromCacheVersion},
+		{Name: "mounts", Value: joinDependencyValues(s.configMountsDependencies())},
+	}
+}
+
+// configMountsDependencies is a flattened ruby hash {tmp_dir: [to, ...], build_dir: [to, ...], from: [to, ...]}
+func (s *DimgStage) configMountsDependencies() []string {
+	deps := []string{"tmp_dir"}
+	deps = append(deps, s.configMountsByType("tmp_dir")...)
+	deps = append(deps, "build_dir")
+	deps = append(deps, s.configMountsByType("build_dir")...)
+
+	for _, customMount := range s.configCustomDirMounts() {
+		deps = append(deps, customMount.from)
+		deps = append(deps, customMount.to...)
+	}
+
+	return deps
+}
+
+func (s *DimgStage) configMountsByType(mountType string) []string {
+	var res []string
+	for _, mount := range s.Dimg.Node.Base().Mount {
+		if mount.Type == mountType {
+			res = append(res, mount.To)
+		}
+	}
+	return res
+}
+
+type customDirMount struct {
+	from string
+	to   []string
+}
+
+func (s *DimgStage) configCustomDirMounts() []*customDirMount {
+	var res []*customDirMount
+
+	for _, mount := range s.Dimg.Node.Base().Mount {
+		if mount.Type != "custom_dir" {
+			continue
+		}
+
+		from := filepath.Clean(mount.From)
+
+		var customMount *customDirMount
+		for _, m := range res {
+			if m.from == from {
+				customMount = m
+				break
+			}
+		}
+		if customMount == nil {
+			customMount = &customDirMount{from: from}
+			res = append(res, customMount)
+		}
+
+		customMount.to = append(customMount.to, mount.To)
+	}
+
+	return res
+}
+
+// artifactImportStages select imports of artifact stages by `before` and `after` import options
+var artifactImportStages = map[StageName]func(*config.ArtifactImport) bool{
+	BeforeInstallArtifactStage: func(i *config.ArtifactImport) bool { return i.Before == "install" },
+	AfterInstallArtifactStage:  func(i *config.ArtifactImport) bool { return i.After == "install" },
+	BeforeSetupArtifactStage:   func(i *config.ArtifactImport) bool { return i.Before == "setup" },
+	AfterSetupArtifactStage:    func(i *config.ArtifactImport) bool { return i.After == "setup" },
+}
+
+func (s *DimgStage) artifactImports() []*config.ArtifactImport {
+	var res []*config.ArtifactImport
+
+	match := artifactImportStages[s.Name]
+	for _, artifactImport := range s.Dimg.Node.Base().Import {
+		if match != nil && match(artifactImport) {
+			res = append(res, artifactImport)
+		}
+	}
+
+	return res
+}
+
+func (s *DimgStage) artifactsDependencies() []StageDependency {
+	var deps []StageDependency
+
+	for _, artifactImport := range s.artifactImports() {
+		artifactStages := s.Dimg.Options.Artifacts[artifactImport.ArtifactDimg]
+
+		args := []string{artifactStages.Signature()}
+		if artifactImport.ArtifactExport != nil && artifactImport.ExportBase != nil {
+			e := artifactImport.ExportBase
+			args = append(args, e.Add, e.To, e.Owner, e.Group)
+			args = append(args, e.IncludePaths...)
+			args = append(args, e.ExcludePaths...)
+		}
+
+		deps = append(deps, StageDependency{Name: artifactStages.Node.String(), Value: util.Sha256Hash(args...)})
+	}
+
+	return deps
+}
+
+func (s *DimgStage) gaArchiveDependencies() ([]StageDependency, error) {
+	// NOTICE: ruby dapp also depends on reset commits from commit messages ([dapp reset], [dapp archive reset]),
+	// NOTICE: which are not supported by native build yet
+	var paramshashes []string
+	for _, ga := range s.Dimg.Options.GitArtifacts {
+		paramshashes = append(paramshashes, ga.Paramshash)
+	}
+
+	deps := []StageDependency{{Name: "git directives", Value: strings.Join(paramshashes, "")}}
+
+	// Archive is recreated for every new commit in dev mode, as ruby dapp dev_mode_dependencies does
+	if s.Dimg.Options.DevMode {
+		var commits []string
+		for _, ga := range s.Dimg.Options.GitArtifacts {
+			commit, err := ga.LatestCommit()
+			if err != nil {
+				return nil, err
+			}
+			commits = append(commits, commit)
+		}
+
+		deps = append(deps, StageDependency{Name: "latest commits", Value: strings.Join(commits, "")})
+	}
+
+	return deps, nil
+}
+
+// gaRelatedStages are user stages, which are preceded by git artifacts patch stages
+var gaRelatedStages = map[StageName]StageName{
+	GAPreInstallPatchStage:  InstallStage,
+	GAPostInstallPatchStage: BeforeSetupStage,
+	GAPreSetupPatchStage:    SetupStage,
+	GAArtifactPatchStage:    BuildArtifactStage,
+}
+
+// relatedStageContext makes patch stage before the related user stage depend on the related stage
+// stageDependencies files and commands, so that the patch is applied before rerunning the related stage
+func (s *DimgStage) relatedStageContext(relatedStage StageName) ([]StageDependency, error) {
+	var deps []StageDependency
+
+	for _, ga := range s.Dimg.Options.GitArtifacts {
+		checksum, err := ga.StageDependenciesChecksum(relatedStage)
+		if err != nil {
+			return nil, err
+		}
+
+		deps = append(deps, StageDependency{
+			Name:  fmt.Sprintf("stageDependencies.%s files of %s", stagesDependenciesKeys[relatedStage], ga),
+			Value: checksum,
+		})
+	}
+
+	return append(deps, s.builderDependency(relatedStage)), nil
+}
+
+// changedStageDependencies returns descriptions of stageDependencies files of the related stage,
+// which are changed since the previous stage layer commit
+func (s *DimgStage) changedStageDependencies() ([]string, error) {
+	relatedStage, isRelated := gaRelatedStages[s.Name]
+	if !isRelated {
+		return nil, nil
+	}
+
+	var res []string
+	for _, ga := range s.Dimg.Options.GitArtifacts {
+		fromCommit, toCommit, err := s.gaPatchCommits(ga)
+		if err != nil {
+			return nil, err
+		}
+
+		if fromCommit == "" || fromCommit == toCommit {
+			continue
+		}
+
+		changes, err := ga.StagesDependenciesChanges(fromCommit, toCommit)
+		if err != nil {
+			return nil, err
+		}
+
+		if change, hasKey := changes[relatedStage]; hasKey && change.IsChanged {
+			res = append(res, fmt.Sprintf("changed stageDependencies.%s files of %s since commit `%s`", stagesDependenciesKeys[relatedStage], ga, fromCommit))
+		}
+	}
+
+	return res, nil
+}
+
+func (s *DimgStage) gaPostSetupPatchDependencies() ([]StageDependency, error) {
+	var size int64
+
+	for _, ga := range s.Dimg.Options.GitArtifacts {
+		fromCommit, toCommit, err := s.gaPatchCommits(ga)
+		if err != nil {
+			return nil, err
+		}
+		if fromCommit == "" || fromCommit == toCommit {
+			continue
+		}
+
+		patchSize, err := ga.PatchSize(fromCommit, toCommit)
+		if err != nil {
+			return nil, err
+		}
+		size += patchSize
+	}
+
+	return []StageDependency{{Name: "git patches size", Value: strconv.FormatInt(size/patchSizeStep, 10)}}, nil
+}
+
+func (s *DimgStage) gaLatestPatchDependencies() ([]StageDependency, error) {
+	var deps []StageDependency
+
+	for _, ga := range s.Dimg.Options.GitArtifacts {
+		fromCommit, toCommit, err := s.gaPatchCommits(ga)
+		if err != nil {
+			return nil, err
+		}
+		if fromCommit == "" || fromCommit == toCommit {
+			continue
+		}
+
+		patchSize, err := ga.PatchSize(fromCommit, toCommit)
+		if err != nil {
+			return nil, err
+		}
+		if patchSize > 0 {
+			deps = append(deps, StageDependency{Name: fmt.Sprintf("commit of %s", ga), Value: toCommit})
+		}
+	}
+
+	return deps, nil
+}
+
+// gaPatchCommits returns previous stage layer commit and latest commit,
+// empty from commit is returned when previous layer commit does not exist in the repo anymore
+func (s *DimgStage) gaPatchCommits(ga *GitArtifact) (string, string, error) {
+	fromCommit, err := s.PrevStage.LayerCommit(ga)
+	if err != nil {
+		return "", "", err
+	}
+
+	exist, err := ga.IsCommitExists(fromCommit)
+	if err != nil {
+		return "", "", err
+	}
+	if !exist {
+		return "", "", nil
+	}
+
+	toCommit, err := ga.LatestCommit()
+	if err != nil {
+		return "", "", err
+	}
+
+	return fromCommit, toCommit, nil
+}
+
+func (s *DimgStage) dockerInstructionsDependencies() []StageDependency {
+	if s.Dimg.Node.IsArtifact() || s.Dimg.Node.Dimg.Docker == nil {
+		return nil
+	}
+
+	docker := s.Dimg.Node.Dimg.Docker
+
+	var deps []string
+	addList := func(name string, values []string) {
+		if len(values) > 0 {
+			deps = append(deps, name)
+			deps = append(deps, values...)
+		}
+	}
+	addMap := func(name string, values map[string]string) {
+		var keys []string
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var list []string
+		for _, key := range keys {
+			list = append(list, fmt.Sprintf("%s=%s", key, values[key]))
+		}
+		addList(name, list)
+	}
+	addValue := func(name string, value string) {
+		if value != "" {
+			deps = append(deps, name, value)
+		}
+	}
+
+	addList("volume", docker.Volume)
+	addList("expose", docker.Expose)
+	addMap("env", docker.Env)
+	addMap("label", docker.Label)
+	addList("cmd", docker.Cmd)
+	addList("onbuild", docker.Onbuild)
+	addValue("workdir", docker.Workdir)
+	addValue("user", docker.User)
+	addList("entrypoint", docker.Entrypoint)
+
+	return []StageDependency{{Name: "docker instructions", Value: joinDependencyValues(deps)}}
+}
+
+func (s *DimgStage) isGitArtifactStage() bool {
+	switch s.Name {
+	case GAArchiveStage, GAPreInstallPatchStage, GAPostInstallPatchStage, GAPreSetupPatchStage,
+		GAPostSetupPatchStage, GALatestPatchStage, GAArtifactPatchStage:
+		return true
+	}
+	return false
+}
+
+func (s *DimgStage) isGitArtifactLatestPatchStage() bool {
+	return s.Name == GALatestPatchStage || s.Name == GAArtifactPatchStage
+}
+
+// LayerCommit is the commit of git artifact files in the stage image: commit from the image label
+// for built stages, latest commit for git artifact stages and previous stage layer commit otherwise
+func (s *DimgStage) LayerCommit(ga *GitArtifact) (string, error) {
+	if commit, hasKey := s.layerCommits[ga]; hasKey {
+		return commit, nil
+	}
+
+	commit, err := s.layerCommit(ga)
+	if err != nil {
+		return "", err
+	}
+
+	s.layerCommits[ga] = commit
+
+	return commit, nil
+}
+
+func (s *DimgStage) layerCommit(ga *GitArtifact) (string, error) {
+	if s.isGitArtifactLatestPatchStage() {
+		return ga.LatestCommit()
+	}
+
+	empty, err := s.IsEmpty()
+	if err != nil {
+		return "", err
+	}
+
+	if !empty {
+		if _, err := s.Signature(); err != nil {
+			return "", err
+		}
+
+		labels, built, err := s.Dimg.Options.Images.GetLabels(s.ImageName())
+		if err != nil {
+			return "", err
+		}
+		if built {
+			return labels[ga.getCommitLabelName()], nil
+		}
+
+		if s.isGitArtifactStage() {
+			return ga.LatestCommit()
+		}
+	}
+
+	if s.PrevStage != nil {
+		return s.PrevStage.LayerCommit(ga)
+	}
+
+	return "", nil
+}
@@ -0,0 +1,454 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/flant/dapp/pkg/dapp"
+	"github.com/flant/dapp/pkg/dappdeps"
+	"github.com/flant/dapp/pkg/docker"
+	"github.com/flant/dapp/pkg/image"
+	uuid "github.com/satori/go.uuid"
+)
+
+// dimgStageImage provides build.Image interface of the stage for git artifacts
+type dimgStageImage struct {
+	stage *DimgStage
+}
+
+func (i *dimgStageImage) GetLabels() (map[string]string, error) {
+	img := i.stage.Image()
+	if img == nil {
+		return nil, nil
+	}
+
+	labels, _, err := i.stage.Dimg.Options.Images.GetLabels(img.Name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get labels of image `%s`: %s", img.Name, err)
+	}
+
+	return labels, nil
+}
+
+func (i *dimgStageImage) AddServiceChangeLabel(name, value string) {
+	i.stage.Image().Container.ServiceCommitChangeOptions.AddLabel(map[string]interface{}{name: value})
+}
+
+// PrepareImage fills stage image container with builder commands, git artifacts commands, mounts and labels,
+// the image is ready to build after that
+func (s *DimgStage) PrepareImage() error {
+	if s.image == nil {
+		return fmt.Errorf("%s is empty and has no image", s)
+	}
+
+	c := s.image.Container
+
+	if err := s.prepareMounts(); err != nil {
+		return err
+	}
+
+	c.ServiceCommitChangeOptions.AddLabel(map[string]interface{}{
+		"dapp":               s.Dimg.Options.ProjectName,
+		"dapp-cache-version": dapp.BuildCacheVersion,
+		"dapp-dimg":          "false",
+	})
+	if s.Dimg.Options.DevMode {
+		c.ServiceCommitChangeOptions.AddLabel(map[string]interface{}{image.DevModeLabel: "true"})
+	}
+
+	b := s.Dimg.Options.Builder
+	builderContainer := s.image.BuilderContainer()
+
+	switch s.Name {
+	case FromStage:
+		return nil
+	case BeforeInstallStage:
+		return b.BeforeInstall(builderContainer)
+	case InstallStage:
+		return b.Install(builderContainer)
+	case BeforeSetupStage:
+		return b.BeforeSetup(builderContainer)
+	case SetupStage:
+		return b.Setup(builderContainer)
+	case BuildArtifactStage:
+		return b.BuildArtifact(builderContainer)
+	case BeforeInstallArtifactStage, AfterInstallArtifactStage, BeforeSetupArtifactStage, AfterSetupArtifactStage:
+		return s.prepareArtifactsImport()
+	case DockerInstructionsStage:
+		s.prepareDockerInstructions()
+		return nil
+	}
+
+	if s.isGitArtifactStage() {
+		return s.prepareGitArtifacts()
+	}
+
+	return nil
+}
+
+func (s *DimgStage) prepareGitArtifacts() error {
+	c := s.image.Container
+
+	gitArtifactContainerName, err := dappdeps.GitArtifactContainer()
+	if err != nil {
+		return err
+	}
+	c.RunOptions.AddVolumeFrom([]string{gitArtifactContainerName})
+
+	volumes := make(map[string]bool)
+	for _, ga := range s.Dimg.Options.GitArtifacts {
+		for _, volume := range []string{
+			fmt.Sprintf("%s:%s:ro", ga.ArchivesDir, ga.ContainerArchivesDir),
+			fmt.Sprintf("%s:%s:ro", ga.PatchesDir, ga.ContainerPatchesDir),
+		} {
+			if !volumes[volume] {
+				volumes[volume] = true
+				c.RunOptions.AddVolume([]string{volume})
+			}
+		}
+	}
+
+	for _, ga := range s.Dimg.Options.GitArtifacts {
+		commit, err := s.LayerCommit(ga)
+		if err != nil {
+			return err
+		}
+		c.ServiceCommitChangeOptions.AddLabel(map[string]interface{}{ga.getCommitLabelName(): commit})
+
+		var commands []string
+		if s.Name == GAArchiveStage && ga.IsArchiveStreamable() {
+			archive, err := ga.ApplyArchiveStream(s)
+			if err != nil {
+				return err
+			}
+			if archive != nil {
+				c.AddArchives(archive)
+			}
+			continue
+		} else if s.Name == GAArchiveStage {
+			commands, err = ga.ApplyArchiveCommand(s)
+		} else {
+			commands, err = ga.ApplyPatchCommand(s)
+		}
+		if err != nil {
+			return err
+		}
+
+		c.AddRunCommands(commands)
+	}
+
+	return nil
+}
+
+// prepareArtifactsImport copies export paths from the last image of every imported artifact into the dimg tmp dir,
+// the stage container copies them from the tmp dir with the import owner and group, the same as ruby dapp does
+func (s *DimgStage) prepareArtifactsImport() error {
+	c := s.image.Container
+
+	baseContainerName, err := dappdeps.BaseContainer()
+	if err != nil {
+		return err
+	}
+
+	toolchainContainerName, err := dappdeps.ToolchainContainer()
+	if err != nil {
+		return err
+	}
+
+	volumes := make(map[string]bool)
+	for _, artifactImport := range s.artifactImports() {
+		if artifactImport.ArtifactExport == nil || artifactImport.ExportBase == nil {
+			return fmt.Errorf("%s: export of artifact `%s` is not specified", s, artifactImport.ArtifactName)
+		}
+
+		e := artifactImport.ExportBase
+		artifactStages := s.Dimg.Options.Artifacts[artifactImport.ArtifactDimg]
+		artifactImage := artifactStages.LastStage().Image()
+
+		artifactImageId, err := artifactImage.MustGetId()
+		if err != nil {
+			return err
+		}
+
+		hostDir := filepath.Join(s.Dimg.Options.TmpDir, "artifact", artifactImport.ArtifactName)
+		if err := os.MkdirAll(hostDir, os.ModePerm); err != nil {
+			return err
+		}
+
+		exportDirName := uuid.NewV4().String()
+
+		artifactContainerDir := path.Join(s.Dimg.Options.ContainerTmpDir, artifactImport.ArtifactName)
+		exportCommand := artifactCopyCommand(e.Add, path.Join(artifactContainerDir, exportDirName), "", "", e.IncludePaths, e.ExcludePaths)
+
+		fmt.Printf("Copying files of %s ...\n", artifactStages.Node)
+
+		err = docker.CliRun(
+			"--rm",
+			fmt.Sprintf("--volume=%s:%s", hostDir, artifactContainerDir),
+			fmt.Sprintf("--volumes-from=%s", toolchainContainerName),
+			fmt.Sprintf("--volumes-from=%s", baseContainerName),
+			fmt.Sprintf("--entrypoint=%s", dappdeps.BaseBinPath("bash")),
+			artifactImageId,
+			"-ec",
+			image.ShelloutPack(exportCommand),
+		)
+		if err != nil {
+			return fmt.Errorf("cannot copy files of %s: %s", artifactStages.Node, err)
+		}
+
+		fmt.Printf("Copying files of %s DONE\n", artifactStages.Node)
+
+		containerDir := path.Join(s.Dimg.Options.ContainerTmpDir, "artifact", artifactImport.ArtifactName)
+		if volume := fmt.Sprintf("%s:%s:ro", hostDir, containerDir); !volumes[volume] {
+			volumes[volume] = true
+			c.RunOptions.AddVolume([]string{volume})
+		}
+
+		c.AddRunCommands([]string{
+			artifactCopyCommand(path.Join(containerDir, exportDirName), e.To, e.Owner, e.Group, e.IncludePaths, e.ExcludePaths),
+		})
+
+		c.ServiceCommitChangeOptions.AddLabel(map[string]interface{}{
+			fmt.Sprintf("dapp-artifact-%s", artifactImport.ArtifactName): artifactImageId,
+		})
+	}
+
+	return nil
+}
+
+// artifactCopyCommand is rsync of from path into to path with include and exclude paths relative to from path,
+// exclude paths have priority over include paths
+func artifactCopyCommand(from, to, owner, group string, includePaths, excludePaths []string) string {
+	cmd := fmt.Sprintf("%s -p %s && %s --archive --links --inplace", dappdeps.BaseBinPath("mkdir"), path.Dir(to), dappdeps.BaseBinPath("rsync"))
+
+	if owner != "" || group != "" {
+		cmd += fmt.Sprintf(" --chown=%s:%s", owner, group)
+	}
+
+	for _, p := range excludePaths {
+		cmd += fmt.Sprintf(" --filter='-/ %s'", path.Join(from, p))
+	}
+
+	if len(includePaths) > 0 {
+		for _, p := range includePaths {
+			targetPath := path.Join(from, p)
+
+			// Every parent of the include path is included, otherwise rsync does not descend into it
+			parts := strings.Split(strings.TrimPrefix(targetPath, "/"), "/")
+			cmd += " --filter='+/ /'"
+			for i := range parts[:len(parts)-1] {
+				cmd += fmt.Sprintf(" --filter='+/ /%s'", strings.Join(parts[:i+1], "/"))
+			}
+
+			// It is unknown whether the include path is a file or a directory, so both are included
+			cmd += fmt.Sprintf(" --filter='+/ %s'", targetPath)
+			cmd += fmt.Sprintf(" --filter='+/ %s'", path.Join(targetPath, "**"))
+		}
+
+		cmd += fmt.Sprintf(" --filter='-/ %s'", path.Join(from, "**"))
+	}
+
+	// Trailing slash copies the content of from directory instead of the directory itself
+	cmd += fmt.Sprintf(" $(if [ -d %[1]s ] ; then echo %[1]s/ ; else echo %[1]s ; fi) %[2]s", from, to)
+
+	return cmd
+}
+
+func (s *DimgStage) prepareDockerInstructions() {
+	docker := s.Dimg.Node.Dimg.Docker
+	options := s.image.Container.CommitChangeOptions
+
+	options.AddVolume(docker.Volume)
+	options.AddExpose(docker.Expose)
+	for env, value := range docker.Env {
+		options.AddEnv(map[string]interface{}{env: value})
+	}
+	for label, value := range docker.Label {
+		options.AddLabel(map[string]interface{}{label: value})
+	}
+	options.Cmd = docker.Cmd
+	options.Onbuild = docker.Onbuild
+	options.Workdir = docker.Workdir
+	options.User = docker.User
+	options.Entrypoint = docker.Entrypoint
+}
+
+func (s *DimgStage) prepareMounts() error {
+	c := s.image.Container
+
+	if s.Name == FromStage {
+		var dirs []string
+		for _, mountType := range []string{"tmp_dir", "build_dir"} {
+			dirs = appendUniq(dirs, s.configMountsByType(mountType)...)
+		}
+		for _, customMount := range s.configCustomDirMounts() {
+			dirs = appendUniq(dirs, customMount.to...)
+		}
+
+		if len(dirs) > 0 {
+			c.AddServiceRunCommands([]string{
+				fmt.Sprintf("%s -rf %s", dappdeps.BaseBinPath("rm"), strings.Join(dirs, " ")),
+				fmt.Sprintf("%s -p %s", dappdeps.BaseBinPath("mkdir"), strings.Join(dirs, " ")),
+			})
+		}
+
+		return nil
+	}
+
+	// Mounts of fromDimg are inherited through the labels of the previous image
+	fromLabels, _, err := s.Dimg.Options.Images.GetLabels(s.image.FromImage.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, mountType := range []string{"tmp_dir", "build_dir"} {
+		labelName := fmt.Sprintf("dapp-mount-%s", strings.Replace(mountType, "_", "-", -1))
+
+		mounts := appendUniq(nil, s.configMountsByType(mountType)...)
+		if value := fromLabels[labelName]; value != "" {
+			mounts = appendUniq(mounts, strings.Split(value, ";")...)
+		}
+		if len(mounts) == 0 {
+			continue
+		}
+
+		hostDir := s.Dimg.Options.TmpDir
+		if mountType == "build_dir" {
+			hostDir = s.Dimg.Options.BuildDir
+		}
+
+		for _, path := range mounts {
+			absolutePath := filepath.Join("/", path)
+			hostPath := filepath.Join(hostDir, "mount", absolutePath[1:])
+			if err := os.MkdirAll(hostPath, os.ModePerm); err != nil {
+				return err
+			}
+			c.RunOptions.AddVolume([]string{fmt.Sprintf("%s:%s", hostPath, absolutePath)})
+		}
+
+		c.ServiceCommitChangeOptions.AddLabel(map[string]interface{}{labelName: strings.Join(mounts, ";")})
+	}
+
+	customMounts := s.configCustomDirMounts()
+	for label, value := range fromLabels {
+		if !strings.HasPrefix(label, "dapp-mount-custom-dir-") {
+			continue
+		}
+
+		from := filepath.Clean(strings.Replace(strings.TrimPrefix(label, "dapp-mount-custom-dir-"), "--", "/", -1))
+
+		var customMount *customDirMount
+		for _, m := range customMounts {
+			if m.from == from {
+				customMount = m
+				break
+			}
+		}
+		if customMount == nil {
+			customMount = &customDirMount{from: from}
+			customMounts = append(customMounts, customMount)
+		}
+
+		customMount.to = appendUniq(customMount.to, strings.Split(value, ";")...)
+	}
+
+	for _, customMount := range customMounts {
+		if err := os.MkdirAll(customMount.from, os.ModePerm); err != nil {
+			return err
+		}
+
+		to := appendUniq(nil, customMount.to...)
+		for _, path := range to {
+			c.RunOptions.AddVolume([]string{fmt.Sprintf("%s:%s", customMount.from, path)})
+		}
+
+		labelName := fmt.Sprintf("dapp-mount-custom-dir-%s", strings.Replace(customMount.from, "/", "--", -1))
+		c.ServiceCommitChangeOptions.AddLabel(map[string]interface{}{labelName: strings.Join(to, ";")})
+	}
+
+	return nil
+}
+
+func appendUniq(list []string, values ...string) []string {
+	for _, value := range values {
+		exist := false
+		for _, v := range list {
+			if v == value {
+				exist = true
+				break
+			}
+		}
+		if !exist {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// Build builds not cached stages one by one, each stage is built under the stage lock
+func (d *DimgStages) Build(lockOwner string) error {
+	if d.Options.FromDimg == nil {
+		fromImage := d.Stages[0].image.FromImage
+
+		inspect, err := fromImage.GetInspect()
+		if err != nil {
+			return err
+		}
+		if inspect == nil {
+			fmt.Printf("Pulling base image `%s` of %s\n", fromImage.Name, d.Node)
+			if err := fromImage.Pull(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, stage := range d.Stages {
+		if stage.image == nil {
+			continue
+		}
+
+		isBuilt := func() (bool, error) {
+			_, built, err := d.Options.Images.GetLabels(stage.image.Name)
+			return built, err
+		}
+
+		err := WithStageLock(d.Options.ProjectName, stage.image.Name, lockOwner, isBuilt, stage.build)
+		if err != nil {
+			return fmt.Errorf("%s build failed: %s", stage, err)
+		}
+	}
+
+	// Inspect is cached before dependants use the last image concurrently
+	if _, err := d.LastStage().Image().MustGetInspect(); err != nil {
+		return err
+	}
+
+	if err := d.saveRecord(); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: cannot save stages record of %s: %s\n", d.Node, err)
+	}
+
+	return nil
+}
+
+func (s *DimgStage) build() error {
+	fmt.Printf("Building %s\n", s)
+
+	if err := s.PrepareImage(); err != nil {
+		return err
+	}
+
+	if err := s.image.Build(&image.StageBuildOptions{}); err != nil {
+		return err
+	}
+
+	if err := s.image.SaveInCache(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Building %s DONE\n", s)
+
+	return nil
+}
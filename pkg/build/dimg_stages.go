@@ -0,0 +1,207 @@
+package build
+
+import (
+	"fmt"
+
+	"github.com/flant/dapp/pkg/build/builder"
+	"github.com/flant/dapp/pkg/config"
+	"github.com/flant/dapp/pkg/image"
+)
+
+// StageName should be in sync with ruby dapp stage names
+type StageName string
+
+const (
+	FromStage                  StageName = "from"
+	BeforeInstallStage         StageName = "before_install"
+	BeforeInstallArtifactStage StageName = "before_install_artifact"
+	GAArchiveStage             StageName = "g_a_archive"
+	GAPreInstallPatchStage     StageName = "g_a_pre_install_patch"
+	InstallStage               StageName = "install"
+	GAPostInstallPatchStage    StageName = "g_a_post_install_patch"
+	AfterInstallArtifactStage  StageName = "after_install_artifact"
+	BeforeSetupStage           StageName = "before_setup"
+	BeforeSetupArtifactStage   StageName = "before_setup_artifact"
+	GAPreSetupPatchStage       StageName = "g_a_pre_setup_patch"
+	SetupStage                 StageName = "setup"
+	GAPostSetupPatchStage      StageName = "g_a_post_setup_patch"
+	AfterSetupArtifactStage    StageName = "after_setup_artifact"
+	GALatestPatchStage         StageName = "g_a_latest_patch"
+	DockerInstructionsStage    StageName = "docker_instructions"
+	GAArtifactPatchStage       StageName = "g_a_artifact_patch"
+	BuildArtifactStage         StageName = "build_artifact"
+)
+
+var dimgStagesNames = []StageName{
+	FromStage,
+	BeforeInstallStage,
+	BeforeInstallArtifactStage,
+	GAArchiveStage,
+	GAPreInstallPatchStage,
+	InstallStage,
+	GAPostInstallPatchStage,
+	AfterInstallArtifactStage,
+	BeforeSetupStage,
+	BeforeSetupArtifactStage,
+	GAPreSetupPatchStage,
+	SetupStage,
+	GAPostSetupPatchStage,
+	AfterSetupArtifactStage,
+	GALatestPatchStage,
+	DockerInstructionsStage,
+}
+
+var artifactStagesNames = []StageName{
+	FromStage,
+	BeforeInstallStage,
+	BeforeInstallArtifactStage,
+	GAArchiveStage,
+	GAPreInstallPatchStage,
+	InstallStage,
+	GAPostInstallPatchStage,
+	AfterInstallArtifactStage,
+	BeforeSetupStage,
+	BeforeSetupArtifactStage,
+	GAPreSetupPatchStage,
+	SetupStage,
+	GAArtifactPatchStage,
+	BuildArtifactStage,
+}
+
+type DimgStagesOptions struct {
+	// ProjectName is used in stage images labels and stage build locks
+	ProjectName string
+	// StageCache is stage images repository, `dimgstage-<project>` in ruby dapp
+	StageCache string
+
+	Builder      builder.Builder
+	GitArtifacts []*GitArtifact
+	Images       StageImages
+
+	// FromDimg is the pipeline of fromDimg or fromDimgArtifact
+	FromDimg *DimgStages
+	// Artifacts are pipelines of imported artifacts
+	Artifacts map[*config.DimgArtifact]*DimgStages
+
+	// TmpDir and BuildDir are host directories for tmp_dir and build_dir mounts
+	TmpDir   string
+	BuildDir string
+	// ContainerTmpDir is the directory of imported artifacts files in stage containers
+	ContainerTmpDir string
+
+	// DevMode stages are built from the working tree of the own repo, they have other signatures
+	// and `dapp-dev-mode` label, so that they are never pushed
+	DevMode bool
+}
+
+// NewDimgBuilder returns builder of dimg or artifact instructions
+func NewDimgBuilder(node *DimgNode, extra *builder.Extra) builder.Builder {
+	if node.Base().Ansible != nil {
+		return builder.NewAnsibleBuilder(node.Base().Ansible, extra)
+	}
+
+	if node.IsArtifact() && node.Artifact.Shell != nil {
+		return builder.NewShellBuilder(node.Artifact.Shell)
+	} else if !node.IsArtifact() && node.Dimg.Shell != nil {
+		return builder.NewShellBuilder(node.Dimg.Shell)
+	}
+
+	return builder.NewNoneBuilder()
+}
+
+// DimgStages is a chain of stages of one dimg or artifact
+type DimgStages struct {
+	Node    *DimgNode
+	Options DimgStagesOptions
+	Stages  []*DimgStage
+}
+
+// NewDimgStages creates stages chain and calculates signatures of all stages, so that DimgStages
+// of dependencies can be used by dependants concurrently after NewDimgStages is done
+func NewDimgStages(node *DimgNode, opts DimgStagesOptions) (*DimgStages, error) {
+	if opts.Builder == nil {
+		opts.Builder = builder.NewNoneBuilder()
+	}
+	if opts.Images == nil {
+		opts.Images = &DockerStageImages{}
+	}
+
+	base := node.Base()
+	if (base.FromDimg != nil || base.FromDimgArtifact != nil) && opts.FromDimg == nil {
+		return nil, fmt.Errorf("%s: fromDimg stages are required", node)
+	}
+	for _, artifactImport := range base.Import {
+		if _, hasKey := opts.Artifacts[artifactImport.ArtifactDimg]; !hasKey {
+			return nil, fmt.Errorf("%s: stages of imported artifact `%s` are required", node, artifactImport.ArtifactName)
+		}
+	}
+
+	d := &DimgStages{Node: node, Options: opts}
+
+	stagesNames := dimgStagesNames
+	if node.IsArtifact() {
+		stagesNames = artifactStagesNames
+	}
+
+	var prevStage *DimgStage
+	for _, name := range stagesNames {
+		stage := &DimgStage{Name: name, Dimg: d, PrevStage: prevStage, layerCommits: make(map[*GitArtifact]string)}
+		d.Stages = append(d.Stages, stage)
+		prevStage = stage
+	}
+
+	for _, stage := range d.Stages {
+		if _, err := stage.Signature(); err != nil {
+			return nil, fmt.Errorf("%s: stage `%s` signature calculation failed: %s", node, stage.Name, err)
+		}
+	}
+
+	if err := d.initImages(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *DimgStages) initImages() error {
+	var fromImage *image.Stage
+	if d.Options.FromDimg != nil {
+		fromImage = d.Options.FromDimg.LastStage().Image()
+	} else {
+		fromImage = image.NewStageImage(nil, d.Node.Base().From)
+	}
+
+	for _, stage := range d.Stages {
+		empty, err := stage.IsEmpty()
+		if err != nil {
+			return err
+		}
+
+		if empty {
+			continue
+		}
+
+		stage.image = image.NewStageImage(fromImage, stage.ImageName())
+		fromImage = stage.image
+	}
+
+	return nil
+}
+
+func (d *DimgStages) LastStage() *DimgStage {
+	return d.Stages[len(d.Stages)-1]
+}
+
+// Signature is the signature of the last stage, which identifies dimg or artifact as a whole
+func (d *DimgStages) Signature() string {
+	return d.LastStage().signature
+}
+
+func (d *DimgStages) GetStage(name StageName) *DimgStage {
+	for _, stage := range d.Stages {
+		if stage.Name == name {
+			return stage
+		}
+	}
+	return nil
+}
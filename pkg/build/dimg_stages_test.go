@@ -0,0 +1,264 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/flant/dapp/pkg/build/builder"
+	"github.com/flant/dapp/pkg/config"
+	"github.com/flant/dapp/pkg/git_repo"
+	git "github.com/flant/go-git"
+)
+
+type testBuilder struct {
+	checksums map[StageName]string
+}
+
+func (b *testBuilder) IsBeforeInstallEmpty() bool { return b.checksums[BeforeInstallStage] == "" }
+func (b *testBuilder) IsInstallEmpty() bool       { return b.checksums[InstallStage] == "" }
+func (b *testBuilder) IsBeforeSetupEmpty() bool   { return b.checksums[BeforeSetupStage] == "" }
+func (b *testBuilder) IsSetupEmpty() bool         { return b.checksums[SetupStage] == "" }
+func (b *testBuilder) IsBuildArtifactEmpty() bool { return b.checksums[BuildArtifactStage] == "" }
+
+func (b *testBuilder) BeforeInstall(c builder.Container) error { return nil }
+func (b *testBuilder) Install(c builder.Container) error       { return nil }
+func (b *testBuilder) BeforeSetup(c builder.Container) error   { return nil }
+func (b *testBuilder) Setup(c builder.Container) error         { return nil }
+func (b *testBuilder) BuildArtifact(c builder.Container) error { return nil }
+
+func (b *testBuilder) BeforeInstallChecksum() string { return b.checksums[BeforeInstallStage] }
+func (b *testBuilder) InstallChecksum() string       { return b.checksums[InstallStage] }
+func (b *testBuilder) BeforeSetupChecksum() string   { return b.checksums[BeforeSetupStage] }
+func (b *testBuilder) SetupChecksum() string         { return b.checksums[SetupStage] }
+func (b *testBuilder) BuildArtifactChecksum() string { return b.checksums[BuildArtifactStage] }
+
+type testStageImages struct {
+	ids map[string]string
+}
+
+func (images *testStageImages) GetLabels(imageName string) (map[string]string, bool, error) {
+	return nil, false, nil
+}
+
+func (images *testStageImages) GetId(imageName string) (string, error) {
+	return images.ids[imageName], nil
+}
+
+func newTestDimgStages(t *testing.T, node *DimgNode, checksums map[StageName]string, opts DimgStagesOptions) *DimgStages {
+	opts.ProjectName = "test"
+	opts.StageCache = "dimgstage-test"
+	opts.Builder = &testBuilder{checksums: checksums}
+	if opts.Images == nil {
+		opts.Images = &testStageImages{}
+	}
+
+	d, err := NewDimgStages(node, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func stagesSignatures(d *DimgStages) map[StageName]string {
+	res := make(map[StageName]string)
+	for _, stage := range d.Stages {
+		res[stage.Name] = stage.signature
+	}
+	return res
+}
+
+func TestDimgStages_Signatures(t *testing.T) {
+	dimg := newTestDimg("dimg")
+	dimg.From = "ubuntu:16.04"
+	node := &DimgNode{Dimg: dimg}
+
+	d := newTestDimgStages(t, node, map[StageName]string{InstallStage: "install"}, DimgStagesOptions{})
+	signatures := stagesSignatures(d)
+
+	if signatures[BeforeInstallStage] != signatures[FromStage] {
+		t.Errorf("empty stage should have signature of the previous stage")
+	}
+	if signatures[InstallStage] == signatures[FromStage] {
+		t.Errorf("install stage should have own signature")
+	}
+	if d.Signature() != signatures[InstallStage] {
+		t.Errorf("dimg signature should be the signature of the last not empty stage")
+	}
+
+	var images []string
+	for _, stage := range d.Stages {
+		if stage.image != nil {
+			images = append(images, stage.image.Name)
+		}
+	}
+	if len(images) != 2 || images[1] != "dimgstage-test:"+signatures[InstallStage] {
+		t.Fatalf("expected from and install stages images, got %v", images)
+	}
+	if d.GetStage(InstallStage).image.FromImage != d.GetStage(FromStage).image {
+		t.Errorf("install image should be built from the from stage image")
+	}
+
+	changed := stagesSignatures(newTestDimgStages(t, node, map[StageName]string{InstallStage: "install2"}, DimgStagesOptions{}))
+	if changed[FromStage] != signatures[FromStage] || changed[InstallStage] == signatures[InstallStage] {
+		t.Errorf("install commands change should invalidate install and next stages only")
+	}
+
+	withBeforeInstall := stagesSignatures(newTestDimgStages(t, node, map[StageName]string{BeforeInstallStage: "before", InstallStage: "install"}, DimgStagesOptions{}))
+	if withBeforeInstall[InstallStage] == signatures[InstallStage] {
+		t.Errorf("before install change should invalidate install stage")
+	}
+
+	dimg.FromCacheVersion = "1"
+	bumped := stagesSignatures(newTestDimgStages(t, node, map[StageName]string{InstallStage: "install"}, DimgStagesOptions{}))
+	if bumped[FromStage] == signatures[FromStage] {
+		t.Errorf("fromCacheVersion change should invalidate from stage")
+	}
+}
+
+func TestDimgStages_DockerInstructions(t *testing.T) {
+	dimg := newTestDimg("dimg")
+	dimg.From = "ubuntu:16.04"
+	node := &DimgNode{Dimg: dimg}
+
+	d := newTestDimgStages(t, node, nil, DimgStagesOptions{})
+	if d.GetStage(DockerInstructionsStage).image != nil {
+		t.Fatalf("docker instructions stage should be empty without docker directives")
+	}
+
+	dimg.Docker = &config.Docker{Env: map[string]string{"A": "1"}, Workdir: "/app"}
+	d = newTestDimgStages(t, node, nil, DimgStagesOptions{})
+	if d.GetStage(DockerInstructionsStage).image == nil {
+		t.Fatalf("docker instructions stage should not be empty")
+	}
+}
+
+func TestDimgStages_Dependencies(t *testing.T) {
+	base := newTestDimg("base")
+	base.From = "ubuntu:16.04"
+	artifact := newTestArtifact("artifact")
+	artifact.From = "alpine"
+
+	dimg := newTestDimg("dimg")
+	dimg.FromDimg = base
+	dimg.Import = append(dimg.Import, &config.ArtifactImport{
+		ArtifactExport: &config.ArtifactExport{ExportBase: &config.ExportBase{Add: "/app", To: "/app"}},
+		ArtifactName:   "artifact",
+		ArtifactDimg:   artifact,
+		After:          "install",
+	})
+
+	nodes, err := NewDimgsGraph([]*config.Dimg{dimg})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newStages := func(baseChecksum, artifactChecksum string) *DimgStages {
+		baseStages := newTestDimgStages(t, nodes[0], map[StageName]string{InstallStage: baseChecksum}, DimgStagesOptions{})
+		artifactStages := newTestDimgStages(t, nodes[1], map[StageName]string{BuildArtifactStage: artifactChecksum}, DimgStagesOptions{})
+		return newTestDimgStages(t, nodes[2], nil, DimgStagesOptions{
+			FromDimg:  baseStages,
+			Artifacts: map[*config.DimgArtifact]*DimgStages{artifact: artifactStages},
+		})
+	}
+
+	d := newStages("base", "artifact")
+	if d.GetStage(FromStage).image.FromImage != d.Options.FromDimg.LastStage().Image() {
+		t.Errorf("from stage should be built from the last image of fromDimg")
+	}
+	if d.GetStage(AfterInstallArtifactStage).image == nil {
+		t.Errorf("after install artifact stage should not be empty")
+	}
+
+	signatures := stagesSignatures(d)
+
+	if stagesSignatures(newStages("base2", "artifact"))[FromStage] == signatures[FromStage] {
+		t.Errorf("fromDimg change should invalidate from stage")
+	}
+
+	changed := stagesSignatures(newStages("base", "artifact2"))
+	if changed[FromStage] != signatures[FromStage] || changed[AfterInstallArtifactStage] == signatures[AfterInstallArtifactStage] {
+		t.Errorf("imported artifact change should invalidate artifact stage only")
+	}
+
+	if _, err := NewDimgStages(nodes[2], DimgStagesOptions{Images: &testStageImages{}}); err == nil {
+		t.Errorf("fromDimg stages should be required")
+	}
+}
+
+func TestDimgStages_DevModeArchive(t *testing.T) {
+	dimg := newTestDimg("dimg")
+	dimg.From = "ubuntu:16.04"
+	node := &DimgNode{Dimg: dimg}
+
+	repoDir, err := ioutil.TempDir("", "dapp-dimg-stages-test-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+
+	repository, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit1 := commitFiles(t, repository, repoDir, map[string]string{"file": "1\n"})
+	commit2 := commitFiles(t, repository, repoDir, map[string]string{"file": "2\n"})
+
+	archiveSignature := func(commit string, devMode bool) string {
+		ga := &GitArtifact{
+			LocalGitRepo: &git_repo.Local{Base: git_repo.Base{Name: "own"}, Path: repoDir, OrigPath: repoDir},
+			RepoPath:     "/",
+			Paramshash:   "paramshash",
+			latestCommit: commit,
+		}
+		d := newTestDimgStages(t, node, nil, DimgStagesOptions{GitArtifacts: []*GitArtifact{ga}, DevMode: devMode})
+		return stagesSignatures(d)[GAArchiveStage]
+	}
+
+	if archiveSignature(commit1, false) != archiveSignature(commit2, false) {
+		t.Errorf("new commit should not invalidate archive stage")
+	}
+	if archiveSignature(commit1, true) == archiveSignature(commit2, true) {
+		t.Errorf("new commit should invalidate archive stage in dev mode")
+	}
+}
+
+func TestDimgStages_PushNotBuilt(t *testing.T) {
+	dimg := newTestDimg("dimg")
+	dimg.From = "ubuntu:16.04"
+
+	d := newTestDimgStages(t, &DimgNode{Dimg: dimg}, nil, DimgStagesOptions{})
+	if err := d.Push("registry.example.com/app", PushOptions{Tags: []string{"latest"}}); err == nil || !strings.Contains(err.Error(), "is not built") {
+		t.Errorf("not built dimg should not be pushed, got %v", err)
+	}
+
+	if repo := DimgRepo("registry.example.com/app", "dimg"); repo != "registry.example.com/app/dimg" {
+		t.Errorf("unexpected dimg repo `%s`", repo)
+	}
+	if repo := DimgRepo("registry.example.com/app", ""); repo != "registry.example.com/app" {
+		t.Errorf("nameless dimg should be pushed into the repo, got `%s`", repo)
+	}
+}
+
+func TestArtifactCopyCommand(t *testing.T) {
+	rsync := "/.dapp/deps/base/0.2.3/embedded/bin/rsync"
+	mkdir := "/.dapp/deps/base/0.2.3/embedded/bin/mkdir"
+
+	cmd := artifactCopyCommand("/app", "/dst/app", "", "", nil, []string{"tmp"})
+	expected := mkdir + " -p /dst && " + rsync + " --archive --links --inplace --filter='-/ /app/tmp'" +
+		" $(if [ -d /app ] ; then echo /app/ ; else echo /app ; fi) /dst/app"
+	if cmd != expected {
+		t.Errorf("unexpected command:\n%s\nexpected:\n%s", cmd, expected)
+	}
+
+	cmd = artifactCopyCommand("/app", "/dst", "app", "1000", []string{"src/lib"}, []string{"src/lib/cache"})
+	expected = mkdir + " -p / && " + rsync + " --archive --links --inplace --chown=app:1000" +
+		" --filter='-/ /app/src/lib/cache'" +
+		" --filter='+/ /' --filter='+/ /app' --filter='+/ /app/src' --filter='+/ /app/src/lib' --filter='+/ /app/src/lib/**'" +
+		" --filter='-/ /app/**'" +
+		" $(if [ -d /app ] ; then echo /app/ ; else echo /app ; fi) /dst"
+	if cmd != expected {
+		t.Errorf("unexpected command:\n%s\nexpected:\n%s", cmd, expected)
+	}
+}
@@ -0,0 +1,140 @@
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flant/dapp/pkg/config"
+)
+
+// DimgNode is a dimg or an artifact dimg, which should be built after its dependencies:
+// fromDimg, fromDimgArtifact and imported artifacts
+type DimgNode struct {
+	Dimg     *config.Dimg
+	Artifact *config.DimgArtifact
+	Deps     []*DimgNode
+}
+
+func (node *DimgNode) Base() *config.DimgBase {
+	if node.Artifact != nil {
+		return node.Artifact.DimgBase
+	}
+	return node.Dimg.DimgBase
+}
+
+func (node *DimgNode) Name() string {
+	return node.Base().Name
+}
+
+func (node *DimgNode) IsArtifact() bool {
+	return node.Artifact != nil
+}
+
+func (node *DimgNode) String() string {
+	if node.IsArtifact() {
+		return fmt.Sprintf("artifact `%s`", node.Name())
+	}
+	return fmt.Sprintf("dimg `%s`", node.Name())
+}
+
+// NewDimgsGraph returns dimgs and all related artifacts in topological order: dependencies go before dependants
+func NewDimgsGraph(dimgs []*config.Dimg) ([]*DimgNode, error) {
+	g := &dimgsGraph{nodes: make(map[interface{}]*DimgNode), state: make(map[*DimgNode]int)}
+
+	for _, dimg := range dimgs {
+		if _, err := g.visit(dimg, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return g.ordered, nil
+}
+
+const (
+	visiting = iota + 1
+	visited
+)
+
+type dimgsGraph struct {
+	nodes   map[interface{}]*DimgNode
+	state   map[*DimgNode]int
+	ordered []*DimgNode
+}
+
+func (g *dimgsGraph) visit(dimgOrArtifact interface{}, path []*DimgNode) (*DimgNode, error) {
+	node := g.node(dimgOrArtifact)
+	path = append(path, node)
+
+	switch g.state[node] {
+	case visited:
+		return node, nil
+	case visiting:
+		var names []string
+		for _, n := range path {
+			names = append(names, n.String())
+		}
+		return nil, fmt.Errorf("dimgs dependency cycle: %s", strings.Join(names, " -> "))
+	}
+
+	g.state[node] = visiting
+
+	base := node.Base()
+
+	var deps []interface{}
+	if base.FromDimg != nil {
+		deps = append(deps, base.FromDimg)
+	}
+	if base.FromDimgArtifact != nil {
+		deps = append(deps, base.FromDimgArtifact)
+	}
+	for _, artifactImport := range base.Import {
+		if artifactImport.ArtifactDimg != nil {
+			deps = append(deps, artifactImport.ArtifactDimg)
+		}
+	}
+
+	for _, dep := range deps {
+		depNode, err := g.visit(dep, path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !containsDimgNode(node.Deps, depNode) {
+			node.Deps = append(node.Deps, depNode)
+		}
+	}
+
+	g.state[node] = visited
+	g.ordered = append(g.ordered, node)
+
+	return node, nil
+}
+
+func (g *dimgsGraph) node(dimgOrArtifact interface{}) *DimgNode {
+	if node, hasKey := g.nodes[dimgOrArtifact]; hasKey {
+		return node
+	}
+
+	node := &DimgNode{}
+	switch c := dimgOrArtifact.(type) {
+	case *config.Dimg:
+		node.Dimg = c
+	case *config.DimgArtifact:
+		node.Artifact = c
+	default:
+		panic(fmt.Sprintf("runtime error: unexpected dimg type %T", dimgOrArtifact))
+	}
+
+	g.nodes[dimgOrArtifact] = node
+
+	return node
+}
+
+func containsDimgNode(nodes []*DimgNode, node *DimgNode) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
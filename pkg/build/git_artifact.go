@@ -1,37 +1,53 @@
 package build
 
 import (
+	"archive/tar"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/flant/dapp/pkg/dapp"
 	"github.com/flant/dapp/pkg/dappdeps"
+	"github.com/flant/dapp/pkg/git_artifacts_cache"
 	"github.com/flant/dapp/pkg/git_repo"
+	"github.com/flant/dapp/pkg/image"
+	"github.com/flant/dapp/pkg/util"
 )
 
 type GitArtifact struct {
 	LocalGitRepo  *git_repo.Local
 	RemoteGitRepo *git_repo.Remote
 
-	Name                 string
-	As                   string
-	Branch               string
-	Tag                  string
-	Commit               string
-	To                   string
-	RepoPath             string
-	Cwd                  string
-	Owner                string
-	Group                string
-	IncludePaths         []string
-	ExcludePaths         []string
-	StagesDependencies   map[string][]string
+	Name               string
+	As                 string
+	Branch             string
+	Tag                string
+	Commit             string
+	To                 string
+	RepoPath           string
+	Cwd                string
+	Owner              string
+	Group              string
+	IncludePaths       []string
+	ExcludePaths       []string
+	StagesDependencies map[string][]string
+	WithSubmodules     bool
+	StreamArchive      bool
+	// DetectRenames and DetectCopies make patches with renames and copies of files
+	DetectRenames, DetectCopies bool
+	// Cache is used for archives and patches instead of ArchivesDir and PatchesDir files when set
+	Cache                *git_artifacts_cache.Cache
 	Paramshash           string // TODO: method
 	PatchesDir           string
 	ContainerPatchesDir  string
 	ArchivesDir          string
 	ContainerArchivesDir string
+
+	latestCommit               string
+	stageDependenciesChecksums map[string]string
 }
 
 type ContainerFileDescriptor struct {
@@ -65,9 +81,10 @@ func (ga *GitArtifact) GitRepo() git_repo.GitRepo {
 
 func (ga *GitArtifact) getRepoFilterOptions() git_repo.FilterOptions {
 	return git_repo.FilterOptions{
-		BasePath:     ga.RepoPath,
-		IncludePaths: ga.IncludePaths,
-		ExcludePaths: ga.ExcludePaths,
+		BasePath:       ga.RepoPath,
+		IncludePaths:   ga.IncludePaths,
+		ExcludePaths:   ga.ExcludePaths,
+		WithSubmodules: ga.WithSubmodules,
 	}
 }
 
@@ -79,7 +96,23 @@ func (ga *GitArtifact) IsLocal() bool {
 	}
 }
 
+// LatestCommit is resolved once, so that all stages of the build use the same commit
 func (ga *GitArtifact) LatestCommit() (string, error) {
+	if ga.latestCommit != "" {
+		return ga.latestCommit, nil
+	}
+
+	commit, err := ga.resolveLatestCommit()
+	if err != nil {
+		return "", err
+	}
+
+	ga.latestCommit = commit
+
+	return commit, nil
+}
+
+func (ga *GitArtifact) resolveLatestCommit() (string, error) {
 	if ga.Commit != "" {
 		fmt.Printf("Using specified commit `%s` of repository `%s`\n", ga.Commit, ga.GitRepo().String())
 		return ga.Commit, nil
@@ -96,6 +129,131 @@ func (ga *GitArtifact) LatestCommit() (string, error) {
 	return ga.GitRepo().HeadCommit()
 }
 
+func (ga *GitArtifact) IsCommitExists(commit string) (bool, error) {
+	if commit == "" {
+		return false, nil
+	}
+	return ga.GitRepo().IsCommitExists(commit)
+}
+
+// PatchSize returns size of the patch between commits, 0 means no changes
+func (ga *GitArtifact) PatchSize(fromCommit, toCommit string) (int64, error) {
+	if ga.Cache != nil {
+		entry, err := ga.cachedPatch(fromCommit, toCommit)
+		if err != nil {
+			return 0, err
+		}
+		return entry.Size, nil
+	}
+
+	patch, err := ga.GitRepo().CreatePatch(git_repo.PatchOptions{
+		FilterOptions: ga.getRepoFilterOptions(),
+		FromCommit:    fromCommit,
+		ToCommit:      toCommit,
+		DetectRenames: ga.DetectRenames,
+		DetectCopies:  ga.DetectCopies,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer patch.Remove()
+
+	fi, err := os.Stat(patch.GetFilePath())
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+// stagesDependenciesKeys are StagesDependencies keys in ruby dapp format
+var stagesDependenciesKeys = map[StageName]string{
+	BeforeInstallStage: "beforeInstall",
+	InstallStage:       "install",
+	BeforeSetupStage:   "beforeSetup",
+	SetupStage:         "setup",
+	BuildArtifactStage: "buildArtifact",
+}
+
+// StageDependenciesChecksum returns checksum of files matching stageDependencies paths of the stage,
+// empty string is returned when stage has no dependencies
+func (ga *GitArtifact) StageDependenciesChecksum(stageName StageName) (string, error) {
+	commit, err := ga.LatestCommit()
+	if err != nil {
+		return "", err
+	}
+
+	return ga.stageDependenciesChecksum(stageName, commit)
+}
+
+type StageDependenciesChange struct {
+	// IsChanged is true when files matching stageDependencies paths are added, removed or changed
+	IsChanged bool
+	// Checksum of files matching stageDependencies paths at the `to` commit
+	Checksum string
+}
+
+// StagesDependenciesChanges returns changes of stageDependencies files of user stages between commits,
+// stages without stageDependencies are skipped and all files are changed when from commit is empty
+func (ga *GitArtifact) StagesDependenciesChanges(fromCommit, toCommit string) (map[StageName]*StageDependenciesChange, error) {
+	res := make(map[StageName]*StageDependenciesChange)
+
+	for stageName := range stagesDependenciesKeys {
+		checksum, err := ga.stageDependenciesChecksum(stageName, toCommit)
+		if err != nil {
+			return nil, err
+		}
+		if checksum == "" {
+			continue
+		}
+
+		change := &StageDependenciesChange{IsChanged: true, Checksum: checksum}
+
+		if fromCommit != "" {
+			fromChecksum, err := ga.stageDependenciesChecksum(stageName, fromCommit)
+			if err != nil {
+				return nil, err
+			}
+			change.IsChanged = fromChecksum != checksum
+		}
+
+		res[stageName] = change
+	}
+
+	return res, nil
+}
+
+func (ga *GitArtifact) stageDependenciesChecksum(stageName StageName, commit string) (string, error) {
+	paths := ga.StagesDependencies[stagesDependenciesKeys[stageName]]
+	if len(paths) == 0 {
+		return "", nil
+	}
+
+	key := fmt.Sprintf("%s:::%s", stageName, commit)
+	if checksum, hasKey := ga.stageDependenciesChecksums[key]; hasKey {
+		return checksum, nil
+	}
+
+	// Excluded paths of the directive and own repo are not dependencies, as in ruby dapp repo_entries
+	filterOptions := ga.getRepoFilterOptions()
+	filterOptions.IncludePaths = paths
+
+	checksum, err := ga.GitRepo().ArchiveChecksum(git_repo.ArchiveOptions{
+		FilterOptions: filterOptions,
+		Commit:        commit,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if ga.stageDependenciesChecksums == nil {
+		ga.stageDependenciesChecksums = make(map[string]string)
+	}
+	ga.stageDependenciesChecksums[key] = checksum
+
+	return checksum, nil
+}
+
 func (ga *GitArtifact) applyPatchCommand(patchFile *ContainerFileDescriptor, archiveType git_repo.ArchiveType) ([]string, error) {
 	commands := make([]string, 0)
 
@@ -139,27 +297,19 @@ func (ga *GitArtifact) ApplyPatchCommand(stage Stage) ([]string, error) {
 		return nil, err
 	}
 
-	patchOpts := git_repo.PatchOptions{
-		FilterOptions: ga.getRepoFilterOptions(),
-		FromCommit:    fromCommit,
-		ToCommit:      toCommit,
-	}
-	patch, err := ga.GitRepo().CreatePatch(patchOpts)
+	patchFile, err := ga.createPatchFile(fromCommit, toCommit)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("cannot create patch file: %s", err)
+	}
+	if patchFile == nil {
+		return nil, nil
 	}
 
-	noChanges, err := patch.IsEmpty()
+	prevStageLabels, err := stage.GetPrevStage().GetImage().GetLabels()
 	if err != nil {
 		return nil, err
 	}
-	if noChanges {
-		return nil, nil
-	}
-
-	archiveType := git_repo.ArchiveType(
-		stage.GetPrevStage().GetImage().
-			GetLabels()[ga.getArchiveTypeLabelName()])
+	archiveType := git_repo.ArchiveType(prevStageLabels[ga.getArchiveTypeLabelName()])
 
 	// Verify archive-type not changed in to-commit repo state
 	currentArchiveType, err := ga.GitRepo().ArchiveType(git_repo.ArchiveOptions{
@@ -173,25 +323,26 @@ func (ga *GitArtifact) ApplyPatchCommand(stage Stage) ([]string, error) {
 		return nil, fmt.Errorf("git repo `%s` archive type changed from `%s` to `%s`: reset cache manually and retry!", ga.GitRepo().String(), archiveType, currentArchiveType)
 	}
 
-	patchFile, err := ga.createPatchFile(patch, fromCommit, toCommit)
-	if err != nil {
-		return nil, fmt.Errorf("cannot create patch file: %s", err)
-	}
-
 	return ga.applyPatchCommand(patchFile, archiveType)
 }
 
-func (ga *GitArtifact) applyArchiveCommand(archiveType git_repo.ArchiveType, commit string) ([]string, error) {
-	var unpackArchiveDirectory string
-	commands := make([]string, 0)
-
+func (ga *GitArtifact) unpackArchiveDirectory(archiveType git_repo.ArchiveType) (string, error) {
 	switch archiveType {
 	case git_repo.FileArchive:
-		unpackArchiveDirectory = filepath.Dir(ga.To)
+		return filepath.Dir(ga.To), nil
 	case git_repo.DirectoryArchive:
-		unpackArchiveDirectory = ga.To
+		return ga.To, nil
 	default:
-		return nil, fmt.Errorf("unknown archive type `%s`", archiveType)
+		return "", fmt.Errorf("unknown archive type `%s`", archiveType)
+	}
+}
+
+func (ga *GitArtifact) applyArchiveCommand(archiveType git_repo.ArchiveType, commit string) ([]string, error) {
+	commands := make([]string, 0)
+
+	unpackArchiveDirectory, err := ga.unpackArchiveDirectory(archiveType)
+	if err != nil {
+		return nil, err
 	}
 
 	commands = append(commands, fmt.Sprintf(
@@ -207,9 +358,10 @@ func (ga *GitArtifact) applyArchiveCommand(archiveType git_repo.ArchiveType, com
 		return nil, fmt.Errorf("cannot create archive for commit `%s`: %s", commit, err)
 	}
 
+	// NOTICE: Owner and group are set in archive entries and are restored by tar running as root,
+	// NOTICE: names which are not found in the image are replaced with ids from archive.
 	commands = append(commands, fmt.Sprintf(
-		"%s %s -xf %s -C \"%s\"",
-		dappdeps.SudoCommand(ga.Owner, ga.Group),
+		"%s -xf %s -C \"%s\"",
 		dappdeps.BaseBinPath("tar"),
 		archiveFile.ContainerFilePath,
 		unpackArchiveDirectory,
@@ -218,10 +370,11 @@ func (ga *GitArtifact) applyArchiveCommand(archiveType git_repo.ArchiveType, com
 	return commands, nil
 }
 
-func (ga *GitArtifact) ApplyArchiveCommand(stage Stage) ([]string, error) {
+// layerArchiveType returns stage layer commit and archive type, empty type is returned when there are no files
+func (ga *GitArtifact) layerArchiveType(stage Stage) (string, git_repo.ArchiveType, error) {
 	commit, err := stage.LayerCommit(ga)
 	if err != nil {
-		return nil, err
+		return "", "", err
 	}
 
 	anyEntries, err := ga.GitRepo().IsAnyEntries(git_repo.ArchiveOptions{
@@ -229,10 +382,10 @@ func (ga *GitArtifact) ApplyArchiveCommand(stage Stage) ([]string, error) {
 		Commit:        commit,
 	})
 	if err != nil {
-		return nil, err
+		return "", "", err
 	}
 	if !anyEntries {
-		return nil, nil
+		return commit, "", nil
 	}
 
 	archiveType, err := ga.GitRepo().ArchiveType(git_repo.ArchiveOptions{
@@ -240,6 +393,15 @@ func (ga *GitArtifact) ApplyArchiveCommand(stage Stage) ([]string, error) {
 		Commit:        commit,
 	})
 	if err != nil {
+		return "", "", err
+	}
+
+	return commit, archiveType, nil
+}
+
+func (ga *GitArtifact) ApplyArchiveCommand(stage Stage) ([]string, error) {
+	commit, archiveType, err := ga.layerArchiveType(stage)
+	if err != nil || archiveType == "" {
 		return nil, err
 	}
 
@@ -253,6 +415,109 @@ func (ga *GitArtifact) ApplyArchiveCommand(stage Stage) ([]string, error) {
 	return commands, err
 }
 
+// IsArchiveStreamable is true when archive can be streamed into the container without archive file,
+// owner and group should be ids, because names are ignored by docker on copy
+func (ga *GitArtifact) IsArchiveStreamable() bool {
+	if !ga.StreamArchive {
+		return false
+	}
+
+	for _, value := range []string{ga.Owner, ga.Group} {
+		if _, err := strconv.Atoi(value); value != "" && err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ApplyArchiveStream returns archive with paths relative to the container root instead of archive file and commands,
+// nil is returned when there are no files
+func (ga *GitArtifact) ApplyArchiveStream(stage Stage) (image.ArchiveFunc, error) {
+	commit, archiveType, err := ga.layerArchiveType(stage)
+	if err != nil || archiveType == "" {
+		return nil, err
+	}
+
+	unpackArchiveDirectory, err := ga.unpackArchiveDirectory(archiveType)
+	if err != nil {
+		return nil, err
+	}
+
+	stage.GetImage().AddServiceChangeLabel(ga.getArchiveTypeLabelName(), string(archiveType))
+
+	return func(w io.Writer) error {
+		reader, writer := io.Pipe()
+		defer reader.Close()
+
+		go func() {
+			writer.CloseWithError(ga.GitRepo().CreateArchiveTar(writer, git_repo.ArchiveOptions{
+				FilterOptions: ga.getRepoFilterOptions(),
+				Commit:        commit,
+				Owner:         ga.Owner,
+				Group:         ga.Group,
+			}))
+		}()
+
+		if err := relocateArchive(w, reader, unpackArchiveDirectory); err != nil {
+			return fmt.Errorf("cannot stream archive for commit `%s`: %s", commit, err)
+		}
+
+		return nil
+	}, nil
+}
+
+// relocateArchive copies tar archive with entries moved into the directory, the directory entry is added
+// with owner of archive entries as `install -d` does for archive file
+func relocateArchive(w io.Writer, r io.Reader, dir string) error {
+	dir = strings.Trim(filepath.ToSlash(dir), "/")
+
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	isFirst := true
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if isFirst && dir != "" {
+			err := tw.WriteHeader(&tar.Header{
+				Format:   header.Format,
+				Typeflag: tar.TypeDir,
+				Name:     dir + "/",
+				Mode:     0755,
+				ModTime:  header.ModTime,
+				Uid:      header.Uid,
+				Gid:      header.Gid,
+				Uname:    header.Uname,
+				Gname:    header.Gname,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		isFirst = false
+
+		if dir != "" {
+			header.Name = dir + "/" + header.Name
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
 func (ga *GitArtifact) getArchiveFileDescriptor(commit string) *ContainerFileDescriptor {
 	fileName := fmt.Sprintf("%s_%s.tar", ga.Paramshash, commit)
 
@@ -263,33 +528,87 @@ func (ga *GitArtifact) getArchiveFileDescriptor(commit string) *ContainerFileDes
 }
 
 func (ga *GitArtifact) createArchiveFile(commit string) (*ContainerFileDescriptor, error) {
+	archiveOptions := git_repo.ArchiveOptions{
+		FilterOptions: ga.getRepoFilterOptions(),
+		Commit:        commit,
+		Owner:         ga.Owner,
+		Group:         ga.Group,
+	}
+
+	if ga.Cache != nil {
+		entry, err := ga.Cache.Get(git_artifacts_cache.ArchivesKind, fmt.Sprintf("%s.tar", ga.cacheKey("archive", commit)), func(w io.Writer) error {
+			return ga.GitRepo().CreateArchiveTar(w, archiveOptions)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return &ContainerFileDescriptor{
+			FilePath:          entry.Path,
+			ContainerFilePath: filepath.Join(ga.ContainerArchivesDir, entry.Name),
+		}, nil
+	}
+
 	fileDesc := ga.getArchiveFileDescriptor(commit)
 
+	// Incomplete archive is removed on termination, complete archive is left for the build
+	removeCleanupHook := dapp.AddCleanupHook(dapp.TmpFilesCleanupStage, func() { os.RemoveAll(fileDesc.FilePath) })
+	defer removeCleanupHook()
+
 	handler, err := fileDesc.Open(os.O_RDWR|os.O_CREATE, 0755)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open archive file `%s`: %s", fileDesc.FilePath, err)
 	}
 
-	err = ga.GitRepo().CreateArchiveTar(handler, git_repo.ArchiveOptions{
-		FilterOptions: ga.getRepoFilterOptions(),
-		Commit:        commit,
-	})
+	err = ga.GitRepo().CreateArchiveTar(handler, archiveOptions)
 	if err != nil {
+		handler.Close()
+		os.RemoveAll(fileDesc.FilePath)
 		return nil, err
 	}
 
 	err = handler.Close()
 	if err != nil {
+		os.RemoveAll(fileDesc.FilePath)
 		return nil, err
 	}
 
 	return fileDesc, nil
 }
 
-func (ga *GitArtifact) createPatchFile(patch git_repo.Patch, fromCommit, toCommit string) (*ContainerFileDescriptor, error) {
-	fileDesc := ga.getPatchFileDescriptor(fromCommit, toCommit)
+// createPatchFile returns nil when there are no changes between commits
+func (ga *GitArtifact) createPatchFile(fromCommit, toCommit string) (*ContainerFileDescriptor, error) {
+	if ga.Cache != nil {
+		entry, err := ga.cachedPatch(fromCommit, toCommit)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Size == 0 {
+			return nil, nil
+		}
+
+		return &ContainerFileDescriptor{
+			FilePath:          entry.Path,
+			ContainerFilePath: filepath.Join(ga.ContainerPatchesDir, entry.Name),
+		}, nil
+	}
 
-	var err error
+	patch, err := ga.createPatch(fromCommit, toCommit)
+	if err != nil {
+		return nil, err
+	}
+	// Temporary patch is moved into PatchesDir on success, otherwise it is not needed anymore
+	defer patch.Remove()
+
+	noChanges, err := patch.IsEmpty()
+	if err != nil {
+		return nil, err
+	}
+	if noChanges {
+		return nil, nil
+	}
+
+	fileDesc := ga.getPatchFileDescriptor(fromCommit, toCommit)
 
 	err = os.MkdirAll(filepath.Dir(fileDesc.FilePath), os.ModePerm)
 	if err != nil {
@@ -304,6 +623,60 @@ func (ga *GitArtifact) createPatchFile(patch git_repo.Patch, fromCommit, toCommi
 	return fileDesc, nil
 }
 
+func (ga *GitArtifact) createPatch(fromCommit, toCommit string) (git_repo.Patch, error) {
+	return ga.GitRepo().CreatePatch(git_repo.PatchOptions{
+		FilterOptions: ga.getRepoFilterOptions(),
+		FromCommit:    fromCommit,
+		ToCommit:      toCommit,
+		DetectRenames: ga.DetectRenames,
+		DetectCopies:  ga.DetectCopies,
+	})
+}
+
+func (ga *GitArtifact) cachedPatch(fromCommit, toCommit string) (*git_artifacts_cache.Entry, error) {
+	// Patches with renames differ from patches without them
+	kind := "patch"
+	if ga.DetectCopies {
+		kind = "patch-copies"
+	} else if ga.DetectRenames {
+		kind = "patch-renames"
+	}
+
+	return ga.Cache.Get(git_artifacts_cache.PatchesKind, fmt.Sprintf("%s.patch", ga.cacheKey(kind, fromCommit, toCommit)), func(w io.Writer) error {
+		patch, err := ga.createPatch(fromCommit, toCommit)
+		if err != nil {
+			return err
+		}
+		defer patch.Remove()
+
+		f, err := os.Open(patch.GetFilePath())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(w, f)
+		return err
+	})
+}
+
+// cacheKey depends on commits and options affecting files content, but not on the repo, because
+// commits identify the content, so that files are shared by projects
+func (ga *GitArtifact) cacheKey(kind string, commits ...string) string {
+	args := []string{kind}
+	args = append(args, commits...)
+	args = append(args,
+		ga.RepoPath,
+		strings.Join(ga.IncludePaths, ","),
+		strings.Join(ga.ExcludePaths, ","),
+		strconv.FormatBool(ga.WithSubmodules),
+		ga.Owner,
+		ga.Group,
+	)
+
+	return util.Sha256Hash(args...)
+}
+
 func (ga *GitArtifact) getPatchFileDescriptor(fromCommit, toCommit string) *ContainerFileDescriptor {
 	fileName := fmt.Sprintf("%s_%s_%s.patch", ga.Paramshash, fromCommit, toCommit)
 
@@ -329,3 +702,11 @@ func (ga *GitArtifact) makeCredentialsOpts() string {
 func (ga *GitArtifact) getArchiveTypeLabelName() string {
 	return fmt.Sprintf("dapp-git-%s-type", ga.Paramshash)
 }
+
+func (ga *GitArtifact) getCommitLabelName() string {
+	return fmt.Sprintf("dapp-git-%s-commit", ga.Paramshash)
+}
+
+func (ga *GitArtifact) String() string {
+	return fmt.Sprintf("git `%s` to `%s`", ga.GitRepo().String(), ga.To)
+}
@@ -0,0 +1,204 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/flant/dapp/pkg/config"
+	"github.com/flant/dapp/pkg/git_repo"
+	git "github.com/flant/go-git"
+	"github.com/flant/go-git/plumbing/object"
+)
+
+func commitFiles(t *testing.T, repository *git.Repository, dir string, files map[string]string) string {
+	worktree, err := repository.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, content := range files {
+		fullPath := filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fullPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := worktree.Add(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hash, err := worktree.Commit("test", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash.String()
+}
+
+func TestGitArtifact_StagesDependenciesChanges(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "dapp-git-artifact-test-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+
+	repository, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ga := &GitArtifact{
+		LocalGitRepo: &git_repo.Local{Base: git_repo.Base{Name: "own"}, Path: repoDir, OrigPath: repoDir},
+		RepoPath:     "/app",
+		ExcludePaths: []string{"config/local.yml"},
+		StagesDependencies: map[string][]string{
+			"install": {"Gemfile", "*.lock", "config/local.yml"},
+			"setup":   {"config/**/*.yml"},
+		},
+	}
+
+	fromCommit := commitFiles(t, repository, repoDir, map[string]string{
+		"app/Gemfile":          "gem 'rails'\n",
+		"app/Gemfile.lock":     "rails (5.0)\n",
+		"app/config/app.yml":   "a: 1\n",
+		"app/config/local.yml": "b: 1\n",
+		"app/src/main.rb":      "main\n",
+		"Gemfile":              "outside of cwd\n",
+		"app/config/README.md": "readme\n",
+	})
+	toCommit := commitFiles(t, repository, repoDir, map[string]string{
+		"app/config/app.yml":   "a: 2\n",
+		"app/config/local.yml": "b: 2\n",
+		"app/src/main.rb":      "changed main\n",
+		"Gemfile":              "changed outside of cwd\n",
+		"app/config/README.md": "changed readme\n",
+	})
+
+	changes, err := ga.StagesDependenciesChanges(fromCommit, toCommit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) != 2 || changes[InstallStage] == nil || changes[SetupStage] == nil {
+		t.Fatalf("only stages with stageDependencies expected, got %v", changes)
+	}
+	if changes[InstallStage].IsChanged {
+		t.Errorf("install stageDependencies should not be changed, excluded paths are not checked")
+	}
+	if !changes[SetupStage].IsChanged {
+		t.Errorf("setup stageDependencies should be changed")
+	}
+
+	for stageName, change := range changes {
+		checksum, err := ga.StageDependenciesChecksum(stageName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checksum != change.Checksum {
+			t.Errorf("stage `%s`: checksum of latest commit expected", stageName)
+		}
+	}
+
+	changes, err = ga.StagesDependenciesChanges("", fromCommit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes[InstallStage].IsChanged || !changes[SetupStage].IsChanged {
+		t.Errorf("all stageDependencies should be changed without from commit")
+	}
+}
+
+func TestRelocateArchive(t *testing.T) {
+	modTime := time.Unix(1500000000, 0)
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, header := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "lib/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "lib/a.txt", Mode: 0644, Size: 2},
+		{Typeflag: tar.TypeSymlink, Name: "b.txt", Mode: 0777, Linkname: "lib/a.txt"},
+	} {
+		header.Format = tar.FormatGNU
+		header.ModTime = modTime
+		header.Uid = 1000
+		header.Gid = 1001
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			if _, err := tw.Write([]byte("a\n")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var relocated bytes.Buffer
+	if err := relocateArchive(&relocated, &archive, "/app/src"); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	tr := tar.NewReader(&relocated)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		names = append(names, header.Name)
+
+		if header.Uid != 1000 || header.Gid != 1001 || !header.ModTime.Equal(modTime) {
+			t.Errorf("%s: owner and mtime should be kept", header.Name)
+		}
+
+		switch header.Name {
+		case "app/src/":
+			if header.Typeflag != tar.TypeDir || header.Mode != 0755 {
+				t.Errorf("directory entry expected, got %#v", header)
+			}
+		case "app/src/lib/a.txt":
+			if content, err := ioutil.ReadAll(tr); err != nil || string(content) != "a\n" {
+				t.Errorf("unexpected content %q: %v", content, err)
+			}
+		case "app/src/b.txt":
+			if header.Linkname != "lib/a.txt" {
+				t.Errorf("symlink target should not be changed, got %s", header.Linkname)
+			}
+		}
+	}
+
+	expectedNames := []string{"app/src/", "app/src/lib/", "app/src/lib/a.txt", "app/src/b.txt"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("expected entries %v, got %v", expectedNames, names)
+	}
+}
+
+func TestNewRemoteGitRepo_ShallowClonePath(t *testing.T) {
+	remote := &config.GitRemote{Name: "company/origin", Url: "https://github.com/company/origin.git"}
+
+	full := NewRemoteGitRepo(remote, GitArtifactsOptions{BuildDir: "/build"})
+	shallow := NewRemoteGitRepo(remote, GitArtifactsOptions{BuildDir: "/build", CloneDepth: 10})
+
+	if shallow.ClonePath != full.ClonePath+"-depth-10" {
+		t.Errorf("shallow clone path `%s` should not be shared with full clone path `%s`", shallow.ClonePath, full.ClonePath)
+	}
+	if filepath.Dir(shallow.ClonePath) != filepath.Dir(full.ClonePath) {
+		t.Errorf("shallow clone `%s` should be listed with remote clones", shallow.ClonePath)
+	}
+}
@@ -0,0 +1,333 @@
+package build
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flant/dapp/pkg/config"
+	"github.com/flant/dapp/pkg/git_artifacts_cache"
+	"github.com/flant/dapp/pkg/git_repo"
+	"github.com/flant/dapp/pkg/util"
+	"github.com/flant/go-git/plumbing/transport"
+)
+
+// RemoteGitRepoCacheVersion should be in sync with ruby dapp GitRepo::Remote::CACHE_VERSION
+const RemoteGitRepoCacheVersion = "3"
+
+type GitArtifactsOptions struct {
+	// ProjectDir is the path of the own (local) git repo
+	ProjectDir string
+	// BuildDir is the project build directory, remote repos are cloned there
+	BuildDir string
+	// TmpDir is the dimg tmp directory for archives and patches
+	TmpDir string
+	// ContainerTmpDir is TmpDir mount point in stage containers
+	ContainerTmpDir string
+	// IsDryRun disables clone, fetch and deepening of remote git repos, existing clones are used
+	IsDryRun bool
+	// StreamArchives enables streaming of archives into stage containers without archives files
+	StreamArchives bool
+	// CloneDepth limits history of remote git repos clones, zero means the whole history
+	CloneDepth int
+	// DevMode uses the working tree snapshot of the own repo instead of HEAD commit
+	DevMode          bool
+	DevModeUntracked bool
+	// DetectRenames and DetectCopies enable renames and copies of files in patches
+	DetectRenames, DetectCopies bool
+	// Cache keeps archives and patches for reuse by builds, files are created in TmpDir without cache
+	Cache *git_artifacts_cache.Cache
+}
+
+// NewGitArtifacts creates git artifacts of dimg git directives in the same way as ruby dapp,
+// artifacts without files for the latest commit are omitted
+func NewGitArtifacts(base *config.DimgBase, opts GitArtifactsOptions) ([]*GitArtifact, error) {
+	if base.Git == nil {
+		return nil, nil
+	}
+
+	var res []*GitArtifact
+
+	if len(base.Git.Local) > 0 {
+		repo := &git_repo.Local{
+			Base:             git_repo.Base{Name: "own"},
+			Path:             opts.ProjectDir,
+			OrigPath:         opts.ProjectDir,
+			DevMode:          opts.DevMode,
+			DevModeUntracked: opts.DevModeUntracked,
+		}
+		excludePaths := ownRepoExcludePaths(opts)
+
+		for _, local := range base.Git.Local {
+			ga := newGitArtifact(local.GitLocalExport, opts)
+			ga.LocalGitRepo = repo
+			ga.As = local.As
+			ga.setPaths(repo.Name, excludePaths)
+
+			res = append(res, ga)
+		}
+	}
+
+	for _, remote := range base.Git.Remote {
+		repo := NewRemoteGitRepo(remote, opts)
+
+		if err := repo.CloneAndFetch(); err != nil {
+			return nil, fmt.Errorf("cannot clone and fetch git repo `%s`: %s", remote.Url, err)
+		}
+
+		// Specified commit may be abbreviated or out of the shallow clone history
+		var commit string
+		if remote.GitRemoteExport != nil && remote.Commit != "" {
+			commit = remote.Commit
+			if !opts.IsDryRun {
+				var err error
+				commit, err = repo.ResolveCommit(remote.Commit)
+				if err != nil {
+					return nil, err
+				}
+				if commit == "" {
+					return nil, fmt.Errorf("commit `%s` is not found in git repo `%s`", remote.Commit, remote.Url)
+				}
+			}
+		}
+
+		var export *config.GitLocalExport
+		if remote.GitRemoteExport != nil {
+			export = remote.GitLocalExport
+		}
+
+		ga := newGitArtifact(export, opts)
+		ga.RemoteGitRepo = repo
+		ga.Name = remote.Name
+		ga.As = remote.As
+		if remote.GitRemoteExport != nil {
+			ga.Branch = remote.Branch
+			ga.Tag = remote.Tag
+			ga.Commit = commit
+		}
+		ga.setPaths(fmt.Sprintf("%s_%s", repo.Name, remote.Name), nil)
+
+		res = append(res, ga)
+	}
+
+	var nonEmpty []*GitArtifact
+	for _, ga := range res {
+		commit, err := ga.LatestCommit()
+		if err != nil {
+			return nil, err
+		}
+
+		anyEntries, err := ga.GitRepo().IsAnyEntries(git_repo.ArchiveOptions{FilterOptions: ga.getRepoFilterOptions(), Commit: commit})
+		if err != nil {
+			return nil, err
+		}
+
+		if anyEntries {
+			nonEmpty = append(nonEmpty, ga)
+		}
+	}
+
+	return nonEmpty, nil
+}
+
+// RemoteGitReposDir contains clones of remote git repos of the project
+func RemoteGitReposDir(buildDir string) string {
+	return filepath.Join(buildDir, "remote_git_repo")
+}
+
+// NewRemoteGitRepo returns remote repo of the git directive, which is not cloned yet
+func NewRemoteGitRepo(remote *config.GitRemote, opts GitArtifactsOptions) *git_repo.Remote {
+	repo := &git_repo.Remote{
+		Base:          git_repo.Base{Name: remote.Name},
+		Url:           remote.Url,
+		ClonePath:     filepath.Join(RemoteGitReposDir(opts.BuildDir), RemoteGitRepoCacheVersion, util.ConsistentUniqSlugify(remote.Name), gitUrlProtocol(remote.Url)),
+		IsDryRun:      opts.IsDryRun,
+		Depth:         opts.CloneDepth,
+		Auth:          gitRemoteAuth(remote.Auth, opts.ProjectDir),
+		Mirrors:       remote.Mirrors,
+		MirrorTimeout: time.Duration(remote.MirrorTimeout) * time.Second,
+	}
+
+	// Pinned clone is not shared with ruby dapp, it is kept when the url protocol or credentials are changed
+	if remote.PinClonePath {
+		repo.ClonePath = filepath.Join(RemoteGitReposDir(opts.BuildDir), RemoteGitRepoCacheVersion, "url", gitUrlHash(remote.Url))
+	}
+
+	// NOTICE: Shallow clone is never shared with ruby dapp, which expects the whole history in its clone,
+	// NOTICE: and full clone is never made shallow.
+	if opts.CloneDepth > 0 {
+		repo.ClonePath = fmt.Sprintf("%s-depth-%d", repo.ClonePath, opts.CloneDepth)
+	}
+
+	// Only refs of the git directive are fetched
+	if remote.GitRemoteExport != nil {
+		if remote.Branch != "" {
+			repo.Branches = []string{remote.Branch}
+		} else if remote.Tag != "" {
+			repo.Tags = []string{remote.Tag}
+		}
+	}
+
+	return repo
+}
+
+func newGitArtifact(export *config.GitLocalExport, opts GitArtifactsOptions) *GitArtifact {
+	ga := &GitArtifact{
+		PatchesDir:           filepath.Join(opts.TmpDir, "patches"),
+		ContainerPatchesDir:  filepath.Join(opts.ContainerTmpDir, "patches"),
+		ArchivesDir:          filepath.Join(opts.TmpDir, "archives"),
+		ContainerArchivesDir: filepath.Join(opts.ContainerTmpDir, "archives"),
+		StagesDependencies:   make(map[string][]string),
+		StreamArchive:        opts.StreamArchives,
+		DetectRenames:        opts.DetectRenames,
+		DetectCopies:         opts.DetectCopies,
+		Cache:                opts.Cache,
+	}
+
+	if opts.Cache != nil {
+		ga.ArchivesDir = opts.Cache.KindDir(git_artifacts_cache.ArchivesKind)
+		ga.PatchesDir = opts.Cache.KindDir(git_artifacts_cache.PatchesKind)
+	}
+
+	if export == nil || export.GitExportBase == nil {
+		return ga
+	}
+
+	if export.GitExport != nil && export.ExportBase != nil {
+		e := export.ExportBase
+		ga.Cwd = e.Add
+		ga.To = e.To
+		ga.IncludePaths = e.IncludePaths
+		ga.ExcludePaths = e.ExcludePaths
+		ga.Owner = e.Owner
+		ga.Group = e.Group
+	}
+
+	ga.WithSubmodules = export.Submodules
+
+	if deps := export.StageDependencies; deps != nil {
+		for key, paths := range map[string][]string{
+			"install":       deps.Install,
+			"beforeSetup":   deps.BeforeSetup,
+			"setup":         deps.Setup,
+			"buildArtifact": deps.BuildArtifact,
+		} {
+			if len(paths) > 0 {
+				ga.StagesDependencies[key] = paths
+			}
+		}
+	}
+
+	return ga
+}
+
+// setPaths normalizes cwd, include and exclude paths and calculates paramshash as ruby dapp does
+func (ga *GitArtifact) setPaths(fullName string, repoExcludePaths []string) {
+	if ga.Cwd == "" || ga.Cwd == "/" {
+		ga.Cwd = ""
+	} else {
+		ga.Cwd = filepath.Join("/", ga.Cwd)[1:]
+	}
+	ga.RepoPath = filepath.Join("/", ga.Cwd)
+
+	includePaths := gitArtifactBasePaths(ga.IncludePaths, "")
+	excludePaths := append(append([]string{}, repoExcludePaths...), gitArtifactBasePaths(ga.ExcludePaths, "")...)
+
+	args := []string{fullName, ga.To, ga.Cwd}
+	args = append(args, includePaths...)
+	args = append(args, excludePaths...)
+	for _, arg := range []string{ga.Owner, ga.Group} {
+		if arg != "" {
+			args = append(args, arg)
+		}
+	}
+	// Paramshash of artifacts without submodules mode is kept in sync with ruby dapp
+	if ga.WithSubmodules {
+		args = append(args, "submodules")
+	}
+	ga.Paramshash = util.Sha256Hash(args...)
+
+	ga.IncludePaths = gitArtifactBasePaths(ga.IncludePaths, ga.Cwd)
+	ga.ExcludePaths = append(append([]string{}, repoExcludePaths...), gitArtifactBasePaths(ga.ExcludePaths, ga.Cwd)...)
+}
+
+// gitRemoteAuth resolves files paths of the dappfile relative to the project directory
+func gitRemoteAuth(auth *config.GitAuth, projectDir string) *git_repo.RemoteAuth {
+	if auth == nil {
+		return nil
+	}
+
+	resolvePath := func(path string) string {
+		if path == "" {
+			return ""
+		} else if path == "~" || strings.HasPrefix(path, "~/") {
+			return filepath.Join(os.Getenv("HOME"), path[1:])
+		} else if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(projectDir, path)
+	}
+
+	res := &git_repo.RemoteAuth{
+		SshAgentSock:    resolvePath(auth.SshAgentSock),
+		Username:        auth.Username,
+		PasswordEnv:     auth.PasswordEnv,
+		TokenEnv:        auth.TokenEnv,
+		CredentialsFile: resolvePath(auth.CredentialsFile),
+	}
+	for _, path := range auth.SshKeys {
+		res.SshKeys = append(res.SshKeys, resolvePath(path))
+	}
+	for _, path := range auth.KnownHosts {
+		res.KnownHosts = append(res.KnownHosts, resolvePath(path))
+	}
+
+	return res
+}
+
+func gitArtifactBasePaths(paths []string, cwd string) []string {
+	var res []string
+	for _, path := range paths {
+		if cwd != "" {
+			path = strings.Join([]string{cwd, path}, "/")
+		}
+		res = append(res, strings.Trim(path, "/"))
+	}
+	return res
+}
+
+// ownRepoExcludePaths should be in sync with ruby dapp local_git_artifact_exclude_paths
+func ownRepoExcludePaths(opts GitArtifactsOptions) []string {
+	excludePaths := []string{"Dappfile", "dappfile.yml", "dappfile.yaml", ".dapp_chef"}
+
+	if relPath, err := filepath.Rel(opts.ProjectDir, opts.BuildDir); err == nil && relPath != "." && !strings.HasPrefix(relPath, "..") {
+		excludePaths = append(excludePaths, relPath)
+	}
+
+	return excludePaths
+}
+
+// gitUrlHash does not depend on the protocol, port, user and `.git` suffix of the url
+func gitUrlHash(rawUrl string) string {
+	key := rawUrl
+	if ep, err := transport.NewEndpoint(rawUrl); err == nil {
+		path := strings.TrimSuffix(strings.Trim(ep.Path, "/"), ".git")
+		key = fmt.Sprintf("%s/%s", strings.ToLower(ep.Host), path)
+	}
+	return util.Sha256Hash(key)[:16]
+}
+
+// gitUrlProtocol should be in sync with ruby dapp url_protocol: unparsable urls like `git@host:repo.git` are ssh urls
+func gitUrlProtocol(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "ssh"
+	}
+	if u.Scheme == "" {
+		return "noname"
+	}
+	return u.Scheme
+}
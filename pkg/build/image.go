@@ -1,7 +1,7 @@
 package build
 
 type Image interface {
-	GetLabels() map[string]string
+	GetLabels() (map[string]string, error)
 	AddServiceChangeLabel(name, value string)
 }
 
@@ -10,8 +10,8 @@ type StubImage struct {
 	ServiceChangeLabels map[string]string
 }
 
-func (image *StubImage) GetLabels() map[string]string {
-	return image.Labels
+func (image *StubImage) GetLabels() (map[string]string, error) {
+	return image.Labels, nil
 }
 
 func (image *StubImage) AddServiceChangeLabel(name, value string) {
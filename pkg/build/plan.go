@@ -0,0 +1,234 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flant/dapp/pkg/util"
+)
+
+// stagesRecord keeps signature inputs of the last built stages of dimg, it is used to explain stages cache misses
+type stagesRecord struct {
+	Stages map[StageName]*stageRecord `json:"stages"`
+	// FromImageId is the id of the base image, which is not a part of from stage signature
+	FromImageId string `json:"from_image_id,omitempty"`
+}
+
+type stageRecord struct {
+	Signature string            `json:"signature"`
+	Inputs    []StageDependency `json:"inputs"`
+}
+
+type StagePlan struct {
+	Name      StageName
+	Signature string
+	Empty     bool
+	// Cached is true when stage image exists locally, stages are not pulled from the repo by build
+	Cached bool
+	// Reason explains why stage should be built
+	Reason string
+}
+
+func (p *StagePlan) IsBuildRequired() bool {
+	return !p.Empty && !p.Cached
+}
+
+// Plan returns stages of dimg with cache status and the reason of the rebuild without running containers
+func (d *DimgStages) Plan() ([]*StagePlan, error) {
+	record, err := d.loadRecord()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: cannot load stages record of %s: %s\n", d.Node, err)
+	}
+
+	fromImageId, err := d.fromImageId()
+	if err != nil {
+		return nil, err
+	}
+
+	var plans []*StagePlan
+	var prevRebuilt *DimgStage
+
+	for _, stage := range d.Stages {
+		p := &StagePlan{Name: stage.Name, Signature: stage.signature}
+		plans = append(plans, p)
+
+		if stage.image == nil {
+			p.Empty = true
+			continue
+		}
+
+		_, built, err := d.Options.Images.GetLabels(stage.image.Name)
+		if err != nil {
+			return nil, err
+		}
+		p.Cached = built
+
+		if !p.IsBuildRequired() {
+			prevRebuilt = nil
+			continue
+		}
+
+		p.Reason = stage.missReason(record, prevRebuilt)
+		// Base image of the same name is pulled again, when the from stage is rebuilt
+		if stage.Name == FromStage && record != nil && record.FromImageId != "" && fromImageId != "" && record.FromImageId != fromImageId {
+			p.Reason = fmt.Sprintf("new base image `%s`", stage.image.FromImage.Name)
+		}
+		prevRebuilt = stage
+	}
+
+	return plans, nil
+}
+
+func (s *DimgStage) missReason(record *stagesRecord, prevRebuilt *DimgStage) string {
+	var prev *stageRecord
+	if record != nil {
+		prev = record.Stages[s.Name]
+	}
+
+	if prev == nil {
+		if record != nil && prevRebuilt != nil {
+			return fmt.Sprintf("previous stage `%s` is rebuilt", prevRebuilt.Name)
+		}
+
+		// Changes of stageDependencies files are found by git without the record
+		changes, err := s.changedStageDependencies()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: cannot check stageDependencies changes of stage `%s`: %s\n", s.Name, err)
+		} else if len(changes) > 0 {
+			return strings.Join(changes, ", ")
+		}
+
+		return "no previous build of the stage is recorded"
+	}
+
+	if prev.Signature == s.signature {
+		return "stage image was removed"
+	}
+
+	if changes := diffStageDependencies(prev.Inputs, s.signatureInputs); len(changes) > 0 {
+		return strings.Join(changes, ", ")
+	}
+
+	if prevRebuilt != nil {
+		return fmt.Sprintf("previous stage `%s` is rebuilt", prevRebuilt.Name)
+	}
+
+	return "previous stage is changed"
+}
+
+func diffStageDependencies(prev, current []StageDependency) []string {
+	prevValues := stageDependenciesValues(prev)
+	currentValues := stageDependenciesValues(current)
+
+	var changes []string
+	seen := make(map[string]bool)
+
+	for _, dep := range append(append([]StageDependency{}, current...), prev...) {
+		if dep.Name == "previous stage" || seen[dep.Name] {
+			continue
+		}
+		seen[dep.Name] = true
+
+		prevValue, inPrev := prevValues[dep.Name]
+		currentValue, inCurrent := currentValues[dep.Name]
+
+		switch {
+		case !inPrev:
+			changes = append(changes, fmt.Sprintf("new %s", dep.Name))
+		case !inCurrent:
+			changes = append(changes, fmt.Sprintf("removed %s", dep.Name))
+		case prevValue != currentValue:
+			changes = append(changes, fmt.Sprintf("changed %s", dep.Name))
+		}
+	}
+
+	return changes
+}
+
+func stageDependenciesValues(deps []StageDependency) map[string]string {
+	res := make(map[string]string)
+	for _, dep := range deps {
+		if value, hasKey := res[dep.Name]; hasKey {
+			res[dep.Name] = value + ":::" + dep.Value
+		} else {
+			res[dep.Name] = dep.Value
+		}
+	}
+	return res
+}
+
+// fromImageId returns id of the local base image, empty id is returned for fromDimg and not pulled base image
+func (d *DimgStages) fromImageId() (string, error) {
+	if d.Options.FromDimg != nil {
+		return "", nil
+	}
+
+	return d.Options.Images.GetId(d.Stages[0].image.FromImage.Name)
+}
+
+func (d *DimgStages) recordPath() string {
+	kind := "dimg"
+	if d.Node.IsArtifact() {
+		kind = "artifact"
+	}
+
+	name := d.Node.Name()
+	if name != "" {
+		name = util.ConsistentUniqSlugify(name)
+	}
+
+	return filepath.Join(d.Options.BuildDir, "stages_record", fmt.Sprintf("%s-%s.json", kind, name))
+}
+
+func (d *DimgStages) loadRecord() (*stagesRecord, error) {
+	if d.Options.BuildDir == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(d.recordPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	record := &stagesRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("bad record `%s`: %s", d.recordPath(), err)
+	}
+
+	return record, nil
+}
+
+func (d *DimgStages) saveRecord() error {
+	if d.Options.BuildDir == "" {
+		return nil
+	}
+
+	fromImageId, err := d.fromImageId()
+	if err != nil {
+		return err
+	}
+
+	record := &stagesRecord{Stages: make(map[StageName]*stageRecord), FromImageId: fromImageId}
+	for _, stage := range d.Stages {
+		if stage.image != nil {
+			record.Stages[stage.Name] = &stageRecord{Signature: stage.signature, Inputs: stage.signatureInputs}
+		}
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(d.recordPath()), os.ModePerm); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(d.recordPath(), data, 0644)
+}
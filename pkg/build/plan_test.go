@@ -0,0 +1,70 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDimgStages_Plan(t *testing.T) {
+	buildDir, err := ioutil.TempDir("", "dapp-plan-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(buildDir)
+
+	dimg := newTestDimg("dimg")
+	dimg.From = "ubuntu:16.04"
+	node := &DimgNode{Dimg: dimg}
+
+	images := &testStageImages{ids: map[string]string{"ubuntu:16.04": "sha256:1"}}
+	d := newTestDimgStages(t, node, map[StageName]string{InstallStage: "install", SetupStage: "setup"}, DimgStagesOptions{BuildDir: buildDir, Images: images})
+
+	plans, err := d.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range plans {
+		if p.Name == InstallStage && p.Reason != "no previous build of the stage is recorded" {
+			t.Errorf("unexpected reason without record: %q", p.Reason)
+		}
+	}
+
+	if err := d.saveRecord(); err != nil {
+		t.Fatal(err)
+	}
+
+	d = newTestDimgStages(t, node, map[StageName]string{InstallStage: "install changed", SetupStage: "setup"}, DimgStagesOptions{BuildDir: buildDir, Images: images})
+	plans, err = d.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[StageName]string{
+		FromStage:    "stage image was removed",
+		InstallStage: "changed install commands",
+		SetupStage:   "previous stage `install` is rebuilt",
+	}
+	for _, p := range plans {
+		reason, hasKey := expected[p.Name]
+		if !hasKey {
+			if !p.Empty {
+				t.Errorf("stage `%s` should be empty", p.Name)
+			}
+			continue
+		}
+
+		if p.Reason != reason {
+			t.Errorf("stage `%s`: expected reason %q, got %q", p.Name, reason, p.Reason)
+		}
+	}
+
+	images.ids["ubuntu:16.04"] = "sha256:2"
+	plans, err = d.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plans[0].Name != FromStage || plans[0].Reason != "new base image `ubuntu:16.04`" {
+		t.Errorf("new base image of the same name expected, got %q", plans[0].Reason)
+	}
+}
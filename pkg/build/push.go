@@ -0,0 +1,111 @@
+package build
+
+import (
+	"fmt"
+
+	"github.com/flant/dapp/pkg/docker"
+	"github.com/flant/dapp/pkg/docker_registry"
+	"github.com/flant/dapp/pkg/image"
+)
+
+type PushOptions struct {
+	// Tags of dimgs images, which are pushed into `<repo>/<dimg name>` or into repo for the nameless dimg
+	Tags []string
+	// WithStages pushes stages images as `<repo>:dimgstage-<signature>`, stages which are in the repo are skipped
+	WithStages bool
+}
+
+// DimgRepo is the docker repo of dimg images, it should be in sync with ruby dapp dimg push
+func DimgRepo(repo, dimgName string) string {
+	if dimgName == "" {
+		return repo
+	}
+	return fmt.Sprintf("%s/%s", repo, dimgName)
+}
+
+// Push pushes images of the built dimg, dev mode images are never pushed
+func (d *DimgStages) Push(repo string, opts PushOptions) error {
+	if d.Node.IsArtifact() {
+		return fmt.Errorf("%s cannot be pushed", d.Node)
+	}
+
+	lastImage := d.LastStage().Image()
+
+	_, built, err := d.Options.Images.GetLabels(lastImage.Name)
+	if err != nil {
+		return err
+	}
+	if !built {
+		return fmt.Errorf("%s is not built: run `dapp dimg build` first", d.Node)
+	}
+
+	if opts.WithStages {
+		if err := d.pushStages(repo); err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range opts.Tags {
+		name := fmt.Sprintf("%s:%s", DimgRepo(repo, d.Node.Name()), tag)
+
+		fmt.Printf("Pushing %s as `%s` ...\n", d.Node, name)
+
+		if err := pushImageAs(lastImage, name); err != nil {
+			return err
+		}
+
+		fmt.Printf("Pushing %s as `%s` DONE\n", d.Node, name)
+	}
+
+	return nil
+}
+
+func (d *DimgStages) pushStages(repo string) error {
+	tags, err := docker_registry.Tags(repo)
+	if err != nil {
+		return err
+	}
+
+	repoTags := make(map[string]bool)
+	for _, tag := range tags {
+		repoTags[tag] = true
+	}
+
+	for _, stage := range d.Stages {
+		if stage.image == nil {
+			continue
+		}
+
+		tag := fmt.Sprintf("dimgstage-%s", stage.signature)
+		if repoTags[tag] {
+			continue
+		}
+
+		name := fmt.Sprintf("%s:%s", repo, tag)
+
+		fmt.Printf("Pushing %s as `%s` ...\n", stage, name)
+
+		if err := pushImageAs(stage.image, name); err != nil {
+			return err
+		}
+
+		fmt.Printf("Pushing %s as `%s` DONE\n", stage, name)
+	}
+
+	return nil
+}
+
+// pushImageAs tags the image by name and pushes it, the tag is removed after push
+func pushImageAs(stageImage *image.Stage, name string) error {
+	if err := stageImage.Tag(name); err != nil {
+		return err
+	}
+
+	pushErr := image.NewStageImage(nil, name).Push()
+
+	if err := docker.CliRmi(name); err != nil && pushErr == nil {
+		return err
+	}
+
+	return pushErr
+}
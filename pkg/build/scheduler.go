@@ -0,0 +1,103 @@
+package build
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/flant/dapp/pkg/dapp"
+	"github.com/flant/dapp/pkg/lock"
+)
+
+// BuildDimgFunc builds one dimg or artifact, lockOwner should be used for all locks taken by the build,
+// so that concurrent builds inside one process exclude each other
+type BuildDimgFunc func(node *DimgNode, lockOwner string) error
+
+type Scheduler struct {
+	// Workers limits number of dimgs built at the same time, runtime.NumCPU() is used when zero
+	Workers int
+}
+
+type buildResult struct {
+	node *DimgNode
+	err  error
+}
+
+// Run builds nodes ordered by NewDimgsGraph: node is started when all its dependencies are built,
+// independent nodes are built concurrently. New builds are not started after the first error or
+// termination, but already started builds are waited for.
+func (s *Scheduler) Run(nodes []*DimgNode, buildFunc BuildDimgFunc) error {
+	workers := s.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	pendingDeps := make(map[*DimgNode]int)
+	dependants := make(map[*DimgNode][]*DimgNode)
+	var ready []*DimgNode
+
+	for _, node := range nodes {
+		pendingDeps[node] = len(node.Deps)
+		for _, dep := range node.Deps {
+			dependants[dep] = append(dependants[dep], node)
+		}
+
+		if len(node.Deps) == 0 {
+			ready = append(ready, node)
+		}
+	}
+
+	results := make(chan buildResult)
+	running := 0
+	built := 0
+
+	var firstErr error
+
+	for {
+		for firstErr == nil && dapp.Context().Err() == nil && running < workers && len(ready) > 0 {
+			node := ready[0]
+			ready = ready[1:]
+
+			running++
+			go func() {
+				results <- buildResult{node: node, err: buildFunc(node, lock.NewOwner())}
+			}()
+		}
+
+		if running == 0 {
+			break
+		}
+
+		res := <-results
+		running--
+
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s build failed: %s", res.node, res.err)
+			}
+			continue
+		}
+
+		built++
+
+		for _, dependant := range dependants[res.node] {
+			pendingDeps[dependant]--
+			if pendingDeps[dependant] == 0 {
+				ready = append(ready, dependant)
+			}
+		}
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if err := dapp.Context().Err(); err != nil {
+		return err
+	}
+
+	if built != len(nodes) {
+		return fmt.Errorf("%d of %d dimgs are not built: dependencies are not satisfied", len(nodes)-built, len(nodes))
+	}
+
+	return nil
+}
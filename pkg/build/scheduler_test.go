@@ -0,0 +1,195 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flant/dapp/pkg/config"
+	"github.com/flant/dapp/pkg/lock"
+)
+
+func newTestDimg(name string) *config.Dimg {
+	return &config.Dimg{DimgBase: &config.DimgBase{Name: name}}
+}
+
+func newTestArtifact(name string) *config.DimgArtifact {
+	return &config.DimgArtifact{DimgBase: &config.DimgBase{Name: name}}
+}
+
+func importArtifact(base *config.DimgBase, artifact *config.DimgArtifact) {
+	base.Import = append(base.Import, &config.ArtifactImport{ArtifactName: artifact.Name, ArtifactDimg: artifact})
+}
+
+func nodesNames(nodes []*DimgNode) []string {
+	var res []string
+	for _, node := range nodes {
+		res = append(res, node.String())
+	}
+	return res
+}
+
+func TestNewDimgsGraph(t *testing.T) {
+	artifact := newTestArtifact("artifact")
+	base := newTestDimg("base")
+
+	a := newTestDimg("a")
+	a.FromDimg = base
+	importArtifact(a.DimgBase, artifact)
+
+	b := newTestDimg("b")
+	importArtifact(b.DimgBase, artifact)
+	importArtifact(b.DimgBase, artifact)
+
+	nodes, err := NewDimgsGraph([]*config.Dimg{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"dimg `base`", "artifact `artifact`", "dimg `a`", "dimg `b`"}
+	if fmt.Sprintf("%v", nodesNames(nodes)) != fmt.Sprintf("%v", expected) {
+		t.Fatalf("expected order %v, got %v", expected, nodesNames(nodes))
+	}
+
+	if len(nodes[3].Deps) != 1 {
+		t.Fatalf("artifact imported twice should be one dependency, got %v", nodesNames(nodes[3].Deps))
+	}
+}
+
+func TestNewDimgsGraph_Cycle(t *testing.T) {
+	a := newTestDimg("a")
+	b := newTestDimg("b")
+	a.FromDimg = b
+	b.FromDimg = a
+
+	if _, err := NewDimgsGraph([]*config.Dimg{a}); err == nil {
+		t.Fatalf("cycle should be detected")
+	}
+}
+
+func TestScheduler_Run(t *testing.T) {
+	artifact := newTestArtifact("artifact")
+
+	var dimgs []*config.Dimg
+	for i := 0; i < 6; i++ {
+		dimg := newTestDimg(fmt.Sprintf("dimg-%d", i))
+		importArtifact(dimg.DimgBase, artifact)
+		dimgs = append(dimgs, dimg)
+	}
+
+	nodes, err := NewDimgsGraph(dimgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	built := make(map[*DimgNode]bool)
+	var running, maxRunning int32
+
+	s := &Scheduler{Workers: 3}
+	err = s.Run(nodes, func(node *DimgNode, lockOwner string) error {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+
+		mutex.Lock()
+		if current > maxRunning {
+			maxRunning = current
+		}
+		for _, dep := range node.Deps {
+			if !built[dep] {
+				mutex.Unlock()
+				return fmt.Errorf("dependency %s is not built", dep)
+			}
+		}
+		mutex.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mutex.Lock()
+		built[node] = true
+		mutex.Unlock()
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(built) != len(nodes) {
+		t.Fatalf("expected %d built dimgs, got %d", len(nodes), len(built))
+	}
+	if maxRunning < 2 || maxRunning > 3 {
+		t.Fatalf("expected 2 or 3 concurrent builds, got %d", maxRunning)
+	}
+}
+
+func TestScheduler_RunError(t *testing.T) {
+	artifact := newTestArtifact("artifact")
+	a := newTestDimg("a")
+	importArtifact(a.DimgBase, artifact)
+
+	nodes, err := NewDimgsGraph([]*config.Dimg{a})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int32
+
+	s := &Scheduler{Workers: 2}
+	err = s.Run(nodes, func(node *DimgNode, lockOwner string) error {
+		atomic.AddInt32(&calls, 1)
+		return fmt.Errorf("failed")
+	})
+	if err == nil {
+		t.Fatalf("error expected")
+	}
+	if calls != 1 {
+		t.Fatalf("dependant should not be built after dependency failure, got %d calls", calls)
+	}
+}
+
+func TestWithStageLock(t *testing.T) {
+	locksDir, err := ioutil.TempDir("", "dapp-build-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(locksDir)
+
+	lock.LocksDir = locksDir
+	if err := lock.InitWithOptions(lock.InitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var isBuilt int32
+	var builds int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := WithStageLock("project", "dimgstage-project:signature", lock.NewOwner(),
+				func() (bool, error) { return atomic.LoadInt32(&isBuilt) == 1, nil },
+				func() error {
+					atomic.AddInt32(&builds, 1)
+					time.Sleep(50 * time.Millisecond)
+					atomic.StoreInt32(&isBuilt, 1)
+					return nil
+				},
+			)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if builds != 1 {
+		t.Fatalf("stage should be built once, got %d builds", builds)
+	}
+}
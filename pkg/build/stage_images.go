@@ -0,0 +1,47 @@
+package build
+
+import (
+	"github.com/docker/docker/client"
+
+	"github.com/flant/dapp/pkg/docker"
+)
+
+// StageImages provides labels of built stage images and ids of base images
+type StageImages interface {
+	GetLabels(imageName string) (map[string]string, bool, error)
+	// GetId returns empty id when image does not exist locally
+	GetId(imageName string) (string, error)
+}
+
+type DockerStageImages struct{}
+
+func (images *DockerStageImages) GetLabels(imageName string) (map[string]string, bool, error) {
+	inspect, err := docker.ImageInspect(imageName)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	labels := make(map[string]string)
+	if inspect.Config != nil {
+		for label, value := range inspect.Config.Labels {
+			labels[label] = value
+		}
+	}
+
+	return labels, true, nil
+}
+
+func (images *DockerStageImages) GetId(imageName string) (string, error) {
+	inspect, err := docker.ImageInspect(imageName)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return inspect.ID, nil
+}
@@ -0,0 +1,36 @@
+package build
+
+import (
+	"fmt"
+
+	"github.com/flant/dapp/pkg/lock"
+)
+
+// StageLockName should be in sync with ruby dapp stage build lock, so that ruby and native builds exclude each other
+func StageLockName(projectName, imageName string) string {
+	return fmt.Sprintf("%s.image.%s", projectName, imageName)
+}
+
+// WithStageLock calls build only when stage image is not built yet: concurrent builds of the same stage signature
+// wait for the lock and skip the build when the image is built by another dimg or another process
+func WithStageLock(projectName, imageName, lockOwner string, isBuilt func() (bool, error), build func() error) error {
+	exist, err := isBuilt()
+	if err != nil {
+		return err
+	}
+	if exist {
+		return nil
+	}
+
+	return lock.WithLock(StageLockName(projectName, imageName), lock.LockOptions{Owner: lockOwner}, func() error {
+		exist, err := isBuilt()
+		if err != nil {
+			return err
+		}
+		if exist {
+			return nil
+		}
+
+		return build()
+	})
+}
@@ -9,24 +9,54 @@ import (
 
 type ConfigError struct {
 	s string
+
+	Message       string
+	ConfigSection string
+	DocPath       string
+	DocLine       int
 }
 
 func (e *ConfigError) Error() string {
 	return e.s
 }
 
+func (e *ConfigError) ErrorCode() string {
+	return "config_error"
+}
+
+func (e *ConfigError) ErrorData() map[string]interface{} {
+	data := map[string]interface{}{"message": e.Message}
+	if e.ConfigSection != "" {
+		data["config_section"] = e.ConfigSection
+	}
+	if e.DocPath != "" {
+		data["doc_path"] = e.DocPath
+		data["doc_line"] = e.DocLine
+	}
+
+	return data
+}
+
 func NewConfigError(message string) error {
-	return &ConfigError{message}
+	return &ConfigError{s: message, Message: message}
 }
 
 func NewDetailedConfigError(message string, configSection interface{}, configDoc *Doc) error {
-	var errorString string
+	var errorString, configSectionDump string
 	if configSection != nil {
-		errorString = fmt.Sprintf("%s\n\n%s\n%s", message, DumpConfigSection(configSection), DumpConfigDoc(configDoc))
+		configSectionDump = DumpConfigSection(configSection)
+		errorString = fmt.Sprintf("%s\n\n%s\n%s", message, configSectionDump, DumpConfigDoc(configDoc))
 	} else {
 		errorString = fmt.Sprintf("%s\n\n%s", message, DumpConfigDoc(configDoc))
 	}
-	return NewConfigError(errorString)
+
+	return &ConfigError{
+		s:             errorString,
+		Message:       message,
+		ConfigSection: configSectionDump,
+		DocPath:       configDoc.RenderFilePath,
+		DocLine:       configDoc.Line + 1,
+	}
 }
 
 func getLines(data []byte) [][]byte {
@@ -0,0 +1,25 @@
+package config
+
+// GitAuth describes credentials of remote git, secrets are read from files, ssh agent and environment
+type GitAuth struct {
+	SshKeys         []string
+	SshAgentSock    string
+	KnownHosts      []string
+	Username        string
+	PasswordEnv     string
+	TokenEnv        string
+	CredentialsFile string
+
+	Raw *RawGitAuth
+}
+
+func (c *GitAuth) Validate() error {
+	if !OneOrNone([]bool{len(c.SshKeys) > 0, c.SshAgentSock != ""}) {
+		return NewDetailedConfigError("Specify only `sshKey: [PATH, ...]|PATH` or `sshAgentSock: PATH` in git auth!", c.Raw, c.Raw.RawGit.RawDimg.Doc)
+	} else if !OneOrNone([]bool{c.PasswordEnv != "", c.TokenEnv != "", c.CredentialsFile != ""}) {
+		return NewDetailedConfigError("Specify only `passwordEnv: ENV`, `tokenEnv: ENV` or `credentialsFile: PATH` in git auth!", c.Raw, c.Raw.RawGit.RawDimg.Doc)
+	} else if c.Username != "" && c.PasswordEnv == "" {
+		return NewDetailedConfigError("`username: USERNAME` should be used with `passwordEnv: ENV` in git auth!", c.Raw, c.Raw.RawGit.RawDimg.Doc)
+	}
+	return nil
+}
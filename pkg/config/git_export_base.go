@@ -3,6 +3,8 @@ package config
 type GitExportBase struct {
 	*GitExport
 	StageDependencies *StageDependencies
+	// Submodules enables files of submodules at the pinned commits in native build
+	Submodules bool
 
 	Raw *RawGit
 }
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+
 	"github.com/flant/dapp/pkg/config/ruby_marshal_config"
 )
 
@@ -9,11 +11,27 @@ type GitRemote struct {
 	As   string
 	Name string
 	Url  string
+	Auth *GitAuth
+	// Mirrors are tried in order after Url, MirrorTimeout limits every attempt in seconds
+	Mirrors       []string
+	MirrorTimeout int
+	// PinClonePath makes clone path depend on the normalized url only, e.g. not on the protocol
+	PinClonePath bool
 
 	Raw *RawGit
 }
 
 func (c *GitRemote) Validate() error {
+	if c.MirrorTimeout < 0 {
+		return NewDetailedConfigError("`mirrorTimeout: SECONDS` should not be negative!", c.Raw, c.Raw.RawDimg.Doc)
+	}
+
+	for _, mirror := range c.Mirrors {
+		if mirror == "" || mirror == c.Url {
+			return NewDetailedConfigError(fmt.Sprintf("Mirror `%s` should be non-empty url other than `url`!", mirror), c.Raw, c.Raw.RawDimg.Doc)
+		}
+	}
+
 	return nil
 }
 
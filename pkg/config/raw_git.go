@@ -13,6 +13,11 @@ type RawGit struct {
 	Tag                  string                `yaml:"tag,omitempty"`
 	Commit               string                `yaml:"commit,omitempty"`
 	RawStageDependencies *RawStageDependencies `yaml:"stageDependencies,omitempty"`
+	Submodules           bool                  `yaml:"submodules,omitempty"`
+	RawAuth              *RawGitAuth           `yaml:"auth,omitempty"`
+	Mirrors              interface{}           `yaml:"mirrors,omitempty"`
+	MirrorTimeout        int                   `yaml:"mirrorTimeout,omitempty"`
+	PinClonePath         bool                  `yaml:"pinClonePath,omitempty"`
 
 	RawDimg *RawDimg `yaml:"-"` // parent
 
@@ -82,6 +87,14 @@ func (c *RawGit) ValidateGitLocalDirective(gitLocal *GitLocal) (err error) {
 		return NewDetailedConfigError("Specify `branch: BRANCH`, `tag: TAG` and `commit: COMMIT` only for remote git!", nil, c.RawDimg.Doc)
 	}
 
+	if c.RawAuth != nil {
+		return NewDetailedConfigError("Specify `auth` only for remote git!", nil, c.RawDimg.Doc)
+	}
+
+	if c.Mirrors != nil || c.MirrorTimeout != 0 || c.PinClonePath {
+		return NewDetailedConfigError("Specify `mirrors: [URL, ...]|URL`, `mirrorTimeout: SECONDS` and `pinClonePath: true` only for remote git!", nil, c.RawDimg.Doc)
+	}
+
 	if err := gitLocal.Validate(); err != nil {
 		return err
 	}
@@ -107,6 +120,8 @@ func (c *RawGit) ToGitLocalExportDirective() (gitLocalExport *GitLocalExport, er
 		}
 	}
 
+	gitLocalExport.Submodules = c.Submodules
+
 	gitLocalExport.Raw = c
 
 	if err := c.ValidateGitLocalExportDirective(gitLocalExport); err != nil {
@@ -136,6 +151,24 @@ func (c *RawGit) ToGitRemoteDirective() (gitRemote *GitRemote, err error) {
 	gitRemote.As = c.As
 	gitRemote.Url = c.Url
 
+	if c.RawAuth != nil {
+		if auth, err := c.RawAuth.ToDirective(); err != nil {
+			return nil, err
+		} else {
+			gitRemote.Auth = auth
+		}
+	}
+
+	if c.Mirrors != nil {
+		if mirrors, err := InterfaceToStringArray(c.Mirrors, c, c.RawDimg.Doc); err != nil {
+			return nil, err
+		} else {
+			gitRemote.Mirrors = mirrors
+		}
+	}
+	gitRemote.MirrorTimeout = c.MirrorTimeout
+	gitRemote.PinClonePath = c.PinClonePath
+
 	// FIXME
 	if url, err := c.getNameFromUrl(); err != nil {
 		return nil, NewDetailedConfigError(err.Error(), c, c.RawDimg.Doc)
@@ -153,12 +186,17 @@ func (c *RawGit) ToGitRemoteDirective() (gitRemote *GitRemote, err error) {
 }
 
 func (c *RawGit) getNameFromUrl() (string, error) {
+	return GitRepoNameFromUrl(c.Url)
+}
+
+// GitRepoNameFromUrl returns name of remote git, which is used in clone path and locks
+func GitRepoNameFromUrl(url string) (string, error) {
 	r := regexp.MustCompile(`.*?([^:/ ]+/[^/ ]+)\.git$`)
-	match := r.FindStringSubmatch(c.Url)
+	match := r.FindStringSubmatch(url)
 	if len(match) == 2 {
 		return match[1], nil
 	} else {
-		return "", fmt.Errorf("Cannot determine repo name from `url: %s`: url is not fit `.*?([^:/ ]+/[^/ ]+)\\.git$` regex!", c.Url)
+		return "", fmt.Errorf("Cannot determine repo name from `url: %s`: url is not fit `.*?([^:/ ]+/[^/ ]+)\\.git$` regex!", url)
 	}
 }
 
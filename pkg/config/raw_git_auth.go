@@ -0,0 +1,70 @@
+package config
+
+type RawGitAuth struct {
+	SshKey          interface{} `yaml:"sshKey,omitempty"`
+	SshAgentSock    string      `yaml:"sshAgentSock,omitempty"`
+	KnownHosts      interface{} `yaml:"knownHosts,omitempty"`
+	Username        string      `yaml:"username,omitempty"`
+	PasswordEnv     string      `yaml:"passwordEnv,omitempty"`
+	TokenEnv        string      `yaml:"tokenEnv,omitempty"`
+	CredentialsFile string      `yaml:"credentialsFile,omitempty"`
+
+	RawGit *RawGit `yaml:"-"` // parent
+
+	UnsupportedAttributes map[string]interface{} `yaml:",inline"`
+}
+
+func (c *RawGitAuth) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if parent, ok := ParentStack.Peek().(*RawGit); ok {
+		c.RawGit = parent
+	}
+
+	type plain RawGitAuth
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if err := CheckOverflow(c.UnsupportedAttributes, c, c.RawGit.RawDimg.Doc); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *RawGitAuth) ToDirective() (gitAuth *GitAuth, err error) {
+	gitAuth = &GitAuth{}
+
+	if sshKeys, err := InterfaceToStringArray(c.SshKey, c, c.RawGit.RawDimg.Doc); err != nil {
+		return nil, err
+	} else {
+		gitAuth.SshKeys = sshKeys
+	}
+
+	if knownHosts, err := InterfaceToStringArray(c.KnownHosts, c, c.RawGit.RawDimg.Doc); err != nil {
+		return nil, err
+	} else {
+		gitAuth.KnownHosts = knownHosts
+	}
+
+	gitAuth.SshAgentSock = c.SshAgentSock
+	gitAuth.Username = c.Username
+	gitAuth.PasswordEnv = c.PasswordEnv
+	gitAuth.TokenEnv = c.TokenEnv
+	gitAuth.CredentialsFile = c.CredentialsFile
+
+	gitAuth.Raw = c
+
+	if err := c.ValidateDirective(gitAuth); err != nil {
+		return nil, err
+	}
+
+	return gitAuth, nil
+}
+
+func (c *RawGitAuth) ValidateDirective(gitAuth *GitAuth) error {
+	if err := gitAuth.Validate(); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -1,43 +1,43 @@
 package dapp
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 )
 
+// BuildCacheVersion should be in sync with ruby dapp BUILD_CACHE_VERSION
+const BuildCacheVersion = "31"
+
 var (
 	HomeDir = filepath.Join(os.Getenv("HOME"), ".dapp")
+	TmpDir  string
 )
 
-/* TODO: will be needed for single go-dapp binary
 func Init() error {
-		TmpDir, err = ioutil.TempDir("", "dapp-")
-		if err != nil {
-			return fmt.Errorf("cannot create temporary dir: %s", err)
-		}
-
-		interruptCh := make(chan os.Signal, 1)
-		signal.Notify(interruptCh, syscall.SIGINT, syscall.SIGTERM)
-
-		go func() {
-			<-interruptCh
-			err := Terminate()
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error terminating dapp: %s", err)
-			}
-			fmt.Fprintf(os.Stderr, "Exiting")
-			os.Exit(1)
-		}()
+	var err error
+
+	TmpDir, err = ioutil.TempDir("", "dapp-")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary dir: %s", err)
+	}
 
 	return nil
 }
 
+// Terminate runs cleanup hooks and removes temporary dir
 func Terminate() error {
-		err := os.RemoveAll(TmpDir)
-		if err != nil {
-			return fmt.Errorf("cannot remove temporary dir: %s", err)
-		}
+	RunCleanupHooks()
+
+	if TmpDir == "" {
+		return nil
+	}
+
+	err := os.RemoveAll(TmpDir)
+	if err != nil {
+		return fmt.Errorf("cannot remove temporary dir: %s", err)
+	}
 
 	return nil
 }
-*/
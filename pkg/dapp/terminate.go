@@ -0,0 +1,142 @@
+package dapp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+type CleanupStage int
+
+// Cleanup hooks are called stage by stage in this order
+const (
+	ContainersCleanupStage CleanupStage = iota
+	TmpFilesCleanupStage
+	LocksCleanupStage
+)
+
+var cleanupStages = []CleanupStage{ContainersCleanupStage, TmpFilesCleanupStage, LocksCleanupStage}
+
+type cleanupHook struct {
+	f func()
+}
+
+var (
+	rootContext, rootCancel = context.WithCancel(context.Background())
+
+	cleanupMutex sync.Mutex
+	cleanupHooks = map[CleanupStage][]*cleanupHook{}
+	// runCleanupMutex keeps stages order when cleanup is started by signal and by the program at the same time
+	runCleanupMutex sync.Mutex
+)
+
+// Context is the root context of the process, which is cancelled on the first termination signal
+func Context() context.Context {
+	return rootContext
+}
+
+func Cancel() {
+	rootCancel()
+}
+
+// AddCleanupHook registers hook, which is called once by RunCleanupHooks or on termination signal.
+// Returned function unregisters the hook, when cleanup is not needed anymore.
+func AddCleanupHook(stage CleanupStage, f func()) func() {
+	cleanupMutex.Lock()
+	defer cleanupMutex.Unlock()
+
+	hook := &cleanupHook{f: f}
+	cleanupHooks[stage] = append(cleanupHooks[stage], hook)
+
+	return func() {
+		cleanupMutex.Lock()
+		defer cleanupMutex.Unlock()
+
+		removeCleanupHook(stage, hook)
+	}
+}
+
+// AddTmpFile registers temporary file, which is removed on termination, also when exit is forced by the second signal.
+// Returned function removes the file and unregisters it.
+func AddTmpFile(path string) func() error {
+	removeHook := AddCleanupHook(TmpFilesCleanupStage, func() { os.RemoveAll(path) })
+
+	return func() error {
+		removeHook()
+		return os.RemoveAll(path)
+	}
+}
+
+func removeCleanupHook(stage CleanupStage, hook *cleanupHook) {
+	hooks := cleanupHooks[stage]
+	for ind := range hooks {
+		if hooks[ind] == hook {
+			cleanupHooks[stage] = append(hooks[:ind:ind], hooks[ind+1:]...)
+			return
+		}
+	}
+}
+
+// RunCleanupHooks calls hooks stage by stage, hooks of one stage are called in reverse order of registration
+func RunCleanupHooks() {
+	runCleanupMutex.Lock()
+	defer runCleanupMutex.Unlock()
+
+	for _, stage := range cleanupStages {
+		runCleanupStage(stage)
+	}
+}
+
+func runCleanupStage(stage CleanupStage) {
+	cleanupMutex.Lock()
+	hooks := cleanupHooks[stage]
+	delete(cleanupHooks, stage)
+	cleanupMutex.Unlock()
+
+	for ind := len(hooks) - 1; ind >= 0; ind-- {
+		hooks[ind].f()
+	}
+}
+
+// TrapSignals cancels root context on the first SIGINT or SIGTERM and removes build containers
+// to interrupt running docker commands, so that the program can finish gracefully.
+// The second signal or SIGQUIT forces exit without waiting for cleanup, only temporary files are removed.
+func TrapSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGPIPE)
+
+	go func() {
+		interrupted := false
+
+		for sig := range c {
+			switch sig {
+			case syscall.SIGPIPE:
+				continue
+			case os.Interrupt, syscall.SIGTERM:
+				if !interrupted {
+					interrupted = true
+
+					fmt.Fprintf(os.Stderr, "Interrupted, terminating ...\n")
+					Cancel()
+					go func() {
+						runCleanupMutex.Lock()
+						defer runCleanupMutex.Unlock()
+
+						runCleanupStage(ContainersCleanupStage)
+					}()
+
+					continue
+				}
+			}
+
+			fmt.Fprintf(os.Stderr, "Forced exit\n")
+			// NOTICE: runCleanupMutex is not taken, it can be held by the running cleanup,
+			// NOTICE: each hook is called once anyway, because hooks are taken from cleanupHooks
+			runCleanupStage(TmpFilesCleanupStage)
+			os.Exit(128 + int(sig.(syscall.Signal)))
+		}
+	}()
+}
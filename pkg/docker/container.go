@@ -1,14 +1,18 @@
 package docker
 
 import (
+	"io"
+
 	"github.com/docker/cli/cli/command/container"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"golang.org/x/net/context"
+
+	"github.com/flant/dapp/pkg/dapp"
 )
 
 func Containers(options types.ContainerListOptions) ([]types.Container, error) {
-	ctx := context.Background()
+	ctx := dapp.Context()
 	return apiClient.ContainerList(ctx, options)
 }
 
@@ -23,12 +27,12 @@ func ContainerExist(ref string) (bool, error) {
 }
 
 func ContainerInspect(ref string) (types.ContainerJSON, error) {
-	ctx := context.Background()
+	ctx := dapp.Context()
 	return apiClient.ContainerInspect(ctx, ref)
 }
 
 func ContainerCommit(ref string, commitOptions types.ContainerCommitOptions) (string, error) {
-	ctx := context.Background()
+	ctx := dapp.Context()
 	response, err := apiClient.ContainerCommit(ctx, ref, commitOptions)
 	if err != nil {
 		return "", err
@@ -37,6 +41,12 @@ func ContainerCommit(ref string, commitOptions types.ContainerCommitOptions) (st
 	return response.ID, nil
 }
 
+// ContainerCopyTo extracts tar archive content into the path of the container filesystem
+func ContainerCopyTo(ref, path string, content io.Reader) error {
+	ctx := dapp.Context()
+	return apiClient.CopyToContainer(ctx, ref, path, content, types.CopyToContainerOptions{})
+}
+
 func ContainerRemove(ref string) error {
 	ctx := context.Background()
 	err := apiClient.ContainerRemove(ctx, ref, types.ContainerRemoveOptions{})
@@ -75,6 +85,20 @@ func CliRun(args ...string) error {
 	return nil
 }
 
+func CliStart(args ...string) error {
+	cmd := container.NewStartCommand(cli)
+	cmd.SilenceErrors = true
+	cmd.SilenceUsage = true
+	cmd.SetArgs(args)
+
+	err := cmd.Execute()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func CliRm(args ...string) error {
 	cmd := container.NewRmCommand(cli)
 	cmd.SilenceErrors = true
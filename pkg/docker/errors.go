@@ -0,0 +1,19 @@
+package docker
+
+import "fmt"
+
+type DaemonError struct {
+	Err error
+}
+
+func (e *DaemonError) Error() string {
+	return fmt.Sprintf("docker daemon request failed: %s", e.Err)
+}
+
+func (e *DaemonError) ErrorCode() string {
+	return "docker_daemon_failed"
+}
+
+func (e *DaemonError) ErrorData() map[string]interface{} {
+	return nil
+}
@@ -3,11 +3,12 @@ package docker
 import (
 	"github.com/docker/cli/cli/command/image"
 	"github.com/docker/docker/api/types"
-	"golang.org/x/net/context"
+
+	"github.com/flant/dapp/pkg/dapp"
 )
 
 func Images(options types.ImageListOptions) ([]types.ImageSummary, error) {
-	ctx := context.Background()
+	ctx := dapp.Context()
 	images, err := apiClient.ImageList(ctx, options)
 	if err != nil {
 		return nil, err
@@ -17,7 +18,7 @@ func Images(options types.ImageListOptions) ([]types.ImageSummary, error) {
 }
 
 func ImageInspect(ref string) (*types.ImageInspect, error) {
-	ctx := context.Background()
+	ctx := dapp.Context()
 	inspect, _, err := apiClient.ImageInspectWithRaw(ctx, ref)
 	if err != nil {
 		return nil, err
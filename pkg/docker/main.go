@@ -35,7 +35,7 @@ func ServerVersion() (*types.Version, error) {
 	ctx := context.Background()
 	version, err := apiClient.ServerVersion(ctx)
 	if err != nil {
-		return nil, err
+		return nil, &DaemonError{Err: err}
 	}
 
 	return &version, nil
@@ -55,6 +55,10 @@ func setDockerClient() error {
 func setDockerApiClient() error {
 	ctx := context.Background()
 	serverVersion, err := cli.Client().ServerVersion(ctx)
+	if err != nil {
+		return &DaemonError{Err: err}
+	}
+
 	apiClient, err = client.NewClientWithOpts(client.WithVersion(serverVersion.APIVersion))
 	if err != nil {
 		return err
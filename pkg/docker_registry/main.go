@@ -22,7 +22,7 @@ func DimgstageTags(reference string) ([]string, error) {
 func tagsByDappDimgLabel(reference, labelValue string) ([]string, error) {
 	var dimgTags []string
 
-	allTags, err := tags(reference)
+	allTags, err := Tags(reference)
 	if err != nil {
 		return nil, err
 	}
@@ -50,7 +50,7 @@ func tagsByDappDimgLabel(reference, labelValue string) ([]string, error) {
 	return dimgTags, nil
 }
 
-func tags(reference string) ([]string, error) {
+func Tags(reference string) ([]string, error) {
 	repo, err := name.NewRepository(reference, name.WeakValidation)
 	if err != nil {
 		return nil, fmt.Errorf("parsing repo %q: %v", reference, err)
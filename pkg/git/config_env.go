@@ -0,0 +1,40 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/Masterminds/semver"
+)
+
+// ConfigEnv returns environment, which passes the config value to git, the value is added after
+// GIT_CONFIG_KEY_<n> and GIT_CONFIG_VALUE_<n> variables of the process environment
+func ConfigEnv(key, value string) ([]string, error) {
+	v, err := CliVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := semver.NewConstraint(fmt.Sprintf(">= %s", MinGitVersionWithConfigEnvConstraint))
+	if err != nil {
+		panic(err)
+	}
+	if !c.Check(v) {
+		return nil, fmt.Errorf("git version >= %s required to pass config through environment, your git version is %s", MinGitVersionWithConfigEnvConstraint, v)
+	}
+
+	count := 0
+	if rawCount := os.Getenv("GIT_CONFIG_COUNT"); rawCount != "" {
+		count, err = strconv.Atoi(rawCount)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("unexpected GIT_CONFIG_COUNT value `%s`", rawCount)
+		}
+	}
+
+	return []string{
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", count+1),
+		fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", count, key),
+		fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", count, value),
+	}, nil
+}
@@ -0,0 +1,52 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/flant/dapp/pkg/dapp"
+)
+
+type FetchOptions struct {
+	RemoteName string
+	RefSpecs   []string
+	// Deepen adds the number of commits to the history of shallow repo
+	Deepen int
+	// Unshallow fetches the whole history of shallow repo
+	Unshallow bool
+	// Env is added to the process environment, it is used to pass credentials
+	Env []string
+}
+
+func Fetch(repoPath string, opts FetchOptions) error {
+	return FetchContext(dapp.Context(), repoPath, opts)
+}
+
+// FetchContext is used to deepen shallow repos, which is not supported by go-git
+func FetchContext(ctx context.Context, repoPath string, opts FetchOptions) error {
+	args := []string{"-C", repoPath, "fetch", "--no-tags"}
+	if opts.Unshallow {
+		args = append(args, "--unshallow")
+	} else if opts.Deepen > 0 {
+		args = append(args, fmt.Sprintf("--deepen=%d", opts.Deepen))
+	}
+	args = append(args, opts.RemoteName)
+	args = append(args, opts.RefSpecs...)
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), opts.Env...)
+
+	out := bytes.Buffer{}
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git fetch error: %s\n%s", err, strings.TrimSpace(out.String()))
+	}
+
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os/exec"
 	"strings"
+	"sync"
 
 	"github.com/Masterminds/semver"
 )
@@ -12,6 +13,7 @@ import (
 const (
 	MinGitVersionConstraint               = "1.9.0"
 	MinGitVersionWithSubmodulesConstraint = "2.14.0"
+	MinGitVersionWithConfigEnvConstraint  = "2.31.0"
 )
 
 var (
@@ -61,6 +63,30 @@ func Init() error {
 	return nil
 }
 
+var (
+	cliVersionOnce sync.Once
+	cliVersion     *semver.Version
+	cliVersionErr  error
+)
+
+// CliVersion returns version of git binary, which is required only for operations not supported by go-git
+func CliVersion() (*semver.Version, error) {
+	cliVersionOnce.Do(func() {
+		v, err := getGitCliVersion()
+		if err != nil {
+			cliVersionErr = err
+			return
+		}
+
+		cliVersion, err = semver.NewVersion(v)
+		if err != nil {
+			cliVersionErr = fmt.Errorf("unexpected `git --version` spec `%s`: %s", v, err)
+		}
+	})
+
+	return cliVersion, cliVersionErr
+}
+
 func getGitCliVersion() (string, error) {
 	cmd := exec.Command("git", "--version")
 
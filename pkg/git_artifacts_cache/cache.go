@@ -0,0 +1,379 @@
+package git_artifacts_cache
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flant/dapp/pkg/dapp"
+	"github.com/flant/dapp/pkg/lock"
+)
+
+// CacheVersion should be changed when archives or patches format is changed
+const CacheVersion = "1"
+
+const (
+	ArchivesKind = "archives"
+	PatchesKind  = "patches"
+
+	// UsageLockName is held in shared mode while files are used by builds and in exclusive mode by prune
+	UsageLockName = "git_artifacts_cache"
+
+	metaExt = ".meta.json"
+	tmpExt  = ".tmp"
+)
+
+var (
+	DefaultDir = filepath.Join(dapp.HomeDir, "git_artifacts_cache", CacheVersion)
+
+	DefaultMaxAge        = 14 * 24 * time.Hour
+	DefaultMaxSize int64 = 10 * 1024 * 1024 * 1024
+)
+
+// Cache keeps archives and patches of git artifacts by keys, which are calculated from commits and
+// filter options, so files are reused by builds of all projects on the host
+type Cache struct {
+	Dir string
+
+	verifiedMutex sync.Mutex
+	// verified are modification times of files, which are verified or created by the process,
+	// such files are not hashed again until they are changed
+	verified map[string]time.Time
+}
+
+type Entry struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Checksum is sha256 of the file content, which is verified before reuse
+	Checksum  string    `json:"checksum"`
+	CreatedAt time.Time `json:"created_at"`
+	// LastUsedAt is modification time of the meta file
+	LastUsedAt time.Time `json:"-"`
+	Path       string    `json:"-"`
+}
+
+type PruneOptions struct {
+	// MaxAge removes entries, which are not used longer, zero means no limit
+	MaxAge time.Duration
+	// MaxSize removes least recently used entries until total size fits, zero means no limit
+	MaxSize int64
+}
+
+// KindDir contains files of the kind, it is mounted into build containers
+func (c *Cache) KindDir(kind string) string {
+	return filepath.Join(c.Dir, kind)
+}
+
+func (c *Cache) entryLockName(kind, name string) string {
+	return fmt.Sprintf("git_artifacts_cache.%s.%s", kind, name)
+}
+
+// Get returns valid entry of the cache or creates it by create function, entries are
+// created under the lock, broken entries are recreated
+func (c *Cache) Get(kind, name string, create func(w io.Writer) error) (*Entry, error) {
+	var entry *Entry
+
+	// Separate owner makes the lock exclusive for concurrent builders of the process
+	lockOptions := lock.LockOptions{Timeout: 600 * time.Second, Owner: lock.NewOwner()}
+
+	err := lock.WithLock(c.entryLockName(kind, name), lockOptions, func() error {
+		var err error
+
+		entry, err = c.readEntry(kind, name)
+		if err != nil {
+			return err
+		}
+
+		if entry != nil {
+			if err := c.verifyEntry(entry); err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: %s: recreating\n", err)
+				entry = nil
+			}
+		}
+
+		if entry == nil {
+			entry, err = c.createEntry(kind, name, create)
+			if err != nil {
+				return err
+			}
+
+			if err := c.setVerified(entry); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		entry.LastUsedAt = now
+
+		return os.Chtimes(entry.Path+metaExt, now, now)
+	})
+
+	return entry, err
+}
+
+// verifyEntry checks the checksum once per process, only the size is checked for verified unchanged files
+func (c *Cache) verifyEntry(entry *Entry) error {
+	fi, err := os.Stat(entry.Path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("git artifacts cache file `%s` is not found", entry.Path)
+	} else if err != nil {
+		return err
+	}
+
+	c.verifiedMutex.Lock()
+	modTime, isVerified := c.verified[entry.Path]
+	c.verifiedMutex.Unlock()
+
+	if isVerified && modTime.Equal(fi.ModTime()) && fi.Size() == entry.Size {
+		return nil
+	}
+
+	if err := entry.Verify(); err != nil {
+		return err
+	}
+
+	return c.setVerified(entry)
+}
+
+func (c *Cache) setVerified(entry *Entry) error {
+	fi, err := os.Stat(entry.Path)
+	if err != nil {
+		return err
+	}
+
+	c.verifiedMutex.Lock()
+	defer c.verifiedMutex.Unlock()
+
+	if c.verified == nil {
+		c.verified = make(map[string]time.Time)
+	}
+	c.verified[entry.Path] = fi.ModTime()
+
+	return nil
+}
+
+func (c *Cache) readEntry(kind, name string) (*Entry, error) {
+	path := filepath.Join(c.KindDir(kind), name)
+
+	data, err := ioutil.ReadFile(path + metaExt)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path + metaExt)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: bad git artifacts cache meta `%s`: %s\n", path+metaExt, err)
+		return nil, nil
+	}
+	entry.Path = path
+	entry.LastUsedAt = fi.ModTime()
+
+	return entry, nil
+}
+
+func (c *Cache) createEntry(kind, name string, create func(w io.Writer) error) (*Entry, error) {
+	path := filepath.Join(c.KindDir(kind), name)
+
+	if err := os.MkdirAll(c.KindDir(kind), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	// Partial file is never used: meta is written after the file is complete
+	os.Remove(path + metaExt)
+
+	f, err := os.OpenFile(path+tmpExt, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path + tmpExt)
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+
+	if err := create(io.MultiWriter(f, hash, counter)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(path+tmpExt, path); err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{
+		Kind:      kind,
+		Name:      name,
+		Size:      counter.Size,
+		Checksum:  fmt.Sprintf("%x", hash.Sum(nil)),
+		CreatedAt: time.Now(),
+		Path:      path,
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(path+metaExt+tmpExt, data, 0644); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(path+metaExt+tmpExt, path+metaExt); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+type countingWriter struct {
+	Size int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.Size += int64(len(p))
+	return len(p), nil
+}
+
+// Verify checks size and checksum of the file
+func (e *Entry) Verify() error {
+	f, err := os.Open(e.Path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("git artifacts cache file `%s` is not found", e.Path)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+
+	if size != e.Size || fmt.Sprintf("%x", hash.Sum(nil)) != e.Checksum {
+		return fmt.Errorf("git artifacts cache file `%s` is corrupted", e.Path)
+	}
+
+	return nil
+}
+
+// List returns entries of all kinds sorted by last use time, the most recently used first
+func (c *Cache) List() ([]*Entry, error) {
+	var res []*Entry
+
+	for _, kind := range []string{ArchivesKind, PatchesKind} {
+		paths, err := filepath.Glob(filepath.Join(c.KindDir(kind), "*"+metaExt))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range paths {
+			entry, err := c.readEntry(kind, strings.TrimSuffix(filepath.Base(path), metaExt))
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil {
+				res = append(res, entry)
+			}
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].LastUsedAt.After(res[j].LastUsedAt)
+	})
+
+	return res, nil
+}
+
+// Prune removes expired entries and least recently used entries exceeding max size, files without
+// meta are left by interrupted builds and are removed too. The usage lock should be held in exclusive mode.
+func (c *Cache) Prune(opts PruneOptions) ([]*Entry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []*Entry
+	var size int64
+	now := time.Now()
+
+	for _, entry := range entries {
+		size += entry.Size
+
+		isExpired := opts.MaxAge != 0 && now.Sub(entry.LastUsedAt) > opts.MaxAge
+		isExceeded := opts.MaxSize != 0 && size > opts.MaxSize
+		if !isExpired && !isExceeded {
+			continue
+		}
+
+		if err := c.removeEntry(entry); err != nil {
+			return removed, err
+		}
+		removed = append(removed, entry)
+		size -= entry.Size
+	}
+
+	for _, kind := range []string{ArchivesKind, PatchesKind} {
+		if err := c.removeOrphans(kind); err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+func (c *Cache) removeEntry(entry *Entry) error {
+	if err := os.Remove(entry.Path + metaExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Cache) removeOrphans(kind string) error {
+	paths, err := filepath.Glob(filepath.Join(c.KindDir(kind), "*"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if strings.HasSuffix(path, metaExt) {
+			continue
+		}
+
+		if _, err := os.Stat(path + metaExt); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
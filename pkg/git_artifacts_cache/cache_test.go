@@ -0,0 +1,183 @@
+package git_artifacts_cache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flant/dapp/pkg/lock"
+)
+
+func newTestCache(t *testing.T) (*Cache, func()) {
+	tmpDir, err := ioutil.TempDir("", "dapp-git-artifacts-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock.LocksDir = filepath.Join(tmpDir, "locks")
+	if err := lock.InitWithOptions(lock.InitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Cache{Dir: filepath.Join(tmpDir, "cache")}, func() { os.RemoveAll(tmpDir) }
+}
+
+func TestCache_Get(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	calls := 0
+	create := func(w io.Writer) error {
+		calls++
+		_, err := fmt.Fprintf(w, "content")
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		entry, err := c.Get(ArchivesKind, "key.tar", create)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(entry.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "content" || entry.Size != 7 {
+			t.Errorf("unexpected entry %#v with content %q", entry, data)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("entry should be created once, created %d times", calls)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(c.KindDir(ArchivesKind), "key.tar"), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ArchivesKind, "key.tar", create); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("corrupted entry should be recreated")
+	}
+
+	_, err := c.Get(PatchesKind, "failed.patch", func(w io.Writer) error {
+		fmt.Fprintf(w, "partial")
+		return fmt.Errorf("failed")
+	})
+	if err == nil {
+		t.Errorf("create error expected")
+	}
+
+	entries, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("failed entry should not be cached, got %d entries", len(entries))
+	}
+}
+
+func TestCache_Prune(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	now := time.Now()
+	for i, name := range []string{"a.patch", "b.patch", "c.patch", "d.patch"} {
+		entry, err := c.Get(PatchesKind, name, func(w io.Writer) error {
+			_, err := w.Write(make([]byte, 100))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lastUsedAt := now.Add(-time.Duration(i) * 24 * time.Hour)
+		if err := os.Chtimes(entry.Path+metaExt, lastUsedAt, lastUsedAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orphanPath := filepath.Join(c.KindDir(PatchesKind), "orphan.patch.tmp")
+	if err := ioutil.WriteFile(orphanPath, []byte("orphan"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := c.Prune(PruneOptions{MaxAge: 60 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Name != "d.patch" {
+		t.Errorf("only expired entry should be removed, got %v", removed)
+	}
+	if _, err := os.Stat(orphanPath); !os.IsNotExist(err) {
+		t.Errorf("orphan file should be removed")
+	}
+
+	removed, err = c.Prune(PruneOptions{MaxSize: 150})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || removed[0].Name != "b.patch" || removed[1].Name != "c.patch" {
+		t.Errorf("least recently used entries should be removed, got %v", removed)
+	}
+
+	entries, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "a.patch" {
+		t.Errorf("unexpected entries after prune: %v", entries)
+	}
+	if _, err := os.Stat(entries[0].Path); err != nil {
+		t.Errorf("kept entry file should exist: %s", err)
+	}
+}
+
+func TestCache_GetVerifiedOnce(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	create := func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "content")
+		return err
+	}
+
+	entry, err := c.Get(PatchesKind, "key.patch", create)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Checksum of unchanged file is not checked again by the process
+	data, err := ioutil.ReadFile(entry.Path + metaExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(entry.Path+metaExt, []byte(strings.Replace(string(data), entry.Checksum, "bad", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get(PatchesKind, "key.patch", func(w io.Writer) error {
+		t.Errorf("verified entry should not be recreated")
+		return create(w)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	other := &Cache{Dir: c.Dir}
+	recreated := false
+	if _, err := other.Get(PatchesKind, "key.patch", func(w io.Writer) error {
+		recreated = true
+		return create(w)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !recreated {
+		t.Errorf("entry with bad checksum should be recreated by another process")
+	}
+}
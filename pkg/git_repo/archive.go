@@ -3,53 +3,72 @@ package git_repo
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
 	"runtime"
 	"runtime/pprof"
+	"sort"
+	"strconv"
 	"time"
 
+	"github.com/flant/dapp/pkg/dapp"
 	git_util "github.com/flant/dapp/pkg/git"
 	"github.com/flant/go-git/plumbing/filemode"
 	"github.com/flant/go-git/plumbing/object"
-	"github.com/flant/go-git/storage"
 	uuid "github.com/satori/go.uuid"
 )
 
 type Archive struct {
-	PathFilter git_util.PathFilter
-	Repo       struct {
-		Tree   *object.Tree
-		Storer storage.Storer
+	PathFilter     git_util.PathFilter
+	WithSubmodules bool
+	Repo           *repoHandle
+	Tree           *object.Tree
+	// ModTime of all entries is the commit time
+	ModTime time.Time
+	// Owner and Group of all entries are names or ids
+	Owner, Group string
+}
+
+func (a *Archive) walk(f func(t *repoTree, path string, entry *object.TreeEntry) error) error {
+	err := walkTreeEntries(a.Repo, a.Tree, "", a.PathFilter.BasePath, a.WithSubmodules, f)
+	if err == errStopWalk {
+		return nil
 	}
+	return err
 }
 
 func (a *Archive) Type() (ArchiveType, error) {
-	treeWalker := object.NewTreeWalker(a.Repo.Tree, true, nil)
-
 	basePath := git_util.NormalizeAbsolutePath(a.PathFilter.BasePath)
 
 	if basePath == "/" {
 		return DirectoryArchive, nil
 	}
 
-	for {
-		name, entry, err := treeWalker.Next()
-		if err == io.EOF {
-			break
+	var res ArchiveType
+	err := a.walk(func(_ *repoTree, path string, entry *object.TreeEntry) error {
+		switch {
+		case git_util.NormalizeAbsolutePath(path) == basePath && entry.Mode != filemode.Submodule:
+			res = FileArchive
+		case git_util.IsFileInBasePath(path, basePath):
+			res = DirectoryArchive
+		default:
+			return nil
 		}
+		return errStopWalk
+	})
+	if err != nil {
+		return "", err
+	}
 
-		if git_util.NormalizeAbsolutePath(name) == basePath {
-			if entry.Mode == filemode.Dir || entry.Mode == filemode.Submodule {
-				return DirectoryArchive, nil
-			}
-			return FileArchive, nil
-		}
+	if res == "" {
+		return "", fmt.Errorf("cannot find base path `%s` entry in repo", a.PathFilter.BasePath)
 	}
 
-	return "", fmt.Errorf("cannot find base path `%s` entry in repo", a.PathFilter.BasePath)
+	return res, nil
 }
 
 func startMemprofile() {
@@ -75,11 +94,10 @@ func (a *Archive) CreateTar(output io.Writer) error {
 	// defer stopMemprofile()
 
 	tw := tar.NewWriter(output)
-	treeWalker := object.NewTreeWalker(a.Repo.Tree, true, nil)
 
 	var err error
 
-	err = a.writeEntriesToArchive(tw, treeWalker)
+	err = a.writeEntriesToArchive(tw)
 	if err != nil {
 		return err
 	}
@@ -92,91 +110,65 @@ func (a *Archive) CreateTar(output io.Writer) error {
 	return nil
 }
 
-func (a *Archive) writeEntriesToArchive(tw *tar.Writer, treeWalker *object.TreeWalker) error {
-	now := time.Now()
-	chunkBuf := make([]byte, 16*1024*1024) // 16Mb chunk
+type archiveEntry struct {
+	Tree  *repoTree
+	Path  string
+	Entry *object.TreeEntry
+}
 
-	for {
-		name, entry, err := treeWalker.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
+// writeEntriesToArchive writes entries sorted by name with parent directories entries,
+// all headers have the same mtime and owner, so that archives of the same commit are identical
+func (a *Archive) writeEntriesToArchive(tw *tar.Writer) error {
+	// Directories are nil entries with trailing slash in the name
+	entries := make(map[string]*archiveEntry)
+	var names []string
 
-		if entry.Mode == filemode.Dir || entry.Mode == filemode.Submodule {
-			continue
+	err := a.walk(func(t *repoTree, name string, entry *object.TreeEntry) error {
+		if entry.Mode == filemode.Submodule {
+			return nil
 		}
 		if !a.PathFilter.IsFilePathValid(name) {
-			continue
-		}
-
-		// NOTICE: Current GetBlob implementation indirectly reading file content.
-		// NOTICE: Which cause big memory usage on big repos.
-		// NOTICE: Also this is a execution speed bottleneck for big repos.
-		// NOTICE: See go-git issue https://github.com/src-d/go-git/issues/832.
-		blob, err := object.GetBlob(a.Repo.Storer, entry.Hash)
-		if err != nil {
-			return err
-		}
-		blobReader, err := blob.Reader()
-		if err != nil {
-			return err
+			return nil
 		}
 
 		filename := a.PathFilter.TrimFileBasePath(name)
 
-		if entry.Mode == filemode.Symlink {
-			buf := bytes.Buffer{}
-			_, readErr := buf.ReadFrom(blobReader)
-			if readErr != nil {
-				return readErr
-			}
-			linkname := buf.String()
-
-			err = tw.WriteHeader(&tar.Header{
-				Format:     tar.FormatGNU,
-				Typeflag:   tar.TypeSymlink,
-				Name:       filename,
-				Mode:       int64(filemode.Symlink),
-				Linkname:   linkname,
-				Size:       blob.Size,
-				ModTime:    now,
-				AccessTime: now,
-				ChangeTime: now,
-			})
-			if err != nil {
-				return fmt.Errorf("unable to write tar symlink header: %s", err)
-			}
-		} else {
-			err = tw.WriteHeader(&tar.Header{
-				Format:     tar.FormatGNU,
-				Name:       filename,
-				Mode:       int64(entry.Mode),
-				Size:       blob.Size,
-				ModTime:    now,
-				AccessTime: now,
-				ChangeTime: now,
-			})
-			if err != nil {
-				return fmt.Errorf("unable to write tar header: %s", err)
+		for dir := path.Dir(filename); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			dirName := dir + "/"
+			if _, hasKey := entries[dirName]; hasKey {
+				break
 			}
+			entries[dirName] = nil
+			names = append(names, dirName)
+		}
 
-			err = ReadChunks(chunkBuf, blobReader, func(bytes []byte) error {
-				_, writeErr := tw.Write(bytes)
-				if writeErr != nil {
-					return fmt.Errorf("unable to write data to tar archive: %s", writeErr)
-				}
-				return nil
-			})
-			if err != nil {
-				return err
+		entries[filename] = &archiveEntry{Tree: t, Path: name, Entry: entry}
+		names = append(names, filename)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(names)
+
+	chunkBuf := make([]byte, 16*1024*1024) // 16Mb chunk
+
+	for _, name := range names {
+		if err := dapp.Context().Err(); err != nil {
+			return err
+		}
+
+		entry := entries[name]
+		if entry == nil {
+			if err := tw.WriteHeader(a.tarHeader(tar.TypeDir, name, 0755)); err != nil {
+				return fmt.Errorf("unable to write tar directory header: %s", err)
 			}
+			continue
 		}
 
-		err = blobReader.Close()
-		if err != nil {
+		if err := a.writeEntryToArchive(tw, chunkBuf, name, entry); err != nil {
 			return err
 		}
 	}
@@ -184,30 +176,131 @@ func (a *Archive) writeEntriesToArchive(tw *tar.Writer, treeWalker *object.TreeW
 	return nil
 }
 
+func (a *Archive) writeEntryToArchive(tw *tar.Writer, chunkBuf []byte, filename string, e *archiveEntry) error {
+	// NOTICE: Current GetBlob implementation indirectly reading file content.
+	// NOTICE: Which cause big memory usage on big repos.
+	// NOTICE: Also this is a execution speed bottleneck for big repos.
+	// NOTICE: See go-git issue https://github.com/src-d/go-git/issues/832.
+	// NOTICE: Git-lfs pointers of files selected by .gitattributes are replaced with objects content.
+	blobReader, size, err := e.Tree.openFile(e.Path, e.Entry)
+	if err != nil {
+		return err
+	}
+	defer blobReader.Close()
+
+	if e.Entry.Mode == filemode.Symlink {
+		buf := bytes.Buffer{}
+		_, readErr := buf.ReadFrom(blobReader)
+		if readErr != nil {
+			return readErr
+		}
+
+		header := a.tarHeader(tar.TypeSymlink, filename, 0777)
+		header.Linkname = buf.String()
+
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("unable to write tar symlink header: %s", err)
+		}
+
+		return nil
+	}
+
+	var mode int64 = 0644
+	if e.Entry.Mode == filemode.Executable {
+		mode = 0755
+	}
+
+	header := a.tarHeader(tar.TypeReg, filename, mode)
+	header.Size = size
+
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("unable to write tar header: %s", err)
+	}
+
+	return ReadChunks(chunkBuf, blobReader, func(bytes []byte) error {
+		_, writeErr := tw.Write(bytes)
+		if writeErr != nil {
+			return fmt.Errorf("unable to write data to tar archive: %s", writeErr)
+		}
+		return nil
+	})
+}
+
+// tarHeader sets owner and group ids or names: numeric values are ids
+func (a *Archive) tarHeader(typeflag byte, name string, mode int64) *tar.Header {
+	header := &tar.Header{
+		Format:   tar.FormatGNU,
+		Typeflag: typeflag,
+		Name:     name,
+		Mode:     mode,
+		ModTime:  a.ModTime,
+	}
+
+	if id, err := strconv.Atoi(a.Owner); err == nil {
+		header.Uid = id
+	} else {
+		header.Uname = a.Owner
+	}
+
+	if id, err := strconv.Atoi(a.Group); err == nil {
+		header.Gid = id
+	} else {
+		header.Gname = a.Group
+	}
+
+	return header
+}
+
 func (a *Archive) IsAnyEntries() (bool, error) {
-	treeWalker := object.NewTreeWalker(a.Repo.Tree, true, nil)
+	res := false
 
-	for {
-		name, entry, err := treeWalker.Next()
-		if err == io.EOF {
-			break
+	err := a.walk(func(_ *repoTree, name string, entry *object.TreeEntry) error {
+		if entry.Mode == filemode.Submodule {
+			return nil
 		}
-		if err != nil {
-			return false, err
+
+		if !a.PathFilter.IsFilePathValid(name) {
+			return nil
 		}
 
-		if entry.Mode == filemode.Dir || entry.Mode == filemode.Submodule {
-			continue
+		res = true
+		return errStopWalk
+	})
+
+	return res, err
+}
+
+// Checksum is calculated from paths relative to base path, modes and blob hashes of the filtered entries,
+// so it does not depend on commit and changes only when these entries are changed
+func (a *Archive) Checksum() (string, error) {
+	var lines []string
+
+	err := a.walk(func(_ *repoTree, name string, entry *object.TreeEntry) error {
+		if entry.Mode == filemode.Submodule {
+			return nil
 		}
 
 		if !a.PathFilter.IsFilePathValid(name) {
-			continue
+			return nil
 		}
 
-		return true, nil
+		// NOTICE: Blob hash of git-lfs pointer depends on object content, so objects are not read.
+		lines = append(lines, fmt.Sprintf("%s:::%o:::%s\n", a.PathFilter.TrimFileBasePath(name), uint32(entry.Mode), entry.Hash))
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sort.Strings(lines)
+
+	hash := sha256.New()
+	for _, line := range lines {
+		io.WriteString(hash, line)
 	}
 
-	return false, nil
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
 }
 
 func ReadChunks(chunkBuf []byte, reader io.Reader, handleChunk func(bytes []byte) error) error {
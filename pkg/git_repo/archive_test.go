@@ -0,0 +1,174 @@
+package git_repo
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	git "github.com/flant/go-git"
+	"github.com/flant/go-git/plumbing"
+)
+
+func TestCreateArchiveTar(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "dapp-archive-test-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+
+	repository, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit := commitTestFiles(t, repository, repoDir, map[string]*testFile{
+		"app/bin/run":         {"#!/bin/sh\n", 0755},
+		"app/lib/a/b/c.txt":   {"c\n", 0644},
+		"app/lib-readme.txt":  {"readme\n", 0644},
+		"app/lib/a/index.txt": {"index\n", 0644},
+	}, nil)
+
+	commitObj, err := repository.CommitObject(plumbing.NewHash(commit))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &Local{Base: Base{Name: "own"}, Path: repoDir, OrigPath: repoDir}
+	opts := ArchiveOptions{FilterOptions: FilterOptions{BasePath: "app"}, Commit: commit, Owner: "app", Group: "1000"}
+
+	var archive bytes.Buffer
+	if err := repo.CreateArchiveTar(&archive, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Second)
+
+	var otherArchive bytes.Buffer
+	if err := repo.CreateArchiveTar(&otherArchive, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(archive.Bytes(), otherArchive.Bytes()) {
+		t.Errorf("archives of the same commit should be identical")
+	}
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		names = append(names, header.Name)
+
+		if !header.ModTime.Equal(commitObj.Committer.When) {
+			t.Errorf("%s: mtime should be commit time %s, got %s", header.Name, commitObj.Committer.When, header.ModTime)
+		}
+		if header.Uname != "app" || header.Uid != 0 || header.Gname != "" || header.Gid != 1000 {
+			t.Errorf("%s: unexpected owner %s(%d):%s(%d)", header.Name, header.Uname, header.Uid, header.Gname, header.Gid)
+		}
+
+		var expectedMode int64 = 0644
+		switch header.Name {
+		case "bin/run":
+			expectedMode = 0755
+		case "bin/", "lib/", "lib/a/", "lib/a/b/":
+			expectedMode = 0755
+			if header.Typeflag != tar.TypeDir {
+				t.Errorf("%s: should be directory", header.Name)
+			}
+		}
+		if header.Mode != expectedMode {
+			t.Errorf("%s: expected mode %o, got %o", header.Name, expectedMode, header.Mode)
+		}
+	}
+
+	expectedNames := []string{"bin/", "bin/run", "lib-readme.txt", "lib/", "lib/a/", "lib/a/b/", "lib/a/b/c.txt", "lib/a/index.txt"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("expected entries %v, got %v", expectedNames, names)
+	}
+}
+
+func TestArchiveChecksum(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "dapp-archive-checksum-test-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+
+	repository, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &Local{Base: Base{Name: "own"}, Path: repoDir, OrigPath: repoDir}
+
+	checksum := func(commit string, filterOptions FilterOptions) string {
+		res, err := repo.ArchiveChecksum(ArchiveOptions{FilterOptions: filterOptions, Commit: commit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	filterOptions := FilterOptions{BasePath: "app", IncludePaths: []string{"src"}}
+
+	initialCommit := commitTestFiles(t, repository, repoDir, map[string]*testFile{
+		"app/src/main.txt": {"main\n", 0644},
+		"app/src/run.sh":   {"#!/bin/sh\n", 0644},
+		"app/README":       {"readme\n", 0644},
+		"other/src/x.txt":  {"x\n", 0644},
+	}, nil)
+	initialChecksum := checksum(initialCommit, filterOptions)
+
+	unrelatedCommit := commitTestFiles(t, repository, repoDir, map[string]*testFile{
+		"app/README":      {"changed readme\n", 0644},
+		"other/src/x.txt": {"changed x\n", 0644},
+	}, nil)
+	if res := checksum(unrelatedCommit, filterOptions); res != initialChecksum {
+		t.Errorf("checksum should not be changed by unrelated files")
+	}
+
+	modeCommit := commitTestFiles(t, repository, repoDir, map[string]*testFile{
+		"app/src/run.sh": {"#!/bin/sh\n", 0755},
+	}, nil)
+	modeChecksum := checksum(modeCommit, filterOptions)
+	if modeChecksum == initialChecksum {
+		t.Errorf("checksum should be changed by file mode")
+	}
+
+	contentCommit := commitTestFiles(t, repository, repoDir, map[string]*testFile{
+		"app/src/main.txt": {"changed main\n", 0644},
+	}, nil)
+	if res := checksum(contentCommit, filterOptions); res == modeChecksum {
+		t.Errorf("checksum should be changed by file content")
+	}
+
+	revertCommit := commitTestFiles(t, repository, repoDir, map[string]*testFile{
+		"app/src/main.txt": {"main\n", 0644},
+		"app/src/run.sh":   {"#!/bin/sh\n", 0644},
+	}, nil)
+	if res := checksum(revertCommit, filterOptions); res != initialChecksum {
+		t.Errorf("checksum should depend on files content rather than commit")
+	}
+
+	removeCommit := commitTestFiles(t, repository, repoDir, nil, []string{"app/src/run.sh"})
+	if res := checksum(removeCommit, filterOptions); res == initialChecksum {
+		t.Errorf("checksum should be changed by removed file")
+	}
+
+	if checksum(initialCommit, FilterOptions{BasePath: "app/src"}) == checksum(initialCommit, FilterOptions{BasePath: "other/src"}) {
+		t.Errorf("checksum should depend on files paths relative to base path")
+	}
+	if checksum(initialCommit, FilterOptions{BasePath: "app/src"}) == checksum(initialCommit, FilterOptions{BasePath: "app", IncludePaths: []string{"src"}}) {
+		t.Errorf("checksum should depend on files paths relative to base path")
+	}
+}
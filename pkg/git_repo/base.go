@@ -9,8 +9,6 @@ import (
 	git_util "github.com/flant/dapp/pkg/git" // Rename to "git" when go-git deleted
 	git "github.com/flant/go-git"
 	"github.com/flant/go-git/plumbing"
-	"github.com/flant/go-git/plumbing/object"
-	"github.com/flant/go-git/storage"
 )
 
 type Base struct {
@@ -52,8 +50,8 @@ func (repo *Base) getReferenceForRepo(repoPath string) (*plumbing.Reference, err
 	return repository.Head()
 }
 
-func (repo *Base) archiveType(repoPath string, opts ArchiveOptions) (ArchiveType, error) {
-	archive, err := repo.createArchiveObject(repoPath, opts)
+func (repo *Base) archiveType(h *repoHandle, opts ArchiveOptions) (ArchiveType, error) {
+	archive, err := repo.createArchiveObject(h, opts)
 	if err != nil {
 		return "", err
 	}
@@ -102,70 +100,96 @@ func (repo *Base) CreateArchiveTar(io.Writer, ArchiveOptions) error {
 }
 
 func (repo *Base) ArchiveChecksum(ArchiveOptions) (string, error) {
+	return "", fmt.Errorf("archive checksum is not supported by git repo `%s`", repo.Name)
+}
+
+func (repo *Base) IsCommitExists(commit string) (bool, error) {
 	panic("not implemented")
 }
 
-func (repo *Base) createPatch(repoPath string, opts PatchOptions) (Patch, error) {
+func (repo *Base) isCommitExists(repoPath, commit string) (bool, error) {
 	repository, err := git.PlainOpen(repoPath)
 	if err != nil {
-		return nil, fmt.Errorf("cannot open repo: %s", err)
+		return false, fmt.Errorf("cannot open repo: %s", err)
 	}
 
-	fromHash := plumbing.NewHash(opts.FromCommit)
-	_, err = repository.CommitObject(fromHash)
-	if err != nil {
-		return nil, fmt.Errorf("bad `from` commit `%s`: %s", opts.FromCommit, err)
+	_, err = repository.CommitObject(plumbing.NewHash(commit))
+	if err == plumbing.ErrObjectNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("cannot get commit `%s`: %s", commit, err)
 	}
 
-	toHash := plumbing.NewHash(opts.ToCommit)
-	_, err = repository.CommitObject(toHash)
+	return true, nil
+}
+
+func (repo *Base) ResolveCommit(commit string) (string, error) {
+	panic("not implemented")
+}
+
+// resolveCommit returns full id of the commit, which may be abbreviated,
+// empty string is returned when commit is not found
+func (repo *Base) resolveCommit(repoPath, commit string) (string, error) {
+	commit = strings.ToLower(commit)
+
+	if len(commit) < 4 || len(commit) > 40 || strings.Trim(commit, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("bad commit `%s`: full or abbreviated commit id of at least 4 hex digits expected", commit)
+	}
+
+	if len(commit) == 40 {
+		exists, err := repo.isCommitExists(repoPath, commit)
+		if err != nil || !exists {
+			return "", err
+		}
+		return commit, nil
+	}
+
+	repository, err := git.PlainOpen(repoPath)
 	if err != nil {
-		return nil, fmt.Errorf("bad `to` commit `%s`: %s", opts.ToCommit, err)
+		return "", fmt.Errorf("cannot open repo: %s", err)
 	}
 
+	return resolveCommitPrefix(repository, commit)
+}
+
+func (repo *Base) createPatch(h *repoHandle, opts PatchOptions) (Patch, error) {
 	patch := NewTmpPatchFile()
 
-	fileFandler, err := os.OpenFile(patch.GetFilePath(), os.O_RDWR|os.O_CREATE, 0755)
+	fileHandler, err := os.OpenFile(patch.GetFilePath(), os.O_RDWR|os.O_CREATE, 0755)
 	if err != nil {
+		patch.Remove()
 		return nil, fmt.Errorf("cannot open patch file: %s", err)
 	}
 
-	err = git_util.Diff(fileFandler, repoPath, git_util.DiffOptions{
-		FromCommit: opts.FromCommit,
-		ToCommit:   opts.ToCommit,
-		PathFilter: git_util.PathFilter{
-			BasePath:     opts.BasePath,
-			IncludePaths: opts.IncludePaths,
-			ExcludePaths: opts.ExcludePaths,
-		},
-	})
+	err = writePatch(fileHandler, h, opts.FromCommit, opts.ToCommit, git_util.PathFilter{
+		BasePath:     opts.BasePath,
+		IncludePaths: opts.IncludePaths,
+		ExcludePaths: opts.ExcludePaths,
+	}, opts.WithSubmodules, patchRenameMode(opts))
 	if err != nil {
+		fileHandler.Close()
+		patch.Remove()
 		return nil, fmt.Errorf("error creating diff between `%s` and `%s` commits: %s", opts.FromCommit, opts.ToCommit, err)
 	}
 
-	err = fileFandler.Close()
+	err = fileHandler.Close()
 	if err != nil {
+		patch.Remove()
 		return nil, fmt.Errorf("error creating diff file: %s", err)
 	}
 
 	return patch, nil
 }
 
-func (repo *Base) createArchiveObject(repoPath string, opts ArchiveOptions) (*Archive, error) {
-	repository, err := git.PlainOpen(repoPath)
-	if err != nil {
-		return nil, fmt.Errorf("cannot open repo: %s", err)
-	}
-
-	commitHash := plumbing.NewHash(opts.Commit)
-	commitObj, err := repository.CommitObject(commitHash)
+func (repo *Base) createArchiveObject(h *repoHandle, opts ArchiveOptions) (*Archive, error) {
+	commit, err := h.Repository.CommitObject(plumbing.NewHash(opts.Commit))
 	if err != nil {
 		return nil, fmt.Errorf("bad commit `%s`: %s", opts.Commit, err)
 	}
 
-	tree, err := commitObj.Tree()
+	tree, err := commit.Tree()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("bad commit `%s`: %s", opts.Commit, err)
 	}
 
 	archive := &Archive{
@@ -174,17 +198,19 @@ func (repo *Base) createArchiveObject(repoPath string, opts ArchiveOptions) (*Ar
 			IncludePaths: opts.IncludePaths,
 			ExcludePaths: opts.ExcludePaths,
 		},
-		Repo: struct {
-			Tree   *object.Tree
-			Storer storage.Storer
-		}{tree, repository.Storer},
+		WithSubmodules: opts.WithSubmodules,
+		Repo:           h,
+		Tree:           tree,
+		ModTime:        commit.Committer.When,
+		Owner:          opts.Owner,
+		Group:          opts.Group,
 	}
 
 	return archive, nil
 }
 
-func (repo *Base) isAnyEntries(repoPath string, opts ArchiveOptions) (bool, error) {
-	archiveObj, err := repo.createArchiveObject(repoPath, opts)
+func (repo *Base) isAnyEntries(h *repoHandle, opts ArchiveOptions) (bool, error) {
+	archiveObj, err := repo.createArchiveObject(h, opts)
 	if err != nil {
 		return false, err
 	}
@@ -197,11 +223,20 @@ func (repo *Base) isAnyEntries(repoPath string, opts ArchiveOptions) (bool, erro
 	return res, nil
 }
 
-func (repo *Base) createArchiveTar(repoPath string, output io.Writer, opts ArchiveOptions) error {
-	archiveObj, err := repo.createArchiveObject(repoPath, opts)
+func (repo *Base) createArchiveTar(h *repoHandle, output io.Writer, opts ArchiveOptions) error {
+	archiveObj, err := repo.createArchiveObject(h, opts)
 	if err != nil {
 		return err
 	}
 
 	return archiveObj.CreateTar(output)
 }
+
+func (repo *Base) archiveChecksum(h *repoHandle, opts ArchiveOptions) (string, error) {
+	archiveObj, err := repo.createArchiveObject(h, opts)
+	if err != nil {
+		return "", err
+	}
+
+	return archiveObj.Checksum()
+}
@@ -0,0 +1,40 @@
+package git_repo
+
+import "fmt"
+
+type ReferenceNotFoundError struct {
+	Repo string
+	Kind string // branch or tag
+	Name string
+}
+
+func (e *ReferenceNotFoundError) Error() string {
+	return fmt.Sprintf("unknown %s `%s` of repo `%s`", e.Kind, e.Name, e.Repo)
+}
+
+func (e *ReferenceNotFoundError) ErrorCode() string {
+	return "git_reference_not_found"
+}
+
+func (e *ReferenceNotFoundError) ErrorData() map[string]interface{} {
+	return map[string]interface{}{"repo": e.Repo, "kind": e.Kind, "name": e.Name}
+}
+
+// RemoteError means that remote repo cannot be cloned or fetched, e.g. because of network or auth problems
+type RemoteError struct {
+	Repo      string
+	Operation string // clone, fetch or deepen
+	Err       error
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("cannot %s remote git repo `%s`: %s", e.Operation, e.Repo, e.Err)
+}
+
+func (e *RemoteError) ErrorCode() string {
+	return "git_remote_failed"
+}
+
+func (e *RemoteError) ErrorData() map[string]interface{} {
+	return map[string]interface{}{"repo": e.Repo, "operation": e.Operation}
+}
@@ -7,16 +7,23 @@ import (
 type FilterOptions struct {
 	BasePath                   string
 	IncludePaths, ExcludePaths []string
+	// WithSubmodules enables files of submodules at the pinned commits in archives and patches
+	WithSubmodules bool
 }
 
 type PatchOptions struct {
 	FilterOptions
 	FromCommit, ToCommit string
+	// DetectRenames pairs removed and added files into renames, DetectCopies also pairs
+	// added files with modified ones into copies, pairs crossing filter paths are not detected
+	DetectRenames, DetectCopies bool
 }
 
 type ArchiveOptions struct {
 	FilterOptions
 	Commit string
+	// Owner and Group are user and group names or ids of archive entries, root is used by default
+	Owner, Group string
 }
 
 type ArchiveType string
@@ -29,6 +36,8 @@ const (
 type Patch interface {
 	GetFilePath() string
 	IsEmpty() (bool, error)
+	// Remove removes temporary patch file
+	Remove() error
 }
 
 type GitRepo interface {
@@ -38,6 +47,9 @@ type GitRepo interface {
 	HeadBranchName() (string, error)
 	LatestBranchCommit(branch string) (string, error)
 	LatestTagCommit(tag string) (string, error)
+	IsCommitExists(commit string) (bool, error)
+	// ResolveCommit returns full id of the abbreviated commit, empty string means that commit is not found
+	ResolveCommit(commit string) (string, error)
 
 	CreatePatch(PatchOptions) (Patch, error)
 
@@ -45,5 +57,5 @@ type GitRepo interface {
 	ArchiveType(ArchiveOptions) (ArchiveType, error)
 	IsAnyEntries(ArchiveOptions) (bool, error)
 	CreateArchiveTar(io.Writer, ArchiveOptions) error
-	ArchiveChecksum(ArchiveOptions) (string, error) // TODO
+	ArchiveChecksum(ArchiveOptions) (string, error)
 }
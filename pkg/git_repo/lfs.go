@@ -0,0 +1,288 @@
+package git_repo
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/flant/go-git/plumbing"
+	"github.com/flant/go-git/plumbing/filemode"
+	"github.com/flant/go-git/plumbing/object"
+)
+
+// lfsPointerMaxSize is the same as in git-lfs: bigger blobs are never pointers
+const lfsPointerMaxSize = 1024
+
+var (
+	lfsPointerVersions = []string{
+		"version https://git-lfs.github.com/spec/v1",
+		"version https://hawser.github.com/spec/v1",
+	}
+	lfsOidRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+type lfsPointer struct {
+	Oid  string
+	Size int64
+}
+
+// parseLfsPointer returns nil when content is not a valid git-lfs pointer
+func parseLfsPointer(content []byte) *lfsPointer {
+	if len(content) >= lfsPointerMaxSize {
+		return nil
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) < 3 {
+		return nil
+	}
+
+	isVersionValid := false
+	for _, version := range lfsPointerVersions {
+		if lines[0] == version {
+			isVersionValid = true
+			break
+		}
+	}
+	if !isVersionValid {
+		return nil
+	}
+
+	pointer := &lfsPointer{Size: -1}
+	for _, line := range lines[1:] {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+
+		switch parts[0] {
+		case "oid":
+			oid := strings.TrimPrefix(parts[1], "sha256:")
+			if oid == parts[1] || !lfsOidRegexp.MatchString(oid) {
+				return nil
+			}
+			pointer.Oid = oid
+		case "size":
+			size, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil || size < 0 {
+				return nil
+			}
+			pointer.Size = size
+		}
+	}
+
+	if pointer.Oid == "" || pointer.Size < 0 {
+		return nil
+	}
+
+	return pointer
+}
+
+// lfsObjectPath is the path of the object in the local git-lfs store of the repo
+func (h *repoHandle) lfsObjectPath(pointer *lfsPointer) string {
+	return filepath.Join(h.GitDir, "lfs", "objects", pointer.Oid[0:2], pointer.Oid[2:4], pointer.Oid)
+}
+
+func (h *repoHandle) openLfsObject(path string, pointer *lfsPointer) (*os.File, error) {
+	objectPath := h.lfsObjectPath(pointer)
+
+	f, err := os.Open(objectPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("git-lfs object `%s` of `%s` is not found in repo `%s`: run `git lfs fetch` to download it", pointer.Oid, path, h.Name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if fi.Size() != pointer.Size {
+		f.Close()
+		return nil, fmt.Errorf("git-lfs object `%s` of `%s` in repo `%s` is corrupted: expected size %d, got %d", pointer.Oid, path, h.Name, pointer.Size, fi.Size())
+	}
+
+	return f, nil
+}
+
+// repoTree is the root tree of the repo or submodule commit, files of the tree are read with its git attributes
+type repoTree struct {
+	Repo *repoHandle
+	Tree *object.Tree
+	// Prefix is the path of submodule in paths of files, it is empty for the repo
+	Prefix string
+
+	attributes map[string][]*lfsAttributeRule
+}
+
+func newRepoTree(h *repoHandle, tree *object.Tree, prefix string) *repoTree {
+	return &repoTree{Repo: h, Tree: tree, Prefix: prefix}
+}
+
+// isLfsFile tells whether .gitattributes files of the tree select git-lfs filter for the file,
+// deeper .gitattributes files and later lines override the others as in git
+func (t *repoTree) isLfsFile(path string) (bool, error) {
+	if t.Tree == nil {
+		return false, nil
+	}
+
+	relPath := strings.TrimPrefix(path, t.Prefix)
+
+	dirs := []string{""}
+	parts := strings.Split(relPath, "/")
+	for i := range parts[:len(parts)-1] {
+		dirs = append(dirs, strings.Join(parts[:i+1], "/"))
+	}
+
+	res := false
+	for _, dir := range dirs {
+		rules, err := t.attributeRules(dir)
+		if err != nil {
+			return false, err
+		}
+
+		dirRelPath := relPath
+		if dir != "" {
+			dirRelPath = strings.TrimPrefix(relPath, dir+"/")
+		}
+
+		for _, rule := range rules {
+			if rule.match(dirRelPath) {
+				res = rule.isLfs
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (t *repoTree) attributeRules(dir string) ([]*lfsAttributeRule, error) {
+	if rules, hasKey := t.attributes[dir]; hasKey {
+		return rules, nil
+	}
+
+	attributesPath := ".gitattributes"
+	if dir != "" {
+		attributesPath = dir + "/.gitattributes"
+	}
+
+	var rules []*lfsAttributeRule
+
+	// NOTICE: Symlinked .gitattributes is not followed, the same as git does.
+	entry, err := t.Tree.FindEntry(attributesPath)
+	if err == nil && (entry.Mode == filemode.Regular || entry.Mode == filemode.Executable) {
+		content, err := t.readBlob(entry)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read `%s`: %s", t.Prefix+attributesPath, err)
+		}
+		rules = parseLfsAttributeRules(string(content))
+	} else if err != nil && err != object.ErrEntryNotFound && err != object.ErrDirectoryNotFound {
+		return nil, fmt.Errorf("cannot read `%s`: %s", t.Prefix+attributesPath, err)
+	}
+
+	if t.attributes == nil {
+		t.attributes = make(map[string][]*lfsAttributeRule)
+	}
+	t.attributes[dir] = rules
+
+	return rules, nil
+}
+
+func (t *repoTree) readBlob(entry *object.TreeEntry) ([]byte, error) {
+	blob, err := t.Repo.Repository.BlobObject(entry.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// openFile returns reader and size of file content, git-lfs pointers of regular files are replaced with objects content
+func (t *repoTree) openFile(path string, entry *object.TreeEntry) (io.ReadCloser, int64, error) {
+	reader, size, _, err := t.openFileContent(path, entry)
+	return reader, size, err
+}
+
+// openFileContent resolves pointers of files selected by git-lfs filter only, other files are read as is
+func (t *repoTree) openFileContent(path string, entry *object.TreeEntry) (io.ReadCloser, int64, *lfsPointer, error) {
+	h := t.Repo
+
+	blob, err := h.Repository.BlobObject(entry.Hash)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if entry.Mode == filemode.Symlink || blob.Size >= lfsPointerMaxSize {
+		return reader, blob.Size, nil, nil
+	}
+
+	isLfs, err := t.isLfsFile(path)
+	if err != nil {
+		reader.Close()
+		return nil, 0, nil, err
+	}
+	if !isLfs {
+		return reader, blob.Size, nil, nil
+	}
+
+	content, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	pointer := parseLfsPointer(content)
+	if pointer == nil {
+		return ioutil.NopCloser(bytes.NewReader(content)), blob.Size, nil, nil
+	}
+
+	f, err := h.openLfsObject(path, pointer)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{bufio.NewReader(f), f}, pointer.Size, pointer, nil
+}
+
+// readFile returns file content and git hash of the content, which differs from the entry hash for git-lfs files
+func (t *repoTree) readFile(path string, entry *object.TreeEntry) ([]byte, plumbing.Hash, error) {
+	reader, _, pointer, err := t.openFileContent(path, entry)
+	if err != nil {
+		return nil, plumbing.ZeroHash, err
+	}
+	defer reader.Close()
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, plumbing.ZeroHash, err
+	}
+
+	if pointer == nil {
+		return content, entry.Hash, nil
+	}
+
+	return content, plumbing.ComputeHash(plumbing.BlobObject, content), nil
+}
@@ -0,0 +1,64 @@
+package git_repo
+
+import (
+	"path"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+// lfsAttributeRule is a line of .gitattributes file, which sets or unsets filter attribute
+type lfsAttributeRule struct {
+	pattern string
+	isLfs   bool
+}
+
+// parseLfsAttributeRules returns rules of filter attribute in the order of lines,
+// macros and quoted patterns are not supported
+func parseLfsAttributeRules(content string) []*lfsAttributeRule {
+	var rules []*lfsAttributeRule
+
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "[attr]") || strings.HasPrefix(fields[0], "\"") {
+			continue
+		}
+
+		// Directory patterns do not match files in git attributes
+		if strings.HasSuffix(fields[0], "/") {
+			continue
+		}
+
+		var rule *lfsAttributeRule
+		for _, attr := range fields[1:] {
+			switch {
+			case attr == "filter=lfs":
+				rule = &lfsAttributeRule{pattern: fields[0], isLfs: true}
+			case attr == "filter" || attr == "-filter" || attr == "!filter" || strings.HasPrefix(attr, "filter="):
+				rule = &lfsAttributeRule{pattern: fields[0]}
+			}
+		}
+
+		if rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// match checks path relative to the directory of .gitattributes file: pattern without slash matches file name
+// at any depth, other patterns match the whole path
+func (r *lfsAttributeRule) match(relPath string) bool {
+	pattern := r.pattern
+	target := relPath
+
+	if !strings.Contains(pattern, "/") {
+		target = path.Base(relPath)
+	} else {
+		pattern = strings.TrimPrefix(pattern, "/")
+	}
+
+	matched, err := doublestar.Match(pattern, target)
+	return err == nil && matched
+}
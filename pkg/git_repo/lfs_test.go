@@ -0,0 +1,177 @@
+package git_repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	git "github.com/flant/go-git"
+)
+
+func lfsPointerContent(content []byte) (string, string) {
+	oid := fmt.Sprintf("%x", sha256.Sum256(content))
+	return oid, fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n", oid, len(content))
+}
+
+func storeLfsObject(t *testing.T, repoDir string, content []byte) string {
+	oid, pointer := lfsPointerContent(content)
+
+	objectPath := filepath.Join(repoDir, ".git", "lfs", "objects", oid[0:2], oid[2:4], oid)
+	if err := os.MkdirAll(filepath.Dir(objectPath), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(objectPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return pointer
+}
+
+func TestParseLfsPointer(t *testing.T) {
+	oid, pointer := lfsPointerContent([]byte("data"))
+
+	if p := parseLfsPointer([]byte(pointer)); p == nil || p.Oid != oid || p.Size != 4 {
+		t.Errorf("pointer is not parsed: %#v", p)
+	}
+
+	for _, content := range []string{
+		"",
+		"plain text\n",
+		strings.Replace(pointer, "sha256:", "sha1:", 1),
+		strings.Replace(pointer, "size 4", "size -4", 1),
+		strings.Replace(pointer, "git-lfs.github.com", "example.com", 1),
+	} {
+		if p := parseLfsPointer([]byte(content)); p != nil {
+			t.Errorf("%q should not be parsed as pointer", content)
+		}
+	}
+}
+
+func TestLfs(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "dapp-lfs-test-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+
+	repository, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v1 := append(bytes.Repeat([]byte("logo v1 "), 500), 0)
+	v2 := append(bytes.Repeat([]byte("logo v2 "), 600), 0)
+
+	_, notLfsPointer := lfsPointerContent([]byte("not lfs"))
+
+	fromCommit := commitTestFiles(t, repository, repoDir, map[string]*testFile{
+		".gitattributes":           {"*.bin filter=lfs diff=lfs merge=lfs -text\n", 0644},
+		"assets/.gitattributes":    {"plain/*.bin -filter\n", 0644},
+		"assets/logo.bin":          {storeLfsObject(t, repoDir, v1), 0644},
+		"assets/readme.txt":        {"readme\n", 0644},
+		"assets/pointer.txt":       {notLfsPointer, 0644},
+		"assets/plain/pointer.bin": {notLfsPointer, 0644},
+	}, nil)
+	toCommit := commitTestFiles(t, repository, repoDir, map[string]*testFile{
+		"assets/logo.bin": {storeLfsObject(t, repoDir, v2), 0644},
+	}, nil)
+
+	_, missingPointer := lfsPointerContent([]byte("missing"))
+	missingCommit := commitTestFiles(t, repository, repoDir, map[string]*testFile{
+		"assets/logo.bin": {missingPointer, 0644},
+	}, nil)
+
+	repo := &Local{Base: Base{Name: "own"}, Path: repoDir, OrigPath: repoDir}
+	filterOptions := FilterOptions{BasePath: "assets"}
+
+	var archive bytes.Buffer
+	if err := repo.CreateArchiveTar(&archive, ArchiveOptions{FilterOptions: filterOptions, Commit: fromCommit}); err != nil {
+		t.Fatal(err)
+	}
+
+	files := tarFiles(t, archive.Bytes())
+	if files["logo.bin"] != string(v1) {
+		t.Errorf("archive should contain git-lfs object content instead of pointer, got %q", files["logo.bin"])
+	}
+	if files["readme.txt"] != "readme\n" {
+		t.Errorf("unexpected readme.txt content %q", files["readme.txt"])
+	}
+	if files["pointer.txt"] != notLfsPointer || files["plain/pointer.bin"] != notLfsPointer {
+		t.Errorf("pointers of files without git-lfs filter should not be resolved, got %q and %q", files["pointer.txt"], files["plain/pointer.bin"])
+	}
+
+	patch, err := repo.CreatePatch(PatchOptions{FilterOptions: filterOptions, FromCommit: fromCommit, ToCommit: toCommit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer patch.Remove()
+
+	err = repo.CreateArchiveTar(ioutil.Discard, ArchiveOptions{FilterOptions: filterOptions, Commit: missingCommit})
+	if err == nil || !strings.Contains(err.Error(), "git lfs fetch") {
+		t.Errorf("missing git-lfs object should fail archive clearly, got %v", err)
+	}
+
+	_, err = repo.CreatePatch(PatchOptions{FilterOptions: filterOptions, FromCommit: toCommit, ToCommit: missingCommit})
+	if err == nil || !strings.Contains(err.Error(), "git lfs fetch") {
+		t.Errorf("missing git-lfs object should fail patch clearly, got %v", err)
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available, patch is not applied")
+	}
+
+	applyDir, err := ioutil.TempDir("", "dapp-lfs-test-apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(applyDir)
+
+	writeTestFiles(t, applyDir, map[string]*testFile{"logo.bin": {string(v1), 0644}})
+
+	cmd := exec.Command("git", "apply", patch.GetFilePath())
+	cmd.Dir = applyDir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git apply failed: %s\n%s", err, output)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(applyDir, "logo.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, v2) {
+		t.Errorf("patch should change git-lfs object content")
+	}
+}
+
+func TestLfsAttributeRule_Match(t *testing.T) {
+	rules := parseLfsAttributeRules("# comment\n*.bin filter=lfs\n/top.dat filter=lfs\ndata/**/*.csv filter=lfs -text\nbuild/ filter=lfs\n*.txt text\n\"quoted name\" filter=lfs\n")
+	if len(rules) != 3 {
+		t.Fatalf("unexpected rules %v", rules)
+	}
+
+	for path, expected := range map[string]bool{
+		"logo.bin":          true,
+		"assets/logo.bin":   true,
+		"top.dat":           true,
+		"assets/top.dat":    false,
+		"data/a/b/file.csv": true,
+		"data/file.csv":     true,
+		"other/file.csv":    false,
+	} {
+		matched := false
+		for _, rule := range rules {
+			if rule.match(path) {
+				matched = rule.isLfs
+			}
+		}
+		if matched != expected {
+			t.Errorf("%s: expected git-lfs filter %v, got %v", path, expected, matched)
+		}
+	}
+}
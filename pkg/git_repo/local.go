@@ -9,9 +9,19 @@ type Local struct {
 	Base
 	Path     string
 	OrigPath string
+	// DevMode makes HEAD commit a snapshot of the working tree with uncommitted changes of tracked files
+	DevMode bool
+	// DevModeUntracked adds untracked files, which are not ignored, to the snapshot
+	DevModeUntracked bool
+
+	workingTreeCommit string
 }
 
 func (repo *Local) HeadCommit() (string, error) {
+	if repo.DevMode {
+		return repo.WorkingTreeCommit()
+	}
+
 	commit, err := repo.getHeadCommitForRepo(repo.Path)
 
 	if err == nil {
@@ -21,18 +31,75 @@ func (repo *Local) HeadCommit() (string, error) {
 	return commit, err
 }
 
+// WorkingTreeCommit returns commit of the working tree snapshot, snapshot is made once
+func (repo *Local) WorkingTreeCommit() (string, error) {
+	if repo.workingTreeCommit != "" {
+		return repo.workingTreeCommit, nil
+	}
+
+	snapshot := &workingTreeSnapshot{Path: repo.Path, WithUntracked: repo.DevModeUntracked}
+
+	commit, err := snapshot.Commit()
+	if err != nil {
+		return "", fmt.Errorf("cannot snapshot working tree of repo `%s`: %s", repo.String(), err)
+	}
+
+	fmt.Printf("Using working tree snapshot commit `%s` of repo `%s`\n", commit, repo.String())
+
+	repo.workingTreeCommit = commit
+
+	return commit, nil
+}
+
+func (repo *Local) IsCommitExists(commit string) (bool, error) {
+	return repo.isCommitExists(repo.Path, commit)
+}
+
+func (repo *Local) ResolveCommit(commit string) (string, error) {
+	return repo.resolveCommit(repo.Path, commit)
+}
+
+// openHandle opens the repo, submodules of local repo are not cloned and should be initialized by user
+func (repo *Local) openHandle() (*repoHandle, error) {
+	return openRepoHandle(repo.String(), repo.Path, "", false)
+}
+
 func (repo *Local) CreatePatch(opts PatchOptions) (Patch, error) {
-	return repo.createPatch(repo.Path, opts)
+	h, err := repo.openHandle()
+	if err != nil {
+		return nil, err
+	}
+	return repo.createPatch(h, opts)
 }
 
 func (repo *Local) ArchiveType(opts ArchiveOptions) (ArchiveType, error) {
-	return repo.archiveType(repo.Path, opts)
+	h, err := repo.openHandle()
+	if err != nil {
+		return "", err
+	}
+	return repo.archiveType(h, opts)
 }
 
 func (repo *Local) IsAnyEntries(opts ArchiveOptions) (bool, error) {
-	return repo.isAnyEntries(repo.Path, opts)
+	h, err := repo.openHandle()
+	if err != nil {
+		return false, err
+	}
+	return repo.isAnyEntries(h, opts)
 }
 
 func (repo *Local) CreateArchiveTar(output io.Writer, opts ArchiveOptions) error {
-	return repo.createArchiveTar(repo.Path, output, opts)
+	h, err := repo.openHandle()
+	if err != nil {
+		return err
+	}
+	return repo.createArchiveTar(h, output, opts)
+}
+
+func (repo *Local) ArchiveChecksum(opts ArchiveOptions) (string, error) {
+	h, err := repo.openHandle()
+	if err != nil {
+		return "", err
+	}
+	return repo.archiveChecksum(h, opts)
 }
@@ -0,0 +1,685 @@
+package git_repo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/flant/dapp/pkg/dapp"
+	git_util "github.com/flant/dapp/pkg/git"
+	"github.com/flant/go-git/plumbing"
+	"github.com/flant/go-git/plumbing/filemode"
+	"github.com/flant/go-git/plumbing/object"
+	"github.com/flant/go-git/utils/merkletrie"
+)
+
+const (
+	patchContextLines = 3
+	// binaryCheckSize is the same as in git buffer_is_binary
+	binaryCheckSize = 8000
+	// maxDiffCost limits the number of edits in lines diff, which keeps about maxDiffCost^2 ints in memory,
+	// changed part of the file is replaced as a whole when exceeded
+	maxDiffCost = 2048
+)
+
+var zeroHash = strings.Repeat("0", 40)
+
+// writePatch writes diff between commits in the format of `git diff --binary --no-renames`
+// or with renames and copies of files without git cli, paths are filtered and trimmed by PathFilter
+func writePatch(out io.Writer, h *repoHandle, fromCommit, toCommit string, filter git_util.PathFilter, withSubmodules bool, renames renameMode) error {
+	fromTree, err := h.commitTree(plumbing.NewHash(fromCommit))
+	if err != nil {
+		return fmt.Errorf("bad `from` commit `%s`: %s", fromCommit, err)
+	}
+
+	toTree, err := h.commitTree(plumbing.NewHash(toCommit))
+	if err != nil {
+		return fmt.Errorf("bad `to` commit `%s`: %s", toCommit, err)
+	}
+
+	w := &patchWriter{out: out, filter: filter, withSubmodules: withSubmodules, renames: renames}
+
+	return w.writeTreesDiff(h, fromTree, h, toTree, "")
+}
+
+type patchWriter struct {
+	out            io.Writer
+	filter         git_util.PathFilter
+	withSubmodules bool
+	renames        renameMode
+}
+
+func (w *patchWriter) printf(format string, args ...interface{}) error {
+	_, err := fmt.Fprintf(w.out, format, args...)
+	return err
+}
+
+// writeTreesDiff writes diff of root trees of repos, trees of submodules are nil when submodule is added or removed
+func (w *patchWriter) writeTreesDiff(fromRepo *repoHandle, fromTree *object.Tree, toRepo *repoHandle, toTree *object.Tree, prefix string) error {
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return fmt.Errorf("cannot diff trees: %s", err)
+	}
+
+	fromRoot := newRepoTree(fromRepo, fromTree, prefix)
+	toRoot := newRepoTree(toRepo, toTree, prefix)
+
+	// Files are not paired when submodule is added or removed
+	var pairs map[string]*renamePair
+	var renamed map[string]bool
+	if w.renames != noRenames && fromTree != nil && toTree != nil {
+		pairs, renamed, err = w.findRenames(fromRoot, toRoot, changes, prefix)
+		if err != nil {
+			return fmt.Errorf("cannot detect renames: %s", err)
+		}
+	}
+
+	for _, change := range changes {
+		if err := dapp.Context().Err(); err != nil {
+			return err
+		}
+
+		action, err := change.Action()
+		if err != nil {
+			return err
+		}
+
+		var from, to *object.TreeEntry
+		name := change.To.Name
+		if action != merkletrie.Insert {
+			from = &change.From.TreeEntry
+			name = change.From.Name
+		}
+		if action != merkletrie.Delete {
+			to = &change.To.TreeEntry
+		}
+		path := prefix + name
+
+		fromSubmodule := from != nil && from.Mode == filemode.Submodule
+		toSubmodule := to != nil && to.Mode == filemode.Submodule
+
+		switch {
+		case fromSubmodule || toSubmodule:
+			// NOTICE: Submodules changes are skipped without submodules mode as `git diff --submodule=log` does.
+			if !w.withSubmodules {
+				continue
+			}
+
+			// Type change between file and submodule is split into file and submodule diffs
+			if w.filter.IsFilePathValid(path) {
+				if from != nil && !fromSubmodule {
+					err = w.writeFileDiff(path, fromRoot, from, nil, nil)
+				} else if to != nil && !toSubmodule {
+					err = w.writeFileDiff(path, nil, nil, toRoot, to)
+				}
+			}
+
+			if err == nil {
+				err = w.writeSubmoduleDiff(path, name, fromRepo, fromTree, from, toRepo, toTree, to)
+			}
+		case !w.filter.IsFilePathValid(path):
+			continue
+		case to == nil && renamed[path]:
+			continue
+		case from == nil && pairs[path] != nil:
+			pair := pairs[path]
+			err = w.writeFilePairDiff(pair.fromPath, path, fromRoot, pair.from, toRoot, to, pair)
+		case from == nil || to == nil:
+			err = w.writeFileDiff(path, fromRoot, from, toRoot, to)
+		case (from.Mode == filemode.Symlink) != (to.Mode == filemode.Symlink):
+			// Type change is split into deletion and creation as git does
+			if err = w.writeFileDiff(path, fromRoot, from, nil, nil); err == nil {
+				err = w.writeFileDiff(path, nil, nil, toRoot, to)
+			}
+		default:
+			err = w.writeFileDiff(path, fromRoot, from, toRoot, to)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot write diff of `%s`: %s", path, err)
+		}
+	}
+
+	return nil
+}
+
+// writeSubmoduleDiff writes diff of files of submodule between the pinned commits
+func (w *patchWriter) writeSubmoduleDiff(path, name string, fromRepo *repoHandle, fromTree *object.Tree, from *object.TreeEntry, toRepo *repoHandle, toTree *object.Tree, to *object.TreeEntry) error {
+	if !isSubmoduleInBasePath(path, w.filter.BasePath) {
+		return nil
+	}
+
+	openSubmodule := func(h *repoHandle, tree *object.Tree, entry *object.TreeEntry) (*repoHandle, *object.Tree, error) {
+		if entry == nil || entry.Mode != filemode.Submodule {
+			return nil, nil, nil
+		}
+
+		sub, err := h.openSubmodule(tree, name, entry.Hash)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		subTree, err := sub.commitTree(entry.Hash)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return sub, subTree, nil
+	}
+
+	fromSub, fromSubTree, err := openSubmodule(fromRepo, fromTree, from)
+	if err != nil {
+		return err
+	}
+
+	toSub, toSubTree, err := openSubmodule(toRepo, toTree, to)
+	if err != nil {
+		return err
+	}
+
+	return w.writeTreesDiff(fromSub, fromSubTree, toSub, toSubTree, path+"/")
+}
+
+// writeFileDiff writes diff of a single file, from is nil for new files and to is nil for deleted files
+func (w *patchWriter) writeFileDiff(path string, fromRoot *repoTree, from *object.TreeEntry, toRoot *repoTree, to *object.TreeEntry) error {
+	return w.writeFilePairDiff(path, path, fromRoot, from, toRoot, to, nil)
+}
+
+// writeFilePairDiff writes diff of renamed or copied file when pair is set
+func (w *patchWriter) writeFilePairDiff(fromPath, toPath string, fromRoot *repoTree, from *object.TreeEntry, toRoot *repoTree, to *object.TreeEntry, pair *renamePair) error {
+	nameA := w.filter.TrimFileBasePath(fromPath)
+	nameB := w.filter.TrimFileBasePath(toPath)
+	pathA := quotePatchPath("a/" + nameA)
+	pathB := quotePatchPath("b/" + nameB)
+
+	isContentChanged := from == nil || to == nil || from.Hash != to.Hash
+
+	// NOTICE: Both versions of the file are read into memory, the same as git does.
+	// NOTICE: Index line has hashes of git-lfs objects content, because git apply checks them for binary patches.
+	fromHash, toHash := zeroHash, zeroHash
+	var fromContent, toContent []byte
+	if from != nil {
+		fromHash = from.Hash.String()
+		if isContentChanged {
+			content, hash, err := fromRoot.readFile(fromPath, from)
+			if err != nil {
+				return err
+			}
+			fromContent, fromHash = content, hash.String()
+		}
+	}
+	if to != nil {
+		toHash = to.Hash.String()
+		if isContentChanged {
+			content, hash, err := toRoot.readFile(toPath, to)
+			if err != nil {
+				return err
+			}
+			toContent, toHash = content, hash.String()
+		}
+	}
+
+	header := []string{fmt.Sprintf("diff --git %s %s", pathA, pathB)}
+
+	switch {
+	case pair != nil:
+		if from.Mode != to.Mode {
+			header = append(header, fmt.Sprintf("old mode %s", patchFileMode(from.Mode)))
+			header = append(header, fmt.Sprintf("new mode %s", patchFileMode(to.Mode)))
+		}
+
+		action := "rename"
+		if pair.isCopy {
+			action = "copy"
+		}
+		header = append(header, fmt.Sprintf("similarity index %d%%", pair.score))
+		header = append(header, fmt.Sprintf("%s from %s", action, quotePatchPath(nameA)))
+		header = append(header, fmt.Sprintf("%s to %s", action, quotePatchPath(nameB)))
+
+		if fromHash != toHash {
+			if from.Mode != to.Mode {
+				header = append(header, fmt.Sprintf("index %s..%s", fromHash, toHash))
+			} else {
+				header = append(header, fmt.Sprintf("index %s..%s %s", fromHash, toHash, patchFileMode(to.Mode)))
+			}
+		}
+	case from == nil:
+		header = append(header, fmt.Sprintf("new file mode %s", patchFileMode(to.Mode)))
+		header = append(header, fmt.Sprintf("index %s..%s", fromHash, toHash))
+	case to == nil:
+		header = append(header, fmt.Sprintf("deleted file mode %s", patchFileMode(from.Mode)))
+		header = append(header, fmt.Sprintf("index %s..%s", fromHash, toHash))
+	case from.Mode != to.Mode:
+		header = append(header, fmt.Sprintf("old mode %s", patchFileMode(from.Mode)))
+		header = append(header, fmt.Sprintf("new mode %s", patchFileMode(to.Mode)))
+		if fromHash != toHash {
+			header = append(header, fmt.Sprintf("index %s..%s", fromHash, toHash))
+		}
+	default:
+		header = append(header, fmt.Sprintf("index %s..%s %s", fromHash, toHash, patchFileMode(to.Mode)))
+	}
+
+	if err := w.printf("%s\n", strings.Join(header, "\n")); err != nil {
+		return err
+	}
+
+	if fromHash == toHash {
+		return nil
+	}
+
+	if isBinaryContent(fromContent) || isBinaryContent(toContent) {
+		return w.writeBinaryDiff(fromContent, toContent)
+	}
+
+	return w.writeTextDiff(pathA, pathB, from == nil, to == nil, fromContent, toContent)
+}
+
+func (w *patchWriter) writeTextDiff(pathA, pathB string, isNew, isDeleted bool, fromContent, toContent []byte) error {
+	hunks := unifiedHunks(diffLines(string(fromContent), string(toContent)), patchContextLines)
+	if len(hunks) == 0 {
+		return nil
+	}
+
+	if isNew {
+		pathA = "/dev/null"
+	}
+	if isDeleted {
+		pathB = "/dev/null"
+	}
+	if err := w.printf("--- %s\n+++ %s\n", pathA, pathB); err != nil {
+		return err
+	}
+
+	for _, h := range hunks {
+		if err := w.printf("@@ -%s +%s @@\n", hunkRange(h.fromLine, h.fromCount), hunkRange(h.toLine, h.toCount)); err != nil {
+			return err
+		}
+
+		for _, line := range h.lines {
+			text := line.text
+			if strings.HasSuffix(text, "\n") {
+				text = text[:len(text)-1]
+			} else {
+				text += "\n\\ No newline at end of file"
+			}
+
+			if err := w.printf("%c%s\n", line.op, text); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeBinaryDiff writes forward and reverse literal hunks as `git diff --binary` does
+func (w *patchWriter) writeBinaryDiff(fromContent, toContent []byte) error {
+	if err := w.printf("GIT binary patch\n"); err != nil {
+		return err
+	}
+
+	for _, content := range [][]byte{toContent, fromContent} {
+		if err := w.writeBinaryLiteral(content); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *patchWriter) writeBinaryLiteral(content []byte) error {
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	if _, err := zw.Write(content); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if err := w.printf("literal %d\n", len(content)); err != nil {
+		return err
+	}
+
+	data := deflated.Bytes()
+	for len(data) > 0 {
+		n := len(data)
+		if n > 52 {
+			n = 52
+		}
+
+		var lengthChar byte
+		if n <= 26 {
+			lengthChar = byte('A' + n - 1)
+		} else {
+			lengthChar = byte('a' + n - 27)
+		}
+
+		if err := w.printf("%c%s\n", lengthChar, encodeBase85(data[:n])); err != nil {
+			return err
+		}
+
+		data = data[n:]
+	}
+
+	return w.printf("\n")
+}
+
+// base85Alphabet should be in sync with git base85.c
+const base85Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz!#$%&()*+-;<=>?@^_`{|}~"
+
+func encodeBase85(data []byte) string {
+	var res []byte
+
+	for i := 0; i < len(data); i += 4 {
+		var acc uint32
+		for j := 0; j < 4; j++ {
+			acc <<= 8
+			if i+j < len(data) {
+				acc |= uint32(data[i+j])
+			}
+		}
+
+		var chunk [5]byte
+		for j := 4; j >= 0; j-- {
+			chunk[j] = base85Alphabet[acc%85]
+			acc /= 85
+		}
+		res = append(res, chunk[:]...)
+	}
+
+	return string(res)
+}
+
+func isBinaryContent(content []byte) bool {
+	if len(content) > binaryCheckSize {
+		content = content[:binaryCheckSize]
+	}
+	return bytes.IndexByte(content, 0) != -1
+}
+
+func patchFileMode(mode filemode.FileMode) string {
+	return fmt.Sprintf("%06o", uint32(mode))
+}
+
+// quotePatchPath quotes path with special characters in the same way as git does
+func quotePatchPath(path string) string {
+	if !strings.ContainsAny(path, "\"\\\a\b\f\n\r\t\v") {
+		return path
+	}
+
+	replacer := strings.NewReplacer(
+		"\"", "\\\"", "\\", "\\\\",
+		"\a", "\\a", "\b", "\\b", "\f", "\\f", "\n", "\\n", "\r", "\\r", "\t", "\\t", "\v", "\\v",
+	)
+
+	return fmt.Sprintf("\"%s\"", replacer.Replace(path))
+}
+
+type patchLine struct {
+	// op is one of ' ', '-' or '+'
+	op   byte
+	text string
+}
+
+type patchHunk struct {
+	fromLine, fromCount int
+	toLine, toCount     int
+	lines               []patchLine
+}
+
+func diffLines(from, to string) []patchLine {
+	a, b := splitLines(from), splitLines(to)
+
+	ids := make(map[string]int)
+	lineIds := func(lines []string) []int {
+		res := make([]int, len(lines))
+		for i, line := range lines {
+			id, hasKey := ids[line]
+			if !hasKey {
+				id = len(ids)
+				ids[line] = id
+			}
+			res[i] = id
+		}
+		return res
+	}
+	aIds, bIds := lineIds(a), lineIds(b)
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && aIds[prefix] == bIds[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && aIds[len(a)-1-suffix] == bIds[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var lines []patchLine
+	for _, line := range a[:prefix] {
+		lines = append(lines, patchLine{op: ' ', text: line})
+	}
+
+	aMiddle, bMiddle := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	ops, ok := myersDiff(aIds[prefix:len(a)-suffix], bIds[prefix:len(b)-suffix], maxDiffCost)
+	if !ok {
+		ops = nil
+		for range aMiddle {
+			ops = append(ops, '-')
+		}
+		for range bMiddle {
+			ops = append(ops, '+')
+		}
+	}
+
+	x, y := 0, 0
+	for _, op := range ops {
+		switch op {
+		case ' ':
+			lines = append(lines, patchLine{op: op, text: aMiddle[x]})
+			x++
+			y++
+		case '-':
+			lines = append(lines, patchLine{op: op, text: aMiddle[x]})
+			x++
+		case '+':
+			lines = append(lines, patchLine{op: op, text: bMiddle[y]})
+			y++
+		}
+	}
+
+	for _, line := range a[len(a)-suffix:] {
+		lines = append(lines, patchLine{op: ' ', text: line})
+	}
+
+	return lines
+}
+
+// splitLines splits text into lines keeping line endings, the last line may have no line ending
+func splitLines(text string) []string {
+	var lines []string
+	for text != "" {
+		lineEnd := strings.IndexByte(text, '\n') + 1
+		if lineEnd == 0 {
+			lineEnd = len(text)
+		}
+
+		lines = append(lines, text[:lineEnd])
+		text = text[lineEnd:]
+	}
+	return lines
+}
+
+// myersDiff returns shortest edit script of ' ', '-' and '+' operations which turns a into b,
+// ok is false when the number of edits exceeds maxCost
+func myersDiff(a, b []int, maxCost int) (ops []byte, ok bool) {
+	n, m := len(a), len(b)
+
+	// Added or deleted lines only, the script is known without search
+	if n == 0 || m == 0 {
+		ops = make([]byte, 0, n+m)
+		for i := 0; i < n; i++ {
+			ops = append(ops, '-')
+		}
+		for i := 0; i < m; i++ {
+			ops = append(ops, '+')
+		}
+		return ops, true
+	}
+
+	// Any script has at least |n-m| edits, so the search is skipped when it cannot succeed
+	if n-m > maxCost || m-n > maxCost {
+		return nil, false
+	}
+
+	max := n + m
+
+	// v[k+offset] is the furthest x on the diagonal k
+	offset := max + 1
+	v := make([]int, 2*max+3)
+
+	// trace[d] keeps v on diagonals -d-1..d+1 before the step d
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		if d > maxCost {
+			return nil, false
+		}
+
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		dv := func(k int) int { return trace[d][k+d+1] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && dv(k-1) < dv(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := dv(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ops = append(ops, ' ')
+			x--
+			y--
+		}
+
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, '+')
+			} else {
+				ops = append(ops, '-')
+			}
+		}
+
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+
+	return ops, true
+}
+
+// unifiedHunks groups changed lines into hunks with context lines around,
+// hunks separated by not more than 2*context unchanged lines are merged
+func unifiedHunks(lines []patchLine, context int) []*patchHunk {
+	var hunks []*patchHunk
+
+	fromLine, toLine := 0, 0
+	for i := 0; i < len(lines); {
+		if lines[i].op == ' ' {
+			fromLine++
+			toLine++
+			i++
+			continue
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+
+		end := i
+		for end < len(lines) {
+			if lines[end].op != ' ' {
+				end++
+				continue
+			}
+
+			run := 0
+			for end+run < len(lines) && lines[end+run].op == ' ' {
+				run++
+			}
+
+			if end+run == len(lines) || run > 2*context {
+				if run > context {
+					run = context
+				}
+				end += run
+				break
+			}
+
+			end += run
+		}
+
+		h := &patchHunk{fromLine: fromLine - (i - start), toLine: toLine - (i - start), lines: lines[start:end]}
+		for _, line := range h.lines {
+			if line.op != '+' {
+				h.fromCount++
+			}
+			if line.op != '-' {
+				h.toCount++
+			}
+		}
+		hunks = append(hunks, h)
+
+		fromLine = h.fromLine + h.fromCount
+		toLine = h.toLine + h.toCount
+		i = end
+	}
+
+	return hunks
+}
+
+// hunkRange formats range as git does: line numbers are 1-based, empty range refers to the line before
+func hunkRange(line, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", line)
+	}
+
+	if count == 1 {
+		return fmt.Sprintf("%d", line+1)
+	}
+
+	return fmt.Sprintf("%d,%d", line+1, count)
+}
@@ -6,15 +6,20 @@ import (
 	"path/filepath"
 
 	uuid "github.com/satori/go.uuid"
+
+	"github.com/flant/dapp/pkg/dapp"
 )
 
 type PatchFile struct {
 	FilePath string
+
+	remove func() error
 }
 
+// NewTmpPatchFile registers patch file to be removed on termination until Remove is called
 func NewTmpPatchFile() *PatchFile {
 	path := filepath.Join("/tmp", fmt.Sprintf("dapp-%s.patch", uuid.NewV4().String()))
-	return &PatchFile{FilePath: path}
+	return &PatchFile{FilePath: path, remove: dapp.AddTmpFile(path)}
 }
 
 func (p *PatchFile) GetFilePath() string {
@@ -31,3 +36,10 @@ func (p *PatchFile) IsEmpty() (bool, error) {
 	}
 	return true, nil
 }
+
+func (p *PatchFile) Remove() error {
+	if p.remove == nil {
+		return os.RemoveAll(p.GetFilePath())
+	}
+	return p.remove()
+}
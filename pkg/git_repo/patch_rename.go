@@ -0,0 +1,257 @@
+package git_repo
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/flant/go-git/plumbing"
+	"github.com/flant/go-git/plumbing/filemode"
+	"github.com/flant/go-git/plumbing/object"
+	"github.com/flant/go-git/utils/merkletrie"
+)
+
+type renameMode int
+
+const (
+	noRenames renameMode = iota
+	// detectRenames pairs deleted and added files as `git diff -M` does
+	detectRenames
+	// detectCopies also pairs added files with modified files as `git diff -C` does
+	detectCopies
+)
+
+// renameMinScore and renameLimit are the same as git defaults: pairs with lower similarity are not renames,
+// inexact renames are not detected when the number of sources multiplied by added files exceeds the square of the limit
+const (
+	renameMinScore = 50
+	renameLimit    = 1000
+)
+
+var emptyBlobHash = plumbing.ComputeHash(plumbing.BlobObject, nil)
+
+func patchRenameMode(opts PatchOptions) renameMode {
+	switch {
+	case opts.DetectCopies:
+		return detectCopies
+	case opts.DetectRenames:
+		return detectRenames
+	default:
+		return noRenames
+	}
+}
+
+// renamePair is the source of the added file
+type renamePair struct {
+	fromPath string
+	from     *object.TreeEntry
+	// score is the similarity of files in percents
+	score  int
+	isCopy bool
+}
+
+type renameSource struct {
+	path      string
+	entry     *object.TreeEntry
+	isDeleted bool
+}
+
+type renameCandidate struct {
+	src     *renameSource
+	dstPath string
+	score   int
+}
+
+// fileFingerprint is used for similarity of files, it counts equal lines in the same way as git counts equal chunks
+type fileFingerprint struct {
+	size  int
+	lines map[string]int
+}
+
+// findRenames returns sources of added files by their paths and paths of renamed deleted files.
+// Files are paired after PathFilter: a rename crossing the filter boundary is left as deletion or addition.
+func (w *patchWriter) findRenames(fromRoot, toRoot *repoTree, changes object.Changes, prefix string) (map[string]*renamePair, map[string]bool, error) {
+	var srcs []*renameSource
+	var dstPaths []string
+	var dsts []*object.TreeEntry
+
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch action {
+		case merkletrie.Delete:
+			path := prefix + change.From.Name
+			if change.From.TreeEntry.Mode != filemode.Submodule && w.filter.IsFilePathValid(path) {
+				srcs = append(srcs, &renameSource{path: path, entry: &change.From.TreeEntry, isDeleted: true})
+			}
+		case merkletrie.Insert:
+			path := prefix + change.To.Name
+			if change.To.TreeEntry.Mode != filemode.Submodule && w.filter.IsFilePathValid(path) {
+				dstPaths = append(dstPaths, path)
+				dsts = append(dsts, &change.To.TreeEntry)
+			}
+		case merkletrie.Modify:
+			path := prefix + change.From.Name
+			if w.renames == detectCopies && change.From.TreeEntry.Mode != filemode.Submodule && w.filter.IsFilePathValid(path) {
+				srcs = append(srcs, &renameSource{path: path, entry: &change.From.TreeEntry})
+			}
+		}
+	}
+
+	if len(srcs) == 0 || len(dsts) == 0 {
+		return nil, nil, nil
+	}
+
+	isSameType := func(a, b *object.TreeEntry) bool {
+		return (a.Mode == filemode.Symlink) == (b.Mode == filemode.Symlink)
+	}
+
+	srcsByHash := make(map[plumbing.Hash][]*renameSource)
+	for _, src := range srcs {
+		srcsByHash[src.entry.Hash] = append(srcsByHash[src.entry.Hash], src)
+	}
+
+	var candidates []*renameCandidate
+	var inexactDsts []int
+
+	for i, dst := range dsts {
+		// NOTICE: Empty files are not paired, the same as git does.
+		if dst.Hash == emptyBlobHash {
+			continue
+		}
+
+		isExact := false
+		for _, src := range srcsByHash[dst.Hash] {
+			if isSameType(src.entry, dst) {
+				candidates = append(candidates, &renameCandidate{src: src, dstPath: dstPaths[i], score: 100})
+				isExact = true
+			}
+		}
+
+		if !isExact {
+			inexactDsts = append(inexactDsts, i)
+		}
+	}
+
+	if len(inexactDsts) > 0 && len(inexactDsts)*len(srcs) <= renameLimit*renameLimit {
+		srcFingerprints := make(map[*renameSource]*fileFingerprint)
+		for _, src := range srcs {
+			fingerprint, err := blobFingerprint(fromRoot, src.path, src.entry)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot read `%s`: %s", src.path, err)
+			}
+			srcFingerprints[src] = fingerprint
+		}
+
+		for _, i := range inexactDsts {
+			dstFingerprint, err := blobFingerprint(toRoot, dstPaths[i], dsts[i])
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot read `%s`: %s", dstPaths[i], err)
+			}
+			if dstFingerprint == nil {
+				continue
+			}
+
+			for _, src := range srcs {
+				srcFingerprint := srcFingerprints[src]
+				if srcFingerprint == nil || !isSameType(src.entry, dsts[i]) {
+					continue
+				}
+
+				if score := similarityScore(srcFingerprint, dstFingerprint); score >= renameMinScore {
+					candidates = append(candidates, &renameCandidate{src: src, dstPath: dstPaths[i], score: score})
+				}
+			}
+		}
+	}
+
+	// The most similar pairs are taken first, deleted files are renamed once without copies
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].dstPath < candidates[j].dstPath
+	})
+
+	pairs := make(map[string]*renamePair)
+	renamed := make(map[string]bool)
+	srcDstPaths := make(map[*renameSource][]string)
+
+	for _, c := range candidates {
+		if _, isAssigned := pairs[c.dstPath]; isAssigned {
+			continue
+		}
+		if c.src.isDeleted && renamed[c.src.path] && w.renames != detectCopies {
+			continue
+		}
+
+		pairs[c.dstPath] = &renamePair{fromPath: c.src.path, from: c.src.entry, score: c.score, isCopy: !c.src.isDeleted}
+		if c.src.isDeleted {
+			renamed[c.src.path] = true
+			srcDstPaths[c.src] = append(srcDstPaths[c.src], c.dstPath)
+		}
+	}
+
+	// NOTICE: Deleted file with several added files is copied into all of them but the last one,
+	// NOTICE: which is the rename, so git apply reads the file before its removal as patches are sorted by path.
+	for _, paths := range srcDstPaths {
+		sort.Strings(paths)
+		for _, path := range paths[:len(paths)-1] {
+			pairs[path].isCopy = true
+		}
+	}
+
+	return pairs, renamed, nil
+}
+
+// blobFingerprint returns nil for git-lfs pointers, which are paired only when they are equal
+func blobFingerprint(t *repoTree, path string, entry *object.TreeEntry) (*fileFingerprint, error) {
+	content, err := t.readBlob(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) == 0 {
+		return nil, nil
+	}
+
+	if entry.Mode != filemode.Symlink && parseLfsPointer(content) != nil {
+		isLfs, err := t.isLfsFile(path)
+		if err != nil || isLfs {
+			return nil, err
+		}
+	}
+
+	fingerprint := &fileFingerprint{size: len(content), lines: make(map[string]int)}
+	for _, line := range splitLines(string(content)) {
+		fingerprint.lines[line]++
+	}
+
+	return fingerprint, nil
+}
+
+// similarityScore is the size of equal lines in percents of the bigger file as git calculates it
+func similarityScore(a, b *fileFingerprint) int {
+	maxSize, minSize := a.size, b.size
+	if minSize > maxSize {
+		maxSize, minSize = minSize, maxSize
+	}
+
+	// Files of too different sizes cannot be similar enough
+	if minSize*100 < maxSize*renameMinScore {
+		return 0
+	}
+
+	var copied int
+	for line, count := range a.lines {
+		if bCount := b.lines[line]; bCount < count {
+			copied += bCount * len(line)
+		} else {
+			copied += count * len(line)
+		}
+	}
+
+	return copied * 100 / maxSize
+}
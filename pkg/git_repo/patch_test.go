@@ -0,0 +1,424 @@
+package git_repo
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	git_util "github.com/flant/dapp/pkg/git"
+	git "github.com/flant/go-git"
+	"github.com/flant/go-git/plumbing/object"
+)
+
+type testFile struct {
+	content string
+	mode    os.FileMode
+}
+
+func numberedLines(from, to int, changed map[int]string) string {
+	var lines []string
+	for i := from; i <= to; i++ {
+		if line, hasKey := changed[i]; hasKey {
+			lines = append(lines, line)
+		} else {
+			lines = append(lines, fmt.Sprintf("line %d", i))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]*testFile) {
+	for path, file := range files {
+		fullPath := filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fullPath, []byte(file.content), file.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(fullPath, file.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func commitTestFiles(t *testing.T, repository *git.Repository, dir string, files map[string]*testFile, removed []string) string {
+	worktree, err := repository.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFiles(t, dir, files)
+	for path := range files {
+		if _, err := worktree.Add(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range removed {
+		if _, err := worktree.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hash, err := worktree.Commit("test", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash.String()
+}
+
+func TestWritePatch(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "dapp-patch-test-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+
+	repository, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binaryContent := func(seed byte) string {
+		var buf bytes.Buffer
+		for i := 0; i < 300; i++ {
+			buf.WriteByte(byte(i) * seed)
+		}
+		return buf.String()
+	}
+
+	fromFiles := map[string]*testFile{
+		"app/a.txt":       {numberedLines(1, 20, nil), 0644},
+		"app/b.txt":       {"removed\n", 0644},
+		"app/bin.dat":     {binaryContent(3), 0644},
+		"app/script.sh":   {"#!/bin/sh\n", 0644},
+		"app/ignored.txt": {"ignored\n", 0644},
+		"other/x.txt":     {"other\n", 0644},
+	}
+	toFiles := map[string]*testFile{
+		"app/a.txt":       {numberedLines(1, 20, map[int]string{2: "changed 2", 18: "changed 18"}), 0644},
+		"app/bin.dat":     {binaryContent(7), 0644},
+		"app/script.sh":   {"#!/bin/sh\n", 0755},
+		"app/c.txt":       {"no newline", 0644},
+		"app/ignored.txt": {"ignored changed\n", 0644},
+		"other/x.txt":     {"other changed\n", 0644},
+	}
+
+	fromCommit := commitTestFiles(t, repository, repoDir, fromFiles, nil)
+	toCommit := commitTestFiles(t, repository, repoDir, toFiles, []string{"app/b.txt"})
+
+	h, err := openRepoHandle("test", repoDir, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var patch bytes.Buffer
+	err = writePatch(&patch, h, fromCommit, toCommit, git_util.PathFilter{BasePath: "app", ExcludePaths: []string{"ignored.txt"}}, false, noRenames)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"diff --git a/a.txt b/a.txt\n",
+		"@@ -1,5 +1,5 @@\n",
+		"@@ -15,6 +15,6 @@\n",
+		"diff --git a/b.txt b/b.txt\ndeleted file mode 100644\n",
+		"diff --git a/c.txt b/c.txt\nnew file mode 100644\n",
+		"+no newline\n\\ No newline at end of file\n",
+		"GIT binary patch\nliteral 300\n",
+		"diff --git a/script.sh b/script.sh\nold mode 100644\nnew mode 100755\n",
+	} {
+		if !strings.Contains(patch.String(), expected) {
+			t.Errorf("patch should contain %q:\n%s", expected, patch.String())
+		}
+	}
+
+	for _, unexpected := range []string{"ignored.txt", "x.txt", "app/"} {
+		if strings.Contains(patch.String(), unexpected) {
+			t.Errorf("patch should not contain %q:\n%s", unexpected, patch.String())
+		}
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available, patch is not applied")
+	}
+
+	applyDir, err := ioutil.TempDir("", "dapp-patch-test-apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(applyDir)
+
+	trimFiles := func(files map[string]*testFile) map[string]*testFile {
+		res := make(map[string]*testFile)
+		for path, file := range files {
+			if strings.HasPrefix(path, "app/") && path != "app/ignored.txt" {
+				res[strings.TrimPrefix(path, "app/")] = file
+			}
+		}
+		return res
+	}
+
+	writeTestFiles(t, applyDir, trimFiles(fromFiles))
+
+	cmd := exec.Command("git", "apply", "--whitespace=nowarn", "-")
+	cmd.Dir = applyDir
+	cmd.Stdin = bytes.NewReader(patch.Bytes())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git apply failed: %s\n%s\npatch:\n%s", err, output, patch.String())
+	}
+
+	expectedFiles := trimFiles(toFiles)
+	for path, file := range expectedFiles {
+		fullPath := filepath.Join(applyDir, path)
+
+		content, err := ioutil.ReadFile(fullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != file.content {
+			t.Errorf("unexpected content of `%s` after patch apply: %q", path, content)
+		}
+
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != file.mode {
+			t.Errorf("unexpected mode of `%s` after patch apply: %s", path, info.Mode())
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(applyDir, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("b.txt should be deleted by patch")
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	randomText := func() string {
+		var lines []string
+		for i := r.Intn(30); i > 0; i-- {
+			lines = append(lines, fmt.Sprintf("line %d", r.Intn(8)))
+		}
+		text := strings.Join(lines, "\n")
+		if text != "" && r.Intn(2) == 0 {
+			text += "\n"
+		}
+		return text
+	}
+
+	for i := 0; i < 1000; i++ {
+		from, to := randomText(), randomText()
+
+		var src, dst string
+		for _, line := range diffLines(from, to) {
+			if line.op != '+' {
+				src += line.text
+			}
+			if line.op != '-' {
+				dst += line.text
+			}
+		}
+
+		if src != from || dst != to {
+			t.Fatalf("diff of %q and %q restores %q and %q", from, to, src, dst)
+		}
+	}
+}
+
+func TestWritePatchRenames(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	repoDir, err := ioutil.TempDir("", "dapp-patch-renames-test-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+
+	repository, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromFiles := map[string]*testFile{
+		"app/dir/a.txt":  {numberedLines(1, 40, nil), 0644},
+		"app/dir/b.txt":  {numberedLines(41, 80, nil), 0644},
+		"app/edit.txt":   {numberedLines(1, 20, map[int]string{1: "edit"}), 0644},
+		"app/script.sh":  {"#!/bin/sh\necho script\n", 0644},
+		"app/src.txt":    {numberedLines(101, 120, nil), 0644},
+		"app/out.txt":    {"out\n", 0644},
+		"app/hidden.txt": {"hidden\n", 0644},
+		"other/in.txt":   {"in\n", 0644},
+	}
+	toFiles := map[string]*testFile{
+		"app/moved/a.txt":        {numberedLines(1, 40, nil), 0644},
+		"app/moved/b.txt":        {numberedLines(41, 80, nil), 0644},
+		"app/edited.txt":         {numberedLines(1, 20, map[int]string{1: "edit", 10: "changed"}), 0644},
+		"app/run.sh":             {"#!/bin/sh\necho script\n", 0755},
+		"app/src.txt":            {numberedLines(101, 120, map[int]string{105: "changed"}), 0644},
+		"app/copy.txt":           {numberedLines(101, 120, nil), 0644},
+		"other/out.txt":          {"out\n", 0644},
+		"app/ignored/hidden.txt": {"hidden\n", 0644},
+		"app/in.txt":             {"in\n", 0644},
+	}
+
+	fromCommit := commitTestFiles(t, repository, repoDir, fromFiles, nil)
+	toCommit := commitTestFiles(t, repository, repoDir, toFiles, []string{
+		"app/dir/a.txt", "app/dir/b.txt", "app/edit.txt", "app/script.sh", "app/out.txt", "app/hidden.txt", "other/in.txt",
+	})
+
+	h, err := openRepoHandle("test", repoDir, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter := git_util.PathFilter{BasePath: "app", ExcludePaths: []string{"ignored"}}
+
+	writeTestPatch := func(renames renameMode) string {
+		var patch bytes.Buffer
+		if err := writePatch(&patch, h, fromCommit, toCommit, filter, false, renames); err != nil {
+			t.Fatal(err)
+		}
+		return patch.String()
+	}
+
+	noRenamesPatch := writeTestPatch(noRenames)
+	renamesPatch := writeTestPatch(detectRenames)
+	copiesPatch := writeTestPatch(detectCopies)
+
+	for _, expected := range []string{
+		"diff --git a/dir/a.txt b/moved/a.txt\nsimilarity index 100%\nrename from dir/a.txt\nrename to moved/a.txt\ndiff",
+		"diff --git a/dir/b.txt b/moved/b.txt\nsimilarity index 100%\nrename from dir/b.txt\nrename to moved/b.txt\ndiff",
+		"similarity index 94%\nrename from edit.txt\nrename to edited.txt\nindex ",
+		"--- a/edit.txt\n+++ b/edited.txt\n",
+		"diff --git a/script.sh b/run.sh\nold mode 100644\nnew mode 100755\nsimilarity index 100%\nrename from script.sh\nrename to run.sh\n",
+		"diff --git a/copy.txt b/copy.txt\nnew file mode 100644\n",
+		"diff --git a/out.txt b/out.txt\ndeleted file mode 100644\n",
+		"diff --git a/hidden.txt b/hidden.txt\ndeleted file mode 100644\n",
+		"diff --git a/in.txt b/in.txt\nnew file mode 100644\n",
+	} {
+		if !strings.Contains(renamesPatch, expected) {
+			t.Errorf("patch with renames should contain %q:\n%s", expected, renamesPatch)
+		}
+	}
+
+	if expected := "diff --git a/src.txt b/copy.txt\nsimilarity index 100%\ncopy from src.txt\ncopy to copy.txt\ndiff"; !strings.Contains(copiesPatch, expected) {
+		t.Errorf("patch with copies should contain %q:\n%s", expected, copiesPatch)
+	}
+
+	for _, unexpected := range []string{"app/", "ignored", "other"} {
+		if strings.Contains(copiesPatch, unexpected) {
+			t.Errorf("patch should not contain %q:\n%s", unexpected, copiesPatch)
+		}
+	}
+
+	if len(renamesPatch) >= len(noRenamesPatch) || len(copiesPatch) >= len(renamesPatch) {
+		t.Errorf("patches with renames and copies should be smaller: %d, %d and %d bytes", len(noRenamesPatch), len(renamesPatch), len(copiesPatch))
+	}
+
+	trimFiles := func(files map[string]*testFile) map[string]*testFile {
+		res := make(map[string]*testFile)
+		for path, file := range files {
+			if strings.HasPrefix(path, "app/") && !strings.HasPrefix(path, "app/ignored/") {
+				res[strings.TrimPrefix(path, "app/")] = file
+			}
+		}
+		return res
+	}
+
+	for _, patch := range []string{noRenamesPatch, renamesPatch, copiesPatch} {
+		tmpDir, err := ioutil.TempDir("", "dapp-patch-renames-test-apply")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		// Patch is applied in the same way as in stage containers
+		applyDir := filepath.Join(tmpDir, "to")
+		writeTestFiles(t, applyDir, trimFiles(fromFiles))
+
+		cmd := exec.Command("git", "apply", "--whitespace=nowarn", fmt.Sprintf("--directory=%s", applyDir), "--unsafe-paths", "-")
+		cmd.Dir = tmpDir
+		cmd.Stdin = strings.NewReader(patch)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git apply failed: %s\n%s\npatch:\n%s", err, output, patch)
+		}
+
+		expectedFiles := trimFiles(toFiles)
+		for path, file := range expectedFiles {
+			fullPath := filepath.Join(applyDir, path)
+
+			content, err := ioutil.ReadFile(fullPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != file.content {
+				t.Errorf("unexpected content of `%s` after patch apply: %q", path, content)
+			}
+
+			info, err := os.Stat(fullPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != file.mode {
+				t.Errorf("unexpected mode of `%s` after patch apply: %s", path, info.Mode())
+			}
+		}
+
+		var files []string
+		err = filepath.Walk(applyDir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				files = append(files, path)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != len(expectedFiles) {
+			t.Errorf("unexpected files after patch apply: %v", files)
+		}
+	}
+}
+
+func TestDiffLinesLargeFiles(t *testing.T) {
+	var lines []string
+	for i := 0; i < 100000; i++ {
+		lines = append(lines, fmt.Sprintf("line %d\n", i))
+	}
+	text := strings.Join(lines, "")
+
+	countOps := func(diff []patchLine) map[byte]int {
+		counts := map[byte]int{}
+		for _, line := range diff {
+			counts[line.op]++
+		}
+		return counts
+	}
+
+	if counts := countOps(diffLines("", text)); counts['+'] != len(lines) || len(counts) != 1 {
+		t.Fatalf("added file diff has unexpected lines: %v", counts)
+	}
+
+	if counts := countOps(diffLines(text, "")); counts['-'] != len(lines) || len(counts) != 1 {
+		t.Fatalf("deleted file diff has unexpected lines: %v", counts)
+	}
+
+	if counts := countOps(diffLines(text, strings.Join(lines[:len(lines)/2], ""))); counts['-'] != len(lines)/2 || counts[' '] != len(lines)/2 {
+		t.Fatalf("truncated file diff has unexpected lines: %v", counts)
+	}
+}
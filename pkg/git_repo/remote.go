@@ -1,17 +1,22 @@
 package git_repo
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/flant/dapp/pkg/dapp"
+	git_util "github.com/flant/dapp/pkg/git"
 	"github.com/flant/dapp/pkg/lock"
+	"github.com/flant/dapp/pkg/util"
 	git "github.com/flant/go-git"
+	"github.com/flant/go-git/config"
 	"github.com/flant/go-git/plumbing"
 	"github.com/flant/go-git/plumbing/storer"
-	"gopkg.in/ini.v1"
 	"gopkg.in/satori/go.uuid.v1"
 )
 
@@ -20,6 +25,96 @@ type Remote struct {
 	Url       string
 	ClonePath string // TODO: move CacheVersion & path construction here
 	IsDryRun  bool
+	// Depth limits history of the clone, zero means the whole history,
+	// shallow clone is deepened when a needed commit is missing
+	Depth int
+	// Branches and Tags are the only refs fetched, all branches are fetched when both are empty
+	Branches []string
+	Tags     []string
+	// Auth is used for ssh and http urls, go-git defaults are used when not specified
+	Auth *RemoteAuth
+	// Mirrors are tried in order after Url, every url is fetched into its own remote of the same clone
+	Mirrors []string
+	// MirrorTimeout limits every clone or fetch attempt when mirrors are specified, zero means no limit
+	MirrorTimeout time.Duration
+
+	// fetchedRemote is the remote, which was cloned or fetched last, its refs are used first
+	fetchedRemote string
+}
+
+// maxDeepenSteps limits the number of deepen fetches before fetching the whole history
+const maxDeepenSteps = 4
+
+// remoteName is the remote of Url, remotes of mirrors are named by url hash
+const remoteName = "origin"
+
+type remoteUrl struct {
+	Name string
+	Url  string
+}
+
+func (repo *Remote) remoteUrls() []remoteUrl {
+	res := []remoteUrl{{Name: remoteName, Url: repo.Url}}
+	for _, url := range repo.Mirrors {
+		res = append(res, remoteUrl{Name: mirrorRemoteName(url), Url: url})
+	}
+	return res
+}
+
+// mirrorRemoteName does not depend on the order of mirrors, so that fetched refs are reused
+func mirrorRemoteName(url string) string {
+	return fmt.Sprintf("mirror-%s", util.Sha256Hash(url)[:12])
+}
+
+// refRemoteNames returns remotes to look for refs in: the last fetched remote, then Url and mirrors
+func (repo *Remote) refRemoteNames() []string {
+	var res []string
+	if repo.fetchedRemote != "" {
+		res = append(res, repo.fetchedRemote)
+	}
+	for _, remote := range repo.remoteUrls() {
+		if remote.Name != repo.fetchedRemote {
+			res = append(res, remote.Name)
+		}
+	}
+	return res
+}
+
+// withRemoteUrls calls f for Url and mirrors in order until success, every attempt is limited by MirrorTimeout
+func (repo *Remote) withRemoteUrls(operation string, f func(ctx context.Context, remote remoteUrl) error) error {
+	remotes := repo.remoteUrls()
+
+	var errs []string
+	for i, remote := range remotes {
+		ctx, cancel := dapp.Context(), func() {}
+		if repo.MirrorTimeout > 0 && len(remotes) > 1 {
+			ctx, cancel = context.WithTimeout(dapp.Context(), repo.MirrorTimeout)
+		}
+
+		err := f(ctx, remote)
+		cancel()
+
+		if err == nil {
+			repo.fetchedRemote = remote.Name
+			return nil
+		}
+
+		// Mirrors are not tried on termination
+		if dapp.Context().Err() != nil {
+			return &RemoteError{Repo: repo.String(), Operation: operation, Err: err}
+		}
+
+		if len(remotes) == 1 {
+			return &RemoteError{Repo: repo.String(), Operation: operation, Err: err}
+		}
+
+		errs = append(errs, fmt.Sprintf("%s: %s", remote.Url, err))
+		if i < len(remotes)-1 {
+			fmt.Fprintf(os.Stderr, "WARNING: cannot %s remote git repo `%s` from `%s`: %s, trying next mirror\n", operation, repo.String(), remote.Url, err)
+		}
+	}
+
+	return &RemoteError{Repo: repo.String(), Operation: operation, Err: fmt.Errorf("all mirrors failed:\n%s", strings.Join(errs, "\n"))}
 }
 
 func (repo *Remote) withLock(f func() error) error {
@@ -28,11 +123,19 @@ func (repo *Remote) withLock(f func() error) error {
 }
 
 func (repo *Remote) CloneAndFetch() error {
+	// Shallow clone is deepened by git fetch, which is not supported by go-git
+	if repo.Depth > 0 && !repo.IsDryRun {
+		if _, err := git_util.CliVersion(); err != nil {
+			return fmt.Errorf("cannot use clone depth %d for git repo `%s`: git binary is required to deepen shallow clones: %s", repo.Depth, repo.String(), err)
+		}
+	}
+
 	isCloned, err := repo.Clone()
 	if err != nil {
 		return err
 	}
-	if isCloned {
+	// Single ref is fetched by clone
+	if isCloned && len(repo.Branches)+len(repo.Tags) <= 1 && !repo.isTagConstraintClone() {
 		return nil
 	}
 
@@ -80,15 +183,38 @@ func (repo *Remote) Clone() (bool, error) {
 
 		path := filepath.Join("/tmp", fmt.Sprintf("dapp-git-repo-%s", uuid.NewV4().String()))
 
-		_, err = git.PlainClone(path, true, &git.CloneOptions{
-			URL:               repo.Url,
-			RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
-		})
-		if err != nil {
-			return err
+		// Partial clone is removed when clone fails or is interrupted
+		defer os.RemoveAll(path)
+
+		// Tags matching the constraint are fetched after clone
+		if repo.isTagConstraintClone() {
+			if _, err := git.PlainInit(path, true); err != nil {
+				return &RemoteError{Repo: repo.String(), Operation: "clone", Err: err}
+			}
+		} else {
+			err = repo.withRemoteUrls("clone", func(ctx context.Context, remote remoteUrl) error {
+				if err := os.RemoveAll(path); err != nil {
+					return err
+				}
+
+				return repo.withAuth(remote.Url, func(auth *remoteAuth) error {
+					cloneOptions := repo.cloneOptions()
+					cloneOptions.URL = remote.Url
+					cloneOptions.RemoteName = remote.Name
+					cloneOptions.Auth = auth.Method
+
+					_, err := git.PlainCloneContext(ctx, path, true, cloneOptions)
+					return err
+				})
+			})
+			if err != nil {
+				return err
+			}
 		}
 
-		defer os.RemoveAll(path)
+		if err := repo.syncRemotesConfig(path); err != nil {
+			return err
+		}
 
 		err = os.MkdirAll(filepath.Dir(repo.ClonePath), 0755)
 		if err != nil {
@@ -111,45 +237,230 @@ func (repo *Remote) Fetch() error {
 		return nil
 	}
 
-	cfgPath := filepath.Join(repo.ClonePath, "config")
+	return repo.withLock(func() error {
+		if err := repo.syncRemotesConfig(repo.ClonePath); err != nil {
+			return err
+		}
 
-	cfg, err := ini.Load(cfgPath)
-	if err != nil {
-		return fmt.Errorf("cannot load repo `%s` config: %s", repo.String(), err)
-	}
+		rawRepo, err := git.PlainOpen(repo.ClonePath)
+		if err != nil {
+			return fmt.Errorf("cannot open repo: %s", err)
+		}
+
+		err = repo.withRemoteUrls("fetch", func(ctx context.Context, remote remoteUrl) error {
+			fmt.Printf("Fetching remote `%s` of repo `%s` ...\n", remote.Name, repo.String())
 
-	remoteName := "origin"
+			err := repo.withAuth(remote.Url, func(auth *remoteAuth) error {
+				return rawRepo.FetchContext(ctx, &git.FetchOptions{
+					RemoteName: remote.Name,
+					RefSpecs:   repo.refSpecs(remote.Name),
+					Depth:      repo.Depth,
+					Tags:       repo.tagMode(),
+					Auth:       auth.Method,
+				})
+			})
+			if err != nil && err != git.NoErrAlreadyUpToDate {
+				return fmt.Errorf("remote `%s`: %s", remote.Name, err)
+			}
 
-	oldUrlKey := cfg.Section(fmt.Sprintf("remote \"%s\"", remoteName)).Key("url")
-	if oldUrlKey != nil && oldUrlKey.Value() != repo.Url {
-		oldUrlKey.SetValue(repo.Url)
-		err := cfg.SaveTo(cfgPath)
+			fmt.Printf("Fetching remote `%s` of repo `%s` DONE\n", remote.Name, repo.String())
+
+			return nil
+		})
 		if err != nil {
-			return fmt.Errorf("cannot update url of repo `%s`: %s", repo.String(), err)
+			return err
 		}
+
+		// Modification time of the clone is the last use time for maintenance
+		return repo.touch()
+	})
+}
+
+// syncRemotesConfig adds remotes of Url and mirrors to the clone config and updates changed urls
+func (repo *Remote) syncRemotesConfig(path string) error {
+	rawRepo, err := git.PlainOpen(path)
+	if err != nil {
+		return fmt.Errorf("cannot open repo: %s", err)
 	}
 
-	return repo.withLock(func() error {
-		rawRepo, err := git.PlainOpen(repo.ClonePath)
-		if err != nil {
-			return fmt.Errorf("cannot open repo: %s", err)
+	cfg, err := rawRepo.Config()
+	if err != nil {
+		return fmt.Errorf("cannot load repo `%s` config: %s", repo.String(), err)
+	}
+
+	isChanged := false
+	for _, remote := range repo.remoteUrls() {
+		if remoteConfig, exists := cfg.Remotes[remote.Name]; exists {
+			if len(remoteConfig.URLs) == 1 && remoteConfig.URLs[0] == remote.Url {
+				continue
+			}
+			remoteConfig.URLs = []string{remote.Url}
+		} else {
+			cfg.Remotes[remote.Name] = &config.RemoteConfig{
+				Name:  remote.Name,
+				URLs:  []string{remote.Url},
+				Fetch: []config.RefSpec{config.RefSpec(fmt.Sprintf(config.DefaultFetchRefSpec, remote.Name))},
+			}
 		}
+		isChanged = true
+	}
+
+	if !isChanged {
+		return nil
+	}
+
+	if err := rawRepo.Storer.SetConfig(cfg); err != nil {
+		return fmt.Errorf("cannot update remotes of repo `%s`: %s", repo.String(), err)
+	}
+
+	return nil
+}
+
+func (repo *Remote) cloneOptions() *git.CloneOptions {
+	opts := &git.CloneOptions{
+		URL:               repo.Url,
+		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+		Depth:             repo.Depth,
+		Tags:              repo.tagMode(),
+	}
 
-		fmt.Printf("Fetching remote `%s` of repo `%s` ...\n", remoteName, repo.String())
+	// The first ref is cloned, other refs are fetched after clone
+	if len(repo.Branches) > 0 {
+		opts.ReferenceName = plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", repo.Branches[0]))
+		opts.SingleBranch = true
+	} else if len(repo.Tags) > 0 {
+		opts.ReferenceName = plumbing.ReferenceName(fmt.Sprintf("refs/tags/%s", repo.Tags[0]))
+		opts.SingleBranch = true
+	}
+
+	return opts
+}
+
+// isTagConstraintClone means that the only ref of the clone is semver constraint, all tags should be fetched then
+func (repo *Remote) isTagConstraintClone() bool {
+	return len(repo.Branches) == 0 && len(repo.Tags) > 0 && IsTagConstraint(repo.Tags[0])
+}
 
-		err = rawRepo.Fetch(&git.FetchOptions{RemoteName: remoteName})
-		if err != nil && err != git.NoErrAlreadyUpToDate {
-			return fmt.Errorf("cannot fetch remote `%s` of repo `%s`: %s", remoteName, repo.String(), err)
+// refSpecs are passed to every fetch, because the clone config may be limited to refs of another git artifact
+func (repo *Remote) refSpecs(name string) []config.RefSpec {
+	if len(repo.Branches) == 0 && len(repo.Tags) == 0 {
+		return []config.RefSpec{config.RefSpec(fmt.Sprintf(config.DefaultFetchRefSpec, name))}
+	}
+
+	var res []config.RefSpec
+	for _, branch := range repo.Branches {
+		res = append(res, config.RefSpec(fmt.Sprintf("+refs/heads/%s:refs/remotes/%s/%s", branch, name, branch)))
+	}
+	for _, tag := range repo.Tags {
+		if IsTagConstraint(tag) {
+			tag = "*"
 		}
+		res = append(res, config.RefSpec(fmt.Sprintf("+refs/tags/%s:refs/tags/%s", tag, tag)))
+	}
 
-		fmt.Printf("Fetching remote `%s` of repo `%s` DONE\n", remoteName, repo.String())
+	return res
+}
 
-		return nil
+func (repo *Remote) tagMode() git.TagMode {
+	if len(repo.Branches) == 0 && len(repo.Tags) == 0 {
+		return git.TagFollowing
+	}
+	return git.NoTags
+}
+
+func (repo *Remote) isShallow() (bool, error) {
+	rawRepo, err := git.PlainOpen(repo.ClonePath)
+	if err != nil {
+		return false, fmt.Errorf("cannot open repo: %s", err)
+	}
+
+	shallows, err := rawRepo.Storer.Shallow()
+	if err != nil {
+		return false, err
+	}
+
+	return len(shallows) > 0, nil
+}
+
+// deepen fetches more history of the shallow clone until the commit is found or the whole history is fetched,
+// full id of the found commit is returned
+func (repo *Remote) deepen(commit string) (string, error) {
+	var res string
+
+	err := repo.withLock(func() error {
+		if err := repo.syncRemotesConfig(repo.ClonePath); err != nil {
+			return err
+		}
+
+		depth := repo.Depth
+
+		for step := 0; ; step++ {
+			var err error
+
+			res, err = repo.resolveCommit(repo.ClonePath, commit)
+			if err != nil || res != "" {
+				return err
+			}
+
+			isShallow, err := repo.isShallow()
+			if err != nil || !isShallow {
+				return err
+			}
+
+			opts := git_util.FetchOptions{}
+			if depth > 0 && step < maxDeepenSteps {
+				opts.Deepen = depth
+				depth *= 2
+			} else {
+				opts.Unshallow = true
+			}
+
+			err = repo.withRemoteUrls("deepen", func(ctx context.Context, remote remoteUrl) error {
+				fmt.Printf("Deepening remote `%s` of repo `%s` to find commit `%s` ...\n", remote.Name, repo.String(), commit)
+
+				opts.RemoteName = remote.Name
+				opts.RefSpecs = nil
+				for _, refSpec := range repo.refSpecs(remote.Name) {
+					opts.RefSpecs = append(opts.RefSpecs, refSpec.String())
+				}
+
+				err := repo.withAuth(remote.Url, func(auth *remoteAuth) error {
+					env, err := auth.CliEnv()
+					if err != nil {
+						return err
+					}
+					opts.Env = env
+
+					return git_util.FetchContext(ctx, repo.ClonePath, opts)
+				})
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("Deepening remote `%s` of repo `%s` to find commit `%s` DONE\n", remote.Name, repo.String(), commit)
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
 	})
+
+	return res, err
+}
+
+// openHandle opens the clone, submodules are cloned into the clone modules directory when needed
+func (repo *Remote) openHandle() (*repoHandle, error) {
+	return openRepoHandle(repo.String(), repo.ClonePath, repo.Url, !repo.IsDryRun)
 }
 
 func (repo *Remote) ArchiveType(opts ArchiveOptions) (ArchiveType, error) {
-	return repo.archiveType(repo.ClonePath, opts)
+	h, err := repo.openHandle()
+	if err != nil {
+		return "", err
+	}
+	return repo.archiveType(h, opts)
 }
 
 func (repo *Remote) HeadCommit() (string, error) {
@@ -181,7 +492,12 @@ func (repo *Remote) findReference(rawRepo *git.Repository, reference string) (st
 
 	err = refs.ForEach(func(ref *plumbing.Reference) error {
 		if ref.Name().String() == reference {
-			res = fmt.Sprintf("%s", ref.Hash())
+			commit, err := peelCommit(rawRepo, ref.Hash())
+			if err != nil {
+				return err
+			}
+
+			res = commit.String()
 			return storer.ErrStop
 		}
 
@@ -202,12 +518,18 @@ func (repo *Remote) LatestBranchCommit(branch string) (string, error) {
 		return "", fmt.Errorf("cannot open repo: %s", err)
 	}
 
-	res, err := repo.findReference(rawRepo, fmt.Sprintf("refs/remotes/origin/%s", branch))
-	if err != nil {
-		return "", err
+	var res string
+	for _, name := range repo.refRemoteNames() {
+		res, err = repo.findReference(rawRepo, fmt.Sprintf("refs/remotes/%s/%s", name, branch))
+		if err != nil {
+			return "", err
+		}
+		if res != "" {
+			break
+		}
 	}
 	if res == "" {
-		return "", fmt.Errorf("unknown branch `%s` of repo `%s`", branch, repo.String())
+		return "", &ReferenceNotFoundError{Repo: repo.String(), Kind: "branch", Name: branch}
 	}
 
 	fmt.Printf("Using commit `%s` of repo `%s` branch `%s`\n", res, repo.String(), branch)
@@ -223,12 +545,26 @@ func (repo *Remote) LatestTagCommit(tag string) (string, error) {
 		return "", fmt.Errorf("cannot open repo: %s", err)
 	}
 
+	if IsTagConstraint(tag) {
+		matchingTag, res, err := latestMatchingTag(rawRepo, tag)
+		if err != nil {
+			return "", err
+		}
+		if res == "" {
+			return "", &ReferenceNotFoundError{Repo: repo.String(), Kind: "tag", Name: tag}
+		}
+
+		fmt.Printf("Using commit `%s` of repo `%s` tag `%s` matching `%s`\n", res, repo.String(), matchingTag, tag)
+
+		return res, nil
+	}
+
 	res, err := repo.findReference(rawRepo, fmt.Sprintf("refs/tags/%s", tag))
 	if err != nil {
 		return "", err
 	}
 	if res == "" {
-		return "", fmt.Errorf("unknown tag `%s` of repo `%s`", tag, repo.String())
+		return "", &ReferenceNotFoundError{Repo: repo.String(), Kind: "tag", Name: tag}
 	}
 
 	fmt.Printf("Using commit `%s` of repo `%s` tag `%s`\n", res, repo.String(), tag)
@@ -236,14 +572,50 @@ func (repo *Remote) LatestTagCommit(tag string) (string, error) {
 	return res, nil
 }
 
+// IsCommitExists deepens the shallow clone when the commit is missing
+func (repo *Remote) IsCommitExists(commit string) (bool, error) {
+	res, err := repo.ResolveCommit(commit)
+	return res != "", err
+}
+
+// ResolveCommit deepens the shallow clone when the commit is missing
+func (repo *Remote) ResolveCommit(commit string) (string, error) {
+	res, err := repo.resolveCommit(repo.ClonePath, commit)
+	if err != nil || res != "" || repo.IsDryRun {
+		return res, err
+	}
+
+	return repo.deepen(commit)
+}
+
 func (repo *Remote) CreatePatch(opts PatchOptions) (Patch, error) {
-	return repo.createPatch(repo.ClonePath, opts)
+	h, err := repo.openHandle()
+	if err != nil {
+		return nil, err
+	}
+	return repo.createPatch(h, opts)
 }
 
 func (repo *Remote) IsAnyEntries(opts ArchiveOptions) (bool, error) {
-	return repo.isAnyEntries(repo.ClonePath, opts)
+	h, err := repo.openHandle()
+	if err != nil {
+		return false, err
+	}
+	return repo.isAnyEntries(h, opts)
 }
 
 func (repo *Remote) CreateArchiveTar(output io.Writer, opts ArchiveOptions) error {
-	return repo.createArchiveTar(repo.ClonePath, output, opts)
+	h, err := repo.openHandle()
+	if err != nil {
+		return err
+	}
+	return repo.createArchiveTar(h, output, opts)
+}
+
+func (repo *Remote) ArchiveChecksum(opts ArchiveOptions) (string, error) {
+	h, err := repo.openHandle()
+	if err != nil {
+		return "", err
+	}
+	return repo.archiveChecksum(h, opts)
 }
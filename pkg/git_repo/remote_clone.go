@@ -0,0 +1,366 @@
+package git_repo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	git "github.com/flant/go-git"
+	"github.com/flant/go-git/config"
+	"github.com/flant/go-git/plumbing"
+	"github.com/flant/go-git/plumbing/filemode"
+	"github.com/flant/go-git/plumbing/format/packfile"
+	"github.com/flant/go-git/plumbing/object"
+	"github.com/flant/go-git/plumbing/storer"
+)
+
+// RepackGracePeriod is the time old packs are kept after repack for builds, which read the clone without the lock,
+// loose objects younger than the period are kept too
+var RepackGracePeriod = 24 * time.Hour
+
+// RemoteClone is a clone of remote git repo cached in the build dir,
+// clones are in <dir>/<cache version>/<name slug or url>/<protocol or url hash>
+type RemoteClone struct {
+	Path string
+	// Url is the url of origin remote, it is empty when the clone config is broken
+	Url     string
+	Mirrors []string
+	Size    int64
+	// LastUsedAt is modification time of the clone dir, it is updated by every clone and fetch
+	LastUsedAt time.Time
+}
+
+// ListRemoteClones returns clones of the dir, which may be broken, sorted by path
+func ListRemoteClones(dir string) ([]*RemoteClone, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var res []*RemoteClone
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			continue
+		}
+
+		clone := &RemoteClone{Path: path, LastUsedAt: fi.ModTime()}
+
+		clone.Size, err = dirSize(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if data, err := ioutil.ReadFile(filepath.Join(path, "config")); err == nil {
+			cfg := config.NewConfig()
+			if err := cfg.Unmarshal(data); err == nil {
+				for name, remote := range cfg.Remotes {
+					if len(remote.URLs) == 0 {
+						continue
+					}
+					if name == remoteName {
+						clone.Url = remote.URLs[0]
+					} else if strings.HasPrefix(name, "mirror-") {
+						clone.Mirrors = append(clone.Mirrors, remote.URLs[0])
+					}
+				}
+				sort.Strings(clone.Mirrors)
+			}
+		}
+
+		res = append(res, clone)
+	}
+
+	return res, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// touch updates the last use time of the clone
+func (repo *Remote) touch() error {
+	now := time.Now()
+	if err := os.Chtimes(repo.ClonePath, now, now); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Verify reads all objects of refs and checks their hashes
+func (repo *Remote) Verify() error {
+	return repo.withLock(func() error {
+		rawRepo, err := git.PlainOpen(repo.ClonePath)
+		if err != nil {
+			return fmt.Errorf("cannot open repo: %s", err)
+		}
+
+		_, err = walkRefsObjects(rawRepo, true)
+		return err
+	})
+}
+
+// Gc packs objects of refs into the new pack, other packs and loose objects are removed after RepackGracePeriod
+func (repo *Remote) Gc() error {
+	return repo.withLock(func() error {
+		rawRepo, err := git.PlainOpen(repo.ClonePath)
+		if err != nil {
+			return fmt.Errorf("cannot open repo: %s", err)
+		}
+
+		fmt.Printf("Repacking remote git repo `%s` ...\n", repo.String())
+
+		if err := repack(rawRepo, filepath.Join(repo.ClonePath, "objects", "pack")); err != nil {
+			return fmt.Errorf("cannot repack remote git repo `%s`: %s", repo.String(), err)
+		}
+
+		fmt.Printf("Repacking remote git repo `%s` DONE\n", repo.String())
+
+		return nil
+	})
+}
+
+// Reclone removes the clone and clones the repo again
+func (repo *Remote) Reclone() error {
+	return repo.withLock(func() error {
+		if err := os.RemoveAll(repo.ClonePath); err != nil {
+			return err
+		}
+
+		return repo.CloneAndFetch()
+	})
+}
+
+// RemoveClone removes the clone, it is cloned again by the next build
+func (repo *Remote) RemoveClone() error {
+	return repo.withLock(func() error {
+		return os.RemoveAll(repo.ClonePath)
+	})
+}
+
+// walkRefsObjects returns objects, which are reachable from refs. Parents of shallow commits
+// and commits of submodules are not in the clone, so they are skipped.
+// Blobs are read and all objects hashes are checked with verify.
+func walkRefsObjects(rawRepo *git.Repository, verify bool) ([]plumbing.Hash, error) {
+	shallows, err := rawRepo.Storer.Shallow()
+	if err != nil {
+		return nil, err
+	}
+	isShallow := make(map[plumbing.Hash]bool)
+	for _, h := range shallows {
+		isShallow[h] = true
+	}
+
+	var stack []plumbing.Hash
+
+	refs, err := rawRepo.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			stack = append(stack, ref.Hash())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	var res []plumbing.Hash
+
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		res = append(res, h)
+
+		obj, err := rawRepo.Storer.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read object `%s`: %s", h, err)
+		}
+
+		if verify {
+			if err := verifyObject(obj, h); err != nil {
+				return nil, err
+			}
+		}
+
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			commit := &object.Commit{}
+			if err := commit.Decode(obj); err != nil {
+				return nil, fmt.Errorf("cannot decode commit `%s`: %s", h, err)
+			}
+
+			stack = append(stack, commit.TreeHash)
+			if !isShallow[h] {
+				stack = append(stack, commit.ParentHashes...)
+			}
+		case plumbing.TreeObject:
+			tree := &object.Tree{}
+			if err := tree.Decode(obj); err != nil {
+				return nil, fmt.Errorf("cannot decode tree `%s`: %s", h, err)
+			}
+
+			for _, entry := range tree.Entries {
+				switch {
+				case entry.Mode == filemode.Submodule:
+				case entry.Mode == filemode.Dir || verify:
+					stack = append(stack, entry.Hash)
+				case !seen[entry.Hash]:
+					// Blobs are not read without verify
+					seen[entry.Hash] = true
+					res = append(res, entry.Hash)
+				}
+			}
+		case plumbing.TagObject:
+			tag := &object.Tag{}
+			if err := tag.Decode(obj); err != nil {
+				return nil, fmt.Errorf("cannot decode tag `%s`: %s", h, err)
+			}
+
+			stack = append(stack, tag.Target)
+		}
+	}
+
+	return res, nil
+}
+
+func verifyObject(obj plumbing.EncodedObject, h plumbing.Hash) error {
+	r, err := obj.Reader()
+	if err != nil {
+		return fmt.Errorf("cannot read object `%s`: %s", h, err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("cannot read object `%s`: %s", h, err)
+	}
+
+	if computed := plumbing.ComputeHash(obj.Type(), data); computed != h {
+		return fmt.Errorf("object `%s` is corrupted: content hash is `%s`", h, computed)
+	}
+
+	return nil
+}
+
+// repack is used instead of go-git RepackObjects, which fails on shallow clones and submodules.
+// Old pack is marked as superseded by repack and removed by the next repack after RepackGracePeriod,
+// so that builds, which have opened the pack before, can read it.
+func repack(rawRepo *git.Repository, packDir string) error {
+	pos, isPackedStorer := rawRepo.Storer.(storer.PackedObjectStorer)
+	los, isLooseStorer := rawRepo.Storer.(storer.LooseObjectStorer)
+	pfw, isPackfileWriter := rawRepo.Storer.(storer.PackfileWriter)
+	if !isPackedStorer || !isLooseStorer || !isPackfileWriter {
+		return fmt.Errorf("repack is not supported by the repo storage")
+	}
+
+	objects, err := walkRefsObjects(rawRepo, false)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return nil
+	}
+
+	oldPacks, err := pos.ObjectPacks()
+	if err != nil {
+		return err
+	}
+
+	w, err := pfw.PackfileWriter()
+	if err != nil {
+		return err
+	}
+
+	packHash, err := packfile.NewEncoder(w, rawRepo.Storer, false).Encode(objects, 10)
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-RepackGracePeriod)
+
+	for _, h := range oldPacks {
+		if h == packHash {
+			continue
+		}
+
+		supersededPath := filepath.Join(packDir, fmt.Sprintf("pack-%s.superseded", h))
+
+		fi, err := os.Stat(supersededPath)
+		if os.IsNotExist(err) {
+			if err := ioutil.WriteFile(supersededPath, nil, 0644); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if fi.ModTime().After(cutoff) {
+			continue
+		}
+
+		if err := pos.DeleteOldObjectPackAndIndex(h, time.Time{}); err != nil {
+			return err
+		}
+		if err := os.Remove(supersededPath); err != nil {
+			return err
+		}
+	}
+
+	var looseObjects []plumbing.Hash
+	err = los.ForEachObjectHash(func(h plumbing.Hash) error {
+		looseObjects = append(looseObjects, h)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, h := range looseObjects {
+		modTime, err := los.LooseObjectTime(h)
+		if err != nil {
+			return err
+		}
+		if modTime.After(cutoff) {
+			continue
+		}
+
+		if err := los.DeleteLooseObject(h); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package git_repo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flant/dapp/pkg/lock"
+)
+
+func TestRemoteCloneMaintenance(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "dapp-remote-clone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	lock.LocksDir = filepath.Join(tmpDir, "locks")
+	if err := lock.InitWithOptions(lock.InitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	originDir := filepath.Join(tmpDir, "origin")
+	if err := os.MkdirAll(originDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, originDir, "init", "-q")
+	runGit(t, originDir, "checkout", "-q", "-b", "master")
+	for i := 0; i < 3; i++ {
+		writeTestFiles(t, originDir, map[string]*testFile{"file.txt": {fmt.Sprintf("v%d\n", i), 0644}})
+		runGit(t, originDir, "add", "-A")
+		runGit(t, originDir, "commit", "-q", "-m", fmt.Sprintf("v%d", i))
+	}
+	// Commit of submodule is not in the clone
+	runGit(t, originDir, "update-index", "--add", "--cacheinfo", "160000,0000000000000000000000000000000000000001,lib")
+	runGit(t, originDir, "commit", "-q", "-m", "submodule")
+	headCommit := runGit(t, originDir, "rev-parse", "HEAD")
+
+	dir := filepath.Join(tmpDir, "remote_git_repo")
+	newRemote := func(protocol string, depth int) *Remote {
+		return &Remote{
+			Base:      Base{Name: "company/origin"},
+			Url:       fmt.Sprintf("file://%s", originDir),
+			ClonePath: filepath.Join(dir, "3", "company-origin", protocol),
+			Depth:     depth,
+			Branches:  []string{"master"},
+		}
+	}
+
+	repos := []*Remote{newRemote("file", 0), newRemote("shallow", 1)}
+	for _, repo := range repos {
+		if err := repo.CloneAndFetch(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clones, err := ListRemoteClones(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clones) != 2 || clones[0].Path != repos[0].ClonePath || clones[0].Url != repos[0].Url || clones[0].Size == 0 {
+		t.Fatalf("unexpected clones %+v", clones)
+	}
+
+	defer func(period time.Duration) { RepackGracePeriod = period }(RepackGracePeriod)
+
+	for _, repo := range repos {
+		if err := repo.Verify(); err != nil {
+			t.Fatalf("%s: %s", repo.ClonePath, err)
+		}
+
+		// Objects are read by builds without the lock, so old packs are kept after the first repack
+		oldPacks, err := filepath.Glob(filepath.Join(repo.ClonePath, "objects", "pack", "*.pack"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		RepackGracePeriod = time.Hour
+		if err := repo.Gc(); err != nil {
+			t.Fatalf("%s: %s", repo.ClonePath, err)
+		}
+		for _, path := range oldPacks {
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("%s: old pack should be kept within grace period: %s", repo.ClonePath, err)
+			}
+		}
+
+		RepackGracePeriod = 0
+		if err := repo.Gc(); err != nil {
+			t.Fatalf("%s: %s", repo.ClonePath, err)
+		}
+
+		packs, err := filepath.Glob(filepath.Join(repo.ClonePath, "objects", "pack", "*.pack"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		loose, err := filepath.Glob(filepath.Join(repo.ClonePath, "objects", "??", "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packs) != 1 || len(loose) != 0 {
+			t.Errorf("%s: objects should be in a single pack, got packs %v and loose objects %v", repo.ClonePath, packs, loose)
+		}
+
+		if err := repo.Verify(); err != nil {
+			t.Errorf("%s: repacked clone should be valid: %s", repo.ClonePath, err)
+		}
+		if commit, err := repo.LatestBranchCommit("master"); err != nil || commit != headCommit {
+			t.Errorf("%s: unexpected master commit %s: %v", repo.ClonePath, commit, err)
+		}
+		runGit(t, repo.ClonePath, "fsck", "--no-dangling")
+	}
+
+	repo := repos[0]
+	packs, err := filepath.Glob(filepath.Join(repo.ClonePath, "objects", "pack", "*.pack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range packs {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := repo.Verify(); err == nil {
+		t.Fatalf("clone without objects should be broken")
+	}
+	if err := repo.Reclone(); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Verify(); err != nil {
+		t.Errorf("clone should be valid after reclone: %s", err)
+	}
+
+	if err := repos[1].RemoveClone(); err != nil {
+		t.Fatal(err)
+	}
+	if clones, err := ListRemoteClones(dir); err != nil || len(clones) != 1 {
+		t.Errorf("removed clone should not be listed, got %+v: %v", clones, err)
+	}
+}
@@ -0,0 +1,280 @@
+package git_repo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flant/dapp/pkg/lock"
+	git "github.com/flant/go-git"
+)
+
+func TestRemoteShallowClone(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "dapp-remote-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	lock.LocksDir = filepath.Join(tmpDir, "locks")
+	if err := lock.InitWithOptions(lock.InitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	originDir := filepath.Join(tmpDir, "origin")
+	if err := os.MkdirAll(originDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, originDir, "init", "-q")
+	runGit(t, originDir, "checkout", "-q", "-b", "master")
+
+	var commits []string
+	for i := 0; i < 8; i++ {
+		writeTestFiles(t, originDir, map[string]*testFile{"file.txt": {fmt.Sprintf("v%d\n", i), 0644}})
+		runGit(t, originDir, "add", "-A")
+		runGit(t, originDir, "commit", "-q", "-m", fmt.Sprintf("v%d", i))
+		commits = append(commits, runGit(t, originDir, "rev-parse", "HEAD"))
+	}
+	runGit(t, originDir, "tag", "v1", commits[1])
+	runGit(t, originDir, "branch", "other", commits[2])
+
+	newRemote := func(branches, tags []string) *Remote {
+		return &Remote{
+			Base:      Base{Name: "origin"},
+			Url:       fmt.Sprintf("file://%s", originDir),
+			ClonePath: filepath.Join(tmpDir, "clone"),
+			Depth:     1,
+			Branches:  branches,
+			Tags:      tags,
+		}
+	}
+
+	repo := newRemote([]string{"master"}, nil)
+	if err := repo.CloneAndFetch(); err != nil {
+		t.Fatal(err)
+	}
+
+	rawRepo, err := git.PlainOpen(repo.ClonePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs := map[string]bool{}
+	iter, err := rawRepo.References()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref, err := iter.Next(); err == nil; ref, err = iter.Next() {
+		refs[ref.Name().String()] = true
+	}
+	if !refs["refs/remotes/origin/master"] || refs["refs/remotes/origin/other"] || refs["refs/tags/v1"] {
+		t.Errorf("only configured branch should be fetched, got %v", refs)
+	}
+
+	if commit, err := repo.LatestBranchCommit("master"); err != nil || commit != commits[7] {
+		t.Errorf("unexpected master commit %s: %v", commit, err)
+	}
+
+	if exists, err := repo.isCommitExists(repo.ClonePath, commits[5]); err != nil || exists {
+		t.Fatalf("commit should be out of shallow clone history: %v", err)
+	}
+
+	if exists, err := repo.IsCommitExists(commits[5]); err != nil || !exists {
+		t.Errorf("clone should be deepened to the commit: %v", err)
+	}
+	if isShallow, err := repo.isShallow(); err != nil || !isShallow {
+		t.Errorf("clone should be deepened rather than unshallowed: %v", err)
+	}
+
+	if exists, err := repo.IsCommitExists(commits[0]); err != nil || !exists {
+		t.Errorf("clone should be deepened to the first commit: %v", err)
+	}
+
+	missingCommit := "0000000000000000000000000000000000000001"
+	if exists, err := repo.IsCommitExists(missingCommit); err != nil || exists {
+		t.Errorf("missing commit should not be found: %v", err)
+	}
+
+	otherRepo := newRemote([]string{"other"}, []string{"v1"})
+	if err := otherRepo.CloneAndFetch(); err != nil {
+		t.Fatal(err)
+	}
+	if commit, err := otherRepo.LatestBranchCommit("other"); err != nil || commit != commits[2] {
+		t.Errorf("unexpected other commit %s: %v", commit, err)
+	}
+	if commit, err := otherRepo.LatestTagCommit("v1"); err != nil || commit != commits[1] {
+		t.Errorf("unexpected v1 commit %s: %v", commit, err)
+	}
+}
+
+func TestRemoteRefResolution(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "dapp-remote-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	lock.LocksDir = filepath.Join(tmpDir, "locks")
+	if err := lock.InitWithOptions(lock.InitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	originDir := filepath.Join(tmpDir, "origin")
+	if err := os.MkdirAll(originDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, originDir, "init", "-q")
+	runGit(t, originDir, "checkout", "-q", "-b", "master")
+
+	commits := map[string]string{}
+	for _, tag := range []string{"v1.3.0", "v1.4.0", "v1.4.2", "v1.5.0", "v2.0.0", "release"} {
+		writeTestFiles(t, originDir, map[string]*testFile{"file.txt": {tag + "\n", 0644}})
+		runGit(t, originDir, "add", "-A")
+		runGit(t, originDir, "commit", "-q", "-m", tag)
+		runGit(t, originDir, "tag", "-a", "-m", tag, tag)
+		commits[tag] = runGit(t, originDir, "rev-parse", "HEAD")
+	}
+
+	newRemote := func(name string, tags []string) *Remote {
+		return &Remote{
+			Base:      Base{Name: name},
+			Url:       fmt.Sprintf("file://%s", originDir),
+			ClonePath: filepath.Join(tmpDir, name),
+			Depth:     1,
+			Tags:      tags,
+		}
+	}
+
+	repo := newRemote("exact", []string{"v1.4.2"})
+	if err := repo.CloneAndFetch(); err != nil {
+		t.Fatal(err)
+	}
+	if commit, err := repo.LatestTagCommit("v1.4.2"); err != nil || commit != commits["v1.4.2"] {
+		t.Errorf("annotated tag should be peeled to commit %s, got %s: %v", commits["v1.4.2"], commit, err)
+	}
+
+	for constraint, expectedTag := range map[string]string{"~1.4": "v1.4.2", "^1.3": "v1.5.0", ">= 1.3, < 1.4": "v1.3.0", "*": "v2.0.0"} {
+		repo := newRemote("constraint", []string{constraint})
+		if err := repo.CloneAndFetch(); err != nil {
+			t.Fatal(err)
+		}
+		if commit, err := repo.LatestTagCommit(constraint); err != nil || commit != commits[expectedTag] {
+			t.Errorf("tag constraint `%s` should be resolved to %s commit %s, got %s: %v", constraint, expectedTag, commits[expectedTag], commit, err)
+		}
+	}
+
+	if _, err := newRemote("constraint", []string{"~3"}).LatestTagCommit("~3"); err == nil {
+		t.Errorf("tag constraint without matching tags should fail")
+	}
+
+	if IsTagConstraint("release") || IsTagConstraint("v1.4.2") || !IsTagConstraint("~1.4") {
+		t.Errorf("unexpected tag constraint detection")
+	}
+
+	shortCommit := commits["v1.3.0"][:7]
+	if commit, err := repo.ResolveCommit(shortCommit); err != nil || commit != commits["v1.3.0"] {
+		t.Errorf("abbreviated commit should be resolved with deepening to %s, got %s: %v", commits["v1.3.0"], commit, err)
+	}
+	if commit, err := repo.ResolveCommit(commits["v1.4.0"]); err != nil || commit != commits["v1.4.0"] {
+		t.Errorf("full commit should be resolved to itself, got %s: %v", commit, err)
+	}
+	if _, err := repo.ResolveCommit("xyz"); err == nil {
+		t.Errorf("bad commit should fail")
+	}
+}
+
+func TestRemoteMirrors(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "dapp-remote-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	lock.LocksDir = filepath.Join(tmpDir, "locks")
+	if err := lock.InitWithOptions(lock.InitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	originDir := filepath.Join(tmpDir, "origin")
+	if err := os.MkdirAll(originDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, originDir, "init", "-q")
+	runGit(t, originDir, "checkout", "-q", "-b", "master")
+	writeTestFiles(t, originDir, map[string]*testFile{"file.txt": {"v1\n", 0644}})
+	runGit(t, originDir, "add", "-A")
+	runGit(t, originDir, "commit", "-q", "-m", "v1")
+	firstCommit := runGit(t, originDir, "rev-parse", "HEAD")
+
+	originUrl := fmt.Sprintf("file://%s", originDir)
+	missingUrl := fmt.Sprintf("file://%s", filepath.Join(tmpDir, "missing"))
+
+	newRemote := func(url string, mirrors []string) *Remote {
+		return &Remote{
+			Base:          Base{Name: "origin"},
+			Url:           url,
+			ClonePath:     filepath.Join(tmpDir, "clone"),
+			Branches:      []string{"master"},
+			Mirrors:       mirrors,
+			MirrorTimeout: 30 * time.Second,
+		}
+	}
+
+	repo := newRemote(missingUrl, []string{originUrl})
+	if err := repo.CloneAndFetch(); err != nil {
+		t.Fatalf("clone should fall back to mirror: %s", err)
+	}
+	if commit, err := repo.LatestBranchCommit("master"); err != nil || commit != firstCommit {
+		t.Errorf("unexpected master commit %s: %v", commit, err)
+	}
+
+	rawRepo, err := git.PlainOpen(repo.ClonePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := rawRepo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote, exists := cfg.Remotes[remoteName]; !exists || remote.URLs[0] != missingUrl {
+		t.Errorf("remote of url should be added to the clone")
+	}
+	if remote, exists := cfg.Remotes[mirrorRemoteName(originUrl)]; !exists || remote.URLs[0] != originUrl {
+		t.Errorf("remote of mirror should be added to the clone")
+	}
+
+	writeTestFiles(t, originDir, map[string]*testFile{"file.txt": {"v2\n", 0644}})
+	runGit(t, originDir, "commit", "-q", "-a", "-m", "v2")
+	secondCommit := runGit(t, originDir, "rev-parse", "HEAD")
+
+	// Url is changed to the working one, mirror refs remain in the same clone
+	repo = newRemote(originUrl, []string{missingUrl})
+	if err := repo.CloneAndFetch(); err != nil {
+		t.Fatal(err)
+	}
+	if commit, err := repo.LatestBranchCommit("master"); err != nil || commit != secondCommit {
+		t.Errorf("unexpected master commit %s: %v", commit, err)
+	}
+
+	repo = newRemote(missingUrl, []string{filepath.Join(tmpDir, "other-missing")})
+	if err := repo.Fetch(); err == nil || !strings.Contains(err.Error(), "all mirrors failed") {
+		t.Errorf("fetch should fail when all mirrors fail, got %v", err)
+	}
+}
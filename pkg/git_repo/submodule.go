@@ -0,0 +1,353 @@
+package git_repo
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flant/dapp/pkg/dapp"
+	git_util "github.com/flant/dapp/pkg/git"
+	"github.com/flant/dapp/pkg/lock"
+	git "github.com/flant/go-git"
+	"github.com/flant/go-git/config"
+	"github.com/flant/go-git/plumbing"
+	"github.com/flant/go-git/plumbing/cache"
+	"github.com/flant/go-git/plumbing/filemode"
+	"github.com/flant/go-git/plumbing/object"
+	"github.com/flant/go-git/storage/filesystem"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+// repoHandle is an opened repo or submodule repo with the location of its submodules
+type repoHandle struct {
+	Name       string
+	Repository *git.Repository
+	// GitDir contains submodules repos in modules/<name> as git does
+	GitDir string
+	// Url is used to resolve relative submodules urls
+	Url string
+	// CloneMissing enables clone and fetch of submodules repos under LockName,
+	// submodules of local repos should be initialized by user
+	CloneMissing bool
+	LockName     string
+}
+
+func openRepoHandle(name, repoPath, url string, cloneMissing bool) (*repoHandle, error) {
+	repository, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open repo: %s", err)
+	}
+
+	gitDir, err := resolveGitDir(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &repoHandle{
+		Name:         name,
+		Repository:   repository,
+		GitDir:       gitDir,
+		Url:          url,
+		CloneMissing: cloneMissing,
+		LockName:     fmt.Sprintf("remote_git_artifact.%s", name),
+	}, nil
+}
+
+// resolveGitDir returns git directory of the repo, which is the repo itself for bare repos
+// and could be referenced by `.git` file for worktrees and submodules
+func resolveGitDir(repoPath string) (string, error) {
+	dotGitPath := filepath.Join(repoPath, ".git")
+
+	fi, err := os.Stat(dotGitPath)
+	if os.IsNotExist(err) {
+		return repoPath, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if fi.IsDir() {
+		return dotGitPath, nil
+	}
+
+	data, err := ioutil.ReadFile(dotGitPath)
+	if err != nil {
+		return "", err
+	}
+
+	line := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(line, "gitdir: ") {
+		return "", fmt.Errorf("bad `.git` file `%s`", dotGitPath)
+	}
+
+	gitDir := strings.TrimPrefix(line, "gitdir: ")
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(repoPath, gitDir)
+	}
+
+	return gitDir, nil
+}
+
+func (h *repoHandle) commitTree(commit plumbing.Hash) (*object.Tree, error) {
+	commitObj, err := h.Repository.CommitObject(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	return commitObj.Tree()
+}
+
+// openSubmodule opens repo of submodule by path in the tree of the repo, repo has the commit after that
+func (h *repoHandle) openSubmodule(tree *object.Tree, path string, commit plumbing.Hash) (*repoHandle, error) {
+	submodule, err := findSubmodule(tree, path)
+	if err != nil {
+		return nil, fmt.Errorf("repo `%s`: %s", h.Name, err)
+	}
+
+	sub := &repoHandle{
+		Name:         fmt.Sprintf("%s/%s", h.Name, path),
+		GitDir:       filepath.Join(h.GitDir, "modules", submodule.Name),
+		Url:          resolveSubmoduleUrl(h.Url, submodule.URL),
+		CloneMissing: h.CloneMissing,
+		LockName:     h.LockName,
+	}
+
+	if err := sub.open(commit); err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+func (h *repoHandle) open(commit plumbing.Hash) error {
+	isCommitExists := func() (bool, error) {
+		repository, err := openGitDir(h.GitDir)
+		if err == git.ErrRepositoryNotExists {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("cannot open submodule repo `%s`: %s", h.Name, err)
+		}
+		h.Repository = repository
+
+		_, err = repository.CommitObject(commit)
+		if err == plumbing.ErrObjectNotFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	if exists, err := isCommitExists(); err != nil || exists {
+		return err
+	}
+
+	if !h.CloneMissing {
+		if h.Repository == nil {
+			return fmt.Errorf("submodule `%s` is not initialized: run `git submodule update --init --recursive`", h.Name)
+		}
+		return fmt.Errorf("commit `%s` of submodule `%s` not found: run `git submodule update --recursive`", commit, h.Name)
+	}
+
+	err := lock.WithLock(h.LockName, lock.LockOptions{Timeout: 600 * time.Second}, func() error {
+		if exists, err := isCommitExists(); err != nil || exists {
+			return err
+		}
+
+		if h.Repository == nil {
+			if err := h.clone(); err != nil {
+				return err
+			}
+		}
+
+		return h.fetch()
+	})
+	if err != nil {
+		return err
+	}
+
+	if exists, err := isCommitExists(); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("commit `%s` of submodule `%s` not found in `%s`", commit, h.Name, h.Url)
+	}
+
+	return nil
+}
+
+func (h *repoHandle) clone() error {
+	fmt.Printf("Clone submodule `%s` ...\n", h.Name)
+
+	path := filepath.Join("/tmp", fmt.Sprintf("dapp-git-repo-%s", uuid.NewV4().String()))
+
+	// Partial clone is removed when clone fails or is interrupted
+	defer os.RemoveAll(path)
+
+	_, err := git.PlainCloneContext(dapp.Context(), path, true, &git.CloneOptions{URL: h.Url})
+	if err != nil {
+		return &RemoteError{Repo: h.Name, Operation: "clone", Err: err}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(h.GitDir), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path, h.GitDir); err != nil {
+		return err
+	}
+
+	fmt.Printf("Clone submodule `%s` DONE\n", h.Name)
+
+	repository, err := openGitDir(h.GitDir)
+	if err != nil {
+		return fmt.Errorf("cannot open submodule repo `%s`: %s", h.Name, err)
+	}
+	h.Repository = repository
+
+	return nil
+}
+
+// openGitDir opens git directory without worktree: git initializes submodules gitdirs in .git/modules
+// with core.bare=false and worktree elsewhere, which PlainOpen does not accept
+func openGitDir(gitDir string) (*git.Repository, error) {
+	return git.Open(filesystem.NewStorage(osfs.New(gitDir), cache.NewObjectLRUDefault()), nil)
+}
+
+func (h *repoHandle) fetch() error {
+	fmt.Printf("Fetching submodule `%s` ...\n", h.Name)
+
+	err := h.Repository.FetchContext(dapp.Context(), &git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"},
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return &RemoteError{Repo: h.Name, Operation: "fetch", Err: err}
+	}
+
+	fmt.Printf("Fetching submodule `%s` DONE\n", h.Name)
+
+	return nil
+}
+
+func findSubmodule(tree *object.Tree, path string) (*config.Submodule, error) {
+	file, err := tree.File(".gitmodules")
+	if err == object.ErrFileNotFound {
+		return nil, fmt.Errorf("submodule `%s` is not found: no .gitmodules", path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	modules := config.NewModules()
+	if err := modules.Unmarshal([]byte(contents)); err != nil {
+		return nil, fmt.Errorf("bad .gitmodules: %s", err)
+	}
+
+	for _, submodule := range modules.Submodules {
+		if filepath.Clean(submodule.Path) == filepath.Clean(path) {
+			return submodule, nil
+		}
+	}
+
+	return nil, fmt.Errorf("submodule `%s` is not found in .gitmodules", path)
+}
+
+// resolveSubmoduleUrl resolves `./` and `../` urls relative to the parent repo url as git does
+func resolveSubmoduleUrl(parentUrl, url string) string {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url
+	}
+
+	base := strings.TrimSuffix(parentUrl, "/")
+	for {
+		if strings.HasPrefix(url, "./") {
+			url = url[2:]
+		} else if strings.HasPrefix(url, "../") {
+			url = url[3:]
+
+			i := strings.LastIndexAny(strings.TrimSuffix(base, ":"), "/:")
+			if i == -1 {
+				base = ""
+			} else if base[i] == ':' {
+				base = base[:i+1]
+			} else {
+				base = base[:i]
+			}
+		} else {
+			break
+		}
+	}
+
+	if base == "" || strings.HasSuffix(base, ":") {
+		return base + url
+	}
+
+	return base + "/" + url
+}
+
+// isSubmoduleInBasePath is true when submodule contains base path or is inside base path
+func isSubmoduleInBasePath(path, basePath string) bool {
+	return git_util.IsFileInBasePath(path, basePath) || git_util.IsFileInBasePath(basePath, path)
+}
+
+var errStopWalk = fmt.Errorf("stop walk")
+
+// walkTreeEntries calls f for all entries of the tree except directories, files of submodules related to base path
+// are walked at the pinned commits with the repo of submodule when withSubmodules is set
+func walkTreeEntries(h *repoHandle, tree *object.Tree, prefix, basePath string, withSubmodules bool, f func(t *repoTree, path string, entry *object.TreeEntry) error) error {
+	t := newRepoTree(h, tree, prefix)
+
+	treeWalker := object.NewTreeWalker(tree, true, nil)
+	defer treeWalker.Close()
+
+	for {
+		if err := dapp.Context().Err(); err != nil {
+			return err
+		}
+
+		name, entry, err := treeWalker.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.Mode == filemode.Dir {
+			continue
+		}
+
+		path := prefix + name
+
+		if entry.Mode == filemode.Submodule && withSubmodules && isSubmoduleInBasePath(path, basePath) {
+			sub, err := h.openSubmodule(tree, name, entry.Hash)
+			if err != nil {
+				return err
+			}
+
+			subTree, err := sub.commitTree(entry.Hash)
+			if err != nil {
+				return err
+			}
+
+			if err := walkTreeEntries(sub, subTree, path+"/", basePath, withSubmodules, f); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := f(t, path, &entry); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package git_repo
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flant/dapp/pkg/lock"
+)
+
+func TestResolveSubmoduleUrl(t *testing.T) {
+	for _, expectation := range []struct{ parentUrl, url, result string }{
+		{"https://github.com/company/name.git", "https://github.com/other/lib.git", "https://github.com/other/lib.git"},
+		{"https://github.com/company/name.git", "../lib.git", "https://github.com/company/lib.git"},
+		{"https://github.com/company/name.git", "./lib.git", "https://github.com/company/name.git/lib.git"},
+		{"git@github.com:company/name.git", "../../other/lib.git", "git@github.com:other/lib.git"},
+		{"git@github.com:name.git", "../lib.git", "git@github.com:lib.git"},
+	} {
+		if result := resolveSubmoduleUrl(expectation.parentUrl, expectation.url); result != expectation.result {
+			t.Errorf("%s relative to %s: expected %s, got %s", expectation.url, expectation.parentUrl, expectation.result, result)
+		}
+	}
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	args = append([]string{
+		"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "protocol.file.allow=always",
+	}, args...)
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %s\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func tarFiles(t *testing.T, data []byte) map[string]string {
+	res := make(map[string]string)
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res[header.Name] = string(content)
+	}
+
+	return res
+}
+
+func TestSubmodules(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "dapp-submodules-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	lock.LocksDir = filepath.Join(tmpDir, "locks")
+	if err := lock.InitWithOptions(lock.InitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	libDir := filepath.Join(tmpDir, "lib")
+	appDir := filepath.Join(tmpDir, "app")
+	for _, dir := range []string{libDir, appDir} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, dir, "init", "-q")
+	}
+
+	writeTestFiles(t, libDir, map[string]*testFile{"lib.txt": {"lib v1\n", 0644}})
+	runGit(t, libDir, "add", "-A")
+	runGit(t, libDir, "commit", "-q", "-m", "v1")
+
+	writeTestFiles(t, appDir, map[string]*testFile{"app.txt": {"app\n", 0644}})
+	runGit(t, appDir, "submodule", "add", "-q", libDir, "vendor/lib")
+	runGit(t, appDir, "add", "-A")
+	runGit(t, appDir, "commit", "-q", "-m", "v1")
+	fromCommit := runGit(t, appDir, "rev-parse", "HEAD")
+
+	writeTestFiles(t, libDir, map[string]*testFile{"lib.txt": {"lib v2\n", 0644}})
+	runGit(t, libDir, "commit", "-q", "-a", "-m", "v2")
+	runGit(t, filepath.Join(appDir, "vendor/lib"), "pull", "-q", "origin", "HEAD")
+	runGit(t, appDir, "commit", "-q", "-a", "-m", "v2")
+	toCommit := runGit(t, appDir, "rev-parse", "HEAD")
+
+	clonePath := filepath.Join(tmpDir, "clone")
+	runGit(t, tmpDir, "clone", "-q", "--bare", appDir, clonePath)
+
+	// Submodule gitdir of the checkout is initialized by git in .git/modules with core.bare=false
+	checkoutDir := filepath.Join(tmpDir, "checkout")
+	runGit(t, tmpDir, "clone", "-q", appDir, checkoutDir)
+	runGit(t, checkoutDir, "submodule", "update", "-q", "--init")
+	if bare := runGit(t, filepath.Join(checkoutDir, ".git", "modules", "vendor/lib"), "config", "core.bare"); bare != "false" {
+		t.Fatalf("unexpected core.bare %q of submodule gitdir", bare)
+	}
+
+	repos := []GitRepo{
+		&Local{Base: Base{Name: "own"}, Path: appDir, OrigPath: appDir},
+		&Local{Base: Base{Name: "checkout"}, Path: checkoutDir, OrigPath: checkoutDir},
+		&Remote{Base: Base{Name: "company/app"}, Url: appDir, ClonePath: clonePath},
+	}
+
+	for _, repo := range repos {
+		for _, withSubmodules := range []bool{false, true} {
+			filterOptions := FilterOptions{WithSubmodules: withSubmodules}
+
+			var archive bytes.Buffer
+			if err := repo.CreateArchiveTar(&archive, ArchiveOptions{FilterOptions: filterOptions, Commit: fromCommit}); err != nil {
+				t.Fatalf("%s: %s", repo, err)
+			}
+
+			files := tarFiles(t, archive.Bytes())
+			if content, hasKey := files["vendor/lib/lib.txt"]; withSubmodules && content != "lib v1\n" {
+				t.Errorf("%s: archive should contain submodule file at the pinned commit, got %q", repo, content)
+			} else if !withSubmodules && hasKey {
+				t.Errorf("%s: archive should not contain submodule files without submodules mode", repo)
+			}
+
+			patch, err := repo.CreatePatch(PatchOptions{FilterOptions: filterOptions, FromCommit: fromCommit, ToCommit: toCommit})
+			if err != nil {
+				t.Fatalf("%s: %s", repo, err)
+			}
+
+			data, err := ioutil.ReadFile(patch.GetFilePath())
+			patch.Remove()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hasLibDiff := strings.Contains(string(data), "diff --git a/vendor/lib/lib.txt b/vendor/lib/lib.txt\n") &&
+				strings.Contains(string(data), "-lib v1\n+lib v2\n")
+			if hasLibDiff != withSubmodules {
+				t.Errorf("%s: unexpected patch with submodules mode %v:\n%s", repo, withSubmodules, data)
+			}
+
+			isType, err := repo.ArchiveType(ArchiveOptions{FilterOptions: FilterOptions{BasePath: "vendor/lib/lib.txt", WithSubmodules: true}, Commit: toCommit})
+			if err != nil || isType != FileArchive {
+				t.Errorf("%s: file in submodule should be file archive, got %q: %v", repo, isType, err)
+			}
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(clonePath, "modules", "vendor/lib")); err != nil {
+		t.Errorf("submodule of remote repo should be cloned into the clone modules directory: %s", err)
+	}
+}
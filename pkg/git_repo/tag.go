@@ -0,0 +1,115 @@
+package git_repo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	git "github.com/flant/go-git"
+	"github.com/flant/go-git/plumbing"
+	"github.com/flant/go-git/plumbing/object"
+)
+
+// IsTagConstraint returns true for semver constraints like `~1.4` or `>= 1.2, < 2`,
+// the highest matching tag is used for such tags of git directives
+func IsTagConstraint(tag string) bool {
+	if !strings.ContainsAny(tag, "~^<>=*,| ") {
+		return false
+	}
+
+	_, err := semver.NewConstraint(tag)
+	return err == nil
+}
+
+// peelCommit returns commit of annotated tags chain or the hash itself
+func peelCommit(rawRepo *git.Repository, hash plumbing.Hash) (plumbing.Hash, error) {
+	for {
+		tag, err := rawRepo.TagObject(hash)
+		if err == plumbing.ErrObjectNotFound {
+			return hash, nil
+		} else if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		switch tag.TargetType {
+		case plumbing.CommitObject:
+			return tag.Target, nil
+		case plumbing.TagObject:
+			hash = tag.Target
+		default:
+			return plumbing.ZeroHash, fmt.Errorf("tag `%s` points to %s rather than commit", tag.Name, tag.TargetType)
+		}
+	}
+}
+
+// latestMatchingTag returns the highest semver tag, which matches the constraint, and its commit,
+// tags which are not semver versions are skipped
+func latestMatchingTag(rawRepo *git.Repository, constraint string) (string, string, error) {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return "", "", fmt.Errorf("bad tag constraint `%s`: %s", constraint, err)
+	}
+
+	tags, err := rawRepo.Tags()
+	if err != nil {
+		return "", "", err
+	}
+
+	var resTag *plumbing.Reference
+	var resVersion *semver.Version
+
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		v, err := semver.NewVersion(ref.Name().Short())
+		if err != nil || !c.Check(v) {
+			return nil
+		}
+
+		if resVersion == nil || v.GreaterThan(resVersion) {
+			resTag, resVersion = ref, v
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	if resTag == nil {
+		return "", "", nil
+	}
+
+	commit, err := peelCommit(rawRepo, resTag.Hash())
+	if err != nil {
+		return "", "", err
+	}
+
+	return resTag.Name().Short(), commit.String(), nil
+}
+
+// resolveCommitPrefix returns full id of the abbreviated commit, empty string is returned when commit is not found
+func resolveCommitPrefix(rawRepo *git.Repository, prefix string) (string, error) {
+	var res []string
+
+	iter, err := rawRepo.CommitObjects()
+	if err != nil {
+		return "", err
+	}
+
+	err = iter.ForEach(func(c *object.Commit) error {
+		if hash := c.Hash.String(); strings.HasPrefix(hash, prefix) {
+			res = append(res, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(res) > 1 {
+		return "", fmt.Errorf("abbreviated commit `%s` is ambiguous: %s", prefix, strings.Join(res, ", "))
+	} else if len(res) == 0 {
+		return "", nil
+	}
+
+	return res[0], nil
+}
@@ -0,0 +1,366 @@
+package git_repo
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	git "github.com/flant/go-git"
+	"github.com/flant/go-git/plumbing"
+	"github.com/flant/go-git/plumbing/filemode"
+	"github.com/flant/go-git/plumbing/format/gitignore"
+	"github.com/flant/go-git/plumbing/format/index"
+	"github.com/flant/go-git/plumbing/object"
+)
+
+const workingTreeCommitMessage = "dapp working tree snapshot\n"
+
+// workingTreeSnapshot writes blobs and trees of the working tree and a commit with HEAD parent
+// into the repo objects without references, as `git stash create` does. HEAD commit is returned
+// for the clean working tree. Snapshot of the same working tree has the same commit.
+type workingTreeSnapshot struct {
+	Path          string
+	WithUntracked bool
+
+	repository *git.Repository
+	// indexModTime is used to detect racily clean index entries, which content should be hashed
+	indexModTime int64
+}
+
+func (s *workingTreeSnapshot) Commit() (string, error) {
+	repository, err := git.PlainOpen(s.Path)
+	if err != nil {
+		return "", fmt.Errorf("cannot open repo: %s", err)
+	}
+	s.repository = repository
+
+	head, err := repository.Head()
+	if err != nil {
+		return "", fmt.Errorf("cannot get repo head: %s", err)
+	}
+
+	headCommit, err := repository.CommitObject(head.Hash())
+	if err != nil {
+		return "", err
+	}
+
+	files, err := s.trackedFiles()
+	if err != nil {
+		return "", err
+	}
+
+	if s.WithUntracked {
+		if err := s.addUntrackedFiles(files); err != nil {
+			return "", err
+		}
+	}
+
+	treeHash, err := s.writeTree(files)
+	if err != nil {
+		return "", err
+	}
+
+	if treeHash == headCommit.TreeHash {
+		return headCommit.Hash.String(), nil
+	}
+
+	signature := object.Signature{Name: "dapp", Email: "dapp@localhost", When: headCommit.Committer.When}
+	commit := &object.Commit{
+		Author:       signature,
+		Committer:    signature,
+		Message:      workingTreeCommitMessage,
+		TreeHash:     treeHash,
+		ParentHashes: []plumbing.Hash{headCommit.Hash},
+	}
+
+	return s.writeObject(commit)
+}
+
+func (s *workingTreeSnapshot) trackedFiles() (map[string]*object.TreeEntry, error) {
+	idx, err := s.repository.Storer.Index()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read repo index: %s", err)
+	}
+
+	gitDir, err := resolveGitDir(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(filepath.Join(gitDir, "index")); err == nil {
+		s.indexModTime = fi.ModTime().UnixNano()
+	}
+
+	files := make(map[string]*object.TreeEntry)
+
+	for _, e := range idx.Entries {
+		if _, exists := files[e.Name]; exists {
+			continue
+		}
+
+		// NOTICE: submodules are used at commits of the index rather than checked out commits
+		if e.Mode == filemode.Submodule {
+			files[e.Name] = &object.TreeEntry{Name: e.Name, Mode: e.Mode, Hash: e.Hash}
+			continue
+		}
+
+		var indexEntry *index.Entry
+		if e.Stage == index.Merged {
+			indexEntry = e
+		}
+
+		entry, err := s.fileEntry(e.Name, indexEntry)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			files[e.Name] = entry
+		}
+	}
+
+	return files, nil
+}
+
+// addUntrackedFiles adds files, which are not ignored by .gitignore files and info/exclude
+func (s *workingTreeSnapshot) addUntrackedFiles(files map[string]*object.TreeEntry) error {
+	gitDir, err := resolveGitDir(s.Path)
+	if err != nil {
+		return err
+	}
+
+	patterns, err := readIgnorePatterns(filepath.Join(gitDir, "info", "exclude"), nil)
+	if err != nil {
+		return err
+	}
+
+	return s.walkUntracked("", patterns, files)
+}
+
+func (s *workingTreeSnapshot) walkUntracked(dir string, patterns []gitignore.Pattern, files map[string]*object.TreeEntry) error {
+	var domain []string
+	if dir != "" {
+		domain = strings.Split(dir, "/")
+	}
+
+	dirPatterns, err := readIgnorePatterns(filepath.Join(s.Path, dir, ".gitignore"), domain)
+	if err != nil {
+		return err
+	}
+	patterns = append(append([]gitignore.Pattern{}, patterns...), dirPatterns...)
+	matcher := gitignore.NewMatcher(patterns)
+
+	infos, err := ioutil.ReadDir(filepath.Join(s.Path, dir))
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range infos {
+		path := fi.Name()
+		if dir != "" {
+			path = dir + "/" + path
+		}
+
+		if fi.IsDir() {
+			if fi.Name() == ".git" || matcher.Match(strings.Split(path, "/"), true) {
+				continue
+			}
+
+			// NOTICE: nested repos, which are not added as submodules, are skipped
+			if _, err := os.Lstat(filepath.Join(s.Path, path, ".git")); err == nil {
+				continue
+			}
+
+			if err := s.walkUntracked(path, patterns, files); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, exists := files[path]; exists || matcher.Match(strings.Split(path, "/"), false) {
+			continue
+		}
+
+		entry, err := s.fileEntry(path, nil)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			files[path] = entry
+		}
+	}
+
+	return nil
+}
+
+func readIgnorePatterns(path string, domain []string) ([]gitignore.Pattern, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []gitignore.Pattern
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		res = append(res, gitignore.ParsePattern(line, domain))
+	}
+
+	return res, scanner.Err()
+}
+
+// fileEntry returns entry of the working tree file, nil is returned for the deleted file,
+// hash of the index entry is used when file is not changed since the index was written
+func (s *workingTreeSnapshot) fileEntry(path string, indexEntry *index.Entry) (*object.TreeEntry, error) {
+	fullPath := filepath.Join(s.Path, path)
+
+	fi, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var mode filemode.FileMode
+	var content []byte
+
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		mode = filemode.Symlink
+
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		content = []byte(target)
+	case fi.Mode().IsRegular():
+		mode = filemode.Regular
+		if fi.Mode()&0111 != 0 {
+			mode = filemode.Executable
+		}
+
+		if indexEntry != nil && indexEntry.Mode == mode && int64(indexEntry.Size) == fi.Size() &&
+			indexEntry.ModifiedAt.Equal(fi.ModTime()) && fi.ModTime().UnixNano() < s.indexModTime {
+			return &object.TreeEntry{Name: path, Mode: mode, Hash: indexEntry.Hash}, nil
+		}
+
+		content, err = ioutil.ReadFile(fullPath)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+
+	hash, err := s.writeBlob(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return &object.TreeEntry{Name: path, Mode: mode, Hash: hash}, nil
+}
+
+func (s *workingTreeSnapshot) writeBlob(content []byte) (plumbing.Hash, error) {
+	obj := s.repository.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	obj.SetSize(int64(len(content)))
+
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := w.Write(content); err != nil {
+		w.Close()
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return s.storeObject(obj)
+}
+
+type encodable interface {
+	Encode(plumbing.EncodedObject) error
+}
+
+func (s *workingTreeSnapshot) writeObject(o encodable) (string, error) {
+	obj := s.repository.Storer.NewEncodedObject()
+	if err := o.Encode(obj); err != nil {
+		return "", err
+	}
+
+	hash, err := s.storeObject(obj)
+	if err != nil {
+		return "", err
+	}
+
+	return hash.String(), nil
+}
+
+func (s *workingTreeSnapshot) storeObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	hash := obj.Hash()
+
+	err := s.repository.Storer.HasEncodedObject(hash)
+	if err == nil {
+		return hash, nil
+	} else if err != plumbing.ErrObjectNotFound {
+		return plumbing.ZeroHash, err
+	}
+
+	return s.repository.Storer.SetEncodedObject(obj)
+}
+
+// writeTree writes trees of files paths recursively, entries are sorted as git does:
+// by names with trailing slash for trees
+func (s *workingTreeSnapshot) writeTree(files map[string]*object.TreeEntry) (plumbing.Hash, error) {
+	var entries []object.TreeEntry
+	subtrees := make(map[string]map[string]*object.TreeEntry)
+
+	for path, entry := range files {
+		parts := strings.SplitN(path, "/", 2)
+		if len(parts) == 1 {
+			entries = append(entries, object.TreeEntry{Name: path, Mode: entry.Mode, Hash: entry.Hash})
+			continue
+		}
+
+		if subtrees[parts[0]] == nil {
+			subtrees[parts[0]] = make(map[string]*object.TreeEntry)
+		}
+		subtrees[parts[0]][parts[1]] = entry
+	}
+
+	for name, subtreeFiles := range subtrees {
+		hash, err := s.writeTree(subtreeFiles)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entries = append(entries, object.TreeEntry{Name: name, Mode: filemode.Dir, Hash: hash})
+	}
+
+	sortName := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return sortName(entries[i]) < sortName(entries[j])
+	})
+
+	hash, err := s.writeObject(&object.Tree{Entries: entries})
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return plumbing.NewHash(hash), nil
+}
@@ -0,0 +1,128 @@
+package git_repo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flant/dapp/pkg/lock"
+)
+
+func TestWorkingTreeCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "dapp-working-tree-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	lock.LocksDir = filepath.Join(tmpDir, "locks")
+	if err := lock.InitWithOptions(lock.InitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	repoDir := filepath.Join(tmpDir, "repo")
+	if err := os.MkdirAll(repoDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, repoDir, "init", "-q")
+	writeTestFiles(t, repoDir, map[string]*testFile{
+		".gitignore":     {"*.log\n", 0644},
+		"app/main.txt":   {"main v1\n", 0644},
+		"app/run.sh":     {"run\n", 0755},
+		"other/file.txt": {"other\n", 0644},
+	})
+	runGit(t, repoDir, "add", "-A")
+	runGit(t, repoDir, "commit", "-q", "-m", "v1")
+	headCommit := runGit(t, repoDir, "rev-parse", "HEAD")
+
+	newLocal := func(withUntracked bool) *Local {
+		return &Local{Base: Base{Name: "own"}, Path: repoDir, OrigPath: repoDir, DevMode: true, DevModeUntracked: withUntracked}
+	}
+
+	if commit, err := newLocal(true).HeadCommit(); err != nil || commit != headCommit {
+		t.Fatalf("snapshot of the clean working tree should be HEAD commit, got %s: %v", commit, err)
+	}
+
+	writeTestFiles(t, repoDir, map[string]*testFile{
+		"app/main.txt":     {"main v2\n", 0644},
+		"app/new.txt":      {"new\n", 0644},
+		"app/debug.log":    {"log\n", 0644},
+		"other/nested.txt": {"nested\n", 0644},
+	})
+	if err := os.Remove(filepath.Join(repoDir, "other/file.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	status := runGit(t, repoDir, "status", "--porcelain")
+
+	repo := newLocal(false)
+	commit, err := repo.HeadCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit == headCommit {
+		t.Fatalf("snapshot of the changed working tree should not be HEAD commit")
+	}
+
+	if otherCommit, err := newLocal(false).HeadCommit(); err != nil || otherCommit != commit {
+		t.Errorf("snapshot of the same working tree should have the same commit, got %s and %s: %v", commit, otherCommit, err)
+	}
+
+	if newStatus := runGit(t, repoDir, "status", "--porcelain"); newStatus != status {
+		t.Errorf("snapshot should not change the index and the working tree: %q != %q", status, newStatus)
+	}
+
+	var archive bytes.Buffer
+	if err := repo.CreateArchiveTar(&archive, ArchiveOptions{FilterOptions: FilterOptions{BasePath: "app"}, Commit: commit}); err != nil {
+		t.Fatal(err)
+	}
+	files := tarFiles(t, archive.Bytes())
+	if files["main.txt"] != "main v2\n" || files["run.sh"] != "run\n" {
+		t.Errorf("archive should contain working tree content of tracked files, got %v", files)
+	}
+	if _, hasKey := files["new.txt"]; hasKey {
+		t.Errorf("archive should not contain untracked files without untracked mode")
+	}
+
+	patch, err := repo.CreatePatch(PatchOptions{FromCommit: headCommit, ToCommit: commit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(patch.GetFilePath())
+	patch.Remove()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "+main v2") || !strings.Contains(string(data), "deleted file mode") {
+		t.Errorf("patch should contain uncommitted changes, got:\n%s", data)
+	}
+
+	untrackedRepo := newLocal(true)
+	untrackedCommit, err := untrackedRepo.HeadCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive.Reset()
+	if err := untrackedRepo.CreateArchiveTar(&archive, ArchiveOptions{Commit: untrackedCommit}); err != nil {
+		t.Fatal(err)
+	}
+	files = tarFiles(t, archive.Bytes())
+	if files["app/new.txt"] != "new\n" || files["other/nested.txt"] != "nested\n" {
+		t.Errorf("archive should contain untracked files in untracked mode, got %v", files)
+	}
+	if _, hasKey := files["app/debug.log"]; hasKey {
+		t.Errorf("archive should not contain ignored files")
+	}
+	if _, hasKey := files["other/file.txt"]; hasKey {
+		t.Errorf("archive should not contain deleted files")
+	}
+}
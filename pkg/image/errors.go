@@ -0,0 +1,21 @@
+package image
+
+import "fmt"
+
+// ContainerRunError means that stage container has been started, but the build instructions failed
+type ContainerRunError struct {
+	ContainerName string
+	Err           error
+}
+
+func (e *ContainerRunError) Error() string {
+	return fmt.Sprintf("container run failed: %s", e.Err)
+}
+
+func (e *ContainerRunError) ErrorCode() string {
+	return "container_run_failed"
+}
+
+func (e *ContainerRunError) ErrorData() map[string]interface{} {
+	return map[string]interface{}{"container_name": e.ContainerName}
+}
@@ -2,13 +2,16 @@ package image
 
 import (
 	"fmt"
-	"strings"
 
 	"github.com/docker/docker/api/types"
 
+	"github.com/flant/dapp/pkg/dapp"
 	"github.com/flant/dapp/pkg/docker"
 )
 
+// DevModeLabel marks stages, which are built from uncommitted changes, such stages are never pushed
+const DevModeLabel = "dapp-dev-mode"
+
 type Stage struct {
 	*Base
 	FromImage  *Stage
@@ -46,7 +49,12 @@ func (i *Stage) MustGetId() (string, error) {
 
 func (i *Stage) Build(options *StageBuildOptions) error {
 	if containerRunErr := i.Container.Run(); containerRunErr != nil {
-		if strings.HasPrefix(containerRunErr.Error(), "container run failed") {
+		// Container is removed by cleanup hook on termination, there is nothing to introspect
+		if err := dapp.Context().Err(); err != nil {
+			return fmt.Errorf("build of container `%s` interrupted: %s", i.Container.Name, err)
+		}
+
+		if _, ok := containerRunErr.(*ContainerRunError); ok {
 			if options.IntrospectBeforeError {
 				if err := i.IntrospectBefore(); err != nil {
 					return fmt.Errorf("introspect error failed: %s", err)
@@ -148,9 +156,28 @@ func (i *Stage) Pull() error {
 }
 
 func (i *Stage) Push() error {
+	if err := i.checkNotDevMode(); err != nil {
+		return err
+	}
+
 	return docker.CliPush(i.Name)
 }
 
+func (i *Stage) checkNotDevMode() error {
+	inspect, err := i.GetInspect()
+	if err != nil {
+		return err
+	}
+
+	if inspect != nil && inspect.Config != nil {
+		if _, ok := inspect.Config.Labels[DevModeLabel]; ok {
+			return fmt.Errorf("stage `%s` is built in dev mode and cannot be pushed", i.Name)
+		}
+	}
+
+	return nil
+}
+
 func (i *Stage) Import(name string) error {
 	importedImage := NewBaseImage(name)
 
@@ -174,7 +201,12 @@ func (i *Stage) Import(name string) error {
 	return nil
 }
 
+// Export pushes stage by name, stages built in dev mode are not exported the same as they are not pushed
 func (i *Stage) Export(name string) error {
+	if err := i.checkNotDevMode(); err != nil {
+		return err
+	}
+
 	if err := i.Tag(name); err != nil {
 		return err
 	}
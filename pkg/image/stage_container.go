@@ -3,20 +3,27 @@ package image
 import (
 	"encoding/base64"
 	"fmt"
+	"io"
+	"os"
 	"strings"
 
 	"github.com/docker/docker/api/types"
 
+	"github.com/flant/dapp/pkg/dapp"
 	"github.com/flant/dapp/pkg/dappdeps"
 	"github.com/flant/dapp/pkg/docker"
 	"github.com/flant/dapp/pkg/util"
 )
 
+// ArchiveFunc writes tar archive, which is extracted into the container root before run commands
+type ArchiveFunc func(w io.Writer) error
+
 type StageContainer struct {
 	Image                      *Stage
 	Name                       string
 	RunCommands                []string
 	ServiceRunCommands         []string
+	Archives                   []ArchiveFunc
 	RunOptions                 *StageContainerOptions
 	CommitChangeOptions        *StageContainerOptions
 	ServiceCommitChangeOptions *StageContainerOptions
@@ -36,6 +43,10 @@ func (c *StageContainer) AddRunCommands(commands []string) {
 	c.RunCommands = append(c.RunCommands, commands...)
 }
 
+func (c *StageContainer) AddArchives(archives ...ArchiveFunc) {
+	c.Archives = append(c.Archives, archives...)
+}
+
 func (c *StageContainer) AddServiceRunCommands(commands []string) {
 	c.ServiceRunCommands = append(c.ServiceRunCommands, commands...)
 }
@@ -222,13 +233,57 @@ func (c *StageContainer) Run() error {
 		return err
 	}
 
-	if err := docker.CliRun(runArgs...); err != nil {
-		return fmt.Errorf("container run failed: %s", err.Error())
+	// Removing of the running container interrupts `docker run` on termination
+	removeCleanupHook := dapp.AddCleanupHook(dapp.ContainersCleanupStage, c.forceRm)
+	defer removeCleanupHook()
+
+	if len(c.Archives) == 0 {
+		if err := docker.CliRun(runArgs...); err != nil {
+			return &ContainerRunError{ContainerName: c.Name, Err: err}
+		}
+
+		return nil
+	}
+
+	// Archives are streamed into the created container, so that run commands see extracted files
+	if err := docker.CliCreate(runArgs...); err != nil {
+		return err
+	}
+
+	for _, archive := range c.Archives {
+		if err := c.copyArchive(archive); err != nil {
+			return fmt.Errorf("cannot copy archive into container `%s`: %s", c.Name, err)
+		}
+	}
+
+	if err := docker.CliStart("--attach", c.Name); err != nil {
+		return &ContainerRunError{ContainerName: c.Name, Err: err}
 	}
 
 	return nil
 }
 
+func (c *StageContainer) copyArchive(archive ArchiveFunc) error {
+	reader, writer := io.Pipe()
+
+	archiveErr := make(chan error, 1)
+	go func() {
+		err := archive(writer)
+		writer.CloseWithError(err)
+		archiveErr <- err
+	}()
+
+	copyErr := docker.ContainerCopyTo(c.Name, "/", reader)
+	// Archive writing is interrupted when copy fails
+	reader.Close()
+
+	if err := <-archiveErr; err != nil {
+		return err
+	}
+
+	return copyErr
+}
+
 func (c *StageContainer) Introspect() error {
 	runArgs, err := c.introspectArgs()
 	if err != nil {
@@ -273,3 +328,10 @@ func (c *StageContainer) Commit() (string, error) {
 func (c *StageContainer) Rm() error {
 	return docker.ContainerRemove(c.Name)
 }
+
+func (c *StageContainer) forceRm() {
+	err := docker.CliRm("--force", c.Name)
+	if err != nil && !strings.Contains(err.Error(), "No such container") {
+		fmt.Fprintf(os.Stderr, "WARNING: cannot remove container `%s`: %s\n", c.Name, err)
+	}
+}
@@ -0,0 +1,29 @@
+package lock
+
+type Backend interface {
+	NewLock(name string) LockObject
+}
+
+type FileBackend struct {
+	LocksDir string
+}
+
+func NewFileBackend(locksDir string) *FileBackend {
+	return &FileBackend{LocksDir: locksDir}
+}
+
+func (backend *FileBackend) NewLock(name string) LockObject {
+	return NewFileLock(name, backend.LocksDir)
+}
+
+type LeaseBackend struct {
+	Client *LeaseClient
+}
+
+func NewLeaseBackend(client *LeaseClient) *LeaseBackend {
+	return &LeaseBackend{Client: client}
+}
+
+func (backend *LeaseBackend) NewLock(name string) LockObject {
+	return NewLeaseLock(name, backend.Client)
+}
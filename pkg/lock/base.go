@@ -1,78 +1,294 @@
 package lock
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"time"
 )
 
-type Base struct {
-	Name        string
-	ActiveLocks int
+type AcquireOptions struct {
+	Ctx      context.Context
+	Timeout  time.Duration
+	ReadOnly bool
+	// Owner is a reentrancy token: nested locks of the same owner do not block each other,
+	// while different owners exclude each other even inside one process
+	Owner  string
+	OnWait func(doWait func() error) error
+}
+
+func (opts AcquireOptions) context() context.Context {
+	if opts.Ctx == nil {
+		return context.Background()
+	}
+	return opts.Ctx
 }
 
+func (opts AcquireOptions) wait(doWait func() error) error {
+	if opts.OnWait == nil {
+		return doWait()
+	}
+	return opts.OnWait(doWait)
+}
+
+// locker is a backend specific lock shared by all owners of the Base inside the process
 type locker interface {
-	Lock() error
+	Lock(opts AcquireOptions) error
+	// ChangeMode upgrades shared lock to exclusive or downgrades exclusive lock to shared
+	ChangeMode(opts AcquireOptions) error
 	Unlock() error
 }
 
-type baseLocker struct {
-	Timeout  time.Duration
-	ReadOnly bool
-	OnWait   func(doWait func() error) error
-}
+type Base struct {
+	Name string
+
+	newLocker func() locker
 
-func (locker *baseLocker) Lock() error {
-	panic("not implemented")
+	mutex          sync.Mutex
+	changed        chan struct{}
+	holders        map[string][]bool // owner => stack of ReadOnly flags of nested locks
+	locker         locker
+	lockerReadOnly bool
+	lockerOnWait   func(doWait func() error) error
+	busy           bool
 }
 
-func (locker *baseLocker) Unlock() error {
-	panic("not implemented")
+func newBase(name string, newLocker func() locker) Base {
+	return Base{
+		Name:      name,
+		newLocker: newLocker,
+		changed:   make(chan struct{}),
+		holders:   make(map[string][]bool),
+	}
 }
 
 func (lock *Base) GetName() string {
 	return lock.Name
 }
 
-func (lock *Base) Lock(l locker) error {
-	if lock.ActiveLocks == 0 {
-		err := l.Lock()
+func (lock *Base) ActiveLocks() int {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+
+	res := 0
+	for _, stack := range lock.holders {
+		res += len(stack)
+	}
+
+	return res
+}
+
+func (lock *Base) Lock(opts AcquireOptions) error {
+	deadline := time.Now().Add(opts.Timeout)
+
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+
+	for {
+		if lock.busy {
+			if err := lock.waitChange(opts, deadline); err != nil {
+				return err
+			}
+			continue
+		}
+
+		stack := lock.holders[opts.Owner]
+		if len(stack) > 0 && (!isSharedStack(stack) || opts.ReadOnly) {
+			lock.holders[opts.Owner] = append(stack, opts.ReadOnly)
+			return nil
+		}
+
+		othersShared, othersExclusive := lock.othersState(opts.Owner)
+		if othersExclusive || (othersShared && !opts.ReadOnly) {
+			if err := lock.waitChange(opts, deadline); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if lock.locker != nil && lock.lockerReadOnly == opts.ReadOnly {
+			lock.holders[opts.Owner] = append(stack, opts.ReadOnly)
+			return nil
+		}
+
+		lockerOpts := opts
+		lockerOpts.Timeout = deadline.Sub(time.Now())
+
+		err := lock.withBusy(func() error {
+			if lock.locker == nil {
+				l := lock.newLocker()
+				if err := l.Lock(lockerOpts); err != nil {
+					return err
+				}
+				lock.locker = l
+				return nil
+			}
+			return lock.locker.ChangeMode(lockerOpts)
+		})
 		if err != nil {
 			return err
 		}
-	}
 
-	lock.ActiveLocks += 1
+		lock.lockerReadOnly = opts.ReadOnly
+		lock.lockerOnWait = opts.OnWait
+		lock.holders[opts.Owner] = append(stack, opts.ReadOnly)
 
-	return nil
+		return nil
+	}
 }
 
-func (lock *Base) Unlock(l locker) error {
-	if lock.ActiveLocks == 0 {
+func (lock *Base) Unlock(owner string) error {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+
+	for lock.busy {
+		if err := lock.waitChange(AcquireOptions{Timeout: DefaultTimeout}, time.Now().Add(DefaultTimeout)); err != nil {
+			return err
+		}
+	}
+
+	stack := lock.holders[owner]
+	if len(stack) == 0 {
 		return nil
 	}
 
-	lock.ActiveLocks -= 1
+	if len(stack) == 1 {
+		delete(lock.holders, owner)
+	} else {
+		lock.holders[owner] = stack[:len(stack)-1]
+	}
+	defer lock.notifyChange()
+
+	if len(lock.holders) == 0 {
+		err := lock.withBusy(func() error {
+			return lock.locker.Unlock()
+		})
+		lock.locker = nil
+		return err
+	}
+
+	if !lock.lockerReadOnly && lock.isShared() {
+		lockerOpts := AcquireOptions{Timeout: DefaultTimeout, ReadOnly: true, OnWait: lock.lockerOnWait}
+
+		err := lock.withBusy(func() error {
+			return lock.locker.ChangeMode(lockerOpts)
+		})
+		if err != nil {
+			return fmt.Errorf("cannot downgrade lock `%s` to shared mode: %s", lock.Name, err)
+		}
 
-	if lock.ActiveLocks == 0 {
-		return l.Unlock()
+		lock.lockerReadOnly = true
 	}
 
 	return nil
 }
 
-func (lock *Base) WithLock(locker locker, f func() error) error {
+// ReleaseAll forgets all holders and unlocks backend lock, lock being acquired or released at the moment is skipped
+func (lock *Base) ReleaseAll() error {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+
+	if lock.busy || lock.locker == nil {
+		return nil
+	}
+
+	lock.holders = make(map[string][]bool)
+	defer lock.notifyChange()
+
+	err := lock.locker.Unlock()
+	lock.locker = nil
+
+	return err
+}
+
+func (lock *Base) WithLock(opts AcquireOptions, f func() error) error {
 	var err error
 
-	err = lock.Lock(locker)
+	err = lock.Lock(opts)
 	if err != nil {
 		return err
 	}
 
 	resErr := f()
 
-	err = lock.Unlock(locker)
+	err = lock.Unlock(opts.Owner)
 	if err != nil {
 		return err
 	}
 
 	return resErr
 }
+
+// withBusy runs backend operation without holding the mutex, other callers wait until it is done
+func (lock *Base) withBusy(f func() error) error {
+	lock.busy = true
+	lock.mutex.Unlock()
+
+	err := f()
+
+	lock.mutex.Lock()
+	lock.busy = false
+	lock.notifyChange()
+
+	return err
+}
+
+func (lock *Base) notifyChange() {
+	close(lock.changed)
+	lock.changed = make(chan struct{})
+}
+
+func (lock *Base) waitChange(opts AcquireOptions, deadline time.Time) error {
+	changed := lock.changed
+
+	lock.mutex.Unlock()
+	defer lock.mutex.Lock()
+
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+		return nil
+	case <-timer.C:
+		return &TimeoutError{Name: lock.Name, Timeout: opts.Timeout}
+	case <-opts.context().Done():
+		return &CancelledError{Name: lock.Name, Err: opts.context().Err()}
+	}
+}
+
+func (lock *Base) othersState(owner string) (bool, bool) {
+	var shared, exclusive bool
+
+	for holderOwner, stack := range lock.holders {
+		if holderOwner == owner {
+			continue
+		}
+
+		if isSharedStack(stack) {
+			shared = true
+		} else {
+			exclusive = true
+		}
+	}
+
+	return shared, exclusive
+}
+
+func (lock *Base) isShared() bool {
+	for _, stack := range lock.holders {
+		if !isSharedStack(stack) {
+			return false
+		}
+	}
+	return true
+}
+
+func isSharedStack(stack []bool) bool {
+	for _, readOnly := range stack {
+		if !readOnly {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,381 @@
+package lock
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type fakeLocker struct {
+	mutex       sync.Mutex
+	isLocked    bool
+	readOnly    bool
+	locks       int
+	modeChanges int
+	unlocks     int
+}
+
+func (l *fakeLocker) Lock(opts AcquireOptions) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.isLocked = true
+	l.readOnly = opts.ReadOnly
+	l.locks++
+
+	return nil
+}
+
+func (l *fakeLocker) ChangeMode(opts AcquireOptions) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.readOnly = opts.ReadOnly
+	l.modeChanges++
+
+	return nil
+}
+
+func (l *fakeLocker) Unlock() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.isLocked = false
+	l.unlocks++
+
+	return nil
+}
+
+func (l *fakeLocker) state() (bool, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.isLocked, l.readOnly
+}
+
+func newTestBase() (*Base, *fakeLocker) {
+	l := &fakeLocker{}
+	base := newBase("test", func() locker { return l })
+	return &base, l
+}
+
+func exclusiveOpts(owner string) AcquireOptions {
+	return AcquireOptions{Owner: owner, Timeout: time.Second}
+}
+
+func sharedOpts(owner string) AcquireOptions {
+	return AcquireOptions{Owner: owner, Timeout: time.Second, ReadOnly: true}
+}
+
+func mustLock(t *testing.T, base *Base, opts AcquireOptions) {
+	if err := base.Lock(opts); err != nil {
+		t.Fatalf("owner `%s` lock error: %s", opts.Owner, err)
+	}
+}
+
+func mustUnlock(t *testing.T, base *Base, owner string) {
+	if err := base.Unlock(owner); err != nil {
+		t.Fatalf("owner `%s` unlock error: %s", owner, err)
+	}
+}
+
+func TestBase_OwnerReentrancy(t *testing.T) {
+	base, l := newTestBase()
+
+	mustLock(t, base, exclusiveOpts("a"))
+	mustLock(t, base, exclusiveOpts("a"))
+	mustLock(t, base, sharedOpts("a"))
+
+	if base.ActiveLocks() != 3 {
+		t.Fatalf("expected 3 active locks, got %d", base.ActiveLocks())
+	}
+
+	mustUnlock(t, base, "a")
+	mustUnlock(t, base, "a")
+
+	if isLocked, _ := l.state(); !isLocked {
+		t.Fatalf("lock should be held until the last unlock")
+	}
+
+	mustUnlock(t, base, "a")
+
+	if isLocked, _ := l.state(); isLocked {
+		t.Fatalf("lock should be released")
+	}
+	if l.locks != 1 || l.unlocks != 1 {
+		t.Fatalf("backend lock should be acquired and released once, got %d locks and %d unlocks", l.locks, l.unlocks)
+	}
+}
+
+func TestBase_ExclusiveOwners(t *testing.T) {
+	base, _ := newTestBase()
+
+	mustLock(t, base, exclusiveOpts("a"))
+
+	err := base.Lock(AcquireOptions{Owner: "b", Timeout: 100 * time.Millisecond})
+	if err == nil {
+		t.Fatalf("owner `b` should not get exclusive lock held by owner `a`")
+	}
+
+	err = base.Lock(AcquireOptions{Owner: "b", Timeout: 100 * time.Millisecond, ReadOnly: true})
+	if err == nil {
+		t.Fatalf("owner `b` should not get shared lock while exclusive lock is held by owner `a`")
+	}
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- base.Lock(exclusiveOpts("b"))
+	}()
+
+	mustUnlock(t, base, "a")
+
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+
+	mustUnlock(t, base, "b")
+}
+
+func TestBase_SharedOwners(t *testing.T) {
+	base, l := newTestBase()
+
+	mustLock(t, base, sharedOpts("a"))
+	mustLock(t, base, sharedOpts("b"))
+
+	if l.locks != 1 {
+		t.Fatalf("backend lock should be acquired once for shared owners, got %d", l.locks)
+	}
+
+	mustUnlock(t, base, "a")
+
+	if isLocked, _ := l.state(); !isLocked {
+		t.Fatalf("lock should be held while owner `b` holds it")
+	}
+
+	mustUnlock(t, base, "b")
+
+	if isLocked, _ := l.state(); isLocked {
+		t.Fatalf("lock should be released")
+	}
+}
+
+func TestBase_Upgrade(t *testing.T) {
+	base, l := newTestBase()
+
+	mustLock(t, base, sharedOpts("a"))
+	mustLock(t, base, sharedOpts("b"))
+
+	upgraded := make(chan error)
+	go func() {
+		upgraded <- base.Lock(exclusiveOpts("a"))
+	}()
+
+	select {
+	case err := <-upgraded:
+		t.Fatalf("owner `a` should wait for owner `b` before upgrade, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mustUnlock(t, base, "b")
+
+	if err := <-upgraded; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, readOnly := l.state(); readOnly {
+		t.Fatalf("lock should be upgraded to exclusive mode")
+	}
+
+	mustUnlock(t, base, "a")
+	mustUnlock(t, base, "a")
+
+	if isLocked, _ := l.state(); isLocked {
+		t.Fatalf("lock should be released")
+	}
+}
+
+func TestBase_Downgrade(t *testing.T) {
+	base, l := newTestBase()
+
+	mustLock(t, base, sharedOpts("a"))
+	mustLock(t, base, exclusiveOpts("a"))
+
+	if _, readOnly := l.state(); readOnly {
+		t.Fatalf("lock should be in exclusive mode")
+	}
+
+	mustUnlock(t, base, "a")
+
+	if _, readOnly := l.state(); !readOnly {
+		t.Fatalf("lock should be downgraded to shared mode")
+	}
+
+	mustLock(t, base, AcquireOptions{Owner: "b", Timeout: 100 * time.Millisecond, ReadOnly: true})
+
+	mustUnlock(t, base, "b")
+	mustUnlock(t, base, "a")
+
+	if l.modeChanges != 2 {
+		t.Fatalf("expected upgrade and downgrade, got %d mode changes", l.modeChanges)
+	}
+}
+
+func TestBase_CancelWaiting(t *testing.T) {
+	base, _ := newTestBase()
+
+	mustLock(t, base, exclusiveOpts("a"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- base.Lock(AcquireOptions{Ctx: ctx, Owner: "b", Timeout: time.Hour})
+	}()
+
+	cancel()
+
+	if err := <-acquired; err == nil {
+		t.Fatalf("cancelled waiting should fail")
+	}
+
+	if base.ActiveLocks() != 1 {
+		t.Fatalf("cancelled owner should not hold the lock")
+	}
+
+	mustUnlock(t, base, "a")
+}
+
+func TestBase_ReleaseAll(t *testing.T) {
+	base, l := newTestBase()
+
+	mustLock(t, base, exclusiveOpts("a"))
+	mustLock(t, base, exclusiveOpts("a"))
+
+	if err := base.ReleaseAll(); err != nil {
+		t.Fatalf("release error: %s", err)
+	}
+
+	if isLocked, _ := l.state(); isLocked {
+		t.Fatalf("lock should be released")
+	}
+	if base.ActiveLocks() != 0 {
+		t.Fatalf("expected no active locks, got %d", base.ActiveLocks())
+	}
+
+	mustLock(t, base, exclusiveOpts("b"))
+	mustUnlock(t, base, "b")
+}
+
+func TestWithLock_ConcurrentOwners(t *testing.T) {
+	locksDir, err := ioutil.TempDir("", "dapp-locks-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(locksDir)
+
+	LocksDir = locksDir
+	if err := InitWithOptions(InitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	counter := 0
+	readers := 0
+	var readersMutex sync.Mutex
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			owner := NewOwner()
+
+			err := WithLock("stage.app", LockOptions{Owner: owner, ReadOnly: i%2 == 0, Timeout: 10 * time.Second}, func() error {
+				if i%2 == 0 {
+					readersMutex.Lock()
+					readers++
+					readersMutex.Unlock()
+					return nil
+				}
+
+				// Nested lock of the same owner must not block
+				return WithLock("stage.app", LockOptions{Owner: owner, Timeout: time.Second}, func() error {
+					counter++
+					return nil
+				})
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if counter != 10 || readers != 10 {
+		t.Fatalf("expected 10 writers and 10 readers, got %d and %d", counter, readers)
+	}
+}
+
+func TestFileLocker_ReleasedOnHolderInfoError(t *testing.T) {
+	locksDir, err := ioutil.TempDir("", "dapp-locks-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(locksDir)
+
+	isFree := func(name string) bool {
+		f, err := os.OpenFile(lockFilePath(locksDir, name), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			return false
+		}
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		return true
+	}
+
+	// Holders dir cannot be created over the file
+	if err := ioutil.WriteFile(holdersDir(locksDir), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	locker := &fileLocker{FileLock: NewFileLock("stage.app", locksDir).(*File)}
+	if err := locker.Lock(AcquireOptions{Timeout: time.Second}); err == nil {
+		t.Fatalf("lock should fail without holder info")
+	}
+	if !isFree("stage.app") || locker.openFileHandler != nil {
+		t.Errorf("failed lock should be released")
+	}
+
+	if err := os.Remove(holdersDir(locksDir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := locker.Lock(AcquireOptions{Timeout: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Holder info cannot be removed when it is a non-empty directory
+	infoPath := holderInfoPath(locksDir, "stage.app", os.Getpid())
+	if err := os.Remove(infoPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(infoPath, "dir"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := locker.Unlock(); err == nil {
+		t.Errorf("unlock should return holder info error")
+	}
+	if !isFree("stage.app") || locker.openFileHandler != nil {
+		t.Errorf("lock should be released when holder info is not removed")
+	}
+}
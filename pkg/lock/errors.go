@@ -0,0 +1,59 @@
+package lock
+
+import (
+	"fmt"
+	"time"
+)
+
+type TimeoutError struct {
+	Name    string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("lock `%s` timeout %s expired", e.Name, e.Timeout)
+}
+
+func (e *TimeoutError) ErrorCode() string {
+	return "lock_timeout"
+}
+
+func (e *TimeoutError) ErrorData() map[string]interface{} {
+	return map[string]interface{}{"name": e.Name, "timeout": e.Timeout.Seconds()}
+}
+
+type CancelledError struct {
+	Name string
+	Err  error
+}
+
+func (e *CancelledError) Error() string {
+	return fmt.Sprintf("lock `%s` waiting cancelled: %s", e.Name, e.Err)
+}
+
+func (e *CancelledError) ErrorCode() string {
+	return "lock_waiting_cancelled"
+}
+
+func (e *CancelledError) ErrorData() map[string]interface{} {
+	return map[string]interface{}{"name": e.Name}
+}
+
+// LeaseLostError means that the lease expired or has been taken over while the lock was held,
+// so the locked resource may have been used by others
+type LeaseLostError struct {
+	Name    string
+	LeaseId string
+}
+
+func (e *LeaseLostError) Error() string {
+	return fmt.Sprintf("lease `%s` of lock `%s` is lost", e.LeaseId, e.Name)
+}
+
+func (e *LeaseLostError) ErrorCode() string {
+	return "lock_lease_lost"
+}
+
+func (e *LeaseLostError) ErrorData() map[string]interface{} {
+	return map[string]interface{}{"name": e.Name}
+}
@@ -6,140 +6,135 @@ import (
 	"path/filepath"
 	"syscall"
 	"time"
-	
+
 	"github.com/flant/dapp/pkg/util"
 )
 
+var (
+	FlockPollInterval = 500 * time.Millisecond
+)
+
 func NewFileLock(name string, locksDir string) LockObject {
-	return &File{Base: Base{Name: name}, LocksDir: locksDir}
+	lock := &File{LocksDir: locksDir}
+	lock.Base = newBase(name, func() locker {
+		return &fileLocker{FileLock: lock}
+	})
+	return lock
 }
 
 type File struct {
 	Base
 	LocksDir string
-	locker   *fileLocker
 }
 
-func (lock *File) newLocker(timeout time.Duration, readOnly bool, onWait func(doWait func() error) error) *fileLocker {
-	return &fileLocker{
-		baseLocker: baseLocker{
-			Timeout:  timeout,
-			ReadOnly: readOnly,
-			OnWait:   onWait,
-		},
-		FileLock: lock,
-	}
+type fileLocker struct {
+	FileLock        *File
+	openFileHandler *os.File
+	readOnly        bool
 }
 
-func (lock *File) Lock(timeout time.Duration, readOnly bool, onWait func(doWait func() error) error) error {
-	lock.locker = lock.newLocker(timeout, readOnly, onWait)
-	return lock.Base.Lock(lock.locker)
+func (locker *fileLocker) lockFilePath() string {
+	return lockFilePath(locker.FileLock.LocksDir, locker.FileLock.GetName())
 }
 
-func (lock *File) Unlock() error {
-	if lock.locker == nil {
-		return nil
-	}
+func lockFilePath(locksDir, name string) string {
+	fileName := util.MurmurHash(name)
+	return filepath.Join(locksDir, fileName)
+}
 
-	err := lock.Base.Unlock(lock.locker)
+func (locker *fileLocker) Lock(opts AcquireOptions) error {
+	f, err := os.OpenFile(locker.lockFilePath(), os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return err
 	}
 
-	lock.locker = nil
-
-	return nil
-}
-
-func (lock *File) WithLock(timeout time.Duration, readOnly bool, onWait func(doWait func() error) error, f func() error) error {
-	lock.locker = lock.newLocker(timeout, readOnly, onWait)
-
-	err := lock.Base.WithLock(lock.locker, f)
+	err = locker.flock(int(f.Fd()), opts)
 	if err != nil {
+		f.Close()
 		return err
 	}
 
-	lock.locker = nil
-
-	return nil
-}
+	// Lock is not recorded by the caller on error, so it is released here
+	if err := writeHolderInfo(locker.FileLock.LocksDir, locker.FileLock.GetName(), opts.ReadOnly); err != nil {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		return err
+	}
 
-type fileLocker struct {
-	baseLocker
+	locker.openFileHandler = f
+	locker.readOnly = opts.ReadOnly
 
-	FileLock        *File
-	openFileHandler *os.File
+	return nil
 }
 
-func (locker *fileLocker) lockFilePath() string {
-	fileName := util.MurmurHash(locker.FileLock.GetName())
-	return filepath.Join(locker.FileLock.LocksDir, fileName)
-}
+func (locker *fileLocker) ChangeMode(opts AcquireOptions) error {
+	fd := int(locker.openFileHandler.Fd())
 
-func (locker *fileLocker) Lock() error {
-	f, err := os.OpenFile(locker.lockFilePath(), os.O_RDWR|os.O_CREATE, 0644)
+	// NOTICE: flock mode conversion is not atomic: the existing lock is removed first,
+	// NOTICE: so the previous mode should be restored when the new one cannot be established.
+	err := locker.flock(fd, opts)
 	if err != nil {
+		restoreOpts := AcquireOptions{Timeout: DefaultTimeout, ReadOnly: locker.readOnly, OnWait: opts.OnWait}
+		if restoreErr := locker.flock(fd, restoreOpts); restoreErr != nil {
+			return fmt.Errorf("%s; cannot restore lock `%s`: %s", err, locker.FileLock.GetName(), restoreErr)
+		}
 		return err
 	}
 
-	locker.openFileHandler = f
+	locker.readOnly = opts.ReadOnly
 
-	fd := int(locker.openFileHandler.Fd())
+	return writeHolderInfo(locker.FileLock.LocksDir, locker.FileLock.GetName(), locker.readOnly)
+}
+
+func (locker *fileLocker) flock(fd int, opts AcquireOptions) error {
 	var mode int
-	if locker.ReadOnly {
+	if opts.ReadOnly {
 		mode = syscall.LOCK_SH
 	} else {
 		mode = syscall.LOCK_EX
 	}
 
-	err = syscall.Flock(fd, mode|syscall.LOCK_NB)
-
+	err := syscall.Flock(fd, mode|syscall.LOCK_NB)
 	if err == syscall.EWOULDBLOCK {
-		return locker.OnWait(func() error {
-			return locker.pollFlock(fd, mode)
+		return opts.wait(func() error {
+			return locker.pollFlock(fd, mode, opts)
 		})
 	}
 
 	return err
 }
 
-func (locker *fileLocker) pollFlock(fd int, mode int) error {
-	flockRes := make(chan error)
-	cancelPoll := make(chan bool)
-
-	go func() {
-		ticker := time.NewTicker(time.Millisecond * 500)
-
-	PollFlock:
-		for {
-			select {
-			case <-ticker.C:
-				err := syscall.Flock(fd, mode|syscall.LOCK_NB)
-				if err == nil || err != syscall.EWOULDBLOCK {
-					flockRes <- err
-				}
-			case <-cancelPoll:
-				break PollFlock
+func (locker *fileLocker) pollFlock(fd int, mode int, opts AcquireOptions) error {
+	ticker := time.NewTicker(FlockPollInterval)
+	defer ticker.Stop()
+
+	timer := time.NewTimer(opts.Timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := syscall.Flock(fd, mode|syscall.LOCK_NB)
+			if err != syscall.EWOULDBLOCK {
+				return err
 			}
+		case <-timer.C:
+			return &TimeoutError{Name: locker.FileLock.GetName(), Timeout: opts.Timeout}
+		case <-opts.context().Done():
+			return &CancelledError{Name: locker.FileLock.GetName(), Err: opts.context().Err()}
 		}
-	}()
-
-	select {
-	case err := <-flockRes:
-		return err
-	case <-time.After(locker.Timeout):
-		cancelPoll <- true
-		return fmt.Errorf("lock `%s` timeout %s expired", locker.FileLock.GetName(), locker.Timeout)
 	}
 }
 
+// Unlock always closes the lock file, because the caller drops the locker even on error
 func (locker *fileLocker) Unlock() error {
-	err := locker.openFileHandler.Close()
-	if err != nil {
-		return err
-	}
+	removeErr := removeHolderInfo(locker.FileLock.LocksDir, locker.FileLock.GetName())
 
+	closeErr := locker.openFileHandler.Close()
 	locker.openFileHandler = nil
 
-	return nil
+	if removeErr != nil {
+		return removeErr
+	}
+	return closeErr
 }
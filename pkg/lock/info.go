@@ -0,0 +1,217 @@
+package lock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flant/dapp/pkg/util"
+)
+
+const (
+	SharedMode    = "shared"
+	ExclusiveMode = "exclusive"
+)
+
+type LockInfo struct {
+	Name     string
+	FileName string
+	Holders  []*HolderInfo
+}
+
+type HolderInfo struct {
+	Name       string    `json:"name"`
+	Pid        int       `json:"pid"`
+	Mode       string    `json:"mode"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	IsAlive    bool      `json:"-"`
+}
+
+func holdersDir(locksDir string) string {
+	return filepath.Join(locksDir, "holders")
+}
+
+func holderInfoPath(locksDir, name string, pid int) string {
+	return filepath.Join(holdersDir(locksDir), fmt.Sprintf("%s.%d", util.MurmurHash(name), pid))
+}
+
+func writeHolderInfo(locksDir, name string, readOnly bool) error {
+	err := writeLockName(locksDir, name)
+	if err != nil {
+		return err
+	}
+
+	mode := ExclusiveMode
+	if readOnly {
+		mode = SharedMode
+	}
+
+	info := &HolderInfo{
+		Name:       name,
+		Pid:        os.Getpid(),
+		Mode:       mode,
+		AcquiredAt: time.Now(),
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(holdersDir(locksDir), 0755)
+	if err != nil {
+		return fmt.Errorf("cannot create lock holders dir: %s", err)
+	}
+
+	err = ioutil.WriteFile(holderInfoPath(locksDir, name, info.Pid), data, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write lock `%s` holder info: %s", name, err)
+	}
+
+	return nil
+}
+
+func removeHolderInfo(locksDir, name string) error {
+	err := os.Remove(holderInfoPath(locksDir, name, os.Getpid()))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove lock `%s` holder info: %s", name, err)
+	}
+
+	return nil
+}
+
+// writeLockName stores human-readable lock name into the lock file, which is named by the name hash
+func writeLockName(locksDir, name string) error {
+	path := lockFilePath(locksDir, name)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Size() > 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(name)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write lock `%s` name: %s", name, err)
+	}
+
+	return f.Close()
+}
+
+// ListLocks returns all file locks from locksDir with their current holders
+func ListLocks(locksDir string) ([]*LockInfo, error) {
+	fileInfos, err := ioutil.ReadDir(locksDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read locks dir `%s`: %s", locksDir, err)
+	}
+
+	var res []*LockInfo
+
+	for _, fi := range fileInfos {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		info := &LockInfo{FileName: fi.Name()}
+
+		data, err := ioutil.ReadFile(filepath.Join(locksDir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		info.Name = string(data)
+
+		holders, err := readHolders(locksDir, fi.Name())
+		if err != nil {
+			return nil, err
+		}
+		info.Holders = holders
+
+		res = append(res, info)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res, nil
+}
+
+// FprintLocks writes locks table with a row for each lock holder
+func FprintLocks(out io.Writer, locks []*LockInfo) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tFILE\tPID\tMODE\tACQUIRED\n")
+
+	for _, l := range locks {
+		if len(l.Holders) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\n", l.Name, l.FileName)
+			continue
+		}
+
+		for _, holder := range l.Holders {
+			pid := fmt.Sprintf("%d", holder.Pid)
+			if !holder.IsAlive {
+				pid += " (dead)"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", l.Name, l.FileName, pid, holder.Mode, holder.AcquiredAt.Format("2006-01-02 15:04:05"))
+		}
+	}
+
+	return w.Flush()
+}
+
+func readHolders(locksDir, lockFileName string) ([]*HolderInfo, error) {
+	paths, err := filepath.Glob(filepath.Join(holdersDir(locksDir), fmt.Sprintf("%s.*", lockFileName)))
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*HolderInfo
+
+	for _, path := range paths {
+		if _, err := strconv.Atoi(strings.TrimPrefix(filepath.Ext(path), ".")); err != nil {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		holder := &HolderInfo{}
+		err = json.Unmarshal(data, holder)
+		if err != nil {
+			return nil, fmt.Errorf("bad lock holder info `%s`: %s", path, err)
+		}
+		holder.IsAlive = isProcessAlive(holder.Pid)
+
+		res = append(res, holder)
+	}
+
+	return res, nil
+}
+
+func isProcessAlive(pid int) bool {
+	err := syscall.Kill(pid, syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
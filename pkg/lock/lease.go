@@ -0,0 +1,183 @@
+package lock
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	LeasePollInterval = 500 * time.Millisecond
+)
+
+func NewLeaseLock(name string, client *LeaseClient) LockObject {
+	lock := &Lease{Client: client}
+	lock.Base = newBase(name, func() locker {
+		return &leaseLocker{LeaseLock: lock}
+	})
+	return lock
+}
+
+type Lease struct {
+	Base
+	Client *LeaseClient
+}
+
+type leaseLocker struct {
+	LeaseLock *Lease
+	leaseId   string
+	readOnly  bool
+	stopRenew chan bool
+	renewDone chan bool
+	// lostErr is set by renew when the lease is lost, it is returned by Unlock
+	lostErr error
+}
+
+func (locker *leaseLocker) Lock(opts AcquireOptions) error {
+	acquired, err := locker.tryAcquire(opts.ReadOnly)
+	if err != nil {
+		return err
+	}
+	if acquired {
+		return nil
+	}
+
+	return opts.wait(func() error {
+		return locker.pollAcquire(opts)
+	})
+}
+
+// ChangeMode releases current lease and acquires a new one, so the change is not atomic
+func (locker *leaseLocker) ChangeMode(opts AcquireOptions) error {
+	prevReadOnly := locker.readOnly
+
+	err := locker.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = locker.Lock(opts)
+	if err != nil {
+		restoreOpts := AcquireOptions{Timeout: DefaultTimeout, ReadOnly: prevReadOnly, OnWait: opts.OnWait}
+		if restoreErr := locker.Lock(restoreOpts); restoreErr != nil {
+			return fmt.Errorf("%s; cannot restore lock `%s`: %s", err, locker.LeaseLock.GetName(), restoreErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (locker *leaseLocker) tryAcquire(readOnly bool) (bool, error) {
+	name := locker.LeaseLock.GetName()
+
+	resp, err := locker.LeaseLock.Client.Acquire(name, readOnly)
+	if err != nil {
+		return false, err
+	}
+	if resp == nil {
+		return false, nil
+	}
+
+	if resp.TakenOver {
+		fmt.Printf("Stale lease of locked resource `%s` has been taken over\n", name)
+	}
+
+	locker.leaseId = resp.LeaseId
+	locker.readOnly = readOnly
+	locker.lostErr = nil
+	locker.startRenew()
+
+	return true, nil
+}
+
+func (locker *leaseLocker) pollAcquire(opts AcquireOptions) error {
+	ticker := time.NewTicker(LeasePollInterval)
+	defer ticker.Stop()
+
+	timer := time.NewTimer(opts.Timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			acquired, err := locker.tryAcquire(opts.ReadOnly)
+			if err != nil {
+				return err
+			}
+			if acquired {
+				return nil
+			}
+		case <-timer.C:
+			return &TimeoutError{Name: locker.LeaseLock.GetName(), Timeout: opts.Timeout}
+		case <-opts.context().Done():
+			return &CancelledError{Name: locker.LeaseLock.GetName(), Err: opts.context().Err()}
+		}
+	}
+}
+
+func (locker *leaseLocker) startRenew() {
+	locker.stopRenew = make(chan bool)
+	locker.renewDone = make(chan bool)
+
+	go func() {
+		defer close(locker.renewDone)
+
+		name := locker.LeaseLock.GetName()
+		ttl := locker.LeaseLock.Client.TTL
+		renewedAt := time.Now()
+
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				_, err := locker.LeaseLock.Client.Renew(name, locker.leaseId)
+				if err == nil {
+					renewedAt = time.Now()
+					continue
+				}
+
+				// Lease expires on the server when it is not renewed within TTL
+				_, isLost := err.(*LeaseLostError)
+				if !isLost && time.Since(renewedAt) < ttl {
+					fmt.Fprintf(os.Stderr, "WARNING: cannot renew lease of locked resource `%s`: %s\n", name, err)
+					continue
+				}
+				if !isLost {
+					err = &LeaseLostError{Name: name, LeaseId: locker.leaseId}
+				}
+
+				fmt.Fprintf(os.Stderr, "WARNING: %s, locked resource `%s` may be used by others\n", err, name)
+				locker.lostErr = err
+
+				return
+			case <-locker.stopRenew:
+				return
+			}
+		}
+	}()
+}
+
+// Unlock returns LeaseLostError when the lease has been lost while the lock was held
+func (locker *leaseLocker) Unlock() error {
+	if locker.stopRenew != nil {
+		close(locker.stopRenew)
+		<-locker.renewDone
+		locker.stopRenew = nil
+	}
+
+	err := locker.LeaseLock.Client.Release(locker.LeaseLock.GetName(), locker.leaseId)
+
+	// Lease is not renewed anymore and expires on the server, when it cannot be released
+	lostErr := locker.lostErr
+	locker.leaseId = ""
+	locker.lostErr = nil
+
+	if lostErr != nil {
+		return lostErr
+	}
+
+	return err
+}
@@ -0,0 +1,159 @@
+package lock
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	DefaultLeaseTTL = 30 * time.Second
+)
+
+type LeaseClient struct {
+	Url        string
+	Owner      string
+	TTL        time.Duration
+	HttpClient *http.Client
+}
+
+func NewLeaseClient(url, owner string, ttl time.Duration) *LeaseClient {
+	if owner == "" {
+		owner = DefaultLeaseOwner()
+	}
+
+	if ttl == 0 {
+		ttl = DefaultLeaseTTL
+	}
+
+	return &LeaseClient{
+		Url:        strings.TrimSuffix(url, "/"),
+		Owner:      owner,
+		TTL:        ttl,
+		HttpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func DefaultLeaseOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+type LeaseRequest struct {
+	Name       string `json:"name"`
+	Owner      string `json:"owner,omitempty"`
+	Shared     bool   `json:"shared,omitempty"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+	LeaseId    string `json:"lease_id,omitempty"`
+}
+
+type LeaseResponse struct {
+	LeaseId   string    `json:"lease_id,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	TakenOver bool      `json:"taken_over,omitempty"`
+	Holders   []string  `json:"holders,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Acquire returns nil response without error when the lease is held by someone else
+func (client *LeaseClient) Acquire(name string, shared bool) (*LeaseResponse, error) {
+	req := LeaseRequest{
+		Name:       name,
+		Owner:      client.Owner,
+		Shared:     shared,
+		TTLSeconds: client.ttlSeconds(),
+	}
+
+	resp, statusCode, err := client.call("acquire", req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch statusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusConflict:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("lease server acquire `%s` failed: %s", name, resp.Error)
+	}
+}
+
+func (client *LeaseClient) Renew(name, leaseId string) (*LeaseResponse, error) {
+	req := LeaseRequest{
+		Name:       name,
+		Owner:      client.Owner,
+		LeaseId:    leaseId,
+		TTLSeconds: client.ttlSeconds(),
+	}
+
+	resp, statusCode, err := client.call("renew", req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch statusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		return nil, &LeaseLostError{Name: name, LeaseId: leaseId}
+	default:
+		return nil, fmt.Errorf("lease server renew `%s` failed: %s", name, resp.Error)
+	}
+}
+
+func (client *LeaseClient) Release(name, leaseId string) error {
+	req := LeaseRequest{
+		Name:    name,
+		Owner:   client.Owner,
+		LeaseId: leaseId,
+	}
+
+	resp, statusCode, err := client.call("release", req)
+	if err != nil {
+		return err
+	}
+
+	switch statusCode {
+	case http.StatusOK, http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("lease server release `%s` failed: %s", name, resp.Error)
+	}
+}
+
+// ttlSeconds rounds TTL up, zero means the default TTL of the server
+func (client *LeaseClient) ttlSeconds() int64 {
+	return int64((client.TTL + time.Second - 1) / time.Second)
+}
+
+func (client *LeaseClient) call(method string, req LeaseRequest) (*LeaseResponse, int, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	url := fmt.Sprintf("%s/v1/leases/%s", client.Url, method)
+
+	httpResp, err := client.HttpClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, fmt.Errorf("lease server request `%s` failed: %s", url, err)
+	}
+	defer httpResp.Body.Close()
+
+	resp := &LeaseResponse{}
+	err = json.NewDecoder(httpResp.Body).Decode(resp)
+	if err != nil {
+		return nil, 0, fmt.Errorf("bad lease server response on `%s`: %s", url, err)
+	}
+
+	return resp, httpResp.StatusCode, nil
+}
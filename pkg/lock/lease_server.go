@@ -0,0 +1,163 @@
+package lock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flant/dapp/pkg/util"
+)
+
+// LeaseServer is a minimal in-memory implementation of the lease protocol used by LeaseClient.
+// It is a local stand-in of the lock server in tests, dapp does not run it.
+type LeaseServer struct {
+	mutex  sync.Mutex
+	leases map[string]*leaseEntry
+	now    func() time.Time
+}
+
+type leaseEntry struct {
+	Shared  bool
+	Holders map[string]*leaseHolder
+}
+
+type leaseHolder struct {
+	Owner     string
+	ExpiresAt time.Time
+}
+
+func NewLeaseServer() *LeaseServer {
+	return &LeaseServer{
+		leases: make(map[string]*leaseEntry),
+		now:    time.Now,
+	}
+}
+
+func (server *LeaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeLeaseResponse(w, http.StatusMethodNotAllowed, &LeaseResponse{Error: fmt.Sprintf("method `%s` not allowed", r.Method)})
+		return
+	}
+
+	req := LeaseRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeLeaseResponse(w, http.StatusBadRequest, &LeaseResponse{Error: fmt.Sprintf("bad request: %s", err)})
+		return
+	}
+
+	if req.Name == "" {
+		writeLeaseResponse(w, http.StatusBadRequest, &LeaseResponse{Error: "lease name required"})
+		return
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	var statusCode int
+	var resp *LeaseResponse
+
+	switch method := strings.TrimPrefix(r.URL.Path, "/v1/leases/"); method {
+	case "acquire":
+		statusCode, resp = server.acquire(req)
+	case "renew":
+		statusCode, resp = server.renew(req)
+	case "release":
+		statusCode, resp = server.release(req)
+	default:
+		statusCode, resp = http.StatusNotFound, &LeaseResponse{Error: fmt.Sprintf("unknown method `%s`", method)}
+	}
+
+	writeLeaseResponse(w, statusCode, resp)
+}
+
+func (server *LeaseServer) acquire(req LeaseRequest) (int, *LeaseResponse) {
+	entry := server.leases[req.Name]
+	takenOver := server.dropStaleHolders(entry)
+
+	if entry != nil && len(entry.Holders) > 0 && !(entry.Shared && req.Shared) {
+		return http.StatusConflict, &LeaseResponse{Holders: holderOwners(entry)}
+	}
+
+	if entry == nil || len(entry.Holders) == 0 {
+		entry = &leaseEntry{Shared: req.Shared, Holders: make(map[string]*leaseHolder)}
+		server.leases[req.Name] = entry
+	}
+
+	leaseId := util.GenerateConsistentRandomString(20)
+	holder := &leaseHolder{Owner: req.Owner, ExpiresAt: server.now().Add(leaseTTL(req))}
+	entry.Holders[leaseId] = holder
+
+	return http.StatusOK, &LeaseResponse{LeaseId: leaseId, ExpiresAt: holder.ExpiresAt, TakenOver: takenOver}
+}
+
+func (server *LeaseServer) renew(req LeaseRequest) (int, *LeaseResponse) {
+	entry := server.leases[req.Name]
+	server.dropStaleHolders(entry)
+
+	if entry == nil || entry.Holders[req.LeaseId] == nil {
+		return http.StatusNotFound, &LeaseResponse{Error: fmt.Sprintf("no such lease `%s`", req.LeaseId)}
+	}
+
+	holder := entry.Holders[req.LeaseId]
+	holder.ExpiresAt = server.now().Add(leaseTTL(req))
+
+	return http.StatusOK, &LeaseResponse{LeaseId: req.LeaseId, ExpiresAt: holder.ExpiresAt}
+}
+
+func (server *LeaseServer) release(req LeaseRequest) (int, *LeaseResponse) {
+	entry := server.leases[req.Name]
+	if entry == nil || entry.Holders[req.LeaseId] == nil {
+		return http.StatusNotFound, &LeaseResponse{Error: fmt.Sprintf("no such lease `%s`", req.LeaseId)}
+	}
+
+	delete(entry.Holders, req.LeaseId)
+	if len(entry.Holders) == 0 {
+		delete(server.leases, req.Name)
+	}
+
+	return http.StatusOK, &LeaseResponse{LeaseId: req.LeaseId}
+}
+
+// dropStaleHolders removes holders which did not renew their leases in time,
+// so that a crashed holder does not block the resource forever
+func (server *LeaseServer) dropStaleHolders(entry *leaseEntry) bool {
+	if entry == nil {
+		return false
+	}
+
+	dropped := false
+	now := server.now()
+	for leaseId, holder := range entry.Holders {
+		if now.After(holder.ExpiresAt) {
+			delete(entry.Holders, leaseId)
+			dropped = true
+		}
+	}
+
+	return dropped
+}
+
+func holderOwners(entry *leaseEntry) []string {
+	var res []string
+	for _, holder := range entry.Holders {
+		res = append(res, holder.Owner)
+	}
+	return res
+}
+
+func leaseTTL(req LeaseRequest) time.Duration {
+	if req.TTLSeconds > 0 {
+		return time.Duration(req.TTLSeconds) * time.Second
+	}
+	return DefaultLeaseTTL
+}
+
+func writeLeaseResponse(w http.ResponseWriter, statusCode int, resp *LeaseResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,199 @@
+package lock
+
+import (
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestLeaseClient(t *testing.T, server *LeaseServer, owner string) (*LeaseClient, func()) {
+	httpServer := httptest.NewServer(server)
+	return NewLeaseClient(httpServer.URL, owner, 3*time.Second), httpServer.Close
+}
+
+func TestLeaseServer_ExclusiveAndShared(t *testing.T) {
+	server := NewLeaseServer()
+
+	client, closeServer := newTestLeaseClient(t, server, "runner-1")
+	defer closeServer()
+
+	exclusive, err := client.Acquire("remote_git_artifact.app", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exclusive == nil {
+		t.Fatalf("exclusive lease should be acquired")
+	}
+
+	resp, err := client.Acquire("remote_git_artifact.app", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != nil {
+		t.Fatalf("shared lease should not be acquired while exclusive lease is held")
+	}
+
+	if err := client.Release("remote_git_artifact.app", exclusive.LeaseId); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Acquire("remote_git_artifact.app", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil {
+			t.Fatalf("shared lease %d should be acquired", i)
+		}
+	}
+
+	resp, err = client.Acquire("remote_git_artifact.app", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != nil {
+		t.Fatalf("exclusive lease should not be acquired while shared leases are held")
+	}
+}
+
+func TestLeaseServer_StaleLeaseTakeover(t *testing.T) {
+	now := time.Now()
+	server := NewLeaseServer()
+	server.now = func() time.Time { return now }
+
+	client1, closeServer := newTestLeaseClient(t, server, "runner-1")
+	defer closeServer()
+	client2 := NewLeaseClient(client1.Url, "runner-2", client1.TTL)
+
+	lease1, err := client1.Acquire("dappdeps.container.base", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease1 == nil {
+		t.Fatalf("lease should be acquired")
+	}
+
+	now = now.Add(client1.TTL + time.Second)
+
+	lease2, err := client2.Acquire("dappdeps.container.base", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease2 == nil || !lease2.TakenOver {
+		t.Fatalf("stale lease should be taken over, got %#v", lease2)
+	}
+
+	if _, err := client1.Renew("dappdeps.container.base", lease1.LeaseId); err == nil {
+		t.Fatalf("renew of taken over lease should fail")
+	}
+}
+
+func TestLease_WithLock(t *testing.T) {
+	server := NewLeaseServer()
+
+	client, closeServer := newTestLeaseClient(t, server, "")
+	defer closeServer()
+
+	err := InitWithOptions(InitOptions{LeaseServerUrl: client.Url})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	called := false
+	err = WithLock("stage.app", LockOptions{Timeout: time.Second}, func() error {
+		called = true
+
+		resp, err := client.Acquire("stage.app", false)
+		if err != nil {
+			return err
+		}
+		if resp != nil {
+			t.Errorf("lease should be held inside WithLock")
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Fatalf("WithLock callback should be called")
+	}
+
+	resp, err := client.Acquire("stage.app", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil {
+		t.Fatalf("lease should be released after WithLock")
+	}
+}
+
+func TestLease_LostLease(t *testing.T) {
+	var offset int64
+	server := NewLeaseServer()
+	server.now = func() time.Time { return time.Now().Add(time.Duration(atomic.LoadInt64(&offset))) }
+
+	client, closeServer := newTestLeaseClient(t, server, "runner-2")
+	defer closeServer()
+
+	if err := InitWithOptions(InitOptions{LeaseServerUrl: client.Url, LeaseTTL: 500 * time.Millisecond}); err == nil {
+		t.Fatalf("sub-second lease ttl should be rejected")
+	}
+
+	err := InitWithOptions(InitOptions{LeaseServerUrl: client.Url, LeaseOwner: "runner-1", LeaseTTL: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = WithLock("remote_git_artifact.app", LockOptions{Timeout: time.Second}, func() error {
+		atomic.AddInt64(&offset, int64(2*time.Second))
+
+		resp, err := client.Acquire("remote_git_artifact.app", false)
+		if err != nil {
+			return err
+		}
+		if resp == nil || !resp.TakenOver {
+			t.Errorf("stale lease should be taken over, got %#v", resp)
+		}
+
+		// Lease is renewed every third of TTL
+		time.Sleep(time.Second)
+
+		return nil
+	})
+	if _, ok := err.(*LeaseLostError); !ok {
+		t.Fatalf("lost lease error expected, got %v", err)
+	}
+
+	resp, err := client.Acquire("remote_git_artifact.app", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != nil {
+		t.Errorf("lease of the new holder should not be released by the previous holder")
+	}
+}
+
+func TestLease_UnlockReleaseError(t *testing.T) {
+	server := NewLeaseServer()
+
+	client, closeServer := newTestLeaseClient(t, server, "runner-1")
+
+	lock := NewLeaseLock("stage.app", client).(*Lease)
+	locker := &leaseLocker{LeaseLock: lock}
+
+	if err := locker.Lock(AcquireOptions{Timeout: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+
+	closeServer()
+
+	if err := locker.Unlock(); err == nil {
+		t.Fatalf("release error expected when lock server is not available")
+	}
+	if locker.leaseId != "" || locker.lostErr != nil {
+		t.Errorf("lease state should be reset when release fails")
+	}
+}
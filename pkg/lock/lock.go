@@ -1,62 +1,157 @@
 package lock
 
 import (
+	"context"
 	"fmt"
-	"github.com/flant/dapp/pkg/dapp"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
+
+	"github.com/flant/dapp/pkg/dapp"
+	"github.com/flant/dapp/pkg/util"
 )
 
 var (
 	Locks          map[string]LockObject
+	LocksMutex     sync.Mutex
 	DefaultTimeout = 24 * time.Hour
 	LocksDir       = filepath.Join(dapp.HomeDir, "locks")
+	LockBackend    Backend
+
+	releaseAllHookOnce sync.Once
 )
 
+type InitOptions struct {
+	// LeaseServerUrl enables distributed locks shared by several hosts,
+	// local file locks in LocksDir are used otherwise
+	LeaseServerUrl string
+	LeaseOwner     string
+	LeaseTTL       time.Duration
+}
+
+// Init configures locks backend with options from DAPP_LOCK_SERVER_URL, DAPP_LOCK_OWNER
+// and DAPP_LOCK_LEASE_TTL environment variables
 func Init() error {
+	opts := InitOptions{
+		LeaseServerUrl: os.Getenv("DAPP_LOCK_SERVER_URL"),
+		LeaseOwner:     os.Getenv("DAPP_LOCK_OWNER"),
+	}
+
+	if value := os.Getenv("DAPP_LOCK_LEASE_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("bad DAPP_LOCK_LEASE_TTL `%s`: %s", value, err)
+		}
+		opts.LeaseTTL = ttl
+	}
+
+	return InitWithOptions(opts)
+}
+
+func InitWithOptions(opts InitOptions) error {
+	LocksMutex.Lock()
+	defer LocksMutex.Unlock()
+
 	Locks = make(map[string]LockObject)
 
+	releaseAllHookOnce.Do(func() {
+		dapp.AddCleanupHook(dapp.LocksCleanupStage, ReleaseAll)
+	})
+
+	if opts.LeaseServerUrl != "" {
+		// Lease server counts TTL in seconds
+		if opts.LeaseTTL != 0 && opts.LeaseTTL < time.Second {
+			return fmt.Errorf("lease ttl %s should be at least 1s", opts.LeaseTTL)
+		}
+
+		LockBackend = NewLeaseBackend(NewLeaseClient(opts.LeaseServerUrl, opts.LeaseOwner, opts.LeaseTTL))
+		return nil
+	}
+
 	err := os.MkdirAll(LocksDir, 0755)
 	if err != nil {
 		return fmt.Errorf("cannot initialize locks dir: %s", err)
 	}
 
+	LockBackend = NewFileBackend(LocksDir)
+
 	return nil
 }
 
 type LockOptions struct {
 	Timeout  time.Duration
 	ReadOnly bool
+	// Owner is a reentrancy token, empty owner is shared by the whole process.
+	// Use NewOwner to get separate owners for concurrent goroutines.
+	Owner string
+}
+
+func NewOwner() string {
+	return util.GenerateConsistentRandomString(16)
 }
 
 func Lock(name string, opts LockOptions) error {
+	return LockContext(dapp.Context(), name, opts)
+}
+
+// LockContext waits for the lock until timeout expires or ctx is cancelled
+func LockContext(ctx context.Context, name string, opts LockOptions) error {
 	lock := getLock(name)
 
-	return lock.Lock(
-		getTimeout(opts), opts.ReadOnly,
-		func(doWait func() error) error { return onWait(name, doWait) },
-	)
+	return lock.Lock(acquireOptions(ctx, name, opts))
 }
 
 func Unlock(name string) error {
-	if _, hasKey := Locks[name]; !hasKey {
+	return UnlockOwner(name, "")
+}
+
+func UnlockOwner(name, owner string) error {
+	LocksMutex.Lock()
+	lock, hasKey := Locks[name]
+	LocksMutex.Unlock()
+
+	if !hasKey {
 		return fmt.Errorf("no such lock `%s` found", name)
 	}
 
-	lock := getLock(name)
-
-	return lock.Unlock()
+	return lock.Unlock(owner)
 }
 
 func WithLock(name string, opts LockOptions, f func() error) error {
+	return WithLockContext(dapp.Context(), name, opts, f)
+}
+
+func WithLockContext(ctx context.Context, name string, opts LockOptions, f func() error) error {
 	lock := getLock(name)
 
-	return lock.WithLock(
-		getTimeout(opts), opts.ReadOnly,
-		func(doWait func() error) error { return onWait(name, doWait) },
-		f,
-	)
+	return lock.WithLock(acquireOptions(ctx, name, opts), f)
+}
+
+// ReleaseAll releases locks held by the process, it is called on termination
+func ReleaseAll() {
+	LocksMutex.Lock()
+	locks := make([]LockObject, 0, len(Locks))
+	for _, lock := range Locks {
+		locks = append(locks, lock)
+	}
+	LocksMutex.Unlock()
+
+	for _, lock := range locks {
+		if err := lock.ReleaseAll(); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: cannot release lock `%s`: %s\n", lock.GetName(), err)
+		}
+	}
+}
+
+func acquireOptions(ctx context.Context, name string, opts LockOptions) AcquireOptions {
+	return AcquireOptions{
+		Ctx:      ctx,
+		Timeout:  getTimeout(opts),
+		ReadOnly: opts.ReadOnly,
+		Owner:    opts.Owner,
+		OnWait:   func(doWait func() error) error { return onWait(name, doWait) },
+	}
 }
 
 func onWait(name string, doWait func() error) error {
@@ -80,18 +175,22 @@ func getTimeout(opts LockOptions) time.Duration {
 }
 
 func getLock(name string) LockObject {
+	LocksMutex.Lock()
+	defer LocksMutex.Unlock()
+
 	if l, hasKey := Locks[name]; hasKey {
 		return l
 	}
 
-	Locks[name] = NewFileLock(name, LocksDir)
+	Locks[name] = LockBackend.NewLock(name)
 
 	return Locks[name]
 }
 
 type LockObject interface {
 	GetName() string
-	Lock(timeout time.Duration, readOnly bool, onWait func(doWait func() error) error) error
-	Unlock() error
-	WithLock(timeout time.Duration, readOnly bool, onWait func(doWait func() error) error, f func() error) error
+	Lock(opts AcquireOptions) error
+	Unlock(owner string) error
+	WithLock(opts AcquireOptions, f func() error) error
+	ReleaseAll() error
 }
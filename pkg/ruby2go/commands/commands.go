@@ -0,0 +1,27 @@
+package commands
+
+import (
+	"sort"
+
+	"github.com/flant/dapp/pkg/ruby2go"
+)
+
+// Commands maps ruby2go program names, which are used by ruby dapp, to their implementations
+var Commands = map[string]ruby2go.RunFunc{
+	"builder":         Builder,
+	"dappdeps":        Dappdeps,
+	"docker_registry": DockerRegistry,
+	"git-artifact":    GitArtifact,
+	"git-repo":        GitRepo,
+	"image":           Image,
+}
+
+func Names() []string {
+	var res []string
+	for name := range Commands {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+
+	return res
+}
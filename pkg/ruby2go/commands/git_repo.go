@@ -0,0 +1,47 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/flant/dapp/pkg/git_repo"
+)
+
+func GitRepo(args map[string]interface{}) (interface{}, error) {
+	err := initLock()
+	if err != nil {
+		return nil, err
+	}
+
+	if state, hasKey := args["LocalGitRepo"]; hasKey {
+		repo := &git_repo.Local{}
+		json.Unmarshal([]byte(state.(string)), repo)
+
+		switch method := args["method"]; method {
+		default:
+			return nil, fmt.Errorf("unknown method \"%s\"", method)
+		}
+	} else if state, hasKey := args["RemoteGitRepo"]; hasKey {
+		repo := &git_repo.Remote{}
+		json.Unmarshal([]byte(state.(string)), repo)
+
+		switch method := args["method"]; method {
+		case "CloneAndFetch":
+			res := make(map[string]interface{})
+			resErr := repo.CloneAndFetch()
+
+			newState, err := json.Marshal(repo)
+			if err != nil {
+				return nil, err
+			}
+			res["RemoteGitRepo"] = string(newState)
+
+			return res, resErr
+
+		default:
+			return nil, fmt.Errorf("unknown method \"%s\"", method)
+		}
+	} else {
+		return nil, fmt.Errorf("bad args %+v", args)
+	}
+}
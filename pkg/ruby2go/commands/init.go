@@ -0,0 +1,51 @@
+package commands
+
+import (
+	"sync"
+
+	"github.com/flant/dapp/pkg/docker"
+	"github.com/flant/dapp/pkg/lock"
+)
+
+// Initialization state is kept between calls, so that commands served by long-running ruby2go server
+// do not re-initialize docker clients and locks on each call.
+var (
+	initMutex           sync.Mutex
+	isLockInitialized   bool
+	isDockerInitialized bool
+	dockerConfigDir     string
+)
+
+func initLock() error {
+	initMutex.Lock()
+	defer initMutex.Unlock()
+
+	if isLockInitialized {
+		return nil
+	}
+
+	if err := lock.Init(); err != nil {
+		return err
+	}
+	isLockInitialized = true
+
+	return nil
+}
+
+// initDocker re-initializes docker clients only when another docker config dir is requested
+func initDocker(hostDockerConfigDir string) error {
+	initMutex.Lock()
+	defer initMutex.Unlock()
+
+	if isDockerInitialized && dockerConfigDir == hostDockerConfigDir {
+		return nil
+	}
+
+	if err := docker.Init(hostDockerConfigDir); err != nil {
+		return err
+	}
+	isDockerInitialized = true
+	dockerConfigDir = hostDockerConfigDir
+
+	return nil
+}
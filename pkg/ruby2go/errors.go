@@ -0,0 +1,36 @@
+package ruby2go
+
+import (
+	"errors"
+	"fmt"
+)
+
+const UnexpectedErrorCode = "unexpected_error"
+
+// CodedError is implemented by typed errors of dapp packages, so that ruby dapp can react on the error by its code
+type CodedError interface {
+	error
+	ErrorCode() string
+	ErrorData() map[string]interface{}
+}
+
+// ResultError is the error object of the command result
+type ResultError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// NewResultError keeps the code of the coded error wrapped by callers with the message of the whole chain
+func NewResultError(err error) *ResultError {
+	var codedErr CodedError
+	if errors.As(err, &codedErr) {
+		return &ResultError{
+			Code:    codedErr.ErrorCode(),
+			Message: err.Error(),
+			Data:    codedErr.ErrorData(),
+		}
+	}
+
+	return &ResultError{Code: UnexpectedErrorCode, Message: fmt.Sprintf("%s", err)}
+}
@@ -0,0 +1,14 @@
+package ruby2go
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNewResultErrorWrapped(t *testing.T) {
+	err := NewResultError(fmt.Errorf("dimg build failed: %w", &testCodedError{}))
+
+	if err.Code != "test_error" || err.Message != "dimg build failed: coded command failed" || err.Data["key"] != "value" {
+		t.Errorf("unexpected result error %+v", err)
+	}
+}
@@ -6,10 +6,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/signal"
-	"sync/atomic"
-	"syscall"
 
+	"github.com/flant/dapp/pkg/dapp"
 	"github.com/flant/dapp/pkg/util"
 )
 
@@ -17,7 +15,6 @@ var (
 	WorkingDir       string
 	ArgsFromFilePath string
 	ResultToFilePath string
-	TrapCleanupHooks []func()
 )
 
 func usage(progname string) {
@@ -60,8 +57,10 @@ func writeJsonObjectToFile(obj map[string]interface{}, path string) error {
 	return nil
 }
 
-func RunCli(progname string, runFunc func(map[string]interface{}) (interface{}, error)) {
-	Trap()
+type RunFunc func(args map[string]interface{}) (interface{}, error)
+
+func RunCli(progname string, runFunc RunFunc) {
+	dapp.TrapSignals()
 
 	WorkingDir, err := os.Getwd()
 	if err != nil {
@@ -84,62 +83,55 @@ func RunCli(progname string, runFunc func(map[string]interface{}) (interface{},
 		os.Exit(1)
 	}
 
-	argsMap, err := readJsonObjectFromFile(ArgsFromFilePath)
+	exitCode, err := RunWithFiles(ArgsFromFilePath, ResultToFilePath, runFunc)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Cannot read args json object from file %s: %s\n", ArgsFromFilePath, err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		exitCode = 1
 	}
 
-	exitCode := 0
-	resultMap := make(map[string]interface{})
+	if err := dapp.Terminate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+	}
 
-	resultMap["data"], err = runFunc(argsMap)
+	os.Exit(exitCode)
+}
+
+// RunWithFiles calls runFunc with args from argsFromFilePath json file and writes result into resultToFilePath json file.
+// Returned exit code is 16 when runFunc fails, error is returned when args cannot be read or result cannot be written.
+func RunWithFiles(argsFromFilePath, resultToFilePath string, runFunc RunFunc) (int, error) {
+	argsMap, err := readJsonObjectFromFile(argsFromFilePath)
 	if err != nil {
-		resultMap["error"] = fmt.Sprintf("%s", err)
+		return 0, fmt.Errorf("Cannot read args json object from file %s: %s", argsFromFilePath, err)
+	}
+
+	exitCode := 0
+
+	resultMap, ok := callRunFunc(runFunc, argsMap)
+	if !ok {
 		exitCode = 16
 	}
 
-	err = writeJsonObjectToFile(resultMap, ResultToFilePath)
+	err = writeJsonObjectToFile(resultMap, resultToFilePath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Cannot write result json object to file %s: %s", ResultToFilePath, err)
-		os.Exit(1)
+		return 0, fmt.Errorf("Cannot write result json object to file %s: %s", resultToFilePath, err)
 	}
 
-	os.Exit(exitCode)
+	return exitCode, nil
 }
 
-func Trap() {
-	c := make(chan os.Signal, 1)
-	signals := []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGPIPE}
-	signal.Notify(c, signals...)
-	go func() {
-		interruptCount := uint32(0)
-		for sig := range c {
-			if sig == syscall.SIGPIPE {
-				continue
-			}
-
-			go func(sig os.Signal) {
-				switch sig {
-				case os.Interrupt, syscall.SIGTERM:
-					if atomic.LoadUint32(&interruptCount) < 3 {
-						if atomic.AddUint32(&interruptCount, 1) == 1 {
-							for _, trapCleanupHook := range TrapCleanupHooks {
-								trapCleanupHook()
-							}
-							os.Exit(0)
-						} else {
-							return
-						}
-					}
-				}
-				for _, trapCleanupHook := range TrapCleanupHooks {
-					trapCleanupHook()
-				}
-				os.Exit(128 + int(sig.(syscall.Signal)))
-			}(sig)
-		}
-	}()
+// callRunFunc returns result object with data and error fields, which is expected by ruby dapp,
+// error is an object with code, message and data fields
+func callRunFunc(runFunc RunFunc, args map[string]interface{}) (map[string]interface{}, bool) {
+	resultMap := make(map[string]interface{})
+
+	data, err := runFunc(args)
+	resultMap["data"] = data
+	if err != nil {
+		resultMap["error"] = NewResultError(err)
+		return resultMap, false
+	}
+
+	return resultMap, true
 }
 
 func CommandFieldFromArgs(args map[string]interface{}) (string, error) {
@@ -0,0 +1,198 @@
+package ruby2go
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	ParseErrorCode     = -32700
+	InvalidRequestCode = -32600
+	MethodNotFoundCode = -32601
+	InternalErrorCode  = -32603
+)
+
+// Request calls command Method (ruby2go program name, e.g. `image`) with Params,
+// which are the same as the content of -args-from-file json file
+type Request struct {
+	JsonRpc string                 `json:"jsonrpc"`
+	Id      interface{}            `json:"id"`
+	Method  string                 `json:"method"`
+	Params  map[string]interface{} `json:"params"`
+}
+
+// Response Result is the same as the content of -result-to-file json file,
+// Error is set only when the command cannot be called
+type Response struct {
+	JsonRpc string                 `json:"jsonrpc"`
+	Id      interface{}            `json:"id"`
+	Result  map[string]interface{} `json:"result,omitempty"`
+	Error   *ResponseError         `json:"error,omitempty"`
+	Timing  *Timing                `json:"timing,omitempty"`
+}
+
+type ResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type Timing struct {
+	StartedAt time.Time `json:"started_at"`
+	Duration  float64   `json:"duration"` // seconds
+}
+
+// Server serves commands by newline delimited JSON-RPC requests, state initialized by commands
+// (docker clients, locks) is kept between calls.
+// NOTICE: Commands are called one at a time, because they share process global state:
+// NOTICE: docker clients and DOCKER_CONFIG of the docker config dir and the lock owner.
+type Server struct {
+	Commands map[string]RunFunc
+
+	callMutex sync.Mutex
+}
+
+func NewServer(commands map[string]RunFunc) *Server {
+	return &Server{Commands: commands}
+}
+
+// Serve accepts connections on listener, requests of all connections are handled sequentially.
+// When listener is closed, reading of open connections is stopped and Serve returns after
+// the current requests are answered
+func (server *Server) Serve(listener net.Listener) error {
+	var wg sync.WaitGroup
+	var connsMutex sync.Mutex
+	conns := map[net.Conn]bool{}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			connsMutex.Lock()
+			for conn := range conns {
+				closeConnRead(conn)
+			}
+			connsMutex.Unlock()
+
+			wg.Wait()
+
+			return err
+		}
+
+		connsMutex.Lock()
+		conns[conn] = true
+		connsMutex.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				connsMutex.Lock()
+				delete(conns, conn)
+				connsMutex.Unlock()
+
+				conn.Close()
+			}()
+
+			if err := server.ServeConn(conn, conn); err != nil {
+				fmt.Fprintf(os.Stderr, "ruby2go server connection error: %s\n", err)
+			}
+		}()
+	}
+}
+
+// closeConnRead lets the response of the current request be written, unix and tcp connections support it
+func closeConnRead(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		if err := c.CloseRead(); err == nil {
+			return
+		}
+	}
+	conn.Close()
+}
+
+// ServeConn handles requests from r until EOF, responses are written into w
+func (server *Server) ServeConn(r io.Reader, w io.Writer) error {
+	decoder := json.NewDecoder(r)
+	encoder := json.NewEncoder(w)
+
+	for {
+		req := &Request{}
+
+		err := decoder.Decode(req)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			if _, ok := err.(*json.UnmarshalTypeError); !ok {
+				// Stream cannot be resynchronized after syntax error
+				encoder.Encode(errorResponse(nil, ParseErrorCode, fmt.Sprintf("bad request: %s", err)))
+				return err
+			}
+
+			if err := encoder.Encode(errorResponse(nil, InvalidRequestCode, fmt.Sprintf("bad request: %s", err))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := encoder.Encode(server.Call(req)); err != nil {
+			return err
+		}
+	}
+}
+
+func (server *Server) Call(req *Request) *Response {
+	runFunc, ok := server.Commands[req.Method]
+	if !ok {
+		return errorResponse(req.Id, MethodNotFoundCode, fmt.Sprintf("command `%s` isn't supported", req.Method))
+	}
+
+	if req.Params == nil {
+		return errorResponse(req.Id, InvalidRequestCode, fmt.Sprintf("command `%s` params required", req.Method))
+	}
+
+	server.callMutex.Lock()
+	defer server.callMutex.Unlock()
+
+	startedAt := time.Now()
+
+	result, err := safeCallRunFunc(runFunc, req.Params)
+	if err != nil {
+		return errorResponse(req.Id, InternalErrorCode, fmt.Sprintf("command `%s` failed: %s", req.Method, err))
+	}
+
+	return &Response{
+		JsonRpc: "2.0",
+		Id:      req.Id,
+		Result:  result,
+		Timing: &Timing{
+			StartedAt: startedAt,
+			Duration:  time.Since(startedAt).Seconds(),
+		},
+	}
+}
+
+// safeCallRunFunc does not let command panic to stop the server
+func safeCallRunFunc(runFunc RunFunc, args map[string]interface{}) (result map[string]interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	result, _ = callRunFunc(runFunc, args)
+
+	return result, nil
+}
+
+func errorResponse(id interface{}, code int, message string) *Response {
+	return &Response{
+		JsonRpc: "2.0",
+		Id:      id,
+		Error:   &ResponseError{Code: code, Message: message},
+	}
+}
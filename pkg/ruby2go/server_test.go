@@ -0,0 +1,251 @@
+package ruby2go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testCodedError struct{}
+
+func (e *testCodedError) Error() string {
+	return "coded command failed"
+}
+
+func (e *testCodedError) ErrorCode() string {
+	return "test_error"
+}
+
+func (e *testCodedError) ErrorData() map[string]interface{} {
+	return map[string]interface{}{"key": "value"}
+}
+
+func testServer() *Server {
+	return NewServer(map[string]RunFunc{
+		"echo": func(args map[string]interface{}) (interface{}, error) {
+			return args["value"], nil
+		},
+		"fail": func(args map[string]interface{}) (interface{}, error) {
+			return nil, fmt.Errorf("command failed")
+		},
+		"coded": func(args map[string]interface{}) (interface{}, error) {
+			return nil, &testCodedError{}
+		},
+		"panic": func(args map[string]interface{}) (interface{}, error) {
+			panic("unexpected")
+		},
+	})
+}
+
+func decodeResponses(t *testing.T, data []byte) []*Response {
+	var res []*Response
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		resp := &Response{}
+		if err := decoder.Decode(resp); err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, resp)
+	}
+
+	return res
+}
+
+func TestServer_ServeConn(t *testing.T) {
+	in := strings.Join([]string{
+		`{"jsonrpc": "2.0", "id": 1, "method": "echo", "params": {"value": "hello"}}`,
+		`{"jsonrpc": "2.0", "id": 2, "method": "fail", "params": {}}`,
+		`{"jsonrpc": "2.0", "id": 3, "method": "panic", "params": {}}`,
+		`{"jsonrpc": "2.0", "id": 4, "method": "unknown", "params": {}}`,
+		`{"jsonrpc": "2.0", "id": 5, "method": "echo", "params": "bad"}`,
+		`{"jsonrpc": "2.0", "id": 6, "method": "echo", "params": {"value": "world"}}`,
+		`{"jsonrpc": "2.0", "id": 7, "method": "coded", "params": {}}`,
+	}, "\n")
+
+	out := &bytes.Buffer{}
+	if err := testServer().ServeConn(strings.NewReader(in), out); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := decodeResponses(t, out.Bytes())
+	if len(responses) != 7 {
+		t.Fatalf("expected 7 responses, got %d: %s", len(responses), out.String())
+	}
+
+	if responses[0].Result["data"] != "hello" || responses[0].Timing == nil {
+		t.Errorf("unexpected echo response: %+v", responses[0])
+	}
+
+	resultError, _ := responses[1].Result["error"].(map[string]interface{})
+	if resultError["code"] != UnexpectedErrorCode || resultError["message"] != "command failed" || responses[1].Error != nil {
+		t.Errorf("command error should be returned in result: %+v", responses[1])
+	}
+
+	if responses[2].Error == nil || responses[2].Error.Code != InternalErrorCode {
+		t.Errorf("command panic should be returned as internal error: %+v", responses[2])
+	}
+
+	if responses[3].Error == nil || responses[3].Error.Code != MethodNotFoundCode {
+		t.Errorf("unknown command should be returned as method not found error: %+v", responses[3])
+	}
+
+	if responses[4].Error == nil || responses[4].Error.Code != InvalidRequestCode {
+		t.Errorf("bad params should be returned as invalid request error: %+v", responses[4])
+	}
+
+	if responses[5].Result["data"] != "world" {
+		t.Errorf("server should continue serving after bad request: %+v", responses[5])
+	}
+
+	resultError, _ = responses[6].Result["error"].(map[string]interface{})
+	resultErrorData, _ := resultError["data"].(map[string]interface{})
+	if resultError["code"] != "test_error" || resultError["message"] != "coded command failed" || resultErrorData["key"] != "value" {
+		t.Errorf("typed command error should be returned with code and data: %+v", responses[6])
+	}
+}
+
+func TestServer_ServeConnParseError(t *testing.T) {
+	out := &bytes.Buffer{}
+	if err := testServer().ServeConn(strings.NewReader(`{"method": `), out); err == nil {
+		t.Fatalf("syntax error expected")
+	}
+
+	responses := decodeResponses(t, out.Bytes())
+	if len(responses) != 1 || responses[0].Error == nil || responses[0].Error.Code != ParseErrorCode {
+		t.Fatalf("expected parse error response, got %s", out.String())
+	}
+}
+
+func TestServer_Serve(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "dapp-ruby2go-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	listener, err := net.Listen("unix", filepath.Join(tmpDir, "ruby2go.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error)
+	go func() {
+		served <- testServer().Serve(listener)
+	}()
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("unix", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := &Request{JsonRpc: "2.0", Id: i, Method: "echo", Params: map[string]interface{}{"value": i}}
+		if err := json.NewEncoder(conn).Encode(req); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := &Response{}
+		if err := json.NewDecoder(conn).Decode(resp); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		if resp.Result["data"] != float64(i) {
+			t.Errorf("unexpected response %+v", resp)
+		}
+	}
+
+	listener.Close()
+	if err := <-served; err == nil {
+		t.Fatalf("serve should fail after listener is closed")
+	}
+}
+
+func TestServer_ServeStopsOpenConns(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "dapp-ruby2go-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	listener, err := net.Listen("unix", filepath.Join(tmpDir, "ruby2go.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error)
+	go func() {
+		served <- testServer().Serve(listener)
+	}()
+
+	conn, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := &Request{JsonRpc: "2.0", Id: 1, Method: "echo", Params: map[string]interface{}{"value": 1}}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		t.Fatal(err)
+	}
+	decoder := json.NewDecoder(conn)
+	if err := decoder.Decode(&Response{}); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.Close()
+
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serve should return after listener is closed while connection is open")
+	}
+
+	if err := decoder.Decode(&Response{}); err == nil {
+		t.Errorf("connection should be closed by server")
+	}
+}
+
+func TestServer_CallSerialized(t *testing.T) {
+	var running, maxRunning int32
+	server := NewServer(map[string]RunFunc{
+		"slow": func(args map[string]interface{}) (interface{}, error) {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			return nil, nil
+		},
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			server.Call(&Request{JsonRpc: "2.0", Id: i, Method: "slow", Params: map[string]interface{}{}})
+		}(i)
+	}
+	wg.Wait()
+
+	if maxRunning != 1 {
+		t.Errorf("commands should be called one at a time, %d were called concurrently", maxRunning)
+	}
+}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	consistentUniqSlugRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	slugSeparatorsRegexp     = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// ConsistentUniqSlugify should be in sync with ruby dapp consistent_uniq_slugify:
+// proper slug is returned as is, otherwise slug is suffixed with murmur hash of the original string
+func ConsistentUniqSlugify(s string) string {
+	if consistentUniqSlugRegexp.MatchString(s) {
+		return s
+	}
+
+	slug := slugSeparatorsRegexp.ReplaceAllString(strings.ToLower(s), "-")
+	slug = strings.Trim(slug, "-")
+
+	var parts []string
+	if slug != "" {
+		parts = append(parts, slug)
+	}
+	parts = append(parts, MurmurHash(s))
+
+	return strings.Join(parts, "-")
+}